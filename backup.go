@@ -0,0 +1,428 @@
+package gomments
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// BackupVersion is the version of the backup format written by Export.
+// Restore reads backups of this version or older.
+const BackupVersion = 1
+
+// BackupRecordType is the type of a line in a backup. Backups are NDJSON, each
+// line being a {"type": ..., "data": ...} object, starting with a header.
+type BackupRecordType string
+
+const (
+	BackupRecordHeader          BackupRecordType = "header"
+	BackupRecordReply           BackupRecordType = "reply"
+	BackupRecordArticleReaction BackupRecordType = "article_reaction"
+	BackupRecordReplyReaction   BackupRecordType = "reply_reaction"
+	BackupRecordBan             BackupRecordType = "ban"
+	BackupRecordFlag            BackupRecordType = "flag"
+	BackupRecordModerationEvent BackupRecordType = "moderation_event"
+)
+
+type backupLine struct {
+	Type BackupRecordType `json:"type"`
+	Data json.RawMessage  `json:"data"`
+}
+
+// BackupFilter limits a backup to the replies on Articles, and to the records
+// created from Since until Until. Zero values don't filter.
+//
+// Bans aren't on articles, so they're left out of backups filtered by article.
+type BackupFilter struct {
+	Articles []string  `json:"articles,omitempty"`
+	Since    time.Time `json:"since,omitzero"`
+	Until    time.Time `json:"until,omitzero"`
+}
+
+type BackupHeader struct {
+	Version    int          `json:"version"`
+	ExportedAt time.Time    `json:"exported_at"`
+	Filter     BackupFilter `json:"filter"`
+}
+
+// Records refer to replies by their idempotency keys, which are the same in
+// every storage backend. IDs are only kept so that the moderation events
+// about records can be pointed at them when they're restored.
+
+type BackupReply struct {
+	ID             int       `db:"id" json:"id"`
+	IdempotencyKey string    `db:"idempotency_key" json:"idempotency_key"`
+	Signature      string    `db:"signature" json:"signature"`
+	Article        string    `db:"article" json:"article"`
+	Body           string    `db:"body" json:"body"`
+	AuthorName     string    `db:"author_name" json:"author_name"`
+	ClientHash     string    `db:"client_hash" json:"client_hash"`
+	Deleted        bool      `db:"deleted" json:"deleted"`
+	Shadowbanned   bool      `db:"shadowbanned" json:"shadowbanned"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+}
+
+type BackupArticleReaction struct {
+	ID           int       `json:"id"`
+	Article      string    `json:"article"`
+	Kind         string    `json:"kind"`
+	DeletionKey  string    `json:"deletion_key"`
+	ClientKey    string    `json:"client_key"`
+	Deleted      bool      `json:"deleted"`
+	Shadowbanned bool      `json:"shadowbanned"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type BackupReplyReaction struct {
+	ID           int       `json:"id"`
+	ReplyKey     string    `json:"reply_key"`
+	Kind         string    `json:"kind"`
+	DeletionKey  string    `json:"deletion_key"`
+	ClientKey    string    `json:"client_key"`
+	Deleted      bool      `json:"deleted"`
+	Shadowbanned bool      `json:"shadowbanned"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type BackupBan struct {
+	ID        int        `db:"id" json:"id"`
+	Kind      BanKind    `db:"kind" json:"kind"`
+	Value     string     `db:"value" json:"value"`
+	Mode      BanMode    `db:"mode" json:"mode"`
+	Reason    string     `db:"reason" json:"reason"`
+	ExpiresAt *time.Time `db:"expires_at" json:"expires_at"`
+	Deleted   bool       `db:"deleted" json:"deleted"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+}
+
+type BackupFlag struct {
+	ID         int       `db:"id" json:"id"`
+	ReplyKey   string    `db:"reply_key" json:"reply_key"`
+	Reason     string    `db:"reason" json:"reason"`
+	ClientHash string    `db:"client_hash" json:"client_hash"`
+	Resolved   bool      `db:"resolved" json:"resolved"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+type ExportRequest struct {
+	Filter BackupFilter
+	Writer io.Writer
+}
+
+type ExportResponse struct {
+	// Counts counts the records written of each type.
+	Counts map[BackupRecordType]int `json:"counts"`
+}
+
+// Export writes a backup of the replies, reactions and moderation data
+// matching a filter, read in one transaction so the backup is consistent.
+func (s *Service) Export(ctx context.Context, req ExportRequest) (*ExportResponse, error) {
+	resp := &ExportResponse{Counts: map[BackupRecordType]int{}}
+
+	enc := json.NewEncoder(req.Writer)
+	write := func(t BackupRecordType, v any) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(backupLine{Type: t, Data: data}); err != nil {
+			return err
+		}
+		if t != BackupRecordHeader {
+			resp.Counts[t]++
+		}
+		return nil
+	}
+
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		if err := write(BackupRecordHeader, BackupHeader{Version: BackupVersion, ExportedAt: time.Now(), Filter: req.Filter}); err != nil {
+			return err
+		}
+
+		// Records are written before the records referring to them.
+		if err := exportReplies(ctx, tx, req.Filter, func(r BackupReply) error {
+			return write(BackupRecordReply, r)
+		}); err != nil {
+			return err
+		}
+		if err := exportArticleReactions(ctx, tx, req.Filter, func(r BackupArticleReaction) error {
+			return write(BackupRecordArticleReaction, r)
+		}); err != nil {
+			return err
+		}
+		if err := exportReplyReactions(ctx, tx, req.Filter, func(r BackupReplyReaction) error {
+			return write(BackupRecordReplyReaction, r)
+		}); err != nil {
+			return err
+		}
+		if len(req.Filter.Articles) == 0 {
+			if err := exportBans(ctx, tx, req.Filter, func(b BackupBan) error {
+				return write(BackupRecordBan, b)
+			}); err != nil {
+				return err
+			}
+		}
+		if err := exportFlags(ctx, tx, req.Filter, func(f BackupFlag) error {
+			return write(BackupRecordFlag, f)
+		}); err != nil {
+			return err
+		}
+		return exportModerationEvents(ctx, tx, req.Filter, func(e ModerationEvent) error {
+			return write(BackupRecordModerationEvent, e)
+		})
+	})
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "exporting: %w", err)
+	}
+
+	return resp, nil
+}
+
+type RestoreRequest struct {
+	Reader io.Reader
+	// DryRun reports what would be restored without restoring anything.
+	DryRun bool
+}
+
+type RestoreResponse struct {
+	// Restored counts the records restored of each type, or that would be in
+	// a dry run, and Existing those that were already there. Conflicts counts
+	// the reactions that weren't restored because the same client already
+	// has that reaction.
+	Restored  map[BackupRecordType]int `json:"restored"`
+	Existing  map[BackupRecordType]int `json:"existing"`
+	Conflicts map[BackupRecordType]int `json:"conflicts"`
+}
+
+func (resp *RestoreResponse) count(t BackupRecordType, restored bool) {
+	if restored {
+		resp.Restored[t]++
+	} else {
+		resp.Existing[t]++
+	}
+}
+
+// errDryRun rolls back a dry run's transaction.
+var errDryRun = errors.New("dry run")
+
+// restoreIDs maps the IDs of records in a backup to their restored IDs, for
+// the moderation events about them.
+type restoreIDs map[ModerationTarget]map[int]int
+
+func (ids restoreIDs) set(target ModerationTarget, from int, to int) {
+	if to == 0 {
+		return
+	}
+	if ids[target] == nil {
+		ids[target] = map[int]int{}
+	}
+	ids[target][from] = to
+}
+
+// targetID returns the restored ID of an event's target, or its ID in the
+// backup if the target wasn't in it.
+func (ids restoreIDs) targetID(target ModerationTarget, id string) string {
+	from, err := strconv.Atoi(id)
+	if err != nil {
+		return id
+	}
+	if to, ok := ids[target][from]; ok {
+		return strconv.Itoa(to)
+	}
+	return id
+}
+
+// Restore restores a backup written by Export, in one transaction. Records
+// that are already there are skipped, so a backup can be restored over the
+// data it was taken from, or restored again.
+func (s *Service) Restore(ctx context.Context, req RestoreRequest) (*RestoreResponse, error) {
+	resp := &RestoreResponse{
+		Restored:  map[BackupRecordType]int{},
+		Existing:  map[BackupRecordType]int{},
+		Conflicts: map[BackupRecordType]int{},
+	}
+
+	ids := restoreIDs{}
+
+	scanner := bufio.NewScanner(req.Reader)
+	// Reply bodies are short, but leave room for restoring from other
+	// backends.
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		for n := 1; scanner.Scan(); n++ {
+			var line backupLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				return Errorf(http.StatusBadRequest, "line %d: %w", n, err)
+			}
+
+			if n == 1 {
+				if line.Type != BackupRecordHeader {
+					return Errorf(http.StatusBadRequest, "not a backup: no header")
+				}
+				var header BackupHeader
+				if err := json.Unmarshal(line.Data, &header); err != nil {
+					return Errorf(http.StatusBadRequest, "line %d: %w", n, err)
+				}
+				if header.Version < 1 || header.Version > BackupVersion {
+					return Errorf(http.StatusBadRequest, "unsupported backup version: %d", header.Version)
+				}
+				continue
+			}
+
+			if err := s.restoreRecord(ctx, tx, line, ids, resp); err != nil {
+				var gsErr ServiceError
+				if errors.As(err, &gsErr) {
+					return Errorf(gsErr.Status(), "line %d: %w", n, err)
+				}
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return Errorf(http.StatusBadRequest, "reading backup: %w", err)
+		}
+
+		if req.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if errors.Is(err, errDryRun) {
+		return resp, nil
+	}
+	var gsErr ServiceError
+	if errors.As(err, &gsErr) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "restoring: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (s *Service) restoreRecord(ctx context.Context, tx *sqlx.Tx, line backupLine, ids restoreIDs, resp *RestoreResponse) error {
+	decode := func(v any) error {
+		if err := json.Unmarshal(line.Data, v); err != nil {
+			return Errorf(http.StatusBadRequest, "decoding %s: %w", line.Type, err)
+		}
+		return nil
+	}
+
+	switch line.Type {
+	case BackupRecordReply:
+		var r BackupReply
+		if err := decode(&r); err != nil {
+			return err
+		}
+
+		id, inserted, err := insertReply(ctx, tx, insertReplyParams{
+			IdempotencyKey: r.IdempotencyKey,
+			Signature:      r.Signature,
+			Article:        r.Article,
+			Body:           r.Body,
+			Deleted:        r.Deleted,
+			CreatedAt:      r.CreatedAt,
+			AuthorName:     r.AuthorName,
+			ClientHash:     r.ClientHash,
+			Shadowbanned:   r.Shadowbanned,
+		})
+		if err != nil {
+			return err
+		}
+		ids.set(ModerationTargetReply, r.ID, id)
+		resp.count(line.Type, inserted)
+
+	case BackupRecordArticleReaction:
+		var r BackupArticleReaction
+		if err := decode(&r); err != nil {
+			return err
+		}
+
+		id, restored, err := restoreArticleReaction(ctx, tx, r)
+		if err != nil {
+			return err
+		}
+		if id == 0 {
+			resp.Conflicts[line.Type]++
+			return nil
+		}
+		ids.set(ModerationTargetReaction, r.ID, id)
+		resp.count(line.Type, restored)
+
+	case BackupRecordReplyReaction:
+		var r BackupReplyReaction
+		if err := decode(&r); err != nil {
+			return err
+		}
+
+		id, restored, err := restoreReplyReaction(ctx, tx, r)
+		if errors.Is(err, errNotFound) {
+			return Errorf(http.StatusBadRequest, "reply reaction on unknown reply: %s", r.ReplyKey)
+		}
+		if err != nil {
+			return err
+		}
+		if id == 0 {
+			resp.Conflicts[line.Type]++
+			return nil
+		}
+		ids.set(ModerationTargetReplyReaction, r.ID, id)
+		resp.count(line.Type, restored)
+
+	case BackupRecordBan:
+		var b BackupBan
+		if err := decode(&b); err != nil {
+			return err
+		}
+
+		id, restored, err := restoreBan(ctx, tx, b)
+		if err != nil {
+			return err
+		}
+		ids.set(ModerationTargetBan, b.ID, id)
+		resp.count(line.Type, restored)
+
+	case BackupRecordFlag:
+		var f BackupFlag
+		if err := decode(&f); err != nil {
+			return err
+		}
+
+		id, restored, err := restoreFlag(ctx, tx, f)
+		if errors.Is(err, errNotFound) {
+			return Errorf(http.StatusBadRequest, "flag on unknown reply: %s", f.ReplyKey)
+		}
+		if err != nil {
+			return err
+		}
+		ids.set(ModerationTargetFlag, f.ID, id)
+		resp.count(line.Type, restored)
+
+	case BackupRecordModerationEvent:
+		var e ModerationEvent
+		if err := decode(&e); err != nil {
+			return err
+		}
+
+		e.TargetID = ids.targetID(e.TargetType, e.TargetID)
+		restored, err := restoreModerationEvent(ctx, tx, e)
+		if err != nil {
+			return err
+		}
+		resp.count(line.Type, restored)
+
+	default:
+		return Errorf(http.StatusBadRequest, "unknown record type: %q", line.Type)
+	}
+
+	return nil
+}
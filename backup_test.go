@@ -0,0 +1,180 @@
+package gomments_test
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_ExportRestore(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	s := f.service
+
+	// The example reply added by the migrations is older than the rest.
+	_, err := f.db.Exec("update reply set created_at = ? where article = 'how-to-foo'", time.Now().Add(-48*time.Hour).UTC())
+	f.NoError(err)
+
+	ids := map[string]int{}
+	for _, req := range []gomments.SubmitReplyRequest{
+		{Article: "first-article", AuthorName: "alice", Body: "hello"},
+		{Article: "first-article", AuthorName: "bob", Body: "rude words"},
+		{Article: "second-article", AuthorName: "carol", Body: "hey"},
+	} {
+		req.IdempotencyKey = uuid.NewString()
+		resp, err := s.SubmitReply(ctx, req)
+		f.NoError(err)
+		ids[req.AuthorName] = resp.Reply.ID
+	}
+
+	_, err = s.CreateReplyReaction(ctx, gomments.CreateReplyReactionRequest{ReplyID: ids["alice"], Kind: "like", ClientIP: "192.0.2.1"})
+	f.NoError(err)
+	_, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "first-article", Kind: "like", ClientIP: "192.0.2.1"})
+	f.NoError(err)
+	_, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "second-article", Kind: "like", ClientIP: "192.0.2.1"})
+	f.NoError(err)
+
+	_, err = s.CreateBan(ctx, gomments.CreateBanRequest{Kind: gomments.BanKindAuthorName, Value: "troll", Mode: gomments.BanModeReject})
+	f.NoError(err)
+
+	_, err = s.FlagReply(ctx, gomments.FlagReplyRequest{ReplyID: ids["bob"], Reason: "rude"})
+	f.NoError(err)
+	_, err = s.ModerateReply(ctx, gomments.ModerateReplyRequest{ReplyID: ids["bob"], Action: gomments.ModerationActionDelete})
+	f.NoError(err)
+
+	export := func(filter gomments.BackupFilter) (*gomments.ExportResponse, string) {
+		var buf bytes.Buffer
+		resp, err := s.Export(ctx, gomments.ExportRequest{Filter: filter, Writer: &buf})
+		f.NoError(err)
+		return resp, buf.String()
+	}
+
+	resp, backup := export(gomments.BackupFilter{})
+	f.Equal(map[gomments.BackupRecordType]int{
+		gomments.BackupRecordReply:           4,
+		gomments.BackupRecordArticleReaction: 2,
+		gomments.BackupRecordReplyReaction:   1,
+		gomments.BackupRecordBan:             1,
+		gomments.BackupRecordFlag:            1,
+		gomments.BackupRecordModerationEvent: 2,
+	}, resp.Counts)
+	f.True(strings.HasPrefix(backup, `{"type":"header","data":{"version":1,`))
+
+	t.Run("restores into an empty database", func(tt *testing.T) {
+		r := require.New(tt)
+		dst := newFixture(tt)
+
+		// Offset the IDs, so restored moderation events have to be pointed at
+		// their targets' new IDs.
+		_, err := insertReply(ctx, dst.db, insertReplyParams{IdempotencyKey: uuid.NewString(), Article: "other-article", Body: "first"})
+		r.NoError(err)
+
+		restoreResp, err := dst.service.Restore(ctx, gomments.RestoreRequest{Reader: strings.NewReader(backup)})
+		r.NoError(err)
+		r.Equal(3, restoreResp.Restored[gomments.BackupRecordReply])
+		r.Equal(1, restoreResp.Existing[gomments.BackupRecordReply])
+		r.Equal(2, restoreResp.Restored[gomments.BackupRecordModerationEvent])
+
+		repliesResp, err := dst.service.GetReplies(ctx, gomments.GetRepliesRequest{Article: "first-article"})
+		r.NoError(err)
+		r.Len(repliesResp.Replies, 1)
+		r.Equal("alice", repliesResp.Replies[0].AuthorName)
+		r.Equal(gomments.ReplyReactionStats{"like": 1}, repliesResp.Replies[0].Reactions)
+
+		statsResp, err := dst.service.GetReactionStatsByArticles(ctx, gomments.GetReactionStatsByArticlesRequest{Articles: []string{"first-article"}})
+		r.NoError(err)
+		r.Equal(1, statsResp.Stats["first-article"]["like"])
+
+		var bobID int
+		r.NoError(dst.db.Get(&bobID, "select id from reply where author_name = 'bob'"))
+		r.NotEqual(ids["bob"], bobID)
+
+		var targetIDs []string
+		r.NoError(dst.db.Select(&targetIDs, "select target_id from moderation_event where target_type = 'reply'"))
+		r.Equal([]string{strconv.Itoa(bobID)}, targetIDs)
+
+		var flagReplyIDs []int
+		r.NoError(dst.db.Select(&flagReplyIDs, "select reply_id from reply_flag"))
+		r.Equal([]int{bobID}, flagReplyIDs)
+
+		again, err := dst.service.Restore(ctx, gomments.RestoreRequest{Reader: strings.NewReader(backup)})
+		r.NoError(err)
+		r.Empty(again.Restored)
+		r.Equal(resp.Counts, again.Existing)
+	})
+
+	t.Run("reports reactions that clash with the same client's", func(tt *testing.T) {
+		r := require.New(tt)
+		dst := newFixture(tt)
+
+		var clientKey string
+		r.NoError(f.db.Get(&clientKey, "select client_key from article_reaction where article = 'first-article'"))
+		_, err := dst.db.Exec(
+			"insert into article_reaction (article, kind, deletion_key, client_key) values ('first-article', 'like', ?, ?)",
+			uuid.NewString(),
+			clientKey,
+		)
+		r.NoError(err)
+
+		restoreResp, err := dst.service.Restore(ctx, gomments.RestoreRequest{Reader: strings.NewReader(backup)})
+		r.NoError(err)
+		r.Equal(1, restoreResp.Restored[gomments.BackupRecordArticleReaction])
+		r.Zero(restoreResp.Existing[gomments.BackupRecordArticleReaction])
+		r.Equal(map[gomments.BackupRecordType]int{gomments.BackupRecordArticleReaction: 1}, restoreResp.Conflicts)
+	})
+
+	t.Run("doesn't restore in a dry run", func(tt *testing.T) {
+		r := require.New(tt)
+		dst := newFixture(tt)
+
+		restoreResp, err := dst.service.Restore(ctx, gomments.RestoreRequest{Reader: strings.NewReader(backup), DryRun: true})
+		r.NoError(err)
+		r.Equal(3, restoreResp.Restored[gomments.BackupRecordReply])
+
+		var count int
+		r.NoError(dst.db.Get(&count, "select count(*) from reply"))
+		r.Equal(1, count)
+	})
+
+	t.Run("filters by article and time", func(tt *testing.T) {
+		r := require.New(tt)
+
+		resp, _ := export(gomments.BackupFilter{Articles: []string{"first-article"}})
+		r.Equal(map[gomments.BackupRecordType]int{
+			gomments.BackupRecordReply:           2,
+			gomments.BackupRecordArticleReaction: 1,
+			gomments.BackupRecordReplyReaction:   1,
+			gomments.BackupRecordFlag:            1,
+			// The ban's event isn't about the article.
+			gomments.BackupRecordModerationEvent: 1,
+		}, resp.Counts)
+
+		resp, _ = export(gomments.BackupFilter{Articles: []string{"second-article"}})
+		r.Equal(map[gomments.BackupRecordType]int{
+			gomments.BackupRecordReply:           1,
+			gomments.BackupRecordArticleReaction: 1,
+		}, resp.Counts)
+
+		resp, _ = export(gomments.BackupFilter{Until: time.Now().Add(-time.Hour)})
+		r.Equal(map[gomments.BackupRecordType]int{
+			gomments.BackupRecordReply: 1,
+		}, resp.Counts)
+	})
+
+	t.Run("rejects backups from newer versions", func(tt *testing.T) {
+		r := require.New(tt)
+
+		_, err := s.Restore(ctx, gomments.RestoreRequest{Reader: strings.NewReader(`{"type":"header","data":{"version":2}}` + "\n")})
+		r.ErrorContains(err, "unsupported backup version: 2")
+
+		_, err = s.Restore(ctx, gomments.RestoreRequest{Reader: strings.NewReader(`{"type":"reply","data":{}}` + "\n")})
+		r.ErrorContains(err, "no header")
+	})
+}
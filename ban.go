@@ -0,0 +1,249 @@
+package gomments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type BanKind string
+
+const (
+	BanKindSignature  BanKind = "signature"
+	BanKindIPHash     BanKind = "ip_hash"
+	BanKindAuthorName BanKind = "author_name"
+)
+
+type BanMode string
+
+const (
+	// BanModeReject refuses the submission with an error.
+	BanModeReject BanMode = "reject"
+	// BanModeShadow accepts the submission but hides it from everyone except
+	// its author.
+	BanModeShadow BanMode = "shadow"
+)
+
+type Ban struct {
+	ID        int        `db:"id" json:"id"`
+	Kind      BanKind    `db:"kind" json:"kind"`
+	Value     string     `db:"value" json:"value"`
+	Mode      BanMode    `db:"mode" json:"mode"`
+	Reason    string     `db:"reason" json:"reason"`
+	ExpiresAt *time.Time `db:"expires_at" json:"expires_at"`
+	Deleted   bool       `db:"deleted" json:"-"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+}
+
+func (b Ban) active(now time.Time) bool {
+	return !b.Deleted && (b.ExpiresAt == nil || b.ExpiresAt.After(now))
+}
+
+type banSubject struct {
+	Signature  string
+	ClientHash string
+	AuthorName string
+}
+
+// banPattern returns the compiled author name pattern of a ban. Patterns are
+// only written by moderators, so every pattern compiled is kept.
+func (s *Service) banPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := s.banPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	s.banPatterns.Store(pattern, re)
+
+	return re, nil
+}
+
+func banError(ban *Ban) ServiceError {
+	msg := "you have been banned from posting"
+	if ban.ExpiresAt != nil {
+		msg += fmt.Sprintf(" until %s", ban.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	if ban.Reason != "" {
+		msg += fmt.Sprintf(": %s", ban.Reason)
+	}
+
+	return Errorf(http.StatusForbidden, "%s", msg)
+}
+
+// findBan returns the active ban matching the subject, preferring a rejecting
+// ban over a shadowban. It returns nil if the subject isn't banned.
+func (s *Service) findBan(ctx context.Context, subject banSubject) (*Ban, error) {
+	now := time.Now()
+	bans, err := getBansForSubject(ctx, s.db, subject, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *Ban
+	for i, ban := range bans {
+		if !ban.active(now) {
+			continue
+		}
+		// Signatures and client hashes are matched by the query, leaving
+		// author name patterns.
+		if ban.Kind == BanKindAuthorName {
+			re, err := s.banPattern(ban.Value)
+			if err != nil || !re.MatchString(subject.AuthorName) {
+				continue
+			}
+		}
+		if ban.Mode == BanModeReject {
+			return &bans[i], nil
+		}
+		if found == nil {
+			found = &bans[i]
+		}
+	}
+
+	return found, nil
+}
+
+type CreateBanRequest struct {
+	Actor     string     `json:"-"`
+	Kind      BanKind    `json:"kind"`
+	Value     string     `json:"value"`
+	Mode      BanMode    `json:"mode"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type CreateBanResponse struct {
+	Ban Ban `json:"ban"`
+}
+
+func (s *Service) CreateBan(ctx context.Context, req CreateBanRequest) (*CreateBanResponse, error) {
+	if req.Value == "" {
+		return nil, Errorf(http.StatusBadRequest, "requires ban value")
+	}
+
+	switch req.Kind {
+	case BanKindSignature:
+	case BanKindIPHash:
+		// Accept a raw IP for convenience, but only ever store its hash.
+		if key, ok := s.clientIP.KeyString(req.Value); ok {
+			req.Value = s.hashClientIP(key)
+		}
+	case BanKindAuthorName:
+		if _, err := regexp.Compile(req.Value); err != nil {
+			return nil, Errorf(http.StatusBadRequest, "compiling author name pattern: %w", err)
+		}
+	default:
+		return nil, Errorf(http.StatusBadRequest, "not a valid ban kind: %q", req.Kind)
+	}
+
+	if req.Mode == "" {
+		req.Mode = BanModeReject
+	}
+	if req.Mode != BanModeReject && req.Mode != BanModeShadow {
+		return nil, Errorf(http.StatusBadRequest, "not a valid ban mode: %q", req.Mode)
+	}
+
+	ban := Ban{
+		Kind:      req.Kind,
+		Value:     req.Value,
+		Mode:      req.Mode,
+		Reason:    req.Reason,
+		ExpiresAt: req.ExpiresAt,
+		CreatedAt: time.Now(),
+	}
+
+	if err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		id, err := insertBan(ctx, tx, ban)
+		if err != nil {
+			return err
+		}
+		ban.ID = id
+
+		_, err = insertModerationEvent(ctx, tx, ModerationEvent{
+			Actor:      getActorFallback(req.Actor),
+			Action:     ModerationActionBan,
+			TargetType: ModerationTargetBan,
+			TargetID:   strconv.Itoa(id),
+			Reason:     req.Reason,
+			CreatedAt:  ban.CreatedAt,
+		})
+		return err
+	}); err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "inserting ban: %w", err)
+	}
+
+	return &CreateBanResponse{Ban: ban}, nil
+}
+
+type ListBansRequest struct {
+	IncludeExpired bool
+}
+
+type ListBansResponse struct {
+	Bans []Ban `json:"bans"`
+}
+
+func (s *Service) ListBans(ctx context.Context, req ListBansRequest) (*ListBansResponse, error) {
+	bans, err := getBans(ctx, s.db)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting bans: %w", err)
+	}
+
+	resp := &ListBansResponse{Bans: []Ban{}}
+	now := time.Now()
+	for _, ban := range bans {
+		if req.IncludeExpired || ban.active(now) {
+			resp.Bans = append(resp.Bans, ban)
+		}
+	}
+
+	return resp, nil
+}
+
+type DeleteBanRequest struct {
+	Actor  string
+	ID     int
+	Reason string
+}
+
+type DeleteBanResponse struct {
+}
+
+func (s *Service) DeleteBan(ctx context.Context, req DeleteBanRequest) (*DeleteBanResponse, error) {
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		ok, err := deleteBan(ctx, tx, req.ID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errNotFound
+		}
+
+		_, err = insertModerationEvent(ctx, tx, ModerationEvent{
+			Actor:      getActorFallback(req.Actor),
+			Action:     ModerationActionUnban,
+			TargetType: ModerationTargetBan,
+			TargetID:   strconv.Itoa(req.ID),
+			Reason:     req.Reason,
+			CreatedAt:  time.Now(),
+		})
+		return err
+	})
+	if errors.Is(err, errNotFound) {
+		return nil, Errorf(http.StatusNotFound, "ban not found: %d", req.ID)
+	}
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "deleting ban: %w", err)
+	}
+
+	return &DeleteBanResponse{}, nil
+}
@@ -0,0 +1,152 @@
+package gomments_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/google/uuid"
+)
+
+func TestService_SubmitReply_Bans(t *testing.T) {
+	t.Run("rejects banned signature", func(tt *testing.T) {
+		ctx := context.Background()
+		f := newFixture(tt)
+		s := f.service
+
+		resp, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			IdempotencyKey:  uuid.NewString(),
+			SignatureSecret: "troll",
+			Article:         "test-article",
+			Body:            "first",
+		})
+		f.NoError(err)
+
+		_, err = s.CreateBan(ctx, gomments.CreateBanRequest{
+			Kind:   gomments.BanKindSignature,
+			Value:  resp.Reply.Signature,
+			Reason: "trolling",
+		})
+		f.NoError(err)
+
+		_, err = s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			IdempotencyKey:  uuid.NewString(),
+			SignatureSecret: "troll",
+			Article:         "test-article",
+			Body:            "second",
+		})
+		var gsErr gomments.ServiceError
+		f.ErrorAs(err, &gsErr)
+		f.Equal(403, gsErr.Status())
+		f.Contains(gsErr.Error(), "trolling")
+	})
+
+	t.Run("ignores expired and lifted bans", func(tt *testing.T) {
+		ctx := context.Background()
+		f := newFixture(tt)
+		s := f.service
+
+		expired := time.Now().Add(-time.Minute)
+		_, err := s.CreateBan(ctx, gomments.CreateBanRequest{
+			Kind:      gomments.BanKindAuthorName,
+			Value:     "(?i)^spam",
+			ExpiresAt: &expired,
+		})
+		f.NoError(err)
+
+		lifted, err := s.CreateBan(ctx, gomments.CreateBanRequest{
+			Kind:  gomments.BanKindAuthorName,
+			Value: "(?i)^spam",
+		})
+		f.NoError(err)
+		_, err = s.DeleteBan(ctx, gomments.DeleteBanRequest{ID: lifted.Ban.ID})
+		f.NoError(err)
+
+		_, err = s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			IdempotencyKey: uuid.NewString(),
+			Article:        "test-article",
+			Body:           "hello",
+			AuthorName:     "SpamBot",
+		})
+		f.NoError(err)
+
+		listResp, err := s.ListBans(ctx, gomments.ListBansRequest{})
+		f.NoError(err)
+		f.Empty(listResp.Bans)
+	})
+
+	t.Run("shadowbanned replies are only visible to their author", func(tt *testing.T) {
+		ctx := context.Background()
+		f := newFixture(tt)
+		s := f.service
+
+		_, err := s.CreateBan(ctx, gomments.CreateBanRequest{
+			Kind:  gomments.BanKindIPHash,
+			Value: "203.0.113.7",
+			Mode:  gomments.BanModeShadow,
+		})
+		f.NoError(err)
+
+		_, err = s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			IdempotencyKey: uuid.NewString(),
+			Article:        "test-article",
+			Body:           "can you see me?",
+			ClientIP:       "203.0.113.7",
+		})
+		f.NoError(err)
+
+		authorResp, err := s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "test-article", ClientIP: "203.0.113.7"})
+		f.NoError(err)
+		f.Len(authorResp.Replies, 1)
+
+		otherResp, err := s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "test-article", ClientIP: "198.51.100.1"})
+		f.NoError(err)
+		f.Empty(otherResp.Replies)
+
+		statsResp, err := s.GetReplyStatsByArticles(ctx, gomments.GetReplyStatsByArticlesRequest{Articles: []string{"test-article"}})
+		f.NoError(err)
+		f.Equal(0, statsResp.Stats["test-article"].Count)
+	})
+}
+
+func TestService_CreateReaction_Bans(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	s := f.service
+
+	_, err := s.CreateBan(ctx, gomments.CreateBanRequest{
+		Kind:  gomments.BanKindIPHash,
+		Value: "203.0.113.7",
+	})
+	f.NoError(err)
+
+	_, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like", ClientIP: "203.0.113.7"})
+	f.Error(err)
+
+	// IPv6 clients are identified by their /64, so banning one IP bans its
+	// whole network
+	_, err = s.CreateBan(ctx, gomments.CreateBanRequest{
+		Kind:  gomments.BanKindIPHash,
+		Value: "2001:db8:1:2::5",
+	})
+	f.NoError(err)
+
+	_, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like", ClientIP: "2001:db8:1:2::/64"})
+	f.Error(err)
+
+	_, err = s.CreateBan(ctx, gomments.CreateBanRequest{
+		Kind:  gomments.BanKindIPHash,
+		Value: "203.0.113.8",
+		Mode:  gomments.BanModeShadow,
+	})
+	f.NoError(err)
+
+	resp, err := s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like", ClientIP: "203.0.113.8"})
+	f.NoError(err)
+	f.NotEmpty(resp.DeletionKey)
+
+	statsResp, err := s.GetReactionStatsByArticles(ctx, gomments.GetReactionStatsByArticlesRequest{Articles: []string{"test-article"}})
+	f.NoError(err)
+	f.Equal(0, statsResp.Stats["test-article"]["like"])
+}
@@ -0,0 +1,186 @@
+package gomments
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arizard/gomments/internal"
+)
+
+// CaptchaConfig configures the image and audio captcha. The captcha is only
+// required once a reply crosses one of the thresholds; with both thresholds
+// at zero it's always required.
+type CaptchaConfig struct {
+	Length int
+	TTL    time.Duration
+	// SpamScoreThreshold requires a captcha for replies whose spam score is
+	// at least this high.
+	SpamScoreThreshold int
+	// RecentRepliesThreshold requires a captcha once a client has submitted
+	// this many replies within RecentWindow.
+	RecentRepliesThreshold int
+	RecentWindow           time.Duration
+}
+
+func DefaultCaptchaConfig() CaptchaConfig {
+	return CaptchaConfig{
+		Length:                 5,
+		TTL:                    10 * time.Minute,
+		SpamScoreThreshold:     3,
+		RecentRepliesThreshold: 3,
+		RecentWindow:           time.Hour,
+	}
+}
+
+// WithCaptcha enables the captcha fallback.
+func WithCaptcha(cfg CaptchaConfig) Option {
+	return func(s *Service) {
+		s.captcha = &cfg
+	}
+}
+
+// captchaRequired decides whether a reply has to be accompanied by a solved
+// captcha, based on its content and the client's recent behaviour.
+func (s *Service) captchaRequired(ctx context.Context, params insertReplyParams) (bool, error) {
+	cfg := s.captcha
+	if cfg.SpamScoreThreshold <= 0 && cfg.RecentRepliesThreshold <= 0 {
+		return true, nil
+	}
+
+	if cfg.SpamScoreThreshold > 0 && spamScore(params.Body, params.AuthorName) >= cfg.SpamScoreThreshold {
+		return true, nil
+	}
+
+	if cfg.RecentRepliesThreshold > 0 && params.ClientHash != "" {
+		count, err := countRepliesByClientSince(ctx, s.db, params.ClientHash, time.Now().Add(-cfg.RecentWindow))
+		if err != nil {
+			return false, err
+		}
+		if count >= cfg.RecentRepliesThreshold {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *Service) verifyCaptcha(ctx context.Context, id string, answer string) error {
+	if id == "" || answer == "" {
+		return Errorf(http.StatusPreconditionRequired, "captcha required")
+	}
+
+	// The captcha is consumed whether or not the answer is right, so it
+	// can't be brute forced.
+	c, err := takeCaptcha(ctx, s.db, id)
+	if err != nil {
+		return Errorf(http.StatusInternalServerError, "getting captcha: %w", err)
+	}
+	if c == nil || !c.ExpiresAt.After(time.Now()) {
+		return Errorf(http.StatusPreconditionRequired, "captcha expired, please try another")
+	}
+
+	if strings.TrimSpace(answer) != c.Answer {
+		return Errorf(http.StatusPreconditionRequired, "captcha answer incorrect, please try another")
+	}
+
+	return nil
+}
+
+type Captcha struct {
+	ID        string    `db:"id"`
+	Answer    string    `db:"answer"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+type CreateCaptchaRequest struct {
+}
+
+type CreateCaptchaResponse struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (s *Service) CreateCaptcha(ctx context.Context, req CreateCaptchaRequest) (*CreateCaptchaResponse, error) {
+	if s.captcha == nil {
+		return nil, Errorf(http.StatusNotFound, "captcha is not enabled")
+	}
+
+	answer := strings.Builder{}
+	for range max(s.captcha.Length, 1) {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return nil, Errorf(http.StatusInternalServerError, "generating captcha: %w", err)
+		}
+		answer.WriteString(n.String())
+	}
+
+	c := Captcha{
+		ID:        hex.EncodeToString(randomBytes(16)),
+		Answer:    answer.String(),
+		ExpiresAt: time.Now().Add(s.captcha.TTL),
+	}
+
+	if err := insertCaptcha(ctx, s.db, c, time.Now()); err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "inserting captcha: %w", err)
+	}
+
+	return &CreateCaptchaResponse{ID: c.ID, ExpiresAt: c.ExpiresAt}, nil
+}
+
+type GetCaptchaMediaRequest struct {
+	ID string
+}
+
+type GetCaptchaMediaResponse struct {
+	ContentType string
+	Data        []byte
+}
+
+func (s *Service) getCaptcha(ctx context.Context, id string) (*Captcha, error) {
+	if s.captcha == nil {
+		return nil, Errorf(http.StatusNotFound, "captcha is not enabled")
+	}
+
+	c, err := getCaptcha(ctx, s.db, id)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting captcha: %w", err)
+	}
+	if c == nil || !c.ExpiresAt.After(time.Now()) {
+		return nil, Errorf(http.StatusNotFound, "captcha not found")
+	}
+
+	return c, nil
+}
+
+func (s *Service) GetCaptchaImage(ctx context.Context, req GetCaptchaMediaRequest) (*GetCaptchaMediaResponse, error) {
+	c, err := s.getCaptcha(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := internal.RenderCaptchaPNG(c.Answer)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "rendering captcha image: %w", err)
+	}
+
+	return &GetCaptchaMediaResponse{ContentType: "image/png", Data: data}, nil
+}
+
+func (s *Service) GetCaptchaAudio(ctx context.Context, req GetCaptchaMediaRequest) (*GetCaptchaMediaResponse, error) {
+	c, err := s.getCaptcha(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := internal.RenderCaptchaWAV(c.Answer)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "rendering captcha audio: %w", err)
+	}
+
+	return &GetCaptchaMediaResponse{ContentType: "audio/wav", Data: data}, nil
+}
@@ -0,0 +1,160 @@
+package gomments_test
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/google/uuid"
+)
+
+func TestService_SubmitReply_Captcha(t *testing.T) {
+	cfg := gomments.DefaultCaptchaConfig()
+	cfg.RecentRepliesThreshold = 2
+
+	t.Run("requires captcha for spammy replies", func(tt *testing.T) {
+		ctx := context.Background()
+		f := newFixture(tt, gomments.WithCaptcha(cfg))
+		s := f.service
+
+		req := gomments.SubmitReplyRequest{
+			IdempotencyKey: uuid.NewString(),
+			Article:        "test-article",
+			Body:           "cheap pills https://spam.example https://spam.example",
+		}
+		_, err := s.SubmitReply(ctx, req)
+		var gsErr gomments.ServiceError
+		f.ErrorAs(err, &gsErr)
+		f.Equal(428, gsErr.Status())
+
+		captchaResp, err := s.CreateCaptcha(ctx, gomments.CreateCaptchaRequest{})
+		f.NoError(err)
+
+		var answer string
+		f.NoError(f.db.Get(&answer, "select answer from captcha where id = ?", captchaResp.ID))
+		f.Len(answer, cfg.Length)
+
+		req.CaptchaID = captchaResp.ID
+		req.CaptchaAnswer = answer
+		_, err = s.SubmitReply(ctx, req)
+		f.NoError(err)
+
+		req.IdempotencyKey = uuid.NewString()
+		_, err = s.SubmitReply(ctx, req)
+		f.ErrorContains(err, "captcha expired")
+	})
+
+	t.Run("requires captcha after repeated replies", func(tt *testing.T) {
+		ctx := context.Background()
+		f := newFixture(tt, gomments.WithCaptcha(cfg))
+		s := f.service
+
+		for range cfg.RecentRepliesThreshold {
+			_, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+				IdempotencyKey: uuid.NewString(),
+				Article:        "test-article",
+				Body:           "hello",
+				ClientIP:       "203.0.113.7",
+			})
+			f.NoError(err)
+		}
+
+		_, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			IdempotencyKey: uuid.NewString(),
+			Article:        "test-article",
+			Body:           "hello again",
+			ClientIP:       "203.0.113.7",
+		})
+		f.ErrorContains(err, "captcha required")
+
+		_, err = s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			IdempotencyKey: uuid.NewString(),
+			Article:        "test-article",
+			Body:           "hello",
+			ClientIP:       "198.51.100.1",
+		})
+		f.NoError(err)
+	})
+
+	t.Run("renders image and audio", func(tt *testing.T) {
+		ctx := context.Background()
+		f := newFixture(tt, gomments.WithCaptcha(cfg))
+		s := f.service
+
+		captchaResp, err := s.CreateCaptcha(ctx, gomments.CreateCaptchaRequest{})
+		f.NoError(err)
+
+		imageResp, err := s.GetCaptchaImage(ctx, gomments.GetCaptchaMediaRequest{ID: captchaResp.ID})
+		f.NoError(err)
+		f.Equal("image/png", imageResp.ContentType)
+		_, err = png.Decode(bytes.NewReader(imageResp.Data))
+		f.NoError(err)
+
+		audioResp, err := s.GetCaptchaAudio(ctx, gomments.GetCaptchaMediaRequest{ID: captchaResp.ID})
+		f.NoError(err)
+		f.Equal("audio/wav", audioResp.ContentType)
+		f.Equal("RIFF", string(audioResp.Data[:4]))
+
+		_, err = s.GetCaptchaImage(ctx, gomments.GetCaptchaMediaRequest{ID: "unknown"})
+		f.ErrorContains(err, "captcha not found")
+	})
+}
+
+func TestService_SubmitReply_CaptchaInsteadOfChallenge(t *testing.T) {
+	ctx := context.Background()
+	cfg := gomments.DefaultCaptchaConfig()
+	f := newFixture(t,
+		gomments.WithCaptcha(cfg),
+		gomments.WithChallenge(gomments.ChallengeConfig{Difficulty: 4, TTL: time.Minute}),
+	)
+	s := f.service
+
+	newCaptcha := func() (string, string) {
+		captchaResp, err := s.CreateCaptcha(ctx, gomments.CreateCaptchaRequest{})
+		f.NoError(err)
+		var answer string
+		f.NoError(f.db.Get(&answer, "select answer from captcha where id = ?", captchaResp.ID))
+		return captchaResp.ID, answer
+	}
+
+	// A captcha replaces the proof-of-work.
+	id, answer := newCaptcha()
+	_, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "test-article",
+		Body:           "hello",
+		CaptchaID:      id,
+		CaptchaAnswer:  answer,
+	})
+	f.NoError(err)
+
+	// A challenge refused for a captcha can be sent again with one.
+	challengeResp, err := s.GetChallenge(ctx, gomments.GetChallengeRequest{})
+	f.NoError(err)
+	req := gomments.SubmitReplyRequest{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "test-article",
+		Body:           "cheap pills https://spam.example https://spam.example",
+		Challenge:      challengeResp.Challenge,
+		Nonce:          solveChallenge(challengeResp.Challenge, challengeResp.Difficulty),
+	}
+	_, err = s.SubmitReply(ctx, req)
+	f.ErrorContains(err, "captcha required")
+
+	req.CaptchaID, req.CaptchaAnswer = newCaptcha()
+	_, err = s.SubmitReply(ctx, req)
+	f.NoError(err)
+
+	// The challenge was never used, so it's still good for a plain reply.
+	_, err = s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "test-article",
+		Body:           "hello again",
+		Challenge:      req.Challenge,
+		Nonce:          req.Nonce,
+	})
+	f.NoError(err)
+}
@@ -0,0 +1,195 @@
+package gomments
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ChallengeConfig configures the hashcash-style proof-of-work required to
+// submit a reply. A client solves a challenge by finding a nonce such that
+// sha256(challenge + ":" + nonce) starts with at least Difficulty zero bits.
+type ChallengeConfig struct {
+	// Difficulty is the number of leading zero bits required when the site
+	// is quiet.
+	Difficulty int
+	// MaxDifficulty caps the difficulty when the site is busy.
+	MaxDifficulty int
+	// TTL is how long an issued challenge can be solved for.
+	TTL time.Duration
+	// Window is how far back submissions are counted to adapt the difficulty.
+	Window time.Duration
+	// Step is the number of submissions in Window that adds one bit of
+	// difficulty.
+	Step int
+}
+
+func DefaultChallengeConfig() ChallengeConfig {
+	return ChallengeConfig{
+		Difficulty:    18,
+		MaxDifficulty: 24,
+		TTL:           10 * time.Minute,
+		Window:        10 * time.Minute,
+		Step:          20,
+	}
+}
+
+// WithChallenge requires replies to carry a solved proof-of-work challenge.
+func WithChallenge(cfg ChallengeConfig) Option {
+	return func(s *Service) {
+		s.challenge = &cfg
+	}
+}
+
+type challenge struct {
+	ID         string
+	Difficulty int
+	ExpiresAt  time.Time
+}
+
+func (c challenge) payload() string {
+	return fmt.Sprintf("%s.%d.%d", c.ID, c.Difficulty, c.ExpiresAt.Unix())
+}
+
+func (s *Service) parseChallenge(token string) (challenge, error) {
+	payload, sig, ok := strings.Cut(strings.TrimSpace(token), "~")
+	if !ok || !s.verifySignature(payload, sig) {
+		return challenge{}, fmt.Errorf("invalid challenge signature")
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return challenge{}, fmt.Errorf("malformed challenge")
+	}
+
+	difficulty, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return challenge{}, fmt.Errorf("parsing challenge difficulty: %w", err)
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return challenge{}, fmt.Errorf("parsing challenge expiry: %w", err)
+	}
+
+	return challenge{
+		ID:         parts[0],
+		Difficulty: difficulty,
+		ExpiresAt:  time.Unix(expiresAt, 0),
+	}, nil
+}
+
+// leadingZeroBits counts the zero bits at the start of sha256(token:nonce).
+func leadingZeroBits(token string, nonce string) int {
+	sum := sha256.Sum256([]byte(token + ":" + nonce))
+	n := 0
+	for _, b := range sum {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+
+	return n
+}
+
+// currentDifficulty raises the base difficulty by one bit for every Step
+// replies submitted within Window.
+func (s *Service) currentDifficulty(ctx context.Context) (int, error) {
+	cfg := s.challenge
+	if cfg.Step <= 0 || cfg.Window <= 0 {
+		return cfg.Difficulty, nil
+	}
+
+	count, err := countRepliesSince(ctx, s.db, time.Now().Add(-cfg.Window))
+	if err != nil {
+		return 0, err
+	}
+
+	return min(cfg.Difficulty+count/cfg.Step, max(cfg.MaxDifficulty, cfg.Difficulty)), nil
+}
+
+type GetChallengeRequest struct {
+}
+
+type GetChallengeResponse struct {
+	Challenge  string    `json:"challenge"`
+	Difficulty int       `json:"difficulty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func (s *Service) GetChallenge(ctx context.Context, req GetChallengeRequest) (*GetChallengeResponse, error) {
+	if s.challenge == nil {
+		return nil, Errorf(http.StatusNotFound, "challenges are not enabled")
+	}
+
+	difficulty, err := s.currentDifficulty(ctx)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting difficulty: %w", err)
+	}
+
+	c := challenge{
+		ID:         hex.EncodeToString(randomBytes(16)),
+		Difficulty: difficulty,
+		ExpiresAt:  time.Now().Add(s.challenge.TTL).Truncate(time.Second),
+	}
+
+	payload := c.payload()
+	return &GetChallengeResponse{
+		Challenge:  payload + "~" + s.sign(payload),
+		Difficulty: c.Difficulty,
+		ExpiresAt:  c.ExpiresAt,
+	}, nil
+}
+
+// verifyChallenge checks the solved challenge on a reply. The challenge is
+// burnt by burnChallenge when the reply is inserted, so it can't be used again.
+func (s *Service) verifyChallenge(token string, nonce string) (*challenge, error) {
+	if token == "" || nonce == "" {
+		return nil, Errorf(http.StatusBadRequest, "requires a solved challenge")
+	}
+
+	c, err := s.parseChallenge(token)
+	if err != nil {
+		return nil, Errorf(http.StatusBadRequest, "parsing challenge: %w", err)
+	}
+
+	if !c.ExpiresAt.After(time.Now()) {
+		return nil, Errorf(http.StatusBadRequest, "challenge expired")
+	}
+
+	if leadingZeroBits(token, nonce) < c.Difficulty {
+		return nil, Errorf(http.StatusBadRequest, "challenge not solved")
+	}
+
+	return &c, nil
+}
+
+// burnChallenge burns a verified challenge, in the transaction inserting its
+// reply, so a reply that fails to insert doesn't lose its challenge.
+func (s *Service) burnChallenge(ctx context.Context, tx *sqlx.Tx, c challenge) error {
+	ok, err := useChallenge(ctx, tx, c.ID, c.ExpiresAt, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return Errorf(http.StatusConflict, "challenge already used")
+	}
+
+	return nil
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
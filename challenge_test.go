@@ -0,0 +1,163 @@
+package gomments_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/google/uuid"
+)
+
+func leadingZeroBits(challenge string, nonce string) int {
+	sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+func solveChallenge(challenge string, difficulty int) string {
+	for i := 0; ; i++ {
+		if nonce := strconv.Itoa(i); leadingZeroBits(challenge, nonce) >= difficulty {
+			return nonce
+		}
+	}
+}
+
+func unsolvedNonce(challenge string, difficulty int) string {
+	for i := 0; ; i++ {
+		if nonce := strconv.Itoa(i); leadingZeroBits(challenge, nonce) < difficulty {
+			return nonce
+		}
+	}
+}
+
+func TestService_SubmitReply_Challenge(t *testing.T) {
+	cfg := gomments.ChallengeConfig{
+		Difficulty:    4,
+		MaxDifficulty: 6,
+		TTL:           time.Minute,
+		Window:        time.Hour,
+		Step:          2,
+	}
+
+	t.Run("requires a solved challenge", func(tt *testing.T) {
+		ctx := context.Background()
+		f := newFixture(tt, gomments.WithChallenge(cfg))
+		s := f.service
+
+		req := gomments.SubmitReplyRequest{
+			IdempotencyKey: uuid.NewString(),
+			Article:        "test-article",
+			Body:           "hello",
+		}
+
+		_, err := s.SubmitReply(ctx, req)
+		f.ErrorContains(err, "requires a solved challenge")
+
+		challengeResp, err := s.GetChallenge(ctx, gomments.GetChallengeRequest{})
+		f.NoError(err)
+		// the example reply seeded by the migrations is below one Step
+		f.Equal(4, challengeResp.Difficulty)
+
+		req.Challenge = challengeResp.Challenge
+		req.Nonce = unsolvedNonce(req.Challenge, challengeResp.Difficulty)
+		_, err = s.SubmitReply(ctx, req)
+		f.ErrorContains(err, "challenge not solved")
+
+		req.Nonce = solveChallenge(challengeResp.Challenge, challengeResp.Difficulty)
+		resp, err := s.SubmitReply(ctx, req)
+		f.NoError(err)
+
+		// A retry, say after a network error, gets the reply back.
+		retryResp, err := s.SubmitReply(ctx, req)
+		f.NoError(err)
+		f.Equal(resp.Reply.ID, retryResp.Reply.ID)
+
+		req.IdempotencyKey = uuid.NewString()
+		_, err = s.SubmitReply(ctx, req)
+		f.ErrorContains(err, "challenge already used")
+	})
+
+	t.Run("rejects tampered challenges", func(tt *testing.T) {
+		ctx := context.Background()
+		f := newFixture(tt, gomments.WithChallenge(cfg))
+		s := f.service
+
+		challengeResp, err := s.GetChallenge(ctx, gomments.GetChallengeRequest{})
+		f.NoError(err)
+
+		tampered := "0" + challengeResp.Challenge[1:]
+		if tampered == challengeResp.Challenge {
+			tampered = "1" + challengeResp.Challenge[1:]
+		}
+
+		_, err = s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			IdempotencyKey: uuid.NewString(),
+			Article:        "test-article",
+			Body:           "hello",
+			Challenge:      tampered,
+			Nonce:          solveChallenge(tampered, cfg.Difficulty),
+		})
+		f.ErrorContains(err, "invalid challenge signature")
+	})
+
+	t.Run("raises difficulty with submission volume", func(tt *testing.T) {
+		ctx := context.Background()
+		f := newFixture(tt, gomments.WithChallenge(cfg))
+		s := f.service
+
+		for range 3 {
+			challengeResp, err := s.GetChallenge(ctx, gomments.GetChallengeRequest{})
+			f.NoError(err)
+
+			_, err = s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+				IdempotencyKey: uuid.NewString(),
+				Article:        "test-article",
+				Body:           "hello",
+				Challenge:      challengeResp.Challenge,
+				Nonce:          solveChallenge(challengeResp.Challenge, challengeResp.Difficulty),
+			})
+			f.NoError(err)
+		}
+
+		challengeResp, err := s.GetChallenge(ctx, gomments.GetChallengeRequest{})
+		f.NoError(err)
+		f.Equal(cfg.MaxDifficulty, challengeResp.Difficulty)
+	})
+}
+
+func TestService_SubmitReply_ChallengeNotBurntOnFailure(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t, gomments.WithChallenge(gomments.ChallengeConfig{Difficulty: 4, TTL: time.Minute}))
+	s := f.service
+
+	_, err := s.CreateBan(ctx, gomments.CreateBanRequest{Kind: gomments.BanKindAuthorName, Value: "^troll$"})
+	f.NoError(err)
+
+	challengeResp, err := s.GetChallenge(ctx, gomments.GetChallengeRequest{})
+	f.NoError(err)
+
+	req := gomments.SubmitReplyRequest{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "test-article",
+		Body:           "hello",
+		AuthorName:     "troll",
+		Challenge:      challengeResp.Challenge,
+		Nonce:          solveChallenge(challengeResp.Challenge, challengeResp.Difficulty),
+	}
+	_, err = s.SubmitReply(ctx, req)
+	f.ErrorContains(err, "banned")
+
+	req.AuthorName = "alice"
+	_, err = s.SubmitReply(ctx, req)
+	f.NoError(err)
+}
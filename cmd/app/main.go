@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"log"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"context"
 	"net/http"
@@ -24,17 +31,304 @@ func mustGetEnv(k string) string {
 	return v
 }
 
+// abortWithError responds with the status of a gomments.ServiceError. Only
+// client errors have their message exposed.
+func abortWithError(c *gin.Context, err error) {
+	c.Error(err)
+
+	status := http.StatusInternalServerError
+	var gsErr gomments.ServiceError
+	if errors.As(err, &gsErr) {
+		status = gsErr.Status()
+	}
+
+	if status >= http.StatusInternalServerError {
+		c.AbortWithStatusJSON(status, gin.H{"error": http.StatusText(status)})
+		return
+	}
+
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
+
+// timeQuery parses an optional RFC 3339 timestamp or date query parameter,
+// responding with an error if it's neither.
+func timeQuery(c *gin.Context, name string) (time.Time, bool) {
+	v := c.Query(name)
+	if v == "" {
+		return time.Time{}, true
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, true
+		}
+	}
+
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid %s, expected a date or RFC 3339 time", name)})
+	return time.Time{}, false
+}
+
+// intParam parses an integer path parameter, responding with an error if it
+// isn't one.
+func intParam(c *gin.Context, name string) (int, bool) {
+	v, err := strconv.Atoi(c.Param(name))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid %s", name)})
+		return 0, false
+	}
+	return v, true
+}
+
+// requestURL returns the absolute URL of a request at publicURL. The Host
+// header isn't used, since the client picks it.
+func requestURL(c *gin.Context, publicURL string) string {
+	return strings.TrimSuffix(publicURL, "/") + c.Request.URL.Path
+}
+
+// serveFeed writes a feed, answering conditional requests with 304 Not
+// Modified when the client already has it.
+func serveFeed(c *gin.Context, resp *gomments.GetFeedResponse) {
+	c.Header("Content-Type", resp.ContentType)
+	c.Header("ETag", resp.ETag)
+	c.Header("Cache-Control", "public, max-age=60")
+	http.ServeContent(c.Writer, c.Request, "", resp.Updated, bytes.NewReader(resp.Data))
+}
+
+// webhookInterval is how often due webhook deliveries are attempted.
+const webhookInterval = 5 * time.Second
+
+// notificationInterval is how often batches of notifications are checked for.
+const notificationInterval = time.Minute
+
+// digestInterval is how often the moderation digest is checked for being due.
+const digestInterval = 10 * time.Minute
+
+// unsubscribePage asks for confirmation before unsubscribing, since mail
+// scanners follow links in emails.
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<body>
+{{if .Done}}<p>You've been unsubscribed.</p>{{else}}<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Unsubscribe</button>
+</form>{{end}}
+</body>
+</html>
+`))
+
+// confirmPage asks for a click before confirming an email, since mail
+// scanners follow links in emails.
+var confirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html>
+<body>
+{{if .Done}}<p>Your email address is confirmed.</p>{{else}}<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Confirm email address</button>
+</form>{{end}}
+</body>
+</html>
+`))
+
+// streamHeartbeat is how often an idle stream sends a comment, so proxies
+// don't close it.
+const streamHeartbeat = 15 * time.Second
+
+// writeStreamEvent writes an event to a server-sent event stream. Only reply
+// events have an ID, so Last-Event-ID is always the last reply seen.
+func writeStreamEvent(c *gin.Context, event gomments.StreamEvent) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+
+	if event.Type == gomments.StreamEventReply {
+		fmt.Fprintf(c.Writer, "id: %d\n", event.ID)
+	}
+	fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event.Type, data)
+	c.Writer.Flush()
+
+	return nil
+}
+
+// streamReplies serves an article's events until the client goes away or
+// falls too far behind.
+func streamReplies(c *gin.Context, svc *gomments.Service) {
+	lastEventID := 0
+	if v := c.GetHeader("Last-Event-ID"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid Last-Event-ID"})
+			return
+		}
+		lastEventID = id
+	}
+
+	resp, err := svc.SubscribeReplies(c.Request.Context(), gomments.SubscribeRepliesRequest{
+		Article:     c.Param("article"),
+		ClientIP:    internal.ClientIP(c),
+		LastEventID: lastEventID,
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	for _, reply := range resp.Backlog {
+		event := gomments.StreamEvent{Type: gomments.StreamEventReply, ID: reply.ID, Data: reply}
+		if err := writeStreamEvent(c, event); err != nil {
+			c.Error(err)
+			return
+		}
+		lastEventID = reply.ID
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-resp.Events:
+			if !ok {
+				return
+			}
+			if event.Type == gomments.StreamEventReply {
+				// already sent in the backlog
+				if event.ID <= lastEventID {
+					continue
+				}
+				lastEventID = event.ID
+			}
+			if err := writeStreamEvent(c, event); err != nil {
+				c.Error(err)
+				return
+			}
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
+
+// rateLimitPolicies returns the rate limits for routes mounted on base. Reads
+// are cheap and get a generous limit, while writes are limited per client, and
+// replies also per article and per signature.
+func rateLimitPolicies(base string) []internal.RateLimitPolicy {
+	route := func(p string) string {
+		return path.Join("/", base, p)
+	}
+	replies := []string{route("/articles/:article/replies")}
+	reactions := []string{route("/articles/:article/reactions/:kind"), route("/replies/:id/reactions/:kind")}
+	bySignature := func(c *gin.Context) (string, bool) {
+		secret, ok := internal.JSONField(c, "signature_secret")
+		if !ok {
+			return "", false
+		}
+		return gomments.ReplySignature(secret), true
+	}
+
+	return []internal.RateLimitPolicy{
+		{
+			Name:    "read",
+			Methods: []string{http.MethodGet, http.MethodHead},
+			Limit:   internal.RateLimit{Rate: 20, Per: time.Second, Burst: 50},
+		},
+		{
+			Name:    "write",
+			Methods: []string{http.MethodPost, http.MethodDelete},
+			Limit:   internal.RateLimit{Rate: 2, Per: time.Second, Burst: 10},
+		},
+		{
+			Name:    "reply",
+			Methods: []string{http.MethodPost},
+			Routes:  replies,
+			Limit:   internal.RateLimit{Rate: 1, Per: 30 * time.Second, Burst: 3},
+		},
+		{
+			Name:      "reply-article",
+			Methods:   []string{http.MethodPost},
+			Routes:    replies,
+			Limit:     internal.RateLimit{Rate: 10, Per: time.Minute, Burst: 20},
+			Dimension: internal.ByParam("article"),
+		},
+		{
+			Name:      "reply-signature",
+			Methods:   []string{http.MethodPost},
+			Routes:    replies,
+			Limit:     internal.RateLimit{Rate: 1, Per: 30 * time.Second, Burst: 3},
+			Dimension: bySignature,
+		},
+		{
+			Name:    "reaction",
+			Methods: []string{http.MethodPost},
+			Routes:  reactions,
+			Limit:   internal.RateLimit{Rate: 1, Per: time.Second, Burst: 5},
+		},
+	}
+}
+
 func main() {
 	settings := struct {
 		port        string
 		baseURL     string
 		allowOrigin string
 		cors        cors.Config
+		adminToken  string
+		ipHashSalt  string
+		signingKey  string
+		powDiff     string
+		formMinAge  string
+		captcha     string
+		reactions   string
+		publicURL   string
+		feedTitle   string
+		articleURL  string
+		rlStore     string
+		rlDB        string
+		rlMaxKeys   string
+		proxies     string
+		ipHeader    string
+		ipv6Prefix  string
+		smtpAddr    string
+		smtpUser    string
+		smtpPass    string
+		smtpFrom    string
+		notifyTo    string
+		notifyTmpl  string
+		digest      string
 	}{
 		port:        mustGetEnv("PORT"),
 		baseURL:     os.Getenv("BASE_URL"),
 		allowOrigin: os.Getenv("ALLOW_ORIGIN"),
 		cors:        cors.DefaultConfig(),
+		adminToken:  os.Getenv("ADMIN_TOKEN"),
+		ipHashSalt:  os.Getenv("IP_HASH_SALT"),
+		signingKey:  os.Getenv("SIGNING_KEY"),
+		powDiff:     os.Getenv("POW_DIFFICULTY"),
+		formMinAge:  os.Getenv("FORM_TOKEN_MIN_AGE"),
+		captcha:     os.Getenv("CAPTCHA"),
+		reactions:   os.Getenv("REACTIONS_CONFIG"),
+		publicURL:   os.Getenv("PUBLIC_URL"),
+		feedTitle:   os.Getenv("FEED_TITLE"),
+		articleURL:  os.Getenv("FEED_ARTICLE_URL"),
+		rlStore:     os.Getenv("RATE_LIMIT_STORE"),
+		rlDB:        os.Getenv("RATE_LIMIT_DB"),
+		rlMaxKeys:   os.Getenv("RATE_LIMIT_MAX_KEYS"),
+		proxies:     os.Getenv("TRUSTED_PROXIES"),
+		ipHeader:    os.Getenv("CLIENT_IP_HEADER"),
+		ipv6Prefix:  os.Getenv("CLIENT_IPV6_PREFIX"),
+		smtpAddr:    os.Getenv("SMTP_ADDR"),
+		smtpUser:    os.Getenv("SMTP_USERNAME"),
+		smtpPass:    os.Getenv("SMTP_PASSWORD"),
+		smtpFrom:    os.Getenv("SMTP_FROM"),
+		notifyTo:    os.Getenv("NOTIFY_OWNERS"),
+		notifyTmpl:  os.Getenv("NOTIFY_TEMPLATES"),
+		digest:      os.Getenv("DIGEST"),
 	}
 
 	if settings.allowOrigin != "" {
@@ -46,10 +340,44 @@ func main() {
 
 	log.Printf("base url is %q", settings.baseURL)
 
-	router := gin.Default()
+	clientIPCfg := internal.DefaultClientIPConfig()
+	if settings.proxies != "" {
+		var err error
+		if clientIPCfg.TrustedProxies, err = internal.ParseTrustedProxies(settings.proxies); err != nil {
+			log.Fatalf("parsing TRUSTED_PROXIES: %s", err)
+		}
+	}
+	if settings.ipHeader != "" {
+		var err error
+		if clientIPCfg.Header, err = internal.ParseClientIPHeader(settings.ipHeader); err != nil {
+			log.Fatalf("parsing CLIENT_IP_HEADER: %s", err)
+		}
+	}
+	if settings.ipv6Prefix != "" {
+		var err error
+		if clientIPCfg.IPv6Prefix, err = strconv.Atoi(settings.ipv6Prefix); err != nil || clientIPCfg.IPv6Prefix < 1 || clientIPCfg.IPv6Prefix > 128 {
+			log.Fatalf("CLIENT_IPV6_PREFIX must be between 1 and 128, got %q", settings.ipv6Prefix)
+		}
+	}
+	clientIP := internal.NewClientIPResolver(clientIPCfg)
+
+	router := gin.New()
 	router.MaxMultipartMemory = 1 << 20 // 1 MB
 	router.SetTrustedProxies(nil)
 
+	// Like gin's default logger, but without client IPs.
+	router.Use(gin.LoggerWithFormatter(func(p gin.LogFormatterParams) string {
+		return fmt.Sprintf("[GIN] %v | %3d | %13v | %-7s %#v\n%s",
+			p.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			p.StatusCode,
+			p.Latency,
+			p.Method,
+			p.Path,
+			p.ErrorMessage,
+		)
+	}))
+	router.Use(gin.Recovery())
+
 	router.Use(secure.Secure(secure.Options{
 		FrameDeny:             true,
 		ContentTypeNosniff:    true,
@@ -57,7 +385,6 @@ func main() {
 		ContentSecurityPolicy: "default-src 'self'",
 	}))
 	router.Use(cors.New(settings.cors))
-	router.Use(internal.NewClientIPRateLimiterMiddleware(10))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -66,22 +393,287 @@ func main() {
 		log.Fatalf("getting migrated dbx: %s", err)
 		return
 	}
-	svc := gomments.New(ctx, dbx)
+
+	limiterCfg := internal.DefaultRateLimiterConfig()
+	limiterCfg.Policies = rateLimitPolicies(settings.baseURL)
+	switch settings.rlStore {
+	case "", "memory":
+		storeCfg := internal.DefaultMemoryRateLimitStoreConfig()
+		if settings.rlMaxKeys != "" {
+			if storeCfg.MaxKeys, err = strconv.Atoi(settings.rlMaxKeys); err != nil || storeCfg.MaxKeys < 1 {
+				log.Fatalf("RATE_LIMIT_MAX_KEYS must be a positive integer, got %q", settings.rlMaxKeys)
+			}
+		}
+		limiterCfg.Store = internal.NewMemoryRateLimitStore(storeCfg)
+	case "sqlite":
+		rlDB := settings.rlDB
+		if rlDB == "" {
+			rlDB = "/home/appuser/data/ratelimit.db"
+		}
+		rldbx, err := internal.InitSQLiteRateLimitDatabase(rlDB)
+		if err != nil {
+			log.Fatalf("opening rate limit db: %s", err)
+		}
+		limiterCfg.Store = internal.NewSQLiteRateLimitStore(rldbx, []byte(settings.ipHashSalt))
+	default:
+		log.Fatalf("RATE_LIMIT_STORE must be one of memory or sqlite, got %q", settings.rlStore)
+	}
+	limiter := internal.NewRateLimiter(limiterCfg)
+	router.Use(internal.NewClientIPMiddleware(clientIP))
+	router.Use(internal.NewRateLimiterMiddleware(limiter))
+
+	if settings.ipHashSalt == "" {
+		log.Println("IP_HASH_SALT is not set, client IP hashes are unsalted")
+	}
+	opts := []gomments.Option{
+		gomments.WithIPHashSalt(settings.ipHashSalt),
+		gomments.WithClientIPResolver(clientIP),
+	}
+
+	if settings.signingKey != "" {
+		opts = append(opts, gomments.WithSigningKey([]byte(settings.signingKey)))
+	} else {
+		log.Println("SIGNING_KEY is not set, issued tokens won't survive a restart")
+	}
+
+	if settings.powDiff != "" {
+		cfg := gomments.DefaultChallengeConfig()
+		if cfg.Difficulty, err = strconv.Atoi(settings.powDiff); err != nil {
+			log.Fatalf("parsing POW_DIFFICULTY: %s", err)
+		}
+		cfg.MaxDifficulty = max(cfg.MaxDifficulty, cfg.Difficulty)
+		opts = append(opts, gomments.WithChallenge(cfg))
+	}
+
+	if settings.formMinAge != "" {
+		cfg := gomments.DefaultFormTokenConfig()
+		if cfg.MinAge, err = time.ParseDuration(settings.formMinAge); err != nil {
+			log.Fatalf("parsing FORM_TOKEN_MIN_AGE: %s", err)
+		}
+		opts = append(opts, gomments.WithFormToken(cfg))
+	}
+
+	switch settings.captcha {
+	case "":
+	case "auto":
+		opts = append(opts, gomments.WithCaptcha(gomments.DefaultCaptchaConfig()))
+	case "always":
+		cfg := gomments.DefaultCaptchaConfig()
+		cfg.SpamScoreThreshold = 0
+		cfg.RecentRepliesThreshold = 0
+		opts = append(opts, gomments.WithCaptcha(cfg))
+	default:
+		log.Fatalf("CAPTCHA must be one of auto or always, got %q", settings.captcha)
+	}
+
+	if settings.reactions != "" {
+		cfg, err := gomments.LoadReactionConfig(settings.reactions)
+		if err != nil {
+			log.Fatalf("loading REACTIONS_CONFIG: %s", err)
+		}
+		opts = append(opts, gomments.WithReactionConfig(cfg))
+	}
+
+	feedCfg := gomments.DefaultFeedConfig()
+	if settings.feedTitle != "" {
+		feedCfg.Title = settings.feedTitle
+	}
+	feedCfg.ArticleURL = settings.articleURL
+	feedCfg.PublicURL = settings.publicURL
+	opts = append(opts, gomments.WithFeedConfig(feedCfg))
+
+	owners, err := gomments.ParseNotifyEmails(settings.notifyTo)
+	if err != nil {
+		log.Fatalf("invalid NOTIFY_OWNERS: %s", err)
+	}
+
+	digestCfg := gomments.DefaultDigestConfig()
+	for _, via := range strings.Split(settings.digest, ",") {
+		switch strings.TrimSpace(via) {
+		case "":
+		case "email":
+			if settings.smtpAddr == "" || len(owners) == 0 {
+				log.Fatalf("DIGEST=email requires SMTP_ADDR and NOTIFY_OWNERS")
+			}
+			digestCfg.Recipients = owners
+		case "webhook":
+			digestCfg.Webhook = true
+		default:
+			log.Fatalf("invalid DIGEST: %q, expected email, webhook or both", settings.digest)
+		}
+	}
+
+	if settings.smtpAddr != "" {
+		if settings.publicURL == "" || settings.smtpFrom == "" {
+			log.Fatalf("SMTP_ADDR requires PUBLIC_URL and SMTP_FROM")
+		}
+
+		cfg := gomments.DefaultNotificationConfig()
+		cfg.Mailer = internal.NewSMTPMailer(internal.SMTPConfig{
+			Addr:     settings.smtpAddr,
+			Username: settings.smtpUser,
+			Password: settings.smtpPass,
+		})
+		cfg.From = settings.smtpFrom
+		// Owners get the digest instead of an email about every reply, if
+		// it's emailed.
+		if len(digestCfg.Recipients) == 0 {
+			cfg.Owners = owners
+		}
+		cfg.UnsubscribeURL = strings.TrimSuffix(settings.publicURL, "/") + path.Join("/", settings.baseURL, "/unsubscribe") + "?token={token}"
+		cfg.ConfirmURL = strings.TrimSuffix(settings.publicURL, "/") + path.Join("/", settings.baseURL, "/confirm") + "?token={token}"
+		if settings.notifyTmpl != "" {
+			if cfg.Templates, err = gomments.LoadNotificationTemplates(settings.notifyTmpl); err != nil {
+				log.Fatalf("loading NOTIFY_TEMPLATES: %s", err)
+			}
+		}
+		opts = append(opts, gomments.WithNotifications(cfg))
+
+		if len(digestCfg.Recipients) > 0 {
+			digestCfg.Mailer = cfg.Mailer
+			digestCfg.From = cfg.From
+		}
+	}
+
+	if settings.notifyTmpl != "" {
+		if digestCfg.Templates, err = gomments.LoadDigestTemplates(settings.notifyTmpl); err != nil {
+			log.Fatalf("loading NOTIFY_TEMPLATES: %s", err)
+		}
+	}
+	opts = append(opts, gomments.WithDigestConfig(digestCfg))
+
+	svc := gomments.New(ctx, dbx, opts...)
+	go svc.RunWebhookDeliveries(ctx, webhookInterval)
+	if settings.smtpAddr != "" {
+		go svc.RunNotifications(ctx, notificationInterval)
+	}
+	if settings.digest != "" {
+		go svc.RunDigests(ctx, digestInterval)
+	}
 
 	rg := router.Group(settings.baseURL)
 	rg.GET("/ping", func(c *gin.Context) {
 		c.String(http.StatusOK, "pong")
 	})
 
-	rg.GET("/articles/:article/replies", func(c *gin.Context) {
-		resp, err := svc.GetReplies(ctx, gomments.GetRepliesRequest{Article: c.Param("article")})
+	rg.GET("/challenge", func(c *gin.Context) {
+		resp, err := svc.GetChallenge(ctx, gomments.GetChallengeRequest{})
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	rg.POST("/captcha", func(c *gin.Context) {
+		resp, err := svc.CreateCaptcha(ctx, gomments.CreateCaptchaRequest{})
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	rg.GET("/captcha/:id/image.png", func(c *gin.Context) {
+		resp, err := svc.GetCaptchaImage(ctx, gomments.GetCaptchaMediaRequest{ID: c.Param("id")})
 		if err != nil {
-			var gsErr *gomments.ServiceError
-			if errors.As(err, &gsErr) {
-				c.AbortWithError(gsErr.Status(), err)
-			} else {
-				c.AbortWithError(http.StatusInternalServerError, err)
+			abortWithError(c, err)
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusOK, resp.ContentType, resp.Data)
+	})
+
+	rg.GET("/captcha/:id/audio.wav", func(c *gin.Context) {
+		resp, err := svc.GetCaptchaAudio(ctx, gomments.GetCaptchaMediaRequest{ID: c.Param("id")})
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusOK, resp.ContentType, resp.Data)
+	})
+
+	for _, format := range gomments.FeedFormats {
+		rg.GET("/articles/:article/replies."+string(format), func(c *gin.Context) {
+			resp, err := svc.GetFeed(ctx, gomments.GetFeedRequest{
+				Article: c.Param("article"),
+				Format:  format,
+				SelfURL: requestURL(c, settings.publicURL),
+			})
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			serveFeed(c, resp)
+		})
+		rg.GET("/replies."+string(format), func(c *gin.Context) {
+			resp, err := svc.GetFeed(ctx, gomments.GetFeedRequest{
+				Format:  format,
+				SelfURL: requestURL(c, settings.publicURL),
+			})
+			if err != nil {
+				abortWithError(c, err)
+				return
 			}
+			serveFeed(c, resp)
+		})
+	}
+
+	rg.GET("/unsubscribe", func(c *gin.Context) {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		unsubscribePage.Execute(c.Writer, gin.H{"Token": c.Query("token")})
+	})
+
+	rg.POST("/unsubscribe", func(c *gin.Context) {
+		token := c.PostForm("token")
+		if token == "" {
+			// one-click unsubscribes post to the link in the email
+			token = c.Query("token")
+		}
+
+		if _, err := svc.Unsubscribe(ctx, gomments.UnsubscribeRequest{Token: token}); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		unsubscribePage.Execute(c.Writer, gin.H{"Done": true})
+	})
+
+	rg.GET("/confirm", func(c *gin.Context) {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		confirmPage.Execute(c.Writer, gin.H{"Token": c.Query("token")})
+	})
+
+	rg.POST("/confirm", func(c *gin.Context) {
+		if _, err := svc.ConfirmSubscription(ctx, gomments.ConfirmSubscriptionRequest{Token: c.PostForm("token")}); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		confirmPage.Execute(c.Writer, gin.H{"Done": true})
+	})
+
+	rg.GET("/articles/:article/replies/stream", func(c *gin.Context) {
+		streamReplies(c, svc)
+	})
+
+	rg.GET("/articles/:article/replies", func(c *gin.Context) {
+		resp, err := svc.GetReplies(ctx, gomments.GetRepliesRequest{
+			Article:  c.Param("article"),
+			ClientIP: internal.ClientIP(c),
+			Sort:     c.Query("sort"),
+		})
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+	rg.GET("/articles/:article/form-token", func(c *gin.Context) {
+		resp, err := svc.GetFormToken(ctx, gomments.GetFormTokenRequest{Article: c.Param("article")})
+		if err != nil {
+			abortWithError(c, err)
 			return
 		}
 		c.JSON(http.StatusOK, resp)
@@ -91,34 +683,51 @@ func main() {
 		c.BindJSON(&req)
 
 		req.Article = c.Param("article")
+		req.ClientIP = internal.ClientIP(c)
 		if len(req.Article) > 1024 {
 			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("article id too long"))
 		}
 		resp, err := svc.SubmitReply(ctx, req)
 		if err != nil {
-			var gsErr *gomments.ServiceError
-			if errors.As(err, &gsErr) {
-				c.AbortWithError(gsErr.Status(), err)
-			} else {
-				c.AbortWithError(http.StatusInternalServerError, err)
-			}
+			abortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	rg.POST("/replies/:id/flags", func(c *gin.Context) {
+		id, ok := intParam(c, "id")
+		if !ok {
+			return
+		}
+
+		var req gomments.FlagReplyRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		req.ReplyID = id
+		req.ClientIP = internal.ClientIP(c)
+
+		resp, err := svc.FlagReply(ctx, req)
+		if err != nil {
+			abortWithError(c, err)
 			return
 		}
 		c.JSON(http.StatusOK, resp)
 	})
 
 	rg.GET("/articles/replies/stats", func(c *gin.Context) {
+		since, ok := timeQuery(c, "since")
+		if !ok {
+			return
+		}
 		req := gomments.GetReplyStatsByArticlesRequest{
 			Articles: c.QueryArray("article"),
+			Since:    since,
 		}
 		resp, err := svc.GetReplyStatsByArticles(ctx, req)
 		if err != nil {
-			var gsErr *gomments.ServiceError
-			if errors.As(err, &gsErr) {
-				c.AbortWithError(gsErr.Status(), err)
-			} else {
-				c.AbortWithError(http.StatusInternalServerError, err)
-			}
+			abortWithError(c, err)
 			return
 		}
 		c.JSON(http.StatusOK, resp)
@@ -126,16 +735,41 @@ func main() {
 
 	rg.POST("/articles/:article/reactions/:kind", func(c *gin.Context) {
 		resp, err := svc.CreateReaction(ctx, gomments.CreateReactionRequest{
-			Kind:    c.Param("kind"),
-			Article: c.Param("article"),
+			Kind:     c.Param("kind"),
+			Article:  c.Param("article"),
+			ClientIP: internal.ClientIP(c),
 		})
 		if err != nil {
-			var gsErr *gomments.ServiceError
-			if errors.As(err, &gsErr) {
-				c.AbortWithError(gsErr.Status(), err)
-			} else {
-				c.AbortWithError(http.StatusInternalServerError, err)
-			}
+			abortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	rg.POST("/replies/:id/reactions/:kind", func(c *gin.Context) {
+		id, ok := intParam(c, "id")
+		if !ok {
+			return
+		}
+
+		resp, err := svc.CreateReplyReaction(ctx, gomments.CreateReplyReactionRequest{
+			Kind:     c.Param("kind"),
+			ReplyID:  id,
+			ClientIP: internal.ClientIP(c),
+		})
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	rg.GET("/reactions/kinds", func(c *gin.Context) {
+		resp, err := svc.GetReactionKinds(ctx, gomments.GetReactionKindsRequest{
+			Article: c.Query("article"),
+		})
+		if err != nil {
+			abortWithError(c, err)
 			return
 		}
 		c.JSON(http.StatusOK, resp)
@@ -144,36 +778,330 @@ func main() {
 	rg.DELETE("/reactions", func(c *gin.Context) {
 		resp, err := svc.DeleteReaction(ctx, gomments.DeleteReactionRequest{
 			DeletionKey: c.Query("key"),
+			ClientIP:    internal.ClientIP(c),
 		})
 		if err != nil {
-			var gsErr *gomments.ServiceError
-			if errors.As(err, &gsErr) {
-				c.AbortWithError(gsErr.Status(), err)
-			} else {
-				c.AbortWithError(http.StatusInternalServerError, err)
-			}
+			abortWithError(c, err)
 			return
 		}
 		c.JSON(http.StatusOK, resp)
 	})
 
 	rg.GET("/articles/reactions/stats", func(c *gin.Context) {
+		since, ok := timeQuery(c, "since")
+		if !ok {
+			return
+		}
 		req := gomments.GetReactionStatsByArticlesRequest{
 			Articles: c.QueryArray("article"),
+			Since:    since,
 		}
 		resp, err := svc.GetReactionStatsByArticles(ctx, req)
 		if err != nil {
-			var gsErr *gomments.ServiceError
-			if errors.As(err, &gsErr) {
-				c.AbortWithError(gsErr.Status(), err)
-			} else {
-				c.AbortWithError(http.StatusInternalServerError, err)
-			}
+			abortWithError(c, err)
 			return
 		}
 		c.JSON(http.StatusOK, resp)
 	})
 
+	rg.GET("/articles/reactions/timeseries", func(c *gin.Context) {
+		start, ok := timeQuery(c, "start")
+		if !ok {
+			return
+		}
+		end, ok := timeQuery(c, "end")
+		if !ok {
+			return
+		}
+
+		resp, err := svc.GetReactionTimeSeries(ctx, gomments.GetReactionTimeSeriesRequest{
+			Articles: c.QueryArray("article"),
+			Interval: gomments.ReactionInterval(c.Query("interval")),
+			Start:    start,
+			End:      end,
+		})
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	if settings.adminToken != "" {
+		admin := rg.Group("/admin", internal.NewAdminTokenMiddleware(settings.adminToken))
+
+		admin.GET("/bans", func(c *gin.Context) {
+			resp, err := svc.ListBans(ctx, gomments.ListBansRequest{
+				IncludeExpired: c.Query("include_expired") == "true",
+			})
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.POST("/bans", func(c *gin.Context) {
+			var req gomments.CreateBanRequest
+			if err := c.BindJSON(&req); err != nil {
+				return
+			}
+			req.Actor = c.GetHeader("X-Moderator")
+
+			resp, err := svc.CreateBan(ctx, req)
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.DELETE("/bans/:id", func(c *gin.Context) {
+			id, ok := intParam(c, "id")
+			if !ok {
+				return
+			}
+
+			resp, err := svc.DeleteBan(ctx, gomments.DeleteBanRequest{
+				Actor:  c.GetHeader("X-Moderator"),
+				ID:     id,
+				Reason: c.Query("reason"),
+			})
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.POST("/replies/:id/moderation", func(c *gin.Context) {
+			id, ok := intParam(c, "id")
+			if !ok {
+				return
+			}
+
+			var req gomments.ModerateReplyRequest
+			if err := c.BindJSON(&req); err != nil {
+				return
+			}
+			req.Actor = c.GetHeader("X-Moderator")
+			req.ReplyID = id
+
+			resp, err := svc.ModerateReply(ctx, req)
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.POST("/reactions/:id/moderation", func(c *gin.Context) {
+			id, ok := intParam(c, "id")
+			if !ok {
+				return
+			}
+
+			var req gomments.ModerateReactionRequest
+			if err := c.BindJSON(&req); err != nil {
+				return
+			}
+			req.Actor = c.GetHeader("X-Moderator")
+			req.ReactionID = id
+
+			resp, err := svc.ModerateReaction(ctx, req)
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.GET("/articles/:article/reactions", func(c *gin.Context) {
+			resp, err := svc.ListReactions(ctx, gomments.ListReactionsRequest{Article: c.Param("article")})
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.GET("/replies/:id/reactions", func(c *gin.Context) {
+			id, ok := intParam(c, "id")
+			if !ok {
+				return
+			}
+
+			resp, err := svc.ListReactions(ctx, gomments.ListReactionsRequest{ReplyID: id})
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.POST("/reply-reactions/:id/moderation", func(c *gin.Context) {
+			id, ok := intParam(c, "id")
+			if !ok {
+				return
+			}
+
+			var req gomments.ModerateReactionRequest
+			if err := c.BindJSON(&req); err != nil {
+				return
+			}
+			req.Actor = c.GetHeader("X-Moderator")
+			req.ReactionID = id
+
+			resp, err := svc.ModerateReplyReaction(ctx, req)
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.GET("/digest", func(c *gin.Context) {
+			since, ok := timeQuery(c, "since")
+			if !ok {
+				return
+			}
+			resp, err := svc.GetDigest(ctx, gomments.GetDigestRequest{Since: since})
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.GET("/flags", func(c *gin.Context) {
+			resp, err := svc.ListFlags(ctx, gomments.ListFlagsRequest{
+				IncludeResolved: c.Query("include_resolved") == "true",
+			})
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.POST("/flags/:id/resolve", func(c *gin.Context) {
+			id, ok := intParam(c, "id")
+			if !ok {
+				return
+			}
+
+			var req gomments.ResolveFlagRequest
+			if err := c.BindJSON(&req); err != nil {
+				return
+			}
+			req.Actor = c.GetHeader("X-Moderator")
+			req.FlagID = id
+
+			resp, err := svc.ResolveFlag(ctx, req)
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.GET("/moderation/events", func(c *gin.Context) {
+			before, _ := strconv.Atoi(c.Query("before"))
+			limit, _ := strconv.Atoi(c.Query("limit"))
+
+			resp, err := svc.ListModerationEvents(ctx, gomments.ListModerationEventsRequest{
+				Before: before,
+				Limit:  limit,
+			})
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.GET("/webhooks", func(c *gin.Context) {
+			resp, err := svc.ListWebhooks(ctx, gomments.ListWebhooksRequest{})
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.POST("/webhooks", func(c *gin.Context) {
+			var req gomments.CreateWebhookRequest
+			if err := c.BindJSON(&req); err != nil {
+				return
+			}
+
+			resp, err := svc.CreateWebhook(ctx, req)
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.DELETE("/webhooks/:id", func(c *gin.Context) {
+			id, ok := intParam(c, "id")
+			if !ok {
+				return
+			}
+
+			resp, err := svc.DeleteWebhook(ctx, gomments.DeleteWebhookRequest{ID: id})
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.GET("/webhooks/:id/deliveries", func(c *gin.Context) {
+			id, ok := intParam(c, "id")
+			if !ok {
+				return
+			}
+			limit, _ := strconv.Atoi(c.Query("limit"))
+
+			resp, err := svc.ListWebhookDeliveries(ctx, gomments.ListWebhookDeliveriesRequest{
+				WebhookID: id,
+				Status:    gomments.WebhookDeliveryStatus(c.Query("status")),
+				Limit:     limit,
+			})
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.POST("/webhooks/deliveries/:id/retry", func(c *gin.Context) {
+			id, ok := intParam(c, "id")
+			if !ok {
+				return
+			}
+
+			resp, err := svc.RetryWebhookDelivery(ctx, gomments.RetryWebhookDeliveryRequest{DeliveryID: id})
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		admin.GET("/ratelimit/stats", func(c *gin.Context) {
+			stats, err := limiter.Stats(ctx)
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, stats)
+		})
+	} else {
+		log.Println("ADMIN_TOKEN is not set, admin routes are disabled")
+	}
+
 	if err := router.Run(fmt.Sprintf(":%s", settings.port)); err != nil {
 		log.Fatalln(err.Error())
 		return
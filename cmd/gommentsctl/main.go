@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/arizard/gomments/internal"
+)
+
+const defaultDBPath = "/home/appuser/data/gomments.db"
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{
+		name:  "moderation-log",
+		usage: "export the moderation audit log as csv or json lines",
+		run:   runModerationLog,
+	},
+	{
+		name:  "export",
+		usage: "export replies, reactions and moderation data as a gomments backup",
+		run:   runExport,
+	},
+	{
+		name:  "import",
+		usage: "restore a gomments backup, or import a disqus, wordpress, isso, commento or remark42 export",
+		run:   runImport,
+	},
+	{
+		name:  "fake-smtp",
+		usage: "run an smtp server that prints the email sent to it, for testing",
+		run:   runFakeSMTP,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: gommentsctl <command> [flags]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(ctx, os.Args[2:]); err != nil {
+				log.Fatalf("%s: %s", cmd.name, err)
+			}
+			return
+		}
+	}
+
+	usage()
+	os.Exit(2)
+}
+
+// openService opens the database, which has to be run from the directory
+// containing the migrations, like the app itself.
+func openService(ctx context.Context, dbPath string) (*gomments.Service, error) {
+	dbx, err := internal.InitSQLiteDatabase(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("getting migrated dbx: %w", err)
+	}
+
+	return gomments.New(ctx, dbx), nil
+}
+
+// openDryRunService opens the database for a dry run, which mustn't create or
+// migrate it. The database has to exist and be migrated already.
+func openDryRunService(ctx context.Context, dbPath string) (*gomments.Service, error) {
+	dbx, err := internal.OpenSQLiteDatabase(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening dbx for a dry run: %w", err)
+	}
+
+	return gomments.New(ctx, dbx), nil
+}
+
+func runModerationLog(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("moderation-log", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDBPath, "path to the sqlite database")
+	format := fs.String("format", "csv", "output format, csv or json")
+	fs.Parse(args)
+
+	svc, err := openService(ctx, *dbPath)
+	if err != nil {
+		return err
+	}
+
+	var write func(gomments.ModerationEvent) error
+	var flush func() error
+	switch *format {
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"id", "created_at", "actor", "action", "target_type", "target_id", "reason"})
+		write = func(e gomments.ModerationEvent) error {
+			return w.Write([]string{
+				strconv.Itoa(e.ID),
+				e.CreatedAt.UTC().Format(time.RFC3339),
+				e.Actor,
+				string(e.Action),
+				string(e.TargetType),
+				e.TargetID,
+				e.Reason,
+			})
+		}
+		flush = func() error {
+			w.Flush()
+			return w.Error()
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		write = func(e gomments.ModerationEvent) error {
+			return enc.Encode(e)
+		}
+		flush = func() error {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unknown format: %q", *format)
+	}
+
+	req := gomments.ListModerationEventsRequest{Limit: 500}
+	for {
+		resp, err := svc.ListModerationEvents(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range resp.Events {
+			if err := write(e); err != nil {
+				return fmt.Errorf("writing event: %w", err)
+			}
+		}
+
+		if resp.NextBefore == 0 {
+			break
+		}
+		req.Before = resp.NextBefore
+	}
+
+	return flush()
+}
+
+// stringsFlag is a flag that can be given several times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// timeFlag is a flag for an RFC 3339 time or a date.
+type timeFlag struct {
+	time.Time
+}
+
+func (f *timeFlag) String() string {
+	if f.IsZero() {
+		return ""
+	}
+	return f.Format(time.RFC3339)
+}
+
+func (f *timeFlag) Set(v string) error {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		if t, err = time.Parse(time.DateOnly, v); err != nil {
+			return fmt.Errorf("not an RFC 3339 time or a date: %q", v)
+		}
+	}
+	f.Time = t
+	return nil
+}
+
+func runExport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDBPath, "path to the sqlite database")
+	out := fs.String("o", "", "file to write the backup to (default stdout)")
+	var articles stringsFlag
+	fs.Var(&articles, "article", "only export this article, can be given several times (leaves out bans)")
+	var since, until timeFlag
+	fs.Var(&since, "since", "only export records created at or after this time or date")
+	fs.Var(&until, "until", "only export records created before this time or date")
+	fs.Parse(args)
+
+	svc, err := openService(ctx, *dbPath)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+
+	bw := bufio.NewWriter(w)
+	resp, err := svc.Export(ctx, gomments.ExportRequest{
+		Filter: gomments.BackupFilter{Articles: articles, Since: since.Time, Until: until.Time},
+		Writer: bw,
+	})
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("writing backup: %w", err)
+	}
+	if *out != "" {
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("writing backup: %w", err)
+		}
+	}
+
+	// Stdout can be the backup, so the counts go to stderr.
+	printBackupCounts(os.Stderr, "exported", resp.Counts, nil)
+	return nil
+}
+
+// printBackupCounts prints how many records of each type were in a backup,
+// and how many of them were already there.
+func printBackupCounts(w io.Writer, verb string, counts map[gomments.BackupRecordType]int, existing map[gomments.BackupRecordType]int) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if existing == nil {
+		fmt.Fprintf(tw, "TYPE\t%s\n", strings.ToUpper(verb))
+	} else {
+		fmt.Fprintf(tw, "TYPE\t%s\tEXISTING\n", strings.ToUpper(verb))
+	}
+
+	for _, t := range []gomments.BackupRecordType{
+		gomments.BackupRecordReply,
+		gomments.BackupRecordArticleReaction,
+		gomments.BackupRecordReplyReaction,
+		gomments.BackupRecordBan,
+		gomments.BackupRecordFlag,
+		gomments.BackupRecordModerationEvent,
+	} {
+		if existing == nil {
+			fmt.Fprintf(tw, "%s\t%d\n", t, counts[t])
+		} else {
+			fmt.Fprintf(tw, "%s\t%d\t%d\n", t, counts[t], existing[t])
+		}
+	}
+	tw.Flush()
+}
+
+// runRestore restores a gomments backup written by export.
+func runRestore(ctx context.Context, dbPath string, path string, dryRun bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	open := openService
+	if dryRun {
+		open = openDryRunService
+	}
+	svc, err := open(ctx, dbPath)
+	if err != nil {
+		return err
+	}
+
+	resp, err := svc.Restore(ctx, gomments.RestoreRequest{Reader: f, DryRun: dryRun})
+	if err != nil {
+		return err
+	}
+
+	verb := "restored"
+	if dryRun {
+		verb = "would restore"
+	}
+	printBackupCounts(os.Stdout, verb, resp.Restored, resp.Existing)
+	for _, t := range slices.Sorted(maps.Keys(resp.Conflicts)) {
+		fmt.Fprintf(os.Stderr, "%d %s records weren't restored, the same client already has that reaction\n", resp.Conflicts[t], t)
+	}
+	return nil
+}
+
+func runImport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDBPath, "path to the sqlite database")
+	from := fs.String("from", "gomments", "system the export is from: gomments, "+strings.Join(slices.Sorted(maps.Keys(gomments.Importers)), ", "))
+	articleURL := fs.String("article-url", "", "url of articles with {article} in place of the article, e.g. https://example.com/posts/{article} (default the last path segment, or the post slug for wordpress)")
+	dryRun := fs.Bool("dry-run", false, "report what would be imported into an existing database without changing it")
+	timezone := fs.String("timezone", "UTC", "timezone of the site, e.g. Europe/London, for wordpress comments missing their GMT date")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gommentsctl import [-from <system>] [flags] <export>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *from == "gomments" && fs.NArg() == 1 {
+		return runRestore(ctx, *dbPath, fs.Arg(0), *dryRun)
+	}
+
+	importer, ok := gomments.Importers[*from]
+	if !ok || fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return fmt.Errorf("loading timezone: %w", err)
+	}
+	if *from == "wordpress" {
+		importer = gomments.WordPressImporter{Location: loc}
+	}
+
+	rule := gomments.ArticleRule{}
+	if *articleURL != "" {
+		if rule, err = gomments.ParseArticleRule(*articleURL); err != nil {
+			return err
+		}
+	}
+
+	replies, mappings, err := importer.Parse(ctx, fs.Arg(0), rule)
+	if err != nil {
+		return err
+	}
+
+	open := openService
+	if *dryRun {
+		open = openDryRunService
+	}
+	svc, err := open(ctx, *dbPath)
+	if err != nil {
+		return err
+	}
+
+	resp, err := svc.ImportReplies(ctx, gomments.ImportRepliesRequest{Replies: replies, DryRun: *dryRun})
+	if err != nil {
+		return err
+	}
+
+	printImportReport(os.Stdout, mappings, resp, *dryRun)
+
+	localTimes := 0
+	for _, reply := range replies {
+		if reply.LocalTime {
+			localTimes++
+		}
+	}
+	if localTimes > 0 {
+		fmt.Printf("%d replies had no UTC time, so their local time was read in %s (set -timezone to the site's)\n", localTimes, loc)
+	}
+
+	return nil
+}
+
+// printImportReport prints where each thread of an export went, and how many
+// of its replies were imported.
+func printImportReport(w io.Writer, mappings []gomments.ImportMapping, resp *gomments.ImportRepliesResponse, dryRun bool) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "THREAD\tARTICLE\tREPLIES\tIMPORTED\tEXISTING\tDELETED\tSPAM\tPENDING\n")
+
+	skipped := 0
+	reported := map[string]bool{}
+	for _, m := range mappings {
+		if m.Article == "" {
+			skipped += m.Replies
+			fmt.Fprintf(tw, "%s\t-\t%d\t\t\t\t\t\n", m.Thread, m.Replies)
+			continue
+		}
+
+		// Articles can be mapped to by several threads, so their stats are
+		// printed once.
+		if reported[m.Article] {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t\t\t\t\t\n", m.Thread, m.Article, m.Replies)
+			continue
+		}
+		reported[m.Article] = true
+
+		stats := resp.Articles[m.Article]
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n", m.Thread, m.Article, m.Replies, stats.Imported, stats.Existing, stats.Deleted, stats.Spam, stats.Pending)
+	}
+	tw.Flush()
+
+	verb := "imported"
+	if dryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(w, "\n%s %d replies, %d already imported, %d skipped from unmapped threads\n", verb, resp.Imported, resp.Existing, skipped)
+}
+
+func runFakeSMTP(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("fake-smtp", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:2525", "address to listen on")
+	fs.Parse(args)
+
+	server, err := internal.NewFakeSMTPServer(*addr, func(msg internal.FakeSMTPMessage) {
+		fmt.Printf("From: %s\nTo: %s\n\n%s\n\n", msg.From, strings.Join(msg.To, ", "), msg.Data)
+	})
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	log.Printf("listening on %s, set SMTP_ADDR=%s", server.Addr(), server.Addr())
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+
+	return nil
+}
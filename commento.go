@@ -0,0 +1,70 @@
+package gomments
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+type commentoExport struct {
+	Version  int `json:"version"`
+	Comments []struct {
+		CommentHex   string    `json:"commentHex"`
+		Domain       string    `json:"domain"`
+		Path         string    `json:"path"`
+		CommenterHex string    `json:"commenterHex"`
+		Markdown     string    `json:"markdown"`
+		State        string    `json:"state"`
+		CreationDate time.Time `json:"creationDate"`
+		Deleted      bool      `json:"deleted"`
+	} `json:"comments"`
+	Commenters []struct {
+		CommenterHex string `json:"commenterHex"`
+		Name         string `json:"name"`
+	} `json:"commenters"`
+}
+
+// ParseCommento reads the replies in a Commento JSON export. Threads are
+// identified by their domain and path, like "example.com/posts/hello".
+//
+// Unapproved comments are imported pending, and comments flagged as spam
+// imported as spam. Comments are written in Markdown, which is kept as it is.
+func ParseCommento(r io.Reader, rule ArticleRule) ([]ImportReply, []ImportMapping, error) {
+	var export commentoExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, nil, fmt.Errorf("reading commento export: %w", err)
+	}
+	if export.Version != 1 {
+		return nil, nil, fmt.Errorf("unsupported commento export version: %d", export.Version)
+	}
+
+	names := map[string]string{}
+	for _, c := range export.Commenters {
+		names[c.CommenterHex] = c.Name
+	}
+
+	mappings := newImportMappings(rule)
+	replies := []ImportReply{}
+
+	for _, c := range export.Comments {
+		article := mappings.add(c.Domain + c.Path)
+		if article == "" {
+			continue
+		}
+
+		replies = append(replies, ImportReply{
+			Source:     "commento",
+			SourceID:   c.CommentHex,
+			Article:    article,
+			AuthorName: names[c.CommenterHex],
+			Body:       c.Markdown,
+			CreatedAt:  c.CreationDate,
+			Deleted:    c.Deleted,
+			Spam:       c.State == "flagged",
+			Pending:    c.State == "unapproved",
+		})
+	}
+
+	return replies, mappings.mappings, nil
+}
@@ -0,0 +1,51 @@
+package gomments_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/stretchr/testify/require"
+)
+
+const commentoExport = `{
+	"version": 1,
+	"comments": [
+		{"commentHex": "c1", "domain": "example.com", "path": "/posts/hello-world/", "commenterHex": "u1", "markdown": "Hi **there**", "html": "<p>Hi <b>there</b></p>", "parentHex": "root", "score": 2, "state": "approved", "creationDate": "2019-03-01T10:00:00Z", "deleted": false},
+		{"commentHex": "c2", "domain": "example.com", "path": "/posts/hello-world/", "commenterHex": "anonymous", "markdown": "Me too", "parentHex": "c1", "state": "unapproved", "creationDate": "2019-03-02T10:00:00Z", "deleted": false},
+		{"commentHex": "c3", "domain": "example.com", "path": "/posts/hello-world/", "commenterHex": "u1", "markdown": "Buy now", "parentHex": "root", "state": "flagged", "creationDate": "2019-03-03T10:00:00Z", "deleted": false},
+		{"commentHex": "c4", "domain": "example.com", "path": "/posts/other/", "commenterHex": "u1", "markdown": "Oops", "parentHex": "root", "state": "approved", "creationDate": "2019-03-04T10:00:00Z", "deleted": true}
+	],
+	"commenters": [
+		{"commenterHex": "u1", "email": "alice@example.com", "name": "Alice", "provider": "commento"}
+	]
+}`
+
+func TestParseCommento(t *testing.T) {
+	r := require.New(t)
+
+	replies, mappings, err := gomments.ParseCommento(strings.NewReader(commentoExport), gomments.ArticleRule{})
+	r.NoError(err)
+
+	r.Equal([]gomments.ImportMapping{
+		{Thread: "example.com/posts/hello-world/", Article: "hello-world", Replies: 3},
+		{Thread: "example.com/posts/other/", Article: "other", Replies: 1},
+	}, mappings)
+
+	r.Equal(gomments.ImportReply{
+		Source:     "commento",
+		SourceID:   "c1",
+		Article:    "hello-world",
+		AuthorName: "Alice",
+		Body:       "Hi **there**",
+		CreatedAt:  time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC),
+	}, replies[0])
+	r.Empty(replies[1].AuthorName)
+	r.True(replies[1].Pending)
+	r.True(replies[2].Spam)
+	r.True(replies[3].Deleted)
+
+	_, _, err = gomments.ParseCommento(strings.NewReader(`{"version": 2}`), gomments.ArticleRule{})
+	r.Error(err)
+}
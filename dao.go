@@ -2,7 +2,11 @@ package gomments
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -19,6 +23,11 @@ type Reply struct {
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 
 	AuthorName string `db:"author_name" json:"author_name"`
+
+	ClientHash   string `db:"client_hash" json:"-"`
+	Shadowbanned bool   `db:"shadowbanned" json:"-"`
+
+	Reactions ReplyReactionStats `db:"-" json:"reactions"`
 }
 
 type Replies []Reply
@@ -33,9 +42,12 @@ type insertReplyParams struct {
 	CreatedAt time.Time `db:"created_at"`
 
 	AuthorName string `db:"author_name"`
+
+	ClientHash   string `db:"client_hash"`
+	Shadowbanned bool   `db:"shadowbanned"`
 }
 
-func insertReply(ctx context.Context, db *sqlx.DB, params insertReplyParams) (int, error) {
+func insertReply(ctx context.Context, db sqlx.ExtContext, params insertReplyParams) (int, bool, error) {
 	query := `
        INSERT INTO reply (
 				   idempotency_key,
@@ -44,7 +56,9 @@ func insertReply(ctx context.Context, db *sqlx.DB, params insertReplyParams) (in
 				   body,
 				   deleted,
 				   created_at,
-				   author_name
+				   author_name,
+				   client_hash,
+				   shadowbanned
        ) VALUES (
            :idempotency_key,
            :signature,
@@ -52,32 +66,41 @@ func insertReply(ctx context.Context, db *sqlx.DB, params insertReplyParams) (in
            :body,
            :deleted,
            :created_at,
-           :author_name
-       ) ON CONFLICT (idempotency_key) DO UPDATE SET
-				   idempotency_key = excluded.idempotency_key
+           :author_name,
+           :client_hash,
+           :shadowbanned
+       ) ON CONFLICT (idempotency_key) DO NOTHING
 			 RETURNING id`
 
 	q, args, err := db.BindNamed(query, params)
 	if err != nil {
-		return 0, fmt.Errorf("binding for insertReply: %w", err)
+		return 0, false, fmt.Errorf("binding for insertReply: %w", err)
 	}
 
-	row := struct {
-		ID int `db:"id"`
-	}{}
+	ids := []int{}
+	if err := sqlx.SelectContext(ctx, db, &ids, q, args...); err != nil {
+		return 0, false, fmt.Errorf("selecting and inserting for insertReply: %w", err)
+	}
 
-	if err := db.GetContext(ctx, &row, q, args...); err != nil {
-		return 0, fmt.Errorf("selecting and inserting for insertReply: %w", err)
+	if len(ids) > 0 {
+		return ids[0], true, nil
 	}
 
-	if row.ID == 0 {
-		return 0, fmt.Errorf("unexpected id after insert")
+	// The reply already exists, so nothing was returned.
+	existing, err := getReplyByIdempotencyKey(ctx, db, params.IdempotencyKey)
+	if err != nil {
+		return 0, false, err
+	}
+	if existing == nil {
+		return 0, false, fmt.Errorf("unexpected missing reply after insert")
 	}
 
-	return row.ID, nil
+	return existing.ID, false, nil
 }
 
-func getRepliesForArticle(ctx context.Context, db *sqlx.DB, article string) (Replies, error) {
+// getRepliesForArticle returns the visible replies for an article. Shadowbanned
+// replies are only included for the client that wrote them.
+func getRepliesForArticle(ctx context.Context, db *sqlx.DB, article string, clientHash string) (Replies, error) {
 	result := Replies{}
 
 	err := db.SelectContext(
@@ -92,12 +115,49 @@ func getRepliesForArticle(ctx context.Context, db *sqlx.DB, article string) (Rep
 			 body,
 			 deleted,
 			 created_at,
-			 author_name
+			 author_name,
+			 client_hash,
+			 shadowbanned
 		FROM reply
 		WHERE article = ? AND deleted == false
+			AND (shadowbanned == false OR (client_hash != '' AND client_hash = ?))
 		ORDER BY created_at DESC
 		`,
 		article,
+		clientHash,
+	)
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// getRecentReplies returns the newest visible replies across all articles.
+func getRecentReplies(ctx context.Context, db *sqlx.DB, limit int) (Replies, error) {
+	result := Replies{}
+
+	err := db.SelectContext(
+		ctx,
+		&result,
+		`
+		SELECT
+			 id,
+			 idempotency_key,
+			 signature,
+			 article,
+			 body,
+			 deleted,
+			 created_at,
+			 author_name,
+			 client_hash,
+			 shadowbanned
+		FROM reply
+		WHERE deleted == false AND shadowbanned == false
+		ORDER BY created_at DESC
+		LIMIT ?
+		`,
+		limit,
 	)
 	if err != nil {
 		return result, err
@@ -114,7 +174,9 @@ type ReplyAggregation struct {
 
 type ReplyAggregations []ReplyAggregation
 
-func getReplyStatsByArticles(ctx context.Context, db *sqlx.DB, articles []string) (ReplyAggregations, error) {
+// getReplyStatsByArticles counts the visible replies on articles written since
+// a time, which can be zero to count every reply.
+func getReplyStatsByArticles(ctx context.Context, db *sqlx.DB, articles []string, since time.Time) (ReplyAggregations, error) {
 	results := []struct {
 		Article     string `db:"article"`
 		Count       int    `db:"count"`
@@ -127,11 +189,12 @@ func getReplyStatsByArticles(ctx context.Context, db *sqlx.DB, articles []string
 			COUNT(id) AS count,
 			DATETIME(MAX(created_at)) AS last_at
 		FROM reply
-		WHERE article IN (?) AND deleted = false
+		WHERE article IN (?) AND deleted = false AND shadowbanned = false
+			AND datetime(created_at) >= datetime(?)
 		GROUP BY article
 	`
 
-	query, args, err := sqlx.In(query, articles)
+	query, args, err := sqlx.In(query, articles, since.UTC())
 	if err != nil {
 		return nil, fmt.Errorf("interpolating IN: %w", err)
 	}
@@ -162,53 +225,106 @@ func getReplyStatsByArticles(ctx context.Context, db *sqlx.DB, articles []string
 	return aggs, nil
 }
 
-func insertReaction(ctx context.Context, db *sqlx.DB, article string, kind string, deletionKey string) error {
-	if _, err := db.ExecContext(
+type insertReactionParams struct {
+	Article      string `db:"article"`
+	Kind         string `db:"kind"`
+	DeletionKey  string `db:"deletion_key"`
+	ClientKey    string `db:"client_key"`
+	Shadowbanned bool   `db:"shadowbanned"`
+}
+
+// insertedReaction is the client's active reaction after an insert.
+type insertedReaction struct {
+	ID          int    `db:"id"`
+	DeletionKey string `db:"deletion_key"`
+}
+
+// insertReaction adds a reaction unless the client already has an active
+// reaction of the same kind on the article. It returns the client's active
+// reaction.
+func insertReaction(ctx context.Context, db sqlx.ExtContext, params insertReactionParams) (insertedReaction, error) {
+	q, args, err := db.BindNamed(
+		`
+			insert into article_reaction (article, kind, deletion_key, client_key, shadowbanned)
+			values (:article, :kind, :deletion_key, :client_key, :shadowbanned)
+			on conflict do nothing
+		`,
+		params,
+	)
+	if err != nil {
+		return insertedReaction{}, fmt.Errorf("binding for insertReaction: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, q, args...); err != nil {
+		return insertedReaction{}, fmt.Errorf("inserting reaction: %w", err)
+	}
+
+	result := insertedReaction{}
+
+	if err := sqlx.GetContext(
 		ctx,
+		db,
+		&result,
 		`
-			insert into article_reaction (article, kind, deletion_key)
-			values ($1, $2, $3)
+		select id, deletion_key from article_reaction
+		where article = $1 and kind = $2 and client_key = $3 and not deleted
 		`,
-		article,
-		kind,
-		deletionKey,
+		params.Article,
+		params.Kind,
+		params.ClientKey,
 	); err != nil {
-		return fmt.Errorf("inserting reaction: %w", err)
+		return insertedReaction{}, fmt.Errorf("getting reaction: %w", err)
 	}
 
-	result := struct {
-		Count int `db:"count"`
-	}{}
+	return result, nil
+}
 
-	if err := db.GetContext(
+// deleteReactionByClient removes the client's active reaction of a kind,
+// returning false if there wasn't one.
+func deleteReactionByClient(ctx context.Context, db sqlx.ExtContext, article string, kind string, clientKey string) (bool, error) {
+	res, err := db.ExecContext(
 		ctx,
-		&result,
 		`
-		select count(*) as count from article_reaction where article = $1 and kind = $2 and not deleted
+			update article_reaction
+			set deleted = true
+			where article = $1 and kind = $2 and client_key = $3 and not deleted
 		`,
 		article,
 		kind,
-	); err != nil {
-		return fmt.Errorf("getting reactions: %w", err)
+		clientKey,
+	)
+	if err != nil {
+		return false, fmt.Errorf("deleting reaction: %w", err)
 	}
 
-	return nil
+	return rowsAffected(res)
 }
 
-func deleteReactionByDeletionKey(ctx context.Context, db *sqlx.DB, deletionKey string) error {
-	if _, err := db.ExecContext(
+// deleteReactionByDeletionKey returns the article of the deleted reaction, or
+// false if the key is unknown or the reaction was already deleted.
+func deleteReactionByDeletionKey(ctx context.Context, db sqlx.ExtContext, deletionKey string) (string, bool, error) {
+	articles := []string{}
+
+	if err := sqlx.SelectContext(
 		ctx,
+		db,
+		&articles,
 		`
 			update article_reaction
 			set deleted = true
-			where deletion_key = $1
+			where deletion_key = $1 and not deleted
+			returning article
 		`,
 		deletionKey,
 	); err != nil {
-		return fmt.Errorf("inserting reaction: %w", err)
+		return "", false, fmt.Errorf("deleting reaction: %w", err)
 	}
 
-	return nil
+	if len(articles) == 0 {
+		return "", false, nil
+	}
+
+	return articles[0], true, nil
 }
 
 type ReactionAggregation struct {
@@ -217,7 +333,9 @@ type ReactionAggregation struct {
 	Kind    string `db:"kind"`
 }
 
-func getReactionStatsByArticles(ctx context.Context, db *sqlx.DB, articles []string) ([]ReactionAggregation, error) {
+// getReactionStatsByArticles counts the visible reactions on articles made
+// since a time, which can be zero to count every reaction.
+func getReactionStatsByArticles(ctx context.Context, db sqlx.ExtContext, articles []string, since time.Time) ([]ReactionAggregation, error) {
 	results := []ReactionAggregation{}
 
 	query := `
@@ -226,17 +344,19 @@ func getReactionStatsByArticles(ctx context.Context, db *sqlx.DB, articles []str
 			kind,
 			COUNT(*) AS count
 		FROM article_reaction
-		WHERE article IN (?) AND deleted = false
+		WHERE article IN (?) AND deleted = false AND shadowbanned = false
+			AND datetime(created_at) >= datetime(?)
 		GROUP BY article, kind
 	`
 
-	query, args, err := sqlx.In(query, articles)
+	query, args, err := sqlx.In(query, articles, since.UTC())
 	if err != nil {
 		return nil, fmt.Errorf("interpolating IN: %w", err)
 	}
 
-	if err := db.SelectContext(
+	if err := sqlx.SelectContext(
 		ctx,
+		db,
 		&results,
 		query,
 		args...,
@@ -246,3 +366,1901 @@ func getReactionStatsByArticles(ctx context.Context, db *sqlx.DB, articles []str
 
 	return results, nil
 }
+
+func insertBan(ctx context.Context, db sqlx.ExtContext, ban Ban) (int, error) {
+	row := struct {
+		ID int `db:"id"`
+	}{}
+
+	if err := sqlx.GetContext(
+		ctx,
+		db,
+		&row,
+		`
+			insert into ban (kind, value, mode, reason, expires_at, created_at)
+			values ($1, $2, $3, $4, $5, $6)
+			returning id
+		`,
+		ban.Kind,
+		ban.Value,
+		ban.Mode,
+		ban.Reason,
+		ban.ExpiresAt,
+		ban.CreatedAt,
+	); err != nil {
+		return 0, fmt.Errorf("inserting ban: %w", err)
+	}
+
+	return row.ID, nil
+}
+
+// getBans returns every ban that hasn't been lifted, including expired ones.
+func getBans(ctx context.Context, db *sqlx.DB) ([]Ban, error) {
+	bans := []Ban{}
+
+	if err := db.SelectContext(
+		ctx,
+		&bans,
+		`
+		select id, kind, value, mode, reason, expires_at, deleted, created_at
+		from ban
+		where not deleted
+		order by created_at desc
+		`,
+	); err != nil {
+		return nil, fmt.Errorf("selecting bans: %w", err)
+	}
+
+	return bans, nil
+}
+
+// getBansForSubject returns the unexpired bans that could match a subject: its
+// signature and client hash bans, and every author name ban if it has an
+// author name.
+func getBansForSubject(ctx context.Context, db *sqlx.DB, subject banSubject, now time.Time) ([]Ban, error) {
+	bans := []Ban{}
+
+	if err := db.SelectContext(
+		ctx,
+		&bans,
+		`
+		select id, kind, value, mode, reason, expires_at, deleted, created_at
+		from ban
+		where not deleted
+			and (expires_at is null or datetime(expires_at) > datetime($1))
+			and (
+				(kind = 'signature' and $2 != '' and value = $2)
+				or (kind = 'ip_hash' and $3 != '' and value = $3)
+				or (kind = 'author_name' and $4 != '')
+			)
+		order by created_at desc
+		`,
+		now,
+		subject.Signature,
+		subject.ClientHash,
+		subject.AuthorName,
+	); err != nil {
+		return nil, fmt.Errorf("selecting bans: %w", err)
+	}
+
+	return bans, nil
+}
+
+func deleteBan(ctx context.Context, db sqlx.ExtContext, id int) (bool, error) {
+	res, err := db.ExecContext(
+		ctx,
+		`
+			update ban
+			set deleted = true
+			where id = $1 and not deleted
+		`,
+		id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("deleting ban: %w", err)
+	}
+
+	return rowsAffected(res)
+}
+
+// getLastReplyID returns the ID of the last reply inserted, or zero if there
+// are none.
+func getLastReplyID(ctx context.Context, db *sqlx.DB) (int, error) {
+	result := struct {
+		ID int `db:"id"`
+	}{}
+
+	if err := db.GetContext(ctx, &result, `select coalesce(max(id), 0) as id from reply`); err != nil {
+		return 0, fmt.Errorf("selecting last reply id: %w", err)
+	}
+
+	return result.ID, nil
+}
+
+func countRepliesSince(ctx context.Context, db *sqlx.DB, since time.Time) (int, error) {
+	result := struct {
+		Count int `db:"count"`
+	}{}
+
+	if err := db.GetContext(
+		ctx,
+		&result,
+		`
+		select count(*) as count from reply where datetime(created_at) > datetime($1)
+		`,
+		since.UTC(),
+	); err != nil {
+		return 0, fmt.Errorf("counting replies: %w", err)
+	}
+
+	return result.Count, nil
+}
+
+// useChallenge records a challenge as used, returning false if it already was.
+// Challenges past their expiry are pruned, since they can't be replayed anyway.
+func useChallenge(ctx context.Context, db sqlx.ExtContext, id string, expiresAt time.Time, now time.Time) (bool, error) {
+	if _, err := db.ExecContext(
+		ctx,
+		`
+			delete from used_challenge where datetime(expires_at) < datetime($1)
+		`,
+		now.UTC(),
+	); err != nil {
+		return false, fmt.Errorf("pruning used challenges: %w", err)
+	}
+
+	res, err := db.ExecContext(
+		ctx,
+		`
+			insert into used_challenge (id, expires_at)
+			values ($1, $2)
+			on conflict (id) do nothing
+		`,
+		id,
+		expiresAt.UTC(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("inserting used challenge: %w", err)
+	}
+
+	return rowsAffected(res)
+}
+
+func countRepliesByClientSince(ctx context.Context, db *sqlx.DB, clientHash string, since time.Time) (int, error) {
+	result := struct {
+		Count int `db:"count"`
+	}{}
+
+	if err := db.GetContext(
+		ctx,
+		&result,
+		`
+		select count(*) as count from reply where client_hash = $1 and datetime(created_at) > datetime($2)
+		`,
+		clientHash,
+		since.UTC(),
+	); err != nil {
+		return 0, fmt.Errorf("counting replies by client: %w", err)
+	}
+
+	return result.Count, nil
+}
+
+// insertCaptcha stores a captcha answer, and prunes expired ones.
+func insertCaptcha(ctx context.Context, db *sqlx.DB, c Captcha, now time.Time) error {
+	if _, err := db.ExecContext(
+		ctx,
+		`
+			delete from captcha where datetime(expires_at) < datetime($1)
+		`,
+		now.UTC(),
+	); err != nil {
+		return fmt.Errorf("pruning captchas: %w", err)
+	}
+
+	if _, err := db.ExecContext(
+		ctx,
+		`
+			insert into captcha (id, answer, expires_at)
+			values ($1, $2, $3)
+		`,
+		c.ID,
+		c.Answer,
+		c.ExpiresAt.UTC(),
+	); err != nil {
+		return fmt.Errorf("inserting captcha: %w", err)
+	}
+
+	return nil
+}
+
+func getCaptcha(ctx context.Context, db *sqlx.DB, id string) (*Captcha, error) {
+	results := []Captcha{}
+
+	if err := db.SelectContext(
+		ctx,
+		&results,
+		`
+		select id, answer, expires_at from captcha where id = $1
+		`,
+		id,
+	); err != nil {
+		return nil, fmt.Errorf("selecting captcha: %w", err)
+	}
+
+	if len(results) == 0 {
+		return nil, nil
+	}
+
+	return &results[0], nil
+}
+
+// takeCaptcha deletes a captcha and returns it, so that each captcha can only
+// be answered once.
+func takeCaptcha(ctx context.Context, db *sqlx.DB, id string) (*Captcha, error) {
+	results := []Captcha{}
+
+	if err := db.SelectContext(
+		ctx,
+		&results,
+		`
+		delete from captcha where id = $1 returning id, answer, expires_at
+		`,
+		id,
+	); err != nil {
+		return nil, fmt.Errorf("deleting captcha: %w", err)
+	}
+
+	if len(results) == 0 {
+		return nil, nil
+	}
+
+	return &results[0], nil
+}
+
+var errNotFound = errors.New("not found")
+
+func insertModerationEvent(ctx context.Context, db sqlx.ExtContext, event ModerationEvent) (int, error) {
+	row := struct {
+		ID int `db:"id"`
+	}{}
+
+	if err := sqlx.GetContext(
+		ctx,
+		db,
+		&row,
+		`
+			insert into moderation_event (actor, action, target_type, target_id, reason, created_at)
+			values ($1, $2, $3, $4, $5, $6)
+			returning id
+		`,
+		event.Actor,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.Reason,
+		event.CreatedAt,
+	); err != nil {
+		return 0, fmt.Errorf("inserting moderation event: %w", err)
+	}
+
+	return row.ID, nil
+}
+
+// getModerationEvents returns up to limit events older than the before id,
+// newest first. A zero before id starts from the newest event.
+func getModerationEvents(ctx context.Context, db *sqlx.DB, before int, limit int) ([]ModerationEvent, error) {
+	events := []ModerationEvent{}
+
+	if err := db.SelectContext(
+		ctx,
+		&events,
+		`
+		select id, actor, action, target_type, target_id, reason, created_at
+		from moderation_event
+		where $1 = 0 or id < $1
+		order by id desc
+		limit $2
+		`,
+		before,
+		limit,
+	); err != nil {
+		return nil, fmt.Errorf("selecting moderation events: %w", err)
+	}
+
+	return events, nil
+}
+
+// rowsAffected reports whether an update touched any row.
+func rowsAffected(res sql.Result) (bool, error) {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("counting affected rows: %w", err)
+	}
+
+	return n > 0, nil
+}
+
+func setReplyDeleted(ctx context.Context, db sqlx.ExtContext, id int, deleted bool) (bool, error) {
+	res, err := db.ExecContext(
+		ctx,
+		`
+			update reply
+			set deleted = $1
+			where id = $2
+		`,
+		deleted,
+		id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("updating reply: %w", err)
+	}
+
+	return rowsAffected(res)
+}
+
+func approveReply(ctx context.Context, db sqlx.ExtContext, id int) (bool, error) {
+	res, err := db.ExecContext(
+		ctx,
+		`
+			update reply
+			set shadowbanned = false
+			where id = $1
+		`,
+		id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("approving reply: %w", err)
+	}
+
+	return rowsAffected(res)
+}
+
+func setReactionDeleted(ctx context.Context, db sqlx.ExtContext, id int, deleted bool) (bool, error) {
+	res, err := db.ExecContext(
+		ctx,
+		`
+			update article_reaction
+			set deleted = $1
+			where id = $2
+		`,
+		deleted,
+		id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("updating reaction: %w", err)
+	}
+
+	return rowsAffected(res)
+}
+
+func setReplyReactionDeleted(ctx context.Context, db sqlx.ExtContext, id int, deleted bool) (bool, error) {
+	res, err := db.ExecContext(
+		ctx,
+		`
+			update reply_reaction
+			set deleted = $1
+			where id = $2
+		`,
+		deleted,
+		id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("updating reply reaction: %w", err)
+	}
+
+	return rowsAffected(res)
+}
+
+// insertFlag flags a reply, returning false if the reply doesn't exist or the
+// client already has an unresolved flag on it.
+func insertFlag(ctx context.Context, db *sqlx.DB, replyID int, reason string, clientHash string, createdAt time.Time) (bool, error) {
+	res, err := db.ExecContext(
+		ctx,
+		`
+			insert into reply_flag (reply_id, reason, client_hash, created_at)
+			select id, $1, $2, $3 from reply where id = $4 and not deleted
+			on conflict do nothing
+		`,
+		reason,
+		clientHash,
+		createdAt,
+		replyID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("inserting flag: %w", err)
+	}
+
+	return rowsAffected(res)
+}
+
+func getFlags(ctx context.Context, db *sqlx.DB, includeResolved bool) ([]Flag, error) {
+	flags := []Flag{}
+
+	if err := db.SelectContext(
+		ctx,
+		&flags,
+		`
+		select id, reply_id, reason, resolved, created_at
+		from reply_flag
+		where $1 or not resolved
+		order by created_at desc
+		`,
+		includeResolved,
+	); err != nil {
+		return nil, fmt.Errorf("selecting flags: %w", err)
+	}
+
+	return flags, nil
+}
+
+func resolveFlag(ctx context.Context, db sqlx.ExtContext, id int) (bool, error) {
+	res, err := db.ExecContext(
+		ctx,
+		`
+			update reply_flag
+			set resolved = true
+			where id = $1 and not resolved
+		`,
+		id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("resolving flag: %w", err)
+	}
+
+	return rowsAffected(res)
+}
+
+// getReplyByIdempotencyKey returns nil if no reply was inserted with the key.
+func getReplyByIdempotencyKey(ctx context.Context, db sqlx.ExtContext, key string) (*Reply, error) {
+	results := Replies{}
+
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&results,
+		`
+		SELECT
+			 id,
+			 idempotency_key,
+			 signature,
+			 article,
+			 body,
+			 deleted,
+			 created_at,
+			 author_name,
+			 client_hash,
+			 shadowbanned
+		FROM reply
+		WHERE idempotency_key = ?
+		`,
+		key,
+	); err != nil {
+		return nil, fmt.Errorf("selecting reply: %w", err)
+	}
+
+	if len(results) == 0 {
+		return nil, nil
+	}
+
+	return &results[0], nil
+}
+
+func getReplyByID(ctx context.Context, db sqlx.ExtContext, id int) (*Reply, error) {
+	results := Replies{}
+
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&results,
+		`
+		SELECT
+			 id,
+			 idempotency_key,
+			 signature,
+			 article,
+			 body,
+			 deleted,
+			 created_at,
+			 author_name,
+			 client_hash,
+			 shadowbanned
+		FROM reply
+		WHERE id = ?
+		`,
+		id,
+	); err != nil {
+		return nil, fmt.Errorf("selecting reply: %w", err)
+	}
+
+	if len(results) == 0 {
+		return nil, nil
+	}
+
+	return &results[0], nil
+}
+
+type insertReplyReactionParams struct {
+	ReplyID      int    `db:"reply_id"`
+	Kind         string `db:"kind"`
+	DeletionKey  string `db:"deletion_key"`
+	ClientKey    string `db:"client_key"`
+	Shadowbanned bool   `db:"shadowbanned"`
+}
+
+// insertReplyReaction is insertReaction for replies.
+func insertReplyReaction(ctx context.Context, db sqlx.ExtContext, params insertReplyReactionParams) (insertedReaction, error) {
+	q, args, err := db.BindNamed(
+		`
+			insert into reply_reaction (reply_id, kind, deletion_key, client_key, shadowbanned)
+			values (:reply_id, :kind, :deletion_key, :client_key, :shadowbanned)
+			on conflict do nothing
+		`,
+		params,
+	)
+	if err != nil {
+		return insertedReaction{}, fmt.Errorf("binding for insertReplyReaction: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, q, args...); err != nil {
+		return insertedReaction{}, fmt.Errorf("inserting reply reaction: %w", err)
+	}
+
+	result := insertedReaction{}
+
+	if err := sqlx.GetContext(
+		ctx,
+		db,
+		&result,
+		`
+		select id, deletion_key from reply_reaction
+		where reply_id = $1 and kind = $2 and client_key = $3 and not deleted
+		`,
+		params.ReplyID,
+		params.Kind,
+		params.ClientKey,
+	); err != nil {
+		return insertedReaction{}, fmt.Errorf("getting reply reaction: %w", err)
+	}
+
+	return result, nil
+}
+
+func deleteReplyReactionByClient(ctx context.Context, db sqlx.ExtContext, replyID int, kind string, clientKey string) (bool, error) {
+	res, err := db.ExecContext(
+		ctx,
+		`
+			update reply_reaction
+			set deleted = true
+			where reply_id = $1 and kind = $2 and client_key = $3 and not deleted
+		`,
+		replyID,
+		kind,
+		clientKey,
+	)
+	if err != nil {
+		return false, fmt.Errorf("deleting reply reaction: %w", err)
+	}
+
+	return rowsAffected(res)
+}
+
+func deleteReplyReactionByDeletionKey(ctx context.Context, db sqlx.ExtContext, deletionKey string) (int, bool, error) {
+	replyIDs := []int{}
+
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&replyIDs,
+		`
+			update reply_reaction
+			set deleted = true
+			where deletion_key = $1 and not deleted
+			returning reply_id
+		`,
+		deletionKey,
+	); err != nil {
+		return 0, false, fmt.Errorf("deleting reply reaction: %w", err)
+	}
+
+	if len(replyIDs) == 0 {
+		return 0, false, nil
+	}
+
+	return replyIDs[0], true, nil
+}
+
+type ReplyReactionAggregation struct {
+	ReplyID int    `db:"reply_id"`
+	Count   int    `db:"count"`
+	Kind    string `db:"kind"`
+}
+
+func getReactionStatsByReplies(ctx context.Context, db sqlx.ExtContext, replyIDs []int) ([]ReplyReactionAggregation, error) {
+	results := []ReplyReactionAggregation{}
+
+	query := `
+		SELECT
+			reply_id,
+			kind,
+			COUNT(*) AS count
+		FROM reply_reaction
+		WHERE reply_id IN (?) AND deleted = false AND shadowbanned = false
+		GROUP BY reply_id, kind
+	`
+
+	query, args, err := sqlx.In(query, replyIDs)
+	if err != nil {
+		return nil, fmt.Errorf("interpolating IN: %w", err)
+	}
+
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&results,
+		query,
+		args...,
+	); err != nil {
+		return nil, fmt.Errorf("aggregating reply reactions: %w", err)
+	}
+
+	return results, nil
+}
+
+type ReactionTimeSeriesAggregation struct {
+	Article string `db:"article"`
+	Kind    string `db:"kind"`
+	Bucket  string `db:"bucket"`
+	Count   int    `db:"count"`
+}
+
+// getReactionTimeSeries counts reactions per article, kind and day or week
+// between start (inclusive) and end (exclusive). Buckets are formatted as the
+// date the interval starts on, with weeks starting on Monday.
+func getReactionTimeSeries(ctx context.Context, db *sqlx.DB, articles []string, interval ReactionInterval, start time.Time, end time.Time) ([]ReactionTimeSeriesAggregation, error) {
+	results := []ReactionTimeSeriesAggregation{}
+
+	bucket := `date(created_at)`
+	if interval == ReactionIntervalWeek {
+		bucket = `date(created_at, 'weekday 0', '-6 days')`
+	}
+
+	query := `
+		SELECT
+			article,
+			kind,
+			` + bucket + ` AS bucket,
+			COUNT(*) AS count
+		FROM article_reaction
+		WHERE article IN (?) AND deleted = false AND shadowbanned = false
+			AND datetime(created_at) >= datetime(?) AND datetime(created_at) < datetime(?)
+		GROUP BY article, kind, bucket
+	`
+
+	query, args, err := sqlx.In(query, articles, start.UTC(), end.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("interpolating IN: %w", err)
+	}
+
+	if err := db.SelectContext(
+		ctx,
+		&results,
+		query,
+		args...,
+	); err != nil {
+		return nil, fmt.Errorf("aggregating reactions over time: %w", err)
+	}
+
+	return results, nil
+}
+
+type webhookRow struct {
+	ID        int           `db:"id"`
+	URL       string        `db:"url"`
+	Format    WebhookFormat `db:"format"`
+	Events    string        `db:"events"`
+	Secret    string        `db:"secret"`
+	CreatedAt time.Time     `db:"created_at"`
+}
+
+func (r webhookRow) webhook() Webhook {
+	w := Webhook{
+		ID:        r.ID,
+		URL:       r.URL,
+		Format:    r.Format,
+		Events:    []WebhookEvent{},
+		Secret:    r.Secret,
+		CreatedAt: r.CreatedAt,
+	}
+	if r.Events != "" {
+		for _, event := range strings.Split(r.Events, ",") {
+			w.Events = append(w.Events, WebhookEvent(event))
+		}
+	}
+
+	return w
+}
+
+func insertWebhook(ctx context.Context, db *sqlx.DB, w Webhook) (int, error) {
+	events := make([]string, 0, len(w.Events))
+	for _, event := range w.Events {
+		events = append(events, string(event))
+	}
+
+	row := struct {
+		ID int `db:"id"`
+	}{}
+
+	if err := db.GetContext(
+		ctx,
+		&row,
+		`
+			insert into webhook (url, format, events, secret, created_at)
+			values ($1, $2, $3, $4, $5)
+			returning id
+		`,
+		w.URL,
+		w.Format,
+		strings.Join(events, ","),
+		w.Secret,
+		w.CreatedAt,
+	); err != nil {
+		return 0, fmt.Errorf("inserting webhook: %w", err)
+	}
+
+	return row.ID, nil
+}
+
+// getWebhooks returns every webhook that hasn't been deleted, secrets
+// included.
+func getWebhooks(ctx context.Context, db sqlx.ExtContext) ([]Webhook, error) {
+	rows := []webhookRow{}
+
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&rows,
+		`
+		select id, url, format, events, secret, created_at
+		from webhook
+		where not deleted
+		order by id
+		`,
+	); err != nil {
+		return nil, fmt.Errorf("selecting webhooks: %w", err)
+	}
+
+	webhooks := []Webhook{}
+	for _, row := range rows {
+		webhooks = append(webhooks, row.webhook())
+	}
+
+	return webhooks, nil
+}
+
+func deleteWebhook(ctx context.Context, db *sqlx.DB, id int) (bool, error) {
+	res, err := db.ExecContext(
+		ctx,
+		`
+			update webhook
+			set deleted = true
+			where id = $1 and not deleted
+		`,
+		id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("deleting webhook: %w", err)
+	}
+
+	return rowsAffected(res)
+}
+
+func insertWebhookDelivery(ctx context.Context, db sqlx.ExtContext, d WebhookDelivery) error {
+	if _, err := db.ExecContext(
+		ctx,
+		`
+			insert into webhook_delivery (webhook_id, event, payload, status, next_attempt_at, created_at)
+			values ($1, $2, $3, $4, $5, $6)
+		`,
+		d.WebhookID,
+		d.Event,
+		d.Payload,
+		d.Status,
+		d.NextAttemptAt.UTC(),
+		d.CreatedAt.UTC(),
+	); err != nil {
+		return fmt.Errorf("inserting webhook delivery: %w", err)
+	}
+
+	return nil
+}
+
+// claimWebhookDeliveries returns up to limit pending deliveries that are due,
+// to webhooks that haven't been deleted. They're leased until leaseUntil, so
+// no other worker claims them in the meantime, and a worker that dies
+// mid-delivery doesn't lose them.
+func claimWebhookDeliveries(ctx context.Context, db *sqlx.DB, now time.Time, leaseUntil time.Time, limit int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+
+	if err := db.SelectContext(
+		ctx,
+		&deliveries,
+		`
+		update webhook_delivery
+		set next_attempt_at = $1
+		where id in (
+			select id from webhook_delivery
+			where status = $2 and julianday(next_attempt_at) <= julianday($3)
+				and webhook_id in (select id from webhook where not deleted)
+			order by next_attempt_at
+			limit $4
+		)
+		returning id, webhook_id, event, payload, status, attempts, next_attempt_at, created_at
+		`,
+		leaseUntil.UTC(),
+		WebhookDeliveryPending,
+		now.UTC(),
+		limit,
+	); err != nil {
+		return nil, fmt.Errorf("claiming webhook deliveries: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+func insertWebhookAttempt(ctx context.Context, db sqlx.ExtContext, a WebhookAttempt) error {
+	if _, err := db.ExecContext(
+		ctx,
+		`
+			insert into webhook_attempt (delivery_id, status_code, error, duration_ms, created_at)
+			values ($1, $2, $3, $4, $5)
+		`,
+		a.DeliveryID,
+		a.StatusCode,
+		a.Error,
+		a.DurationMs,
+		a.CreatedAt.UTC(),
+	); err != nil {
+		return fmt.Errorf("inserting webhook attempt: %w", err)
+	}
+
+	return nil
+}
+
+func updateWebhookDelivery(ctx context.Context, db sqlx.ExtContext, d WebhookDelivery) error {
+	if _, err := db.ExecContext(
+		ctx,
+		`
+			update webhook_delivery
+			set status = $1, attempts = $2, next_attempt_at = $3
+			where id = $4
+		`,
+		d.Status,
+		d.Attempts,
+		d.NextAttemptAt.UTC(),
+		d.ID,
+	); err != nil {
+		return fmt.Errorf("updating webhook delivery: %w", err)
+	}
+
+	return nil
+}
+
+// getWebhookDeliveries returns a webhook's deliveries newest first, optionally
+// only those with a status.
+func getWebhookDeliveries(ctx context.Context, db *sqlx.DB, webhookID int, status WebhookDeliveryStatus, limit int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+
+	if err := db.SelectContext(
+		ctx,
+		&deliveries,
+		`
+		select id, webhook_id, event, payload, status, attempts, next_attempt_at, created_at
+		from webhook_delivery
+		where webhook_id = $1 and ($2 = '' or status = $2)
+		order by id desc
+		limit $3
+		`,
+		webhookID,
+		status,
+		limit,
+	); err != nil {
+		return nil, fmt.Errorf("selecting webhook deliveries: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+// getWebhookAttempts returns the attempts at deliveries, oldest first.
+func getWebhookAttempts(ctx context.Context, db *sqlx.DB, deliveryIDs []int) ([]WebhookAttempt, error) {
+	attempts := []WebhookAttempt{}
+	if len(deliveryIDs) == 0 {
+		return attempts, nil
+	}
+
+	query, args, err := sqlx.In(
+		`
+		select id, delivery_id, status_code, error, duration_ms, created_at
+		from webhook_attempt
+		where delivery_id in (?)
+		order by id
+		`,
+		deliveryIDs,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("interpolating IN: %w", err)
+	}
+
+	if err := db.SelectContext(ctx, &attempts, query, args...); err != nil {
+		return nil, fmt.Errorf("selecting webhook attempts: %w", err)
+	}
+
+	return attempts, nil
+}
+
+// retryWebhookDelivery puts a delivery that isn't pending back in the queue,
+// with its attempts reset.
+func retryWebhookDelivery(ctx context.Context, db *sqlx.DB, id int, now time.Time) (bool, error) {
+	res, err := db.ExecContext(
+		ctx,
+		`
+			update webhook_delivery
+			set status = $1, attempts = 0, next_attempt_at = $2
+			where id = $3 and status != $1
+		`,
+		WebhookDeliveryPending,
+		now.UTC(),
+		id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("retrying webhook delivery: %w", err)
+	}
+
+	return rowsAffected(res)
+}
+
+// insertEmailSubscription subscribes an email to an article's replies. The
+// subscription is only active once the email is confirmed, which it already
+// is if it confirmed another subscription. An existing subscription is left
+// alone, so commenting again doesn't undo unsubscribing.
+func insertEmailSubscription(ctx context.Context, db sqlx.ExtContext, email string, article string, now time.Time) error {
+	if _, err := db.ExecContext(
+		ctx,
+		`
+			insert into email_subscription (email, article, unsubscribed, created_at, confirmed_at)
+			select $1, $2, false, $3, case
+				when exists (select 1 from email_subscription where email = $1 and confirmed_at is not null) then $3
+			end
+			where true
+			on conflict (email, article) do nothing
+		`,
+		email,
+		article,
+		now.UTC(),
+	); err != nil {
+		return fmt.Errorf("inserting email subscription: %w", err)
+	}
+
+	return nil
+}
+
+// setEmailUnsubscribed unsubscribes an email from an article's replies, or
+// from every reply for owners.
+func setEmailUnsubscribed(ctx context.Context, db sqlx.ExtContext, email string, article string, now time.Time) error {
+	if _, err := db.ExecContext(
+		ctx,
+		`
+			insert into email_subscription (email, article, unsubscribed, created_at)
+			values ($1, $2, true, $3)
+			on conflict (email, article) do update set unsubscribed = true
+		`,
+		email,
+		article,
+		now.UTC(),
+	); err != nil {
+		return fmt.Errorf("unsubscribing email: %w", err)
+	}
+
+	return nil
+}
+
+// getEmailSubscribers returns the confirmed emails subscribed to an article,
+// or of those that unsubscribed if unsubscribed is set.
+func getEmailSubscribers(ctx context.Context, db sqlx.ExtContext, article string, unsubscribed bool) ([]string, error) {
+	emails := []string{}
+
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&emails,
+		`
+			select email from email_subscription
+			where article = $1 and unsubscribed = $2 and (unsubscribed or confirmed_at is not null)
+			order by email
+		`,
+		article,
+		unsubscribed,
+	); err != nil {
+		return nil, fmt.Errorf("selecting email subscribers: %w", err)
+	}
+
+	return emails, nil
+}
+
+type unconfirmedEmailSubscription struct {
+	Email   string `db:"email"`
+	Article string `db:"article"`
+}
+
+// getUnconfirmedEmailSubscriptions returns up to limit emails waiting for a
+// confirmation email to be sent, each with one of the articles it subscribed
+// to.
+func getUnconfirmedEmailSubscriptions(ctx context.Context, db *sqlx.DB, limit int) ([]unconfirmedEmailSubscription, error) {
+	subs := []unconfirmedEmailSubscription{}
+
+	if err := db.SelectContext(
+		ctx,
+		&subs,
+		`
+			select email, min(article) as article from email_subscription
+			where confirmed_at is null and confirmation_sent_at is null and not unsubscribed
+			group by email
+			order by min(created_at)
+			limit $1
+		`,
+		limit,
+	); err != nil {
+		return nil, fmt.Errorf("selecting unconfirmed email subscriptions: %w", err)
+	}
+
+	return subs, nil
+}
+
+func markEmailConfirmationSent(ctx context.Context, db *sqlx.DB, email string, now time.Time) error {
+	if _, err := db.ExecContext(
+		ctx,
+		`update email_subscription set confirmation_sent_at = $1 where email = $2 and confirmed_at is null`,
+		now.UTC(),
+		email,
+	); err != nil {
+		return fmt.Errorf("marking email confirmation sent: %w", err)
+	}
+
+	return nil
+}
+
+// confirmEmailSubscriptions activates every subscription of an email.
+func confirmEmailSubscriptions(ctx context.Context, db *sqlx.DB, email string, now time.Time) error {
+	if _, err := db.ExecContext(
+		ctx,
+		`update email_subscription set confirmed_at = $1 where email = $2 and confirmed_at is null`,
+		now.UTC(),
+		email,
+	); err != nil {
+		return fmt.Errorf("confirming email subscriptions: %w", err)
+	}
+
+	return nil
+}
+
+func insertEmailNotification(ctx context.Context, db sqlx.ExtContext, email string, article string, replyID int, now time.Time) error {
+	if _, err := db.ExecContext(
+		ctx,
+		`
+			insert into email_notification (email, article, reply_id, created_at)
+			values ($1, $2, $3, $4)
+		`,
+		email,
+		article,
+		replyID,
+		now.UTC(),
+	); err != nil {
+		return fmt.Errorf("inserting email notification: %w", err)
+	}
+
+	return nil
+}
+
+type emailNotificationGroup struct {
+	Email   string `db:"email"`
+	Article string `db:"article"`
+}
+
+// getDueEmailNotificationGroups returns up to limit subscriptions whose oldest
+// unsent notification was queued before since, and that aren't waiting to be
+// retried after now.
+func getDueEmailNotificationGroups(ctx context.Context, db *sqlx.DB, since time.Time, now time.Time, limit int) ([]emailNotificationGroup, error) {
+	groups := []emailNotificationGroup{}
+
+	if err := db.SelectContext(
+		ctx,
+		&groups,
+		`
+		select email, article
+		from email_notification
+		where sent_at is null and dead_at is null
+		group by email, article
+		having julianday(min(created_at)) <= julianday($1)
+			and (max(next_attempt_at) is null or julianday(max(next_attempt_at)) <= julianday($2))
+		order by min(created_at)
+		limit $3
+		`,
+		since.UTC(),
+		now.UTC(),
+		limit,
+	); err != nil {
+		return nil, fmt.Errorf("selecting due email notifications: %w", err)
+	}
+
+	return groups, nil
+}
+
+type emailNotification struct {
+	ID       int `db:"notification_id"`
+	Attempts int `db:"attempts"`
+	Reply
+}
+
+// getUnsentEmailNotifications returns a subscription's unsent notifications,
+// oldest first, with the replies they're about.
+func getUnsentEmailNotifications(ctx context.Context, db *sqlx.DB, group emailNotificationGroup) ([]emailNotification, error) {
+	notifications := []emailNotification{}
+
+	if err := db.SelectContext(
+		ctx,
+		&notifications,
+		`
+		SELECT
+			 n.id AS notification_id,
+			 n.attempts,
+			 r.id,
+			 r.idempotency_key,
+			 r.signature,
+			 r.article,
+			 r.body,
+			 r.deleted,
+			 r.created_at,
+			 r.author_name,
+			 r.client_hash,
+			 r.shadowbanned
+		FROM email_notification n
+		JOIN reply r ON r.id = n.reply_id
+		WHERE n.email = $1 AND n.article = $2 AND n.sent_at IS NULL AND n.dead_at IS NULL
+		ORDER BY n.id
+		`,
+		group.Email,
+		group.Article,
+	); err != nil {
+		return nil, fmt.Errorf("selecting unsent email notifications: %w", err)
+	}
+
+	return notifications, nil
+}
+
+func markEmailNotificationsSent(ctx context.Context, db *sqlx.DB, ids []int, now time.Time) error {
+	query, args, err := sqlx.In(`update email_notification set sent_at = ? where id in (?)`, now.UTC(), ids)
+	if err != nil {
+		return fmt.Errorf("interpolating IN: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("marking email notifications sent: %w", err)
+	}
+
+	return nil
+}
+
+// markEmailNotificationsFailed records a failed attempt at sending
+// notifications, and when to retry them, or gives up on them if dead.
+func markEmailNotificationsFailed(ctx context.Context, db *sqlx.DB, ids []int, attempts int, nextAttemptAt time.Time, dead bool, now time.Time) error {
+	var deadAt *time.Time
+	if dead {
+		now = now.UTC()
+		deadAt = &now
+	}
+
+	query, args, err := sqlx.In(
+		`update email_notification set attempts = ?, next_attempt_at = ?, dead_at = ? where id in (?)`,
+		attempts,
+		nextAttemptAt.UTC(),
+		deadAt,
+		ids,
+	)
+	if err != nil {
+		return fmt.Errorf("interpolating IN: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("marking email notifications failed: %w", err)
+	}
+
+	return nil
+}
+
+func deleteUnsentEmailNotifications(ctx context.Context, db sqlx.ExtContext, email string, article string) error {
+	if _, err := db.ExecContext(
+		ctx,
+		`delete from email_notification where email = $1 and article = $2 and sent_at is null`,
+		email,
+		article,
+	); err != nil {
+		return fmt.Errorf("deleting unsent email notifications: %w", err)
+	}
+
+	return nil
+}
+
+// getActiveArticles returns the articles with visible replies or reactions
+// since a time.
+func getActiveArticles(ctx context.Context, db *sqlx.DB, since time.Time) ([]string, error) {
+	articles := []string{}
+
+	if err := db.SelectContext(
+		ctx,
+		&articles,
+		`
+		select article from reply
+		where deleted = false and shadowbanned = false and datetime(created_at) >= datetime($1)
+		union
+		select article from article_reaction
+		where deleted = false and shadowbanned = false and datetime(created_at) >= datetime($1)
+		order by article
+		`,
+		since.UTC(),
+	); err != nil {
+		return nil, fmt.Errorf("selecting active articles: %w", err)
+	}
+
+	return articles, nil
+}
+
+// getPendingReplies returns every shadowbanned reply, however old, which is
+// waiting to be approved or deleted.
+func getPendingReplies(ctx context.Context, db *sqlx.DB) (Replies, error) {
+	replies := Replies{}
+
+	if err := db.SelectContext(
+		ctx,
+		&replies,
+		`
+		SELECT
+			 id,
+			 idempotency_key,
+			 signature,
+			 article,
+			 body,
+			 deleted,
+			 created_at,
+			 author_name,
+			 client_hash,
+			 shadowbanned
+		FROM reply
+		WHERE deleted = false AND shadowbanned = true
+		ORDER BY created_at
+		`,
+	); err != nil {
+		return nil, fmt.Errorf("selecting pending replies: %w", err)
+	}
+
+	return replies, nil
+}
+
+// getLastDigestEnd returns when the last digest's period ended, or zero if
+// there hasn't been one.
+func getLastDigestEnd(ctx context.Context, db *sqlx.DB) (time.Time, error) {
+	results := []time.Time{}
+
+	if err := db.SelectContext(
+		ctx,
+		&results,
+		`select period_end from digest order by period_end desc limit 1`,
+	); err != nil {
+		return time.Time{}, fmt.Errorf("selecting last digest: %w", err)
+	}
+
+	if len(results) == 0 {
+		return time.Time{}, nil
+	}
+
+	return results[0], nil
+}
+
+// claimDigest records a digest for a period, unless another digest ended
+// after dueAfter. The check and insert are one statement, so only one of the
+// instances sharing the database claims each period.
+func claimDigest(ctx context.Context, db sqlx.ExtContext, start time.Time, end time.Time, dueAfter time.Time, now time.Time) (bool, error) {
+	res, err := db.ExecContext(
+		ctx,
+		`
+			insert into digest (period_start, period_end, created_at)
+			select $1, $2, $3
+			where not exists (select 1 from digest where julianday(period_end) > julianday($4))
+		`,
+		start.UTC(),
+		end.UTC(),
+		now.UTC(),
+		dueAfter.UTC(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("inserting digest: %w", err)
+	}
+
+	return rowsAffected(res)
+}
+
+// getExistingIdempotencyKeys returns which of the keys replies were inserted
+// with.
+func getExistingIdempotencyKeys(ctx context.Context, db sqlx.ExtContext, keys []string) (map[string]bool, error) {
+	existing := map[string]bool{}
+
+	// Stay well under SQLite's limit on variables.
+	for chunk := range slices.Chunk(keys, 500) {
+		query, args, err := sqlx.In(`select idempotency_key from reply where idempotency_key in (?)`, chunk)
+		if err != nil {
+			return nil, fmt.Errorf("interpolating IN: %w", err)
+		}
+
+		found := []string{}
+		if err := sqlx.SelectContext(ctx, db, &found, query, args...); err != nil {
+			return nil, fmt.Errorf("selecting idempotency keys: %w", err)
+		}
+
+		for _, key := range found {
+			existing[key] = true
+		}
+	}
+
+	return existing, nil
+}
+
+// backupFilterWhere returns the conditions limiting the records in a backup,
+// by the column holding their article and their creation time, for use with
+// sqlx.In.
+func backupFilterWhere(filter BackupFilter, articleColumn string, createdAtColumn string) (string, []any) {
+	conds := []string{"1 = 1"}
+	args := []any{}
+
+	if len(filter.Articles) > 0 {
+		conds = append(conds, articleColumn+" in (?)")
+		args = append(args, filter.Articles)
+	}
+	if !filter.Since.IsZero() {
+		conds = append(conds, "datetime("+createdAtColumn+") >= datetime(?)")
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		conds = append(conds, "datetime("+createdAtColumn+") < datetime(?)")
+		args = append(args, filter.Until)
+	}
+
+	return strings.Join(conds, " and "), args
+}
+
+// exportRows streams the rows of a query to fn, so exports don't hold every
+// row in memory.
+func exportRows[T any](ctx context.Context, db sqlx.ExtContext, query string, args []any, fn func(T) error) error {
+	query, args, err := sqlx.In(query, args...)
+	if err != nil {
+		return fmt.Errorf("interpolating IN: %w", err)
+	}
+
+	rows, err := db.QueryxContext(ctx, db.Rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("selecting for export: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row T
+		if err := rows.StructScan(&row); err != nil {
+			return fmt.Errorf("scanning for export: %w", err)
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func exportReplies(ctx context.Context, db sqlx.ExtContext, filter BackupFilter, fn func(BackupReply) error) error {
+	where, args := backupFilterWhere(filter, "article", "created_at")
+
+	return exportRows(
+		ctx,
+		db,
+		`
+		select id, idempotency_key, signature, article, body, author_name, client_hash, deleted, shadowbanned, created_at
+		from reply
+		where `+where+`
+		order by id
+		`,
+		args,
+		fn,
+	)
+}
+
+// reactionRow is a reaction as stored, with its created_at as the TEXT the
+// reaction tables keep it in.
+type reactionRow struct {
+	ID           int    `db:"id"`
+	Article      string `db:"article"`
+	ReplyID      int    `db:"reply_id"`
+	ReplyKey     string `db:"reply_key"`
+	Kind         string `db:"kind"`
+	DeletionKey  string `db:"deletion_key"`
+	ClientKey    string `db:"client_key"`
+	Deleted      bool   `db:"deleted"`
+	Shadowbanned bool   `db:"shadowbanned"`
+	CreatedAt    string `db:"created_at"`
+}
+
+func (r reactionRow) createdAt() (time.Time, error) {
+	createdAt, err := time.Parse(time.DateTime, r.CreatedAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing reaction created_at: %w", err)
+	}
+
+	return createdAt, nil
+}
+
+func exportArticleReactions(ctx context.Context, db sqlx.ExtContext, filter BackupFilter, fn func(BackupArticleReaction) error) error {
+	where, args := backupFilterWhere(filter, "article", "created_at")
+
+	return exportRows(
+		ctx,
+		db,
+		`
+		select id, article, kind, deletion_key, client_key, deleted, shadowbanned, datetime(created_at) as created_at
+		from article_reaction
+		where `+where+`
+		order by id
+		`,
+		args,
+		func(r reactionRow) error {
+			createdAt, err := r.createdAt()
+			if err != nil {
+				return err
+			}
+
+			return fn(BackupArticleReaction{
+				ID:           r.ID,
+				Article:      r.Article,
+				Kind:         r.Kind,
+				DeletionKey:  r.DeletionKey,
+				ClientKey:    r.ClientKey,
+				Deleted:      r.Deleted,
+				Shadowbanned: r.Shadowbanned,
+				CreatedAt:    createdAt,
+			})
+		},
+	)
+}
+
+func exportReplyReactions(ctx context.Context, db sqlx.ExtContext, filter BackupFilter, fn func(BackupReplyReaction) error) error {
+	where, args := backupFilterWhere(filter, "r.article", "rr.created_at")
+
+	return exportRows(
+		ctx,
+		db,
+		`
+		select rr.id, r.idempotency_key as reply_key, rr.kind, rr.deletion_key, rr.client_key, rr.deleted, rr.shadowbanned,
+			datetime(rr.created_at) as created_at
+		from reply_reaction rr
+		join reply r on r.id = rr.reply_id
+		where `+where+`
+		order by rr.id
+		`,
+		args,
+		func(r reactionRow) error {
+			createdAt, err := r.createdAt()
+			if err != nil {
+				return err
+			}
+
+			return fn(BackupReplyReaction{
+				ID:           r.ID,
+				ReplyKey:     r.ReplyKey,
+				Kind:         r.Kind,
+				DeletionKey:  r.DeletionKey,
+				ClientKey:    r.ClientKey,
+				Deleted:      r.Deleted,
+				Shadowbanned: r.Shadowbanned,
+				CreatedAt:    createdAt,
+			})
+		},
+	)
+}
+
+func exportBans(ctx context.Context, db sqlx.ExtContext, filter BackupFilter, fn func(BackupBan) error) error {
+	where, args := backupFilterWhere(filter, "", "created_at")
+
+	return exportRows(
+		ctx,
+		db,
+		`
+		select id, kind, value, mode, reason, expires_at, deleted, created_at
+		from ban
+		where `+where+`
+		order by id
+		`,
+		args,
+		fn,
+	)
+}
+
+func exportFlags(ctx context.Context, db sqlx.ExtContext, filter BackupFilter, fn func(BackupFlag) error) error {
+	where, args := backupFilterWhere(filter, "r.article", "f.created_at")
+
+	return exportRows(
+		ctx,
+		db,
+		`
+		select f.id, r.idempotency_key as reply_key, f.reason, f.client_hash, f.resolved, f.created_at
+		from reply_flag f
+		join reply r on r.id = f.reply_id
+		where `+where+`
+		order by f.id
+		`,
+		args,
+		fn,
+	)
+}
+
+// exportModerationEvents exports the moderation events in a filter's time
+// range. Filtered by article, it exports only the events about the replies,
+// reactions and flags on the articles.
+func exportModerationEvents(ctx context.Context, db sqlx.ExtContext, filter BackupFilter, fn func(ModerationEvent) error) error {
+	where, args := backupFilterWhere(BackupFilter{Since: filter.Since, Until: filter.Until}, "", "created_at")
+
+	if len(filter.Articles) > 0 {
+		where += `
+			and (
+				(target_type = 'reply' and target_id in (
+					select cast(id as text) from reply where article in (?)
+				))
+				or (target_type = 'reaction' and target_id in (
+					select cast(id as text) from article_reaction where article in (?)
+				))
+				or (target_type = 'reply_reaction' and target_id in (
+					select cast(rr.id as text) from reply_reaction rr join reply r on r.id = rr.reply_id where r.article in (?)
+				))
+				or (target_type = 'flag' and target_id in (
+					select cast(f.id as text) from reply_flag f join reply r on r.id = f.reply_id where r.article in (?)
+				))
+			)`
+		args = append(args, filter.Articles, filter.Articles, filter.Articles, filter.Articles)
+	}
+
+	return exportRows(
+		ctx,
+		db,
+		`
+		select id, actor, action, target_type, target_id, reason, created_at
+		from moderation_event
+		where `+where+`
+		order by id
+		`,
+		args,
+		fn,
+	)
+}
+
+// getReplyIDByIdempotencyKey returns errNotFound if there's no reply with the
+// key.
+func getReplyIDByIdempotencyKey(ctx context.Context, db sqlx.ExtContext, key string) (int, error) {
+	ids := []int{}
+
+	if err := sqlx.SelectContext(ctx, db, &ids, `select id from reply where idempotency_key = $1`, key); err != nil {
+		return 0, fmt.Errorf("selecting reply id: %w", err)
+	}
+
+	if len(ids) == 0 {
+		return 0, errNotFound
+	}
+
+	return ids[0], nil
+}
+
+// restoreArticleReaction inserts a reaction unless there's one with its
+// deletion key, and returns its id and whether it was inserted. The id is zero
+// if the reaction clashed with another from the same client, and wasn't
+// inserted.
+func restoreArticleReaction(ctx context.Context, db sqlx.ExtContext, r BackupArticleReaction) (int, bool, error) {
+	res, err := db.ExecContext(
+		ctx,
+		`
+			insert into article_reaction (article, kind, deletion_key, client_key, deleted, shadowbanned, created_at)
+			values ($1, $2, $3, $4, $5, $6, $7)
+			on conflict do nothing
+		`,
+		r.Article,
+		r.Kind,
+		r.DeletionKey,
+		r.ClientKey,
+		r.Deleted,
+		r.Shadowbanned,
+		r.CreatedAt.UTC().Format(time.DateTime),
+	)
+	if err != nil {
+		return 0, false, fmt.Errorf("inserting article reaction: %w", err)
+	}
+
+	inserted, err := rowsAffected(res)
+	if err != nil {
+		return 0, false, err
+	}
+
+	ids := []int{}
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&ids,
+		`select id from article_reaction where deletion_key = $1`,
+		r.DeletionKey,
+	); err != nil {
+		return 0, false, fmt.Errorf("selecting article reaction: %w", err)
+	}
+
+	if len(ids) == 0 {
+		return 0, inserted, nil
+	}
+
+	return ids[0], inserted, nil
+}
+
+// restoreReplyReaction is restoreArticleReaction for replies.
+func restoreReplyReaction(ctx context.Context, db sqlx.ExtContext, r BackupReplyReaction) (int, bool, error) {
+	replyID, err := getReplyIDByIdempotencyKey(ctx, db, r.ReplyKey)
+	if err != nil {
+		return 0, false, err
+	}
+
+	res, err := db.ExecContext(
+		ctx,
+		`
+			insert into reply_reaction (reply_id, kind, deletion_key, client_key, deleted, shadowbanned, created_at)
+			values ($1, $2, $3, $4, $5, $6, $7)
+			on conflict do nothing
+		`,
+		replyID,
+		r.Kind,
+		r.DeletionKey,
+		r.ClientKey,
+		r.Deleted,
+		r.Shadowbanned,
+		r.CreatedAt.UTC().Format(time.DateTime),
+	)
+	if err != nil {
+		return 0, false, fmt.Errorf("inserting reply reaction: %w", err)
+	}
+
+	inserted, err := rowsAffected(res)
+	if err != nil {
+		return 0, false, err
+	}
+
+	ids := []int{}
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&ids,
+		`select id from reply_reaction where deletion_key = $1`,
+		r.DeletionKey,
+	); err != nil {
+		return 0, false, fmt.Errorf("selecting reply reaction: %w", err)
+	}
+
+	if len(ids) == 0 {
+		return 0, inserted, nil
+	}
+
+	return ids[0], inserted, nil
+}
+
+// restoreBan inserts a ban unless there's the same ban created at the same
+// time, and returns its id and whether it was inserted.
+func restoreBan(ctx context.Context, db sqlx.ExtContext, b BackupBan) (int, bool, error) {
+	ids := []int{}
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&ids,
+		`
+		select id from ban
+		where kind = $1 and value = $2 and mode = $3 and reason = $4 and datetime(created_at) = datetime($5)
+		`,
+		b.Kind,
+		b.Value,
+		b.Mode,
+		b.Reason,
+		b.CreatedAt,
+	); err != nil {
+		return 0, false, fmt.Errorf("selecting ban: %w", err)
+	}
+
+	if len(ids) > 0 {
+		return ids[0], false, nil
+	}
+
+	row := struct {
+		ID int `db:"id"`
+	}{}
+
+	if err := sqlx.GetContext(
+		ctx,
+		db,
+		&row,
+		`
+			insert into ban (kind, value, mode, reason, expires_at, deleted, created_at)
+			values ($1, $2, $3, $4, $5, $6, $7)
+			returning id
+		`,
+		b.Kind,
+		b.Value,
+		b.Mode,
+		b.Reason,
+		b.ExpiresAt,
+		b.Deleted,
+		b.CreatedAt,
+	); err != nil {
+		return 0, false, fmt.Errorf("inserting ban: %w", err)
+	}
+
+	return row.ID, true, nil
+}
+
+// restoreFlag is restoreBan for flags.
+func restoreFlag(ctx context.Context, db sqlx.ExtContext, f BackupFlag) (int, bool, error) {
+	replyID, err := getReplyIDByIdempotencyKey(ctx, db, f.ReplyKey)
+	if err != nil {
+		return 0, false, err
+	}
+
+	ids := []int{}
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&ids,
+		`
+		select id from reply_flag
+		where reply_id = $1 and reason = $2 and client_hash = $3 and datetime(created_at) = datetime($4)
+		`,
+		replyID,
+		f.Reason,
+		f.ClientHash,
+		f.CreatedAt,
+	); err != nil {
+		return 0, false, fmt.Errorf("selecting flag: %w", err)
+	}
+
+	if len(ids) > 0 {
+		return ids[0], false, nil
+	}
+
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&ids,
+		`
+			insert into reply_flag (reply_id, reason, client_hash, resolved, created_at)
+			values ($1, $2, $3, $4, $5)
+			on conflict do nothing
+			returning id
+		`,
+		replyID,
+		f.Reason,
+		f.ClientHash,
+		f.Resolved,
+		f.CreatedAt,
+	); err != nil {
+		return 0, false, fmt.Errorf("inserting flag: %w", err)
+	}
+
+	if len(ids) > 0 {
+		return ids[0], true, nil
+	}
+
+	// The client already has an unresolved flag on the reply, which stands in
+	// for this one.
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&ids,
+		`
+		select id from reply_flag
+		where reply_id = $1 and client_hash = $2 and not resolved
+		`,
+		replyID,
+		f.ClientHash,
+	); err != nil {
+		return 0, false, fmt.Errorf("selecting flag: %w", err)
+	}
+
+	if len(ids) == 0 {
+		return 0, false, fmt.Errorf("flag conflicts with no unresolved flag")
+	}
+
+	return ids[0], false, nil
+}
+
+// restoreModerationEvent inserts an event unless the same event happened at
+// the same time, and returns whether it was inserted.
+func restoreModerationEvent(ctx context.Context, db sqlx.ExtContext, e ModerationEvent) (bool, error) {
+	ids := []int{}
+	if err := sqlx.SelectContext(
+		ctx,
+		db,
+		&ids,
+		`
+		select id from moderation_event
+		where actor = $1 and action = $2 and target_type = $3 and target_id = $4 and reason = $5
+			and datetime(created_at) = datetime($6)
+		`,
+		e.Actor,
+		e.Action,
+		e.TargetType,
+		e.TargetID,
+		e.Reason,
+		e.CreatedAt,
+	); err != nil {
+		return false, fmt.Errorf("selecting moderation event: %w", err)
+	}
+
+	if len(ids) > 0 {
+		return false, nil
+	}
+
+	if _, err := insertModerationEvent(ctx, db, e); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// getReactions returns the reactions on an article, or on a reply if replyID
+// isn't zero, newest first.
+func getReactions(ctx context.Context, db *sqlx.DB, article string, replyID int) ([]Reaction, error) {
+	rows := []reactionRow{}
+
+	query := `
+		select id, article, kind, deleted, shadowbanned, datetime(created_at) as created_at
+		from article_reaction
+		where article = $1
+		order by id desc
+		`
+	arg := any(article)
+	if replyID != 0 {
+		query = `
+		select id, reply_id, kind, deleted, shadowbanned, datetime(created_at) as created_at
+		from reply_reaction
+		where reply_id = $1
+		order by id desc
+		`
+		arg = replyID
+	}
+
+	if err := db.SelectContext(ctx, &rows, query, arg); err != nil {
+		return nil, fmt.Errorf("selecting reactions: %w", err)
+	}
+
+	reactions := make([]Reaction, len(rows))
+	for i, r := range rows {
+		createdAt, err := r.createdAt()
+		if err != nil {
+			return nil, err
+		}
+
+		reactions[i] = Reaction{
+			ID:           r.ID,
+			Article:      r.Article,
+			ReplyID:      r.ReplyID,
+			Kind:         r.Kind,
+			Deleted:      r.Deleted,
+			Shadowbanned: r.Shadowbanned,
+			CreatedAt:    createdAt,
+		}
+	}
+
+	return reactions, nil
+}
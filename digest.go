@@ -0,0 +1,364 @@
+package gomments
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/arizard/gomments/internal"
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultDigestText = `Comments from {{.Start.UTC.Format "2 Jan 2006 15:04 MST"}} to {{.End.UTC.Format "2 Jan 2006 15:04 MST"}}.
+
+New comments:
+{{range .Articles}}{{if .Replies.Count}}  {{.Article}}: {{.Replies.Count}}{{with .Link}} {{.}}{{end}}
+{{end}}{{else}}  None.
+{{end}}
+Pending moderation:
+{{range .Pending}}  {{.AuthorName}} on {{.Article}}, {{.CreatedAt.UTC.Format "2 Jan 2006 15:04 MST"}}: {{.Body}}
+{{else}}  None.
+{{end}}
+Flags:
+{{range .Flags}}  Reply {{.ReplyID}}{{with .Reason}}: {{.}}{{end}}
+{{else}}  None.
+{{end}}{{with .TopReacted}}
+Most reacted:
+{{range .}}  {{.Article}}: {{.ReactionCount}}{{range $kind, $count := .Reactions}}{{if $count}} {{$kind}} {{$count}}{{end}}{{end}}
+{{end}}{{end}}`
+
+const defaultDigestHTML = `<!DOCTYPE html>
+<html>
+<body>
+<p>Comments from {{.Start.UTC.Format "2 Jan 2006 15:04 MST"}} to {{.End.UTC.Format "2 Jan 2006 15:04 MST"}}.</p>
+<h3>New comments</h3>
+<ul>
+{{range .Articles}}{{if .Replies.Count}}<li>{{if .Link}}<a href="{{.Link}}">{{.Article}}</a>{{else}}{{.Article}}{{end}}: {{.Replies.Count}}</li>
+{{end}}{{else}}<li>None.</li>
+{{end}}</ul>
+<h3>Pending moderation</h3>
+<ul>
+{{range .Pending}}<li><strong>{{.AuthorName}}</strong> on {{.Article}}, {{.CreatedAt.UTC.Format "2 Jan 2006 15:04 MST"}}: <span style="white-space: pre-wrap">{{.Body}}</span></li>
+{{else}}<li>None.</li>
+{{end}}</ul>
+<h3>Flags</h3>
+<ul>
+{{range .Flags}}<li>Reply {{.ReplyID}}{{with .Reason}}: {{.}}{{end}}</li>
+{{else}}<li>None.</li>
+{{end}}</ul>
+{{with .TopReacted}}<h3>Most reacted</h3>
+<ul>
+{{range .}}<li>{{.Article}}: {{.ReactionCount}}{{range $kind, $count := .Reactions}}{{if $count}} {{$kind}} {{$count}}{{end}}{{end}}</li>
+{{end}}</ul>
+{{end}}</body>
+</html>
+`
+
+// DigestTemplates render digest emails, from a Digest.
+type DigestTemplates struct {
+	Text *texttemplate.Template
+	HTML *htmltemplate.Template
+}
+
+func DefaultDigestTemplates() DigestTemplates {
+	return DigestTemplates{
+		Text: texttemplate.Must(texttemplate.New("digest.txt").Parse(defaultDigestText)),
+		HTML: htmltemplate.Must(htmltemplate.New("digest.html").Parse(defaultDigestHTML)),
+	}
+}
+
+// LoadDigestTemplates reads digest.txt and digest.html from a directory,
+// keeping the default for either that doesn't exist.
+func LoadDigestTemplates(dir string) (DigestTemplates, error) {
+	templates := DefaultDigestTemplates()
+
+	if b, err := os.ReadFile(filepath.Join(dir, "digest.txt")); err == nil {
+		if templates.Text, err = texttemplate.New("digest.txt").Parse(string(b)); err != nil {
+			return templates, fmt.Errorf("parsing digest.txt: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return templates, err
+	}
+
+	if b, err := os.ReadFile(filepath.Join(dir, "digest.html")); err == nil {
+		if templates.HTML, err = htmltemplate.New("digest.html").Parse(string(b)); err != nil {
+			return templates, fmt.Errorf("parsing digest.html: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return templates, err
+	}
+
+	return templates, nil
+}
+
+// DigestConfig configures the moderation digest, which summarises each Period
+// for the moderators. It's emailed to Recipients if Mailer is set, and sent
+// to webhooks as a digest.created event if Webhook is set.
+type DigestConfig struct {
+	Period time.Duration
+	// TopArticles is how many of the most reacted articles are listed.
+	TopArticles int
+
+	Mailer     internal.Mailer
+	From       string
+	Recipients []string
+	Webhook    bool
+	Templates  DigestTemplates
+}
+
+func DefaultDigestConfig() DigestConfig {
+	return DigestConfig{
+		Period:      24 * time.Hour,
+		TopArticles: 5,
+		Templates:   DefaultDigestTemplates(),
+	}
+}
+
+func WithDigestConfig(cfg DigestConfig) Option {
+	return func(s *Service) {
+		s.digest = cfg
+	}
+}
+
+type DigestArticle struct {
+	Article   string               `json:"article"`
+	Link      string               `json:"link,omitempty"`
+	Replies   ArticleReplyStats    `json:"replies"`
+	Reactions ArticleReactionStats `json:"reactions"`
+	// ReactionCount totals Reactions.
+	ReactionCount int `json:"reaction_count"`
+}
+
+// Digest summarises a period: the articles with new replies or reactions,
+// the replies waiting for approval, and the flags raised, that are still
+// unresolved.
+type Digest struct {
+	Start    time.Time       `json:"start"`
+	End      time.Time       `json:"end"`
+	Articles []DigestArticle `json:"articles"`
+	// TopReacted are the articles with the most reactions in the period.
+	TopReacted []DigestArticle `json:"top_reacted"`
+	Pending    Replies         `json:"pending"`
+	Flags      []Flag          `json:"flags"`
+}
+
+// Summary is a line describing the digest, used as its email subject.
+func (d Digest) Summary() string {
+	replies := 0
+	for _, a := range d.Articles {
+		replies += a.Replies.Count
+	}
+
+	return fmt.Sprintf("Comments digest: %d new, %d pending, %d flagged", replies, len(d.Pending), len(d.Flags))
+}
+
+type GetDigestRequest struct {
+	// Since defaults to a Period ago.
+	Since time.Time
+}
+
+type GetDigestResponse struct {
+	Digest Digest `json:"digest"`
+}
+
+// GetDigest summarises the activity since a time, using the same stats as
+// GetReplyStatsByArticles and GetReactionStatsByArticles.
+func (s *Service) GetDigest(ctx context.Context, req GetDigestRequest) (*GetDigestResponse, error) {
+	end := time.Now()
+	start := req.Since
+	if start.IsZero() {
+		start = end.Add(-s.digest.Period)
+	}
+
+	articles, err := getActiveArticles(ctx, s.db, start)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting active articles: %w", err)
+	}
+
+	replyStats, err := s.GetReplyStatsByArticles(ctx, GetReplyStatsByArticlesRequest{Articles: articles, Since: start})
+	if err != nil {
+		return nil, err
+	}
+	reactionStats, err := s.GetReactionStatsByArticles(ctx, GetReactionStatsByArticlesRequest{Articles: articles, Since: start})
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := getPendingReplies(ctx, s.db)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting pending replies: %w", err)
+	}
+
+	flags, err := getFlags(ctx, s.db, false)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting flags: %w", err)
+	}
+
+	digest := Digest{
+		Start:      start,
+		End:        end,
+		Articles:   []DigestArticle{},
+		TopReacted: []DigestArticle{},
+		Pending:    pending,
+		Flags:      []Flag{},
+	}
+
+	for _, article := range articles {
+		a := DigestArticle{
+			Article:   article,
+			Link:      s.articleURL(article),
+			Replies:   replyStats.Stats[article],
+			Reactions: reactionStats.Stats[article],
+		}
+		for _, count := range a.Reactions {
+			a.ReactionCount += count
+		}
+		digest.Articles = append(digest.Articles, a)
+	}
+
+	// Articles with the most new replies first.
+	slices.SortStableFunc(digest.Articles, func(a, b DigestArticle) int {
+		return cmp.Compare(b.Replies.Count, a.Replies.Count)
+	})
+
+	for _, a := range digest.Articles {
+		if a.ReactionCount > 0 {
+			digest.TopReacted = append(digest.TopReacted, a)
+		}
+	}
+	slices.SortStableFunc(digest.TopReacted, func(a, b DigestArticle) int {
+		return cmp.Compare(b.ReactionCount, a.ReactionCount)
+	})
+	if len(digest.TopReacted) > s.digest.TopArticles {
+		digest.TopReacted = digest.TopReacted[:s.digest.TopArticles]
+	}
+
+	for _, flag := range flags {
+		if !flag.CreatedAt.Before(start) {
+			digest.Flags = append(digest.Flags, flag)
+		}
+	}
+
+	return &GetDigestResponse{Digest: digest}, nil
+}
+
+func (s *Service) digestEmail(digest Digest, to string) (internal.Email, error) {
+	var text, html bytes.Buffer
+	if err := s.digest.Templates.Text.Execute(&text, digest); err != nil {
+		return internal.Email{}, fmt.Errorf("rendering text: %w", err)
+	}
+	if err := s.digest.Templates.HTML.Execute(&html, digest); err != nil {
+		return internal.Email{}, fmt.Errorf("rendering html: %w", err)
+	}
+
+	return internal.Email{
+		From:    s.digest.From,
+		To:      to,
+		Subject: digest.Summary(),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+type SendDigestRequest struct {
+}
+
+type SendDigestResponse struct {
+	// Sent is false if the last digest was sent less than a Period ago.
+	Sent bool `json:"sent"`
+	// Emailed counts the recipients emailed, and Failed those that couldn't
+	// be.
+	Emailed int `json:"emailed"`
+	Failed  int `json:"failed"`
+}
+
+// SendDigest sends a digest of everything since the last digest ended, or of
+// the last Period for the first, unless one was sent less than a Period ago.
+func (s *Service) SendDigest(ctx context.Context, req SendDigestRequest) (*SendDigestResponse, error) {
+	if s.digest.Mailer == nil && !s.digest.Webhook {
+		return nil, Errorf(http.StatusNotFound, "digests are disabled")
+	}
+
+	lastEnd, err := getLastDigestEnd(ctx, s.db)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting last digest: %w", err)
+	}
+	if time.Since(lastEnd) < s.digest.Period {
+		return &SendDigestResponse{}, nil
+	}
+
+	// Each digest picks up where the last one ended, so nothing is missed
+	// when one is late.
+	digestResp, err := s.GetDigest(ctx, GetDigestRequest{Since: lastEnd})
+	if err != nil {
+		return nil, err
+	}
+	digest := digestResp.Digest
+
+	// The digest is claimed first, so a failure to deliver it isn't retried
+	// for every recipient, and another instance can't send it too. Its
+	// webhooks are queued with the claim, so they're never lost.
+	claimed := false
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		claimed, err = claimDigest(ctx, tx, digest.Start, digest.End, digest.End.Add(-s.digest.Period), time.Now())
+		if err != nil || !claimed || !s.digest.Webhook {
+			return err
+		}
+
+		return s.enqueueWebhooks(ctx, tx, WebhookEventDigestCreated, digest.Summary(), digest)
+	})
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "recording digest: %w", err)
+	}
+	if !claimed {
+		return &SendDigestResponse{}, nil
+	}
+
+	resp := &SendDigestResponse{Sent: true}
+
+	if s.digest.Mailer != nil {
+		for _, to := range s.digest.Recipients {
+			email, err := s.digestEmail(digest, to)
+			if err != nil {
+				return nil, Errorf(http.StatusInternalServerError, "rendering digest: %w", err)
+			}
+
+			if err := s.digest.Mailer.Send(ctx, email); err != nil {
+				log.Printf("sending digest: %s", err)
+				resp.Failed++
+				continue
+			}
+			resp.Emailed++
+		}
+	}
+
+	return resp, nil
+}
+
+// RunDigests checks whether a digest is due every interval until ctx is done.
+func (s *Service) RunDigests(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := s.SendDigest(ctx, SendDigestRequest{}); err != nil {
+			log.Printf("sending digest: %s", err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package gomments_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/arizard/gomments/internal"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_GetDigest(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t, gomments.WithDigestConfig(gomments.DigestConfig{
+		Period:      24 * time.Hour,
+		TopArticles: 1,
+		Templates:   gomments.DefaultDigestTemplates(),
+	}))
+	s := f.service
+
+	// The example reply added by the migrations isn't part of the test.
+	_, err := f.db.Exec("update reply set created_at = ? where article = 'how-to-foo'", time.Now().Add(-48*time.Hour).UTC())
+	f.NoError(err)
+
+	_, err = s.CreateBan(ctx, gomments.CreateBanRequest{
+		Kind:  gomments.BanKindIPHash,
+		Value: "203.0.113.7",
+		Mode:  gomments.BanModeShadow,
+	})
+	f.NoError(err)
+
+	for _, req := range []gomments.SubmitReplyRequest{
+		{Article: "busy-article", AuthorName: "alice", Body: "hello"},
+		{Article: "busy-article", AuthorName: "bob", Body: "hi"},
+		{Article: "quiet-article", AuthorName: "carol", Body: "hey"},
+		{Article: "quiet-article", AuthorName: "spammer", Body: "buy now", ClientIP: "203.0.113.7"},
+	} {
+		req.IdempotencyKey = uuid.NewString()
+		resp, err := s.SubmitReply(ctx, req)
+		f.NoError(err)
+
+		if req.AuthorName == "carol" {
+			_, err = s.FlagReply(ctx, gomments.FlagReplyRequest{ReplyID: resp.Reply.ID, Reason: "rude"})
+			f.NoError(err)
+		}
+	}
+
+	_, err = insertReply(ctx, f.db, insertReplyParams{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "old-article",
+		Body:           "old news",
+		CreatedAt:      time.Now().Add(-48 * time.Hour),
+	})
+	f.NoError(err)
+
+	// Pending replies are listed until they're dealt with, however old.
+	oldSpamID, err := insertReply(ctx, f.db, insertReplyParams{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "old-article",
+		Body:           "old spam",
+		CreatedAt:      time.Now().Add(-48 * time.Hour),
+	})
+	f.NoError(err)
+	_, err = f.db.Exec("update reply set shadowbanned = true where id = ?", oldSpamID)
+	f.NoError(err)
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		_, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "quiet-article", Kind: "like", ClientIP: ip})
+		f.NoError(err)
+	}
+	_, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "busy-article", Kind: "like", ClientIP: "192.0.2.1"})
+	f.NoError(err)
+
+	resp, err := s.GetDigest(ctx, gomments.GetDigestRequest{})
+	f.NoError(err)
+	digest := resp.Digest
+
+	f.Len(digest.Articles, 2)
+	f.Equal("busy-article", digest.Articles[0].Article)
+	f.Equal(2, digest.Articles[0].Replies.Count)
+	f.Equal("quiet-article", digest.Articles[1].Article)
+	f.Equal(1, digest.Articles[1].Replies.Count)
+	f.Equal(2, digest.Articles[1].Reactions["like"])
+
+	f.Len(digest.TopReacted, 1)
+	f.Equal("quiet-article", digest.TopReacted[0].Article)
+	f.Equal(2, digest.TopReacted[0].ReactionCount)
+
+	f.Len(digest.Pending, 2)
+	f.Equal("old spam", digest.Pending[0].Body)
+	f.Equal("buy now", digest.Pending[1].Body)
+	f.Len(digest.Flags, 1)
+	f.Equal("rude", digest.Flags[0].Reason)
+	f.Equal("Comments digest: 3 new, 2 pending, 1 flagged", digest.Summary())
+
+	resp, err = s.GetDigest(ctx, gomments.GetDigestRequest{Since: time.Now().Add(-72 * time.Hour)})
+	f.NoError(err)
+	f.Len(resp.Digest.Articles, 4)
+}
+
+func TestService_SendDigest(t *testing.T) {
+	ctx := context.Background()
+
+	server, err := internal.NewFakeSMTPServer("127.0.0.1:0", nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	cfg := gomments.DefaultDigestConfig()
+	cfg.Mailer = internal.NewSMTPMailer(internal.SMTPConfig{Addr: server.Addr()})
+	cfg.From = "Comments <comments@example.com>"
+	cfg.Recipients = []string{"mod@example.com"}
+	cfg.Webhook = true
+	f := newFixture(t, gomments.WithDigestConfig(cfg), gomments.WithWebhookConfig(gomments.WebhookConfig{
+		Timeout:     time.Second,
+		MaxAttempts: 1,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+		BatchSize:   10,
+	}))
+	s := f.service
+
+	_, err = f.db.Exec("update reply set created_at = ? where article = 'how-to-foo'", time.Now().Add(-48*time.Hour).UTC())
+	f.NoError(err)
+
+	rcv := newWebhookReceiver(t)
+	_, err = s.CreateWebhook(ctx, gomments.CreateWebhookRequest{
+		URL:    rcv.URL,
+		Events: []gomments.WebhookEvent{gomments.WebhookEventDigestCreated},
+	})
+	f.NoError(err)
+
+	_, err = s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+		Article:        "test-article",
+		AuthorName:     "alice",
+		Body:           "hello",
+		IdempotencyKey: uuid.NewString(),
+	})
+	f.NoError(err)
+
+	resp, err := s.SendDigest(ctx, gomments.SendDigestRequest{})
+	f.NoError(err)
+	f.Equal(&gomments.SendDigestResponse{Sent: true, Emailed: 1}, resp)
+
+	t.Run("emails the digest", func(tt *testing.T) {
+		r := require.New(tt)
+
+		emails := emailsTo(r, server, "mod@example.com")
+		r.Len(emails, 1)
+		r.Equal("Comments digest: 1 new, 0 pending, 0 flagged", emails[0].Subject)
+		r.Contains(emails[0].Text, "test-article: 1")
+		r.Contains(emails[0].HTML, "<li>test-article: 1</li>")
+	})
+
+	t.Run("sends the digest to webhooks", func(tt *testing.T) {
+		r := require.New(tt)
+
+		delivered, err := s.DeliverWebhooks(ctx, gomments.DeliverWebhooksRequest{})
+		r.NoError(err)
+		r.Equal(1, delivered.Delivered)
+
+		requests := rcv.received()
+		r.Len(requests, 1)
+		r.Equal("digest.created", requests[0].Header.Get("X-Gomments-Event"))
+
+		payload := struct {
+			Data gomments.Digest `json:"data"`
+		}{}
+		r.NoError(json.Unmarshal(requests[0].Body, &payload))
+		r.Len(payload.Data.Articles, 1)
+		r.Equal(1, payload.Data.Articles[0].Replies.Count)
+	})
+
+	t.Run("waits a period before sending another", func(tt *testing.T) {
+		r := require.New(tt)
+
+		resp, err := s.SendDigest(ctx, gomments.SendDigestRequest{})
+		r.NoError(err)
+		r.False(resp.Sent)
+		r.Len(server.Messages(), 1)
+	})
+
+	t.Run("picks up where the last digest ended", func(tt *testing.T) {
+		r := require.New(tt)
+
+		// The last digest was due a day ago, but was missed.
+		lastEnd := time.Now().Add(-2 * cfg.Period).UTC()
+		_, err := f.db.Exec("update digest set period_start = ?, period_end = ?", lastEnd.Add(-cfg.Period), lastEnd)
+		r.NoError(err)
+
+		resp, err := s.SendDigest(ctx, gomments.SendDigestRequest{})
+		r.NoError(err)
+		r.True(resp.Sent)
+
+		starts := []time.Time{}
+		r.NoError(f.db.Select(&starts, "select period_start from digest order by id"))
+		r.Len(starts, 2)
+		r.WithinDuration(lastEnd, starts[1], time.Second)
+	})
+}
+
+func TestService_SendDigest_disabled(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+
+	_, err := f.service.SendDigest(ctx, gomments.SendDigestRequest{})
+	var gsErr gomments.ServiceError
+	f.ErrorAs(err, &gsErr)
+	f.Equal(http.StatusNotFound, gsErr.Status())
+}
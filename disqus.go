@@ -0,0 +1,104 @@
+package gomments
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+type disqusThread struct {
+	ID   string `xml:"http://disqus.com/disqus-internals id,attr"`
+	Link string `xml:"link"`
+}
+
+type disqusPost struct {
+	ID        string    `xml:"http://disqus.com/disqus-internals id,attr"`
+	Message   string    `xml:"message"`
+	CreatedAt time.Time `xml:"createdAt"`
+	IsDeleted bool      `xml:"isDeleted"`
+	IsSpam    bool      `xml:"isSpam"`
+	Author    struct {
+		Name     string `xml:"name"`
+		Username string `xml:"username"`
+	} `xml:"author"`
+	Thread struct {
+		ID string `xml:"http://disqus.com/disqus-internals id,attr"`
+	} `xml:"thread"`
+}
+
+// ParseDisqus reads the replies in a Disqus XML export, mapping their threads
+// to articles with rule. Replies in threads that don't map to an article are
+// left out, and reported in the mappings with an empty Article.
+//
+// Gomments replies aren't threaded, so replies to other replies are imported
+// as replies to the article.
+func ParseDisqus(r io.Reader, rule ArticleRule) ([]ImportReply, []ImportMapping, error) {
+	threads := map[string]string{}
+	posts := []disqusPost{}
+
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading disqus export: %w", err)
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "thread":
+			var thread disqusThread
+			if err := dec.DecodeElement(&thread, &start); err != nil {
+				return nil, nil, fmt.Errorf("reading disqus thread: %w", err)
+			}
+			threads[thread.ID] = thread.Link
+		case "post":
+			var post disqusPost
+			if err := dec.DecodeElement(&post, &start); err != nil {
+				return nil, nil, fmt.Errorf("reading disqus post: %w", err)
+			}
+			posts = append(posts, post)
+		}
+	}
+
+	mappings := newImportMappings(rule)
+	replies := []ImportReply{}
+
+	for _, post := range posts {
+		link, ok := threads[post.Thread.ID]
+		if !ok {
+			return nil, nil, fmt.Errorf("post %s is in unknown thread %s", post.ID, post.Thread.ID)
+		}
+
+		article := mappings.add(link)
+		if article == "" {
+			continue
+		}
+
+		authorName := post.Author.Name
+		if authorName == "" {
+			authorName = post.Author.Username
+		}
+
+		replies = append(replies, ImportReply{
+			Source:     "disqus",
+			SourceID:   post.ID,
+			Article:    article,
+			AuthorName: authorName,
+			Body:       htmlToText(post.Message),
+			CreatedAt:  post.CreatedAt,
+			Deleted:    post.IsDeleted,
+			Spam:       post.IsSpam,
+		})
+	}
+
+	return replies, mappings.mappings, nil
+}
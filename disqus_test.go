@@ -0,0 +1,152 @@
+package gomments_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/stretchr/testify/require"
+)
+
+const disqusExport = `<?xml version="1.0" encoding="utf-8"?>
+<disqus xmlns="http://disqus.com" xmlns:dsq="http://disqus.com/disqus-internals">
+  <category dsq:id="1">
+    <forum>example</forum>
+    <title>General</title>
+  </category>
+  <thread dsq:id="100">
+    <id>hello</id>
+    <link>https://example.com/posts/hello-world/</link>
+    <title>Hello world</title>
+    <createdAt>2013-05-01T09:00:00Z</createdAt>
+    <author><name>Owner</name></author>
+  </thread>
+  <thread dsq:id="101">
+    <link>http://example.com/posts/hello-world?utm_source=feed</link>
+  </thread>
+  <thread dsq:id="102">
+    <link>https://elsewhere.example.org/about</link>
+  </thread>
+  <post dsq:id="1000">
+    <message><![CDATA[<p>First!</p><p>Great post &amp; thanks.</p>]]></message>
+    <createdAt>2013-05-02T10:30:00Z</createdAt>
+    <isDeleted>false</isDeleted>
+    <isSpam>false</isSpam>
+    <author><name>Alice</name><username>alice</username></author>
+    <thread dsq:id="100"/>
+  </post>
+  <post dsq:id="1001">
+    <message><![CDATA[I agree<br/>with Alice]]></message>
+    <createdAt>2013-05-03T11:00:00Z</createdAt>
+    <isDeleted>true</isDeleted>
+    <isSpam>false</isSpam>
+    <author><username>bob</username></author>
+    <thread dsq:id="101"/>
+    <parent dsq:id="1000"/>
+  </post>
+  <post dsq:id="1002">
+    <message><![CDATA[<a href="http://spam.example">cheap pills</a>]]></message>
+    <createdAt>2013-05-04T12:00:00Z</createdAt>
+    <isDeleted>false</isDeleted>
+    <isSpam>true</isSpam>
+    <author><name>Spammer</name></author>
+    <thread dsq:id="100"/>
+  </post>
+  <post dsq:id="1003">
+    <message><![CDATA[Lost comment]]></message>
+    <createdAt>2013-05-05T12:00:00Z</createdAt>
+    <author><name>Carol</name></author>
+    <thread dsq:id="102"/>
+  </post>
+</disqus>
+`
+
+func TestParseDisqus(t *testing.T) {
+	r := require.New(t)
+
+	rule, err := gomments.ParseArticleRule("https://example.com/posts/{article}")
+	r.NoError(err)
+
+	replies, mappings, err := gomments.ParseDisqus(strings.NewReader(disqusExport), rule)
+	r.NoError(err)
+
+	r.Equal([]gomments.ImportMapping{
+		{Thread: "https://example.com/posts/hello-world/", Article: "hello-world", Replies: 2},
+		{Thread: "http://example.com/posts/hello-world?utm_source=feed", Article: "hello-world", Replies: 1},
+		{Thread: "https://elsewhere.example.org/about", Article: "", Replies: 1},
+	}, mappings)
+
+	r.Len(replies, 3)
+	r.Equal(gomments.ImportReply{
+		Source:     "disqus",
+		SourceID:   "1000",
+		Article:    "hello-world",
+		AuthorName: "Alice",
+		Body:       "First!\n\nGreat post & thanks.",
+		CreatedAt:  time.Date(2013, 5, 2, 10, 30, 0, 0, time.UTC),
+	}, replies[0])
+	r.Equal("bob", replies[1].AuthorName)
+	r.Equal("I agree\nwith Alice", replies[1].Body)
+	r.True(replies[1].Deleted)
+	r.Equal("cheap pills", replies[2].Body)
+	r.True(replies[2].Spam)
+
+	_, err = gomments.ParseArticleRule("https://example.com/posts/")
+	r.Error(err)
+
+	t.Run("maps to the last path segment by default", func(tt *testing.T) {
+		r := require.New(tt)
+
+		_, mappings, err := gomments.ParseDisqus(strings.NewReader(disqusExport), gomments.ArticleRule{})
+		r.NoError(err)
+		r.Equal("hello-world", mappings[0].Article)
+		r.Equal("about", mappings[2].Article)
+	})
+}
+
+func TestService_ImportReplies(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	s := f.service
+
+	replies, _, err := gomments.ParseDisqus(strings.NewReader(disqusExport), gomments.ArticleRule{})
+	f.NoError(err)
+
+	dryRun, err := s.ImportReplies(ctx, gomments.ImportRepliesRequest{Replies: replies, DryRun: true})
+	f.NoError(err)
+	f.Equal(4, dryRun.Imported)
+	f.Equal(gomments.ImportArticleStats{Imported: 3, Deleted: 1, Spam: 1}, dryRun.Articles["hello-world"])
+
+	repliesResp, err := s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "hello-world"})
+	f.NoError(err)
+	f.Empty(repliesResp.Replies)
+
+	imported, err := s.ImportReplies(ctx, gomments.ImportRepliesRequest{Replies: replies})
+	f.NoError(err)
+	f.Equal(dryRun, imported)
+
+	t.Run("keeps timestamps and hides deleted and spam replies", func(tt *testing.T) {
+		r := require.New(tt)
+
+		repliesResp, err := s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "hello-world"})
+		r.NoError(err)
+		r.Len(repliesResp.Replies, 1)
+		r.Equal("Alice", repliesResp.Replies[0].AuthorName)
+		r.True(repliesResp.Replies[0].CreatedAt.Equal(time.Date(2013, 5, 2, 10, 30, 0, 0, time.UTC)))
+	})
+
+	t.Run("doesn't import replies twice", func(tt *testing.T) {
+		r := require.New(tt)
+
+		again, err := s.ImportReplies(ctx, gomments.ImportRepliesRequest{Replies: replies})
+		r.NoError(err)
+		r.Equal(0, again.Imported)
+		r.Equal(4, again.Existing)
+
+		var count int
+		r.NoError(f.db.Get(&count, "select count(*) from reply where article in ('hello-world', 'about')"))
+		r.Equal(4, count)
+	})
+}
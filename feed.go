@@ -0,0 +1,403 @@
+package gomments
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FeedConfig configures reply feeds. ArticleURL is the URL of an article's
+// page, with {article} in place of the article, which replies link to. When
+// it isn't set, replies link to the feed itself.
+type FeedConfig struct {
+	Title      string
+	ArticleURL string
+	// PublicURL is the origin the API is served at. Feeds are only served when
+	// it's set, so their IDs never come from a request's Host header.
+	PublicURL string
+	// Limit is how many of the newest replies a feed has.
+	Limit int
+}
+
+func DefaultFeedConfig() FeedConfig {
+	return FeedConfig{
+		Title: "Comments",
+		Limit: 50,
+	}
+}
+
+// WithFeedConfig sets how reply feeds are titled and linked.
+func WithFeedConfig(cfg FeedConfig) Option {
+	return func(s *Service) {
+		s.feed = cfg
+	}
+}
+
+type FeedFormat string
+
+const (
+	FeedFormatAtom FeedFormat = "atom"
+	FeedFormatRSS  FeedFormat = "rss"
+	FeedFormatJSON FeedFormat = "json"
+)
+
+var FeedFormats = []FeedFormat{FeedFormatAtom, FeedFormatRSS, FeedFormatJSON}
+
+// feed is a feed of replies, independent of the format it's rendered in.
+type feed struct {
+	ID      string
+	Title   string
+	Link    string
+	SelfURL string
+	Updated time.Time
+	Items   []feedItem
+}
+
+type feedItem struct {
+	ID         string
+	Title      string
+	Link       string
+	Body       string
+	AuthorName string
+	// Signature is the author's tripcode, if they signed the reply.
+	Signature string
+	Published time.Time
+}
+
+// feedAuthority returns the host that feed and reply IDs are minted under,
+// from the configured URLs only, or "" if neither has a host.
+func (s *Service) feedAuthority() string {
+	for _, v := range []string{s.feed.ArticleURL, s.feed.PublicURL} {
+		if u, err := url.Parse(v); err == nil && u.Hostname() != "" {
+			return u.Hostname()
+		}
+	}
+
+	return ""
+}
+
+// articleURL returns the link to an article, or "" if there isn't one.
+func (s *Service) articleURL(article string) string {
+	if s.feed.ArticleURL == "" {
+		return ""
+	}
+
+	return strings.ReplaceAll(s.feed.ArticleURL, "{article}", url.PathEscape(article))
+}
+
+// replyURL returns the permalink of a reply.
+func (s *Service) replyURL(reply Reply, selfURL string) string {
+	link := s.articleURL(reply.Article)
+	if link == "" {
+		link = selfURL
+	}
+
+	return fmt.Sprintf("%s#reply-%d", link, reply.ID)
+}
+
+// newFeed builds a feed from replies, newest first. Reply IDs never change,
+// so each item's ID is stable.
+func (s *Service) newFeed(id string, title string, link string, selfURL string, replies Replies) feed {
+	authority := s.feedAuthority()
+	f := feed{
+		ID:      fmt.Sprintf("tag:%s,2025:%s", authority, id),
+		Title:   title,
+		Link:    link,
+		SelfURL: selfURL,
+		Updated: time.Unix(0, 0).UTC(),
+	}
+	if f.Link == "" {
+		f.Link = selfURL
+	}
+
+	for _, reply := range replies {
+		f.Items = append(f.Items, feedItem{
+			ID:         fmt.Sprintf("tag:%s,2025:reply-%d", authority, reply.ID),
+			Title:      fmt.Sprintf("%s on %s", reply.AuthorName, reply.Article),
+			Link:       s.replyURL(reply, selfURL),
+			Body:       reply.Body,
+			AuthorName: reply.AuthorName,
+			Signature:  reply.Signature,
+			Published:  reply.CreatedAt.UTC(),
+		})
+		if reply.CreatedAt.After(f.Updated) {
+			f.Updated = reply.CreatedAt.UTC()
+		}
+	}
+
+	return f
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Author    atomAuthor `xml:"author"`
+	Link      atomLink   `xml:"link"`
+	Content   atomText   `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func (f feed) atom() ([]byte, error) {
+	out := atomFeed{
+		ID:      f.ID,
+		Title:   f.Title,
+		Updated: f.Updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "alternate", Href: f.Link},
+			{Rel: "self", Href: f.SelfURL},
+		},
+	}
+
+	for _, item := range f.Items {
+		published := item.Published.Format(time.RFC3339)
+		out.Entries = append(out.Entries, atomEntry{
+			ID:        item.ID,
+			Title:     item.Title,
+			Updated:   published,
+			Published: published,
+			Author:    atomAuthor{Name: item.AuthorName},
+			Link:      atomLink{Rel: "alternate", Href: item.Link},
+			Content:   atomText{Type: "text", Body: item.Body},
+		})
+	}
+
+	return marshalXML(out)
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Creator     string  `xml:"dc:creator"`
+	Description string  `xml:"description"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	SelfLink      atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	DCNS    string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+func (f feed) rss() ([]byte, error) {
+	out := rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		DCNS:    "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          f.Link,
+			Description:   f.Title,
+			LastBuildDate: f.Updated.Format(time.RFC1123Z),
+			SelfLink:      atomLink{Rel: "self", Href: f.SelfURL},
+		},
+	}
+
+	for _, item := range f.Items {
+		out.Channel.Items = append(out.Channel.Items, rssItem{
+			Title:       item.Title,
+			Link:        item.Link,
+			GUID:        rssGUID{Value: item.ID},
+			PubDate:     item.Published.Format(time.RFC1123Z),
+			Creator:     item.AuthorName,
+			Description: item.Body,
+		})
+	}
+
+	return marshalXML(out)
+}
+
+type jsonFeedAuthorExtension struct {
+	Signature string `json:"signature"`
+}
+
+type jsonFeedAuthor struct {
+	Name      string                   `json:"name"`
+	Extension *jsonFeedAuthorExtension `json:"_gomments,omitempty"`
+}
+
+type jsonFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url"`
+	Title         string           `json:"title"`
+	ContentText   string           `json:"content_text"`
+	DatePublished string           `json:"date_published"`
+	DateModified  string           `json:"date_modified"`
+	Authors       []jsonFeedAuthor `json:"authors"`
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+func (f feed) json() ([]byte, error) {
+	out := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.Link,
+		FeedURL:     f.SelfURL,
+		Items:       []jsonFeedItem{},
+	}
+
+	for _, item := range f.Items {
+		author := jsonFeedAuthor{Name: item.AuthorName}
+		if item.Signature != "" {
+			author.Extension = &jsonFeedAuthorExtension{Signature: item.Signature}
+		}
+
+		published := item.Published.Format(time.RFC3339)
+		out.Items = append(out.Items, jsonFeedItem{
+			ID:            item.ID,
+			URL:           item.Link,
+			Title:         item.Title,
+			ContentText:   item.Body,
+			DatePublished: published,
+			DateModified:  published,
+			Authors:       []jsonFeedAuthor{author},
+		})
+	}
+
+	return json.MarshalIndent(out, "", "  ")
+}
+
+func marshalXML(v any) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), b...), nil
+}
+
+// render renders the feed in a format, returning its content type.
+func (f feed) render(format FeedFormat) ([]byte, string, error) {
+	switch format {
+	case FeedFormatAtom:
+		b, err := f.atom()
+		return b, "application/atom+xml; charset=utf-8", err
+	case FeedFormatRSS:
+		b, err := f.rss()
+		return b, "application/rss+xml; charset=utf-8", err
+	case FeedFormatJSON:
+		b, err := f.json()
+		return b, "application/feed+json; charset=utf-8", err
+	default:
+		return nil, "", fmt.Errorf("unknown feed format: %q", format)
+	}
+}
+
+type GetFeedRequest struct {
+	// Article is the article to get replies for, or "" for recent replies
+	// across all articles.
+	Article string
+	Format  FeedFormat
+	// SelfURL is the URL the feed is served at.
+	SelfURL string
+}
+
+type GetFeedResponse struct {
+	ContentType string
+	Data        []byte
+	// Updated is when the newest reply in the feed was written.
+	Updated time.Time
+	ETag    string
+}
+
+// GetFeed renders a feed of the newest replies on an article, or on every
+// article.
+func (s *Service) GetFeed(ctx context.Context, req GetFeedRequest) (*GetFeedResponse, error) {
+	if s.feed.PublicURL == "" || s.feedAuthority() == "" {
+		return nil, Errorf(http.StatusNotFound, "feeds are not enabled")
+	}
+
+	if !slices.Contains(FeedFormats, req.Format) {
+		return nil, Errorf(http.StatusBadRequest, "not a valid feed format: %q", req.Format)
+	}
+
+	var f feed
+	if req.Article != "" {
+		replies, err := getRepliesForArticle(ctx, s.db, req.Article, "")
+		if err != nil {
+			return nil, Errorf(http.StatusInternalServerError, "getting replies: %w", err)
+		}
+		if len(replies) > s.feed.Limit {
+			replies = replies[:s.feed.Limit]
+		}
+
+		title := fmt.Sprintf("%s on %s", s.feed.Title, req.Article)
+		f = s.newFeed("article:"+url.PathEscape(req.Article), title, s.articleURL(req.Article), req.SelfURL, replies)
+	} else {
+		replies, err := getRecentReplies(ctx, s.db, s.feed.Limit)
+		if err != nil {
+			return nil, Errorf(http.StatusInternalServerError, "getting recent replies: %w", err)
+		}
+
+		f = s.newFeed("replies", "Recent "+strings.ToLower(s.feed.Title), "", req.SelfURL, replies)
+	}
+
+	data, contentType, err := f.render(req.Format)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "rendering feed: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+
+	return &GetFeedResponse{
+		ContentType: contentType,
+		Data:        data,
+		Updated:     f.Updated,
+		ETag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+	}, nil
+}
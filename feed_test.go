@@ -0,0 +1,206 @@
+package gomments_test
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"testing"
+
+	"github.com/arizard/gomments"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_GetFeed(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t, gomments.WithFeedConfig(gomments.FeedConfig{
+		Title:      "Comments",
+		ArticleURL: "https://example.com/posts/{article}",
+		PublicURL:  "https://comments.example.com",
+		Limit:      10,
+	}))
+	s := f.service
+
+	_, err := s.CreateBan(ctx, gomments.CreateBanRequest{
+		Kind:  gomments.BanKindIPHash,
+		Value: "203.0.113.7",
+		Mode:  gomments.BanModeShadow,
+	})
+	f.NoError(err)
+
+	ids := []int{}
+	for _, req := range []gomments.SubmitReplyRequest{
+		{Article: "test-article", AuthorName: "alice", Body: "first"},
+		{Article: "test-article", AuthorName: "bob", Body: "second <b>bold</b>", SignatureSecret: "bob's secret"},
+		{Article: "other-article", AuthorName: "carol", Body: "elsewhere"},
+		{Article: "test-article", AuthorName: "spammer", Body: "spam", ClientIP: "203.0.113.7"},
+	} {
+		req.IdempotencyKey = uuid.NewString()
+		resp, err := s.SubmitReply(ctx, req)
+		f.NoError(err)
+		ids = append(ids, resp.Reply.ID)
+	}
+
+	t.Run("renders article atom feeds", func(tt *testing.T) {
+		r := require.New(tt)
+		resp, err := s.GetFeed(ctx, gomments.GetFeedRequest{
+			Article: "test-article",
+			Format:  gomments.FeedFormatAtom,
+			SelfURL: "https://comments.example.com/articles/test-article/replies.atom",
+		})
+		r.NoError(err)
+		r.Equal("application/atom+xml; charset=utf-8", resp.ContentType)
+		r.NotEmpty(resp.ETag)
+
+		feed := struct {
+			ID      string `xml:"id"`
+			Title   string `xml:"title"`
+			Updated string `xml:"updated"`
+			Entries []struct {
+				ID      string `xml:"id"`
+				Updated string `xml:"updated"`
+				Author  string `xml:"author>name"`
+				Link    struct {
+					Href string `xml:"href,attr"`
+				} `xml:"link"`
+				Content string `xml:"content"`
+			} `xml:"entry"`
+		}{}
+		r.NoError(xml.Unmarshal(resp.Data, &feed))
+
+		r.Equal("tag:example.com,2025:article:test-article", feed.ID)
+		r.Equal("Comments on test-article", feed.Title)
+		r.Len(feed.Entries, 2)
+		r.Equal(fmt.Sprintf("tag:example.com,2025:reply-%d", ids[1]), feed.Entries[0].ID)
+		r.Equal(fmt.Sprintf("https://example.com/posts/test-article#reply-%d", ids[1]), feed.Entries[0].Link.Href)
+		r.Equal("bob", feed.Entries[0].Author)
+		r.Equal("second <b>bold</b>", feed.Entries[0].Content)
+		r.Equal(feed.Entries[0].Updated, feed.Updated)
+		r.Equal(resp.Updated.UTC().Format("2006-01-02T15:04:05Z07:00"), feed.Updated)
+		r.Equal(fmt.Sprintf("tag:example.com,2025:reply-%d", ids[0]), feed.Entries[1].ID)
+	})
+
+	t.Run("escapes articles in feed ids", func(tt *testing.T) {
+		r := require.New(tt)
+		resp, err := s.GetFeed(ctx, gomments.GetFeedRequest{
+			Article: "café #1/2",
+			Format:  gomments.FeedFormatAtom,
+			SelfURL: "https://comments.example.com/articles/caf%C3%A9%20%231%2F2/replies.atom",
+		})
+		r.NoError(err)
+
+		feed := struct {
+			ID string `xml:"id"`
+		}{}
+		r.NoError(xml.Unmarshal(resp.Data, &feed))
+		r.Equal("tag:example.com,2025:article:caf%C3%A9%20%231%2F2", feed.ID)
+	})
+
+	t.Run("renders site wide rss feeds", func(tt *testing.T) {
+		r := require.New(tt)
+		resp, err := s.GetFeed(ctx, gomments.GetFeedRequest{
+			Format:  gomments.FeedFormatRSS,
+			SelfURL: "https://comments.example.com/replies.rss",
+		})
+		r.NoError(err)
+		r.Equal("application/rss+xml; charset=utf-8", resp.ContentType)
+
+		feed := struct {
+			Channel struct {
+				Title string `xml:"title"`
+				Items []struct {
+					GUID    string `xml:"guid"`
+					Link    string `xml:"link"`
+					Creator string `xml:"creator"`
+				} `xml:"item"`
+			} `xml:"channel"`
+		}{}
+		r.NoError(xml.Unmarshal(resp.Data, &feed))
+
+		r.Equal("Recent comments", feed.Channel.Title)
+		guids := []string{}
+		for _, item := range feed.Channel.Items {
+			guids = append(guids, item.GUID)
+		}
+		r.Contains(guids, fmt.Sprintf("tag:example.com,2025:reply-%d", ids[2]))
+		r.Contains(guids, fmt.Sprintf("tag:example.com,2025:reply-%d", ids[0]))
+		r.NotContains(guids, fmt.Sprintf("tag:example.com,2025:reply-%d", ids[3]))
+		r.Equal(fmt.Sprintf("https://example.com/posts/other-article#reply-%d", ids[2]), feed.Channel.Items[0].Link)
+		r.Equal("carol", feed.Channel.Items[0].Creator)
+	})
+
+	t.Run("renders json feeds", func(tt *testing.T) {
+		r := require.New(tt)
+		resp, err := s.GetFeed(ctx, gomments.GetFeedRequest{
+			Article: "test-article",
+			Format:  gomments.FeedFormatJSON,
+			SelfURL: "https://comments.example.com/articles/test-article/replies.json",
+		})
+		r.NoError(err)
+		r.Equal("application/feed+json; charset=utf-8", resp.ContentType)
+
+		feed := struct {
+			Version     string `json:"version"`
+			HomePageURL string `json:"home_page_url"`
+			FeedURL     string `json:"feed_url"`
+			Items       []struct {
+				ID      string `json:"id"`
+				URL     string `json:"url"`
+				Content string `json:"content_text"`
+				Authors []struct {
+					Name      string `json:"name"`
+					Extension *struct {
+						Signature string `json:"signature"`
+					} `json:"_gomments"`
+				} `json:"authors"`
+			} `json:"items"`
+		}{}
+		r.NoError(json.Unmarshal(resp.Data, &feed))
+
+		r.Equal("https://jsonfeed.org/version/1.1", feed.Version)
+		r.Equal("https://example.com/posts/test-article", feed.HomePageURL)
+		r.Equal("https://comments.example.com/articles/test-article/replies.json", feed.FeedURL)
+		r.Len(feed.Items, 2)
+		r.Equal(fmt.Sprintf("tag:example.com,2025:reply-%d", ids[1]), feed.Items[0].ID)
+		r.Equal(fmt.Sprintf("https://example.com/posts/test-article#reply-%d", ids[1]), feed.Items[0].URL)
+		r.Equal("bob", feed.Items[0].Authors[0].Name)
+		r.Equal(gomments.ReplySignature("bob's secret"), feed.Items[0].Authors[0].Extension.Signature)
+		r.Equal("alice", feed.Items[1].Authors[0].Name)
+		r.Nil(feed.Items[1].Authors[0].Extension)
+	})
+
+	t.Run("changes etag when replies change", func(tt *testing.T) {
+		r := require.New(tt)
+		req := gomments.GetFeedRequest{Article: "test-article", Format: gomments.FeedFormatAtom, SelfURL: "https://comments.example.com/feed"}
+
+		before, err := s.GetFeed(ctx, req)
+		r.NoError(err)
+		again, err := s.GetFeed(ctx, req)
+		r.NoError(err)
+		r.Equal(before.ETag, again.ETag)
+
+		_, err = s.ModerateReply(ctx, gomments.ModerateReplyRequest{ReplyID: ids[0], Action: gomments.ModerationActionDelete})
+		r.NoError(err)
+
+		after, err := s.GetFeed(ctx, req)
+		r.NoError(err)
+		r.NotEqual(before.ETag, after.ETag)
+	})
+
+	t.Run("rejects unknown formats", func(tt *testing.T) {
+		r := require.New(tt)
+		_, err := s.GetFeed(ctx, gomments.GetFeedRequest{Article: "test-article", Format: "csv"})
+		r.ErrorContains(err, "not a valid feed format")
+	})
+
+	t.Run("requires a public url", func(tt *testing.T) {
+		r := require.New(tt)
+		dst := newFixture(tt, gomments.WithFeedConfig(gomments.FeedConfig{Title: "Comments", Limit: 10}))
+
+		_, err := dst.service.GetFeed(ctx, gomments.GetFeedRequest{Format: gomments.FeedFormatAtom, SelfURL: "https://attacker.example/replies.atom"})
+		var gsErr gomments.ServiceError
+		r.ErrorAs(err, &gsErr)
+		r.Equal(404, gsErr.Status())
+	})
+}
@@ -21,7 +21,7 @@ type fixture struct {
 	service *gomments.Service
 }
 
-func newFixture(t *testing.T) fixture {
+func newFixture(t *testing.T, opts ...gomments.Option) fixture {
 	ctx := context.Background()
 	t.Parallel()
 
@@ -38,7 +38,7 @@ func newFixture(t *testing.T) fixture {
 	return fixture{
 		require.New(t),
 		dbx,
-		gomments.New(ctx, dbx),
+		gomments.New(ctx, dbx, opts...),
 	}
 }
 
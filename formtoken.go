@@ -0,0 +1,93 @@
+package gomments
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FormTokenConfig configures the signed form tokens that replies must carry.
+// A token records when the reply form was loaded, so submissions that come
+// back faster than a human could type, or long after, are rejected.
+type FormTokenConfig struct {
+	MinAge time.Duration
+	MaxAge time.Duration
+}
+
+func DefaultFormTokenConfig() FormTokenConfig {
+	return FormTokenConfig{
+		MinAge: 3 * time.Second,
+		MaxAge: 24 * time.Hour,
+	}
+}
+
+// WithFormToken requires replies to carry a form token issued for the same
+// article.
+func WithFormToken(cfg FormTokenConfig) Option {
+	return func(s *Service) {
+		s.formToken = &cfg
+	}
+}
+
+func formTokenPayload(article string, issuedAt int64) string {
+	return fmt.Sprintf("%s\n%d", article, issuedAt)
+}
+
+func (s *Service) issueFormToken(article string, now time.Time) string {
+	issuedAt := now.Unix()
+	return fmt.Sprintf("%d~%s", issuedAt, s.sign(formTokenPayload(article, issuedAt)))
+}
+
+func (s *Service) verifyFormToken(article string, token string, now time.Time) error {
+	if token == "" {
+		return Errorf(http.StatusBadRequest, "requires form token")
+	}
+
+	issued, sig, ok := strings.Cut(token, "~")
+	if !ok {
+		return Errorf(http.StatusBadRequest, "malformed form token")
+	}
+
+	issuedAt, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil {
+		return Errorf(http.StatusBadRequest, "parsing form token: %w", err)
+	}
+
+	if !s.verifySignature(formTokenPayload(article, issuedAt), sig) {
+		return Errorf(http.StatusBadRequest, "invalid form token signature")
+	}
+
+	age := now.Sub(time.Unix(issuedAt, 0))
+	if age < s.formToken.MinAge {
+		return Errorf(http.StatusBadRequest, "reply submitted too quickly, please try again")
+	}
+	if age > s.formToken.MaxAge {
+		return Errorf(http.StatusBadRequest, "form token expired, please reload the page")
+	}
+
+	return nil
+}
+
+type GetFormTokenRequest struct {
+	Article string
+}
+
+type GetFormTokenResponse struct {
+	FormToken string `json:"form_token"`
+}
+
+func (s *Service) GetFormToken(ctx context.Context, req GetFormTokenRequest) (*GetFormTokenResponse, error) {
+	if s.formToken == nil {
+		return nil, Errorf(http.StatusNotFound, "form tokens are not enabled")
+	}
+
+	article := strings.TrimSpace(req.Article)
+	if article == "" {
+		return nil, Errorf(http.StatusBadRequest, "requires article")
+	}
+
+	return &GetFormTokenResponse{FormToken: s.issueFormToken(article, time.Now())}, nil
+}
@@ -0,0 +1,115 @@
+package gomments_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/google/uuid"
+)
+
+func TestService_SubmitReply_FormToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        gomments.FormTokenConfig
+		article    string
+		tokenFor   string
+		err        string
+		wantStored bool
+	}{
+		{
+			name:       "accepts_valid_token",
+			cfg:        gomments.FormTokenConfig{MinAge: 0, MaxAge: time.Hour},
+			article:    "test-article",
+			tokenFor:   "test-article",
+			wantStored: true,
+		},
+		{
+			name:     "rejects_fast_submissions",
+			cfg:      gomments.FormTokenConfig{MinAge: time.Hour, MaxAge: 2 * time.Hour},
+			article:  "test-article",
+			tokenFor: "test-article",
+			err:      "reply submitted too quickly",
+		},
+		{
+			name:     "rejects_expired_token",
+			cfg:      gomments.FormTokenConfig{MinAge: -2 * time.Hour, MaxAge: -time.Hour},
+			article:  "test-article",
+			tokenFor: "test-article",
+			err:      "form token expired",
+		},
+		{
+			name:     "rejects_token_for_other_article",
+			cfg:      gomments.FormTokenConfig{MinAge: 0, MaxAge: time.Hour},
+			article:  "test-article",
+			tokenFor: "other-article",
+			err:      "invalid form token signature",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(tt *testing.T) {
+			ctx := context.Background()
+			f := newFixture(tt, gomments.WithFormToken(tc.cfg))
+			s := f.service
+
+			repliesResp, err := s.GetReplies(ctx, gomments.GetRepliesRequest{Article: tc.tokenFor})
+			f.NoError(err)
+			f.NotEmpty(repliesResp.FormToken)
+
+			_, err = s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+				IdempotencyKey: uuid.NewString(),
+				Article:        tc.article,
+				Body:           "hello",
+				FormToken:      repliesResp.FormToken,
+			})
+			if tc.err == "" {
+				f.NoError(err)
+			} else {
+				f.ErrorContains(err, tc.err)
+			}
+
+			statsResp, err := s.GetReplyStatsByArticles(ctx, gomments.GetReplyStatsByArticlesRequest{Articles: []string{tc.article}})
+			f.NoError(err)
+			f.Equal(tc.wantStored, statsResp.Stats[tc.article].Count == 1)
+		})
+	}
+}
+
+func TestService_SubmitReply_Honeypot(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	s := f.service
+
+	resp, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "test-article",
+		Body:           "buy now",
+		Website:        "https://example.com",
+	})
+	f.NoError(err)
+	f.Equal("buy now", resp.Reply.Body)
+
+	// The response looks like a real reply's.
+	realResp, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "other-article",
+		Body:           "hello",
+	})
+	f.NoError(err)
+	f.NotZero(resp.Reply.ID)
+	f.Equal(realResp.Reply.Reactions, resp.Reply.Reactions)
+
+	again, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "test-article",
+		Body:           "buy now",
+		Website:        "https://example.com",
+	})
+	f.NoError(err)
+	f.Greater(again.Reply.ID, realResp.Reply.ID)
+
+	repliesResp, err := s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "test-article"})
+	f.NoError(err)
+	f.Empty(repliesResp.Replies)
+}
@@ -0,0 +1,281 @@
+package gomments
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// importNamespace derives the idempotency keys of imported replies.
+var importNamespace = uuid.MustParse("0b7e2f0c-3f0e-4d36-9a57-6c1f2a8e5d41")
+
+// ImportReply is a reply exported from another comment system.
+type ImportReply struct {
+	// Source names the system, and SourceID identifies the reply in it. They
+	// derive the reply's idempotency key, so importing it again does nothing.
+	Source   string
+	SourceID string
+
+	Article    string
+	AuthorName string
+	Body       string
+	CreatedAt  time.Time
+	// LocalTime is set when CreatedAt was read in the site's local time,
+	// because the export had no UTC time for the reply.
+	LocalTime bool
+	Deleted   bool
+	// Spam and Pending replies, which were waiting for approval, are imported
+	// shadowbanned, so they're hidden until approved.
+	Spam    bool
+	Pending bool
+}
+
+func (r ImportReply) IdempotencyKey() string {
+	return uuid.NewSHA1(importNamespace, []byte(r.Source+":"+r.SourceID)).String()
+}
+
+// ImportMapping reports how a thread in an export, identified by its URL or
+// slug, was mapped to an article. Article is "" when it couldn't be, and its
+// replies are skipped.
+type ImportMapping struct {
+	Thread  string `json:"thread"`
+	Article string `json:"article"`
+	Replies int    `json:"replies"`
+}
+
+// Importer reads the replies in an export from another comment system, at
+// path, mapping its threads to articles with rule. Replies in threads that
+// don't map to an article are left out, and reported in the mappings with an
+// empty Article. Replies are imported with ImportReplies.
+type Importer interface {
+	Parse(ctx context.Context, path string, rule ArticleRule) ([]ImportReply, []ImportMapping, error)
+}
+
+// ImporterFunc adapts a function reading an export file to an Importer.
+type ImporterFunc func(r io.Reader, rule ArticleRule) ([]ImportReply, []ImportMapping, error)
+
+func (f ImporterFunc) Parse(ctx context.Context, path string, rule ArticleRule) ([]ImportReply, []ImportMapping, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	return f(file, rule)
+}
+
+// Importers are the systems replies can be imported from, by name.
+var Importers = map[string]Importer{
+	"disqus":    ImporterFunc(ParseDisqus),
+	"wordpress": WordPressImporter{},
+	"isso":      IssoImporter{},
+	"commento":  ImporterFunc(ParseCommento),
+	"remark42":  ImporterFunc(ParseRemark42),
+}
+
+// importMappings collects the mappings of threads to articles, in the order
+// threads are first replied to.
+type importMappings struct {
+	rule     ArticleRule
+	mappings []ImportMapping
+	index    map[string]int
+}
+
+func newImportMappings(rule ArticleRule) *importMappings {
+	return &importMappings{rule: rule, mappings: []ImportMapping{}, index: map[string]int{}}
+}
+
+// add counts a reply in a thread, returning the article the thread maps to
+// or "" if it doesn't.
+func (m *importMappings) add(thread string) string {
+	i, ok := m.index[thread]
+	if !ok {
+		article, _ := m.rule.Article(thread)
+		i = len(m.mappings)
+		m.index[thread] = i
+		m.mappings = append(m.mappings, ImportMapping{Thread: thread, Article: article})
+	}
+	m.mappings[i].Replies++
+
+	return m.mappings[i].Article
+}
+
+// ArticleRule maps the URLs of threads in exports to articles. A rule is a
+// URL template like FeedConfig.ArticleURL, with {article} in place of the
+// article, such as "https://example.com/posts/{article}". URLs are matched
+// ignoring their scheme, query, fragment and trailing slash.
+//
+// The zero ArticleRule maps URLs to their last path segment.
+type ArticleRule struct {
+	re *regexp.Regexp
+}
+
+func ParseArticleRule(template string) (ArticleRule, error) {
+	before, after, ok := strings.Cut(normalizeThreadURL(template), "{article}")
+	if !ok {
+		return ArticleRule{}, fmt.Errorf("article rule has no {article}: %q", template)
+	}
+
+	return ArticleRule{
+		re: regexp.MustCompile("^" + regexp.QuoteMeta(before) + "(.+?)" + regexp.QuoteMeta(after) + "$"),
+	}, nil
+}
+
+// Article returns the article a thread URL maps to, if any.
+func (r ArticleRule) Article(link string) (string, bool) {
+	link = normalizeThreadURL(link)
+
+	if r.re == nil {
+		u, err := url.Parse("//" + link)
+		if err != nil {
+			return "", false
+		}
+		segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+		article := segments[len(segments)-1]
+		return article, article != ""
+	}
+
+	m := r.re.FindStringSubmatch(link)
+	if m == nil {
+		return "", false
+	}
+
+	article, err := url.PathUnescape(m[1])
+	if err != nil {
+		return "", false
+	}
+
+	return article, true
+}
+
+// normalizeThreadURL strips what sites tend to vary in links to the same page.
+func normalizeThreadURL(link string) string {
+	link = strings.TrimSpace(link)
+	if _, rest, ok := strings.Cut(link, "://"); ok {
+		link = rest
+	}
+	link, _, _ = strings.Cut(link, "#")
+	link, _, _ = strings.Cut(link, "?")
+	return strings.TrimSuffix(link, "/")
+}
+
+var (
+	reHTMLBreaks     = regexp.MustCompile(`(?i)<br\s*/?>`)
+	reHTMLParagraphs = regexp.MustCompile(`(?i)</p>\s*<p[^>]*>`)
+	reHTMLTags       = regexp.MustCompile(`<[^>]*>`)
+)
+
+// htmlToText converts the HTML bodies of exported comments to plain text.
+func htmlToText(s string) string {
+	s = reHTMLBreaks.ReplaceAllString(s, "\n")
+	s = reHTMLParagraphs.ReplaceAllString(s, "\n\n")
+	s = reHTMLTags.ReplaceAllString(s, "")
+	return strings.TrimSpace(stripConsecutiveWhitespace(html.UnescapeString(s)))
+}
+
+type ImportRepliesRequest struct {
+	Replies []ImportReply
+	// DryRun reports what would be imported without importing anything.
+	DryRun bool
+}
+
+type ImportArticleStats struct {
+	// Imported counts the replies imported, or that would be in a dry run,
+	// of which Deleted, Spam and Pending were deleted, spam or pending.
+	// Existing counts those already imported.
+	Imported int `json:"imported"`
+	Existing int `json:"existing"`
+	Deleted  int `json:"deleted"`
+	Spam     int `json:"spam"`
+	Pending  int `json:"pending"`
+}
+
+type ImportRepliesResponse struct {
+	Imported int                           `json:"imported"`
+	Existing int                           `json:"existing"`
+	Articles map[string]ImportArticleStats `json:"articles"`
+}
+
+// ImportReplies imports replies from another comment system, in one
+// transaction, skipping any already imported. Imported replies aren't sent to
+// webhooks or notified.
+func (s *Service) ImportReplies(ctx context.Context, req ImportRepliesRequest) (*ImportRepliesResponse, error) {
+	resp := &ImportRepliesResponse{Articles: map[string]ImportArticleStats{}}
+
+	params := []insertReplyParams{}
+	for _, r := range req.Replies {
+		if r.Article == "" || r.SourceID == "" {
+			return nil, Errorf(http.StatusBadRequest, "imported reply requires an article and source id")
+		}
+
+		params = append(params, insertReplyParams{
+			IdempotencyKey: r.IdempotencyKey(),
+			Article:        r.Article,
+			Body:           stripConsecutiveWhitespace(r.Body),
+			Deleted:        r.Deleted,
+			CreatedAt:      r.CreatedAt,
+			AuthorName:     getAuthorNameFallback(strings.TrimSpace(r.AuthorName)),
+			Shadowbanned:   r.Spam || r.Pending,
+		})
+	}
+
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		keys := make([]string, len(params))
+		for i, p := range params {
+			keys[i] = p.IdempotencyKey
+		}
+
+		existing, err := getExistingIdempotencyKeys(ctx, tx, keys)
+		if err != nil {
+			return err
+		}
+
+		for i, p := range params {
+			stats := resp.Articles[p.Article]
+			if existing[p.IdempotencyKey] {
+				stats.Existing++
+				resp.Existing++
+				resp.Articles[p.Article] = stats
+				continue
+			}
+			// Replies can repeat in an export.
+			existing[p.IdempotencyKey] = true
+
+			stats.Imported++
+			resp.Imported++
+			if p.Deleted {
+				stats.Deleted++
+			}
+			if req.Replies[i].Spam {
+				stats.Spam++
+			} else if req.Replies[i].Pending {
+				stats.Pending++
+			}
+			resp.Articles[p.Article] = stats
+
+			if req.DryRun {
+				continue
+			}
+			if _, _, err := insertReply(ctx, tx, p); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "importing replies: %w", err)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand/v2"
+)
+
+// captchaGlyphs is a 5x7 bitmap font for the digits 0-9, so that captchas can
+// be rendered without any font files.
+var captchaGlyphs = [10][7]uint8{
+	{0b01110, 0b10001, 0b10011, 0b10101, 0b11001, 0b10001, 0b01110},
+	{0b00100, 0b01100, 0b00100, 0b00100, 0b00100, 0b00100, 0b01110},
+	{0b01110, 0b10001, 0b00001, 0b00010, 0b00100, 0b01000, 0b11111},
+	{0b11111, 0b00010, 0b00100, 0b00010, 0b00001, 0b10001, 0b01110},
+	{0b00010, 0b00110, 0b01010, 0b10010, 0b11111, 0b00010, 0b00010},
+	{0b11111, 0b10000, 0b11110, 0b00001, 0b00001, 0b10001, 0b01110},
+	{0b00110, 0b01000, 0b10000, 0b11110, 0b10001, 0b10001, 0b01110},
+	{0b11111, 0b00001, 0b00010, 0b00100, 0b01000, 0b01000, 0b01000},
+	{0b01110, 0b10001, 0b10001, 0b01110, 0b10001, 0b10001, 0b01110},
+	{0b01110, 0b10001, 0b10001, 0b01111, 0b00001, 0b00010, 0b01100},
+}
+
+const (
+	captchaScale  = 6
+	captchaHeight = 80
+)
+
+// RenderCaptchaPNG draws the digits as a distorted PNG image.
+func RenderCaptchaPNG(digits string) ([]byte, error) {
+	width := len(digits)*(6*captchaScale) + 40
+	mask := make([][]bool, captchaHeight)
+	for y := range mask {
+		mask[y] = make([]bool, width)
+	}
+
+	for i, r := range digits {
+		if r < '0' || r > '9' {
+			return nil, fmt.Errorf("captcha can only render digits, got %q", r)
+		}
+		glyph := captchaGlyphs[r-'0']
+		originX := 20 + i*(6*captchaScale) + rand.IntN(5) - 2
+		originY := (captchaHeight-7*captchaScale)/2 + rand.IntN(13) - 6
+
+		for gy, row := range glyph {
+			for gx := range 5 {
+				if row&(1<<(4-gx)) == 0 {
+					continue
+				}
+				for dy := range captchaScale {
+					for dx := range captchaScale {
+						x, y := originX+gx*captchaScale+dx, originY+gy*captchaScale+dy
+						if x >= 0 && x < width && y >= 0 && y < captchaHeight {
+							mask[y][x] = true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, captchaHeight))
+	background := color.RGBA{240, 238, 230, 255}
+	ink := color.RGBA{40, 40, 60, 255}
+
+	// Warp the glyphs along two sine waves, so they don't line up with a
+	// grid that a simple OCR could use.
+	amplitudeY, periodY, phaseY := 3+rand.Float64()*3, 60+rand.Float64()*40, rand.Float64()*2*math.Pi
+	amplitudeX, periodX, phaseX := 1+rand.Float64()*2, 40+rand.Float64()*20, rand.Float64()*2*math.Pi
+	for y := range captchaHeight {
+		for x := range width {
+			sx := x + int(amplitudeX*math.Sin(2*math.Pi*float64(y)/periodX+phaseX))
+			sy := y + int(amplitudeY*math.Sin(2*math.Pi*float64(x)/periodY+phaseY))
+			if sx >= 0 && sx < width && sy >= 0 && sy < captchaHeight && mask[sy][sx] {
+				img.SetRGBA(x, y, ink)
+			} else {
+				img.SetRGBA(x, y, background)
+			}
+		}
+	}
+
+	for range width * captchaHeight / 12 {
+		img.SetRGBA(rand.IntN(width), rand.IntN(captchaHeight), color.RGBA{
+			uint8(rand.IntN(160)), uint8(rand.IntN(160)), uint8(rand.IntN(160)), 255,
+		})
+	}
+
+	for range 4 {
+		y0, y1 := float64(rand.IntN(captchaHeight)), float64(rand.IntN(captchaHeight))
+		for x := range width {
+			y := int(y0 + (y1-y0)*float64(x)/float64(width))
+			img.SetRGBA(x, y, ink)
+		}
+	}
+
+	buf := bytes.Buffer{}
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encoding png: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+const captchaSampleRate = 8000
+
+// RenderCaptchaWAV renders the digits as audio. Each digit is played as that
+// many short beeps, and zero as a single long tone, over background noise.
+func RenderCaptchaWAV(digits string) ([]byte, error) {
+	samples := []byte{}
+	tone := func(d float64, freq float64) {
+		n := int(d * captchaSampleRate)
+		for i := range n {
+			// fade the ends to avoid clicks
+			envelope := min(1, float64(i)/200, float64(n-i)/200)
+			v := 0.5 * envelope * math.Sin(2*math.Pi*freq*float64(i)/captchaSampleRate)
+			samples = append(samples, sample(v))
+		}
+	}
+	silence := func(d float64) {
+		for range int(d * captchaSampleRate) {
+			samples = append(samples, sample(0))
+		}
+	}
+
+	silence(0.5)
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return nil, fmt.Errorf("captcha can only render digits, got %q", r)
+		}
+
+		freq := 600 + rand.Float64()*400
+		if r == '0' {
+			tone(0.8, freq)
+		}
+		for range int(r - '0') {
+			tone(0.12, freq)
+			silence(0.12)
+		}
+		silence(0.9)
+	}
+
+	for i := range samples {
+		noise := (rand.Float64() - 0.5) * 0.1
+		samples[i] = sample(float64(int(samples[i])-128)/127 + noise)
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+len(samples)))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))
+	binary.Write(&buf, binary.LittleEndian, uint16(1)) // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(1)) // mono
+	binary.Write(&buf, binary.LittleEndian, uint32(captchaSampleRate))
+	binary.Write(&buf, binary.LittleEndian, uint32(captchaSampleRate)) // byte rate
+	binary.Write(&buf, binary.LittleEndian, uint16(1))                 // block align
+	binary.Write(&buf, binary.LittleEndian, uint16(8))                 // bits per sample
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(samples)))
+	buf.Write(samples)
+
+	return buf.Bytes(), nil
+}
+
+// sample converts a value in [-1, 1] to unsigned 8-bit PCM.
+func sample(v float64) byte {
+	v = max(-1, min(1, v))
+	return byte(128 + v*127)
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The forwarding headers a ClientIPResolver can read the client from.
+const (
+	HeaderXForwardedFor  = "X-Forwarded-For"
+	HeaderForwarded      = "Forwarded"
+	HeaderCFConnectingIP = "CF-Connecting-IP"
+)
+
+// ClientIPConfig configures a ClientIPResolver. Header is the one forwarding
+// header the proxies in front of the app set, and it's only believed when it
+// was added by one of the TrustedProxies. IPv6 clients are grouped by
+// IPv6Prefix bits, since one client usually has a whole /64.
+type ClientIPConfig struct {
+	TrustedProxies []netip.Prefix
+	Header         string
+	IPv6Prefix     int
+}
+
+func DefaultClientIPConfig() ClientIPConfig {
+	return ClientIPConfig{Header: HeaderXForwardedFor, IPv6Prefix: 64}
+}
+
+// ParseClientIPHeader parses the name of a forwarding header a
+// ClientIPResolver can read.
+func ParseClientIPHeader(s string) (string, error) {
+	for _, header := range []string{HeaderXForwardedFor, HeaderForwarded, HeaderCFConnectingIP} {
+		if strings.EqualFold(strings.TrimSpace(s), header) {
+			return header, nil
+		}
+	}
+
+	return "", fmt.Errorf("not a supported header: %q", s)
+}
+
+// ParseTrustedProxies parses a comma separated list of CIDRs or IPs.
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if addr, err := netip.ParseAddr(v); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("not a CIDR or IP: %q", v)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// ClientIPResolver works out which client sent a request. Everything that
+// identifies clients by IP, like rate limits and bans, should go through it
+// so they agree on who a client is.
+type ClientIPResolver struct {
+	cfg ClientIPConfig
+}
+
+func NewClientIPResolver(cfg ClientIPConfig) *ClientIPResolver {
+	return &ClientIPResolver{cfg: cfg}
+}
+
+func (r *ClientIPResolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range r.cfg.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseHost parses an IP with an optional port, as found in RemoteAddr and
+// forwarding headers.
+func parseHost(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
+
+// forwardedHops returns the addresses in the configured header, with the
+// nearest hop last. Only the one header is read, so a client can't add hops
+// through another header the proxies pass along untouched.
+func (r *ClientIPResolver) forwardedHops(h http.Header) []string {
+	hops := []string{}
+
+	switch r.cfg.Header {
+	case HeaderForwarded:
+		for _, v := range h.Values(HeaderForwarded) {
+			for _, element := range strings.Split(v, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(name, "for") {
+						hops = append(hops, value)
+					}
+				}
+			}
+		}
+	case HeaderXForwardedFor:
+		for _, v := range h.Values(HeaderXForwardedFor) {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	case HeaderCFConnectingIP:
+		// Cloudflare sets a single address, replacing any sent by the client.
+		if v := h.Get(HeaderCFConnectingIP); v != "" {
+			hops = append(hops, v)
+		}
+	}
+
+	return hops
+}
+
+// Resolve returns the client's IP. The configured header is walked back from
+// the nearest hop for as long as each hop is a trusted proxy, so a client
+// can't pick its own IP by sending the header itself.
+func (r *ClientIPResolver) Resolve(req *http.Request) netip.Addr {
+	client, ok := parseHost(req.RemoteAddr)
+	if !ok || !r.isTrusted(client) {
+		return client
+	}
+
+	hops := r.forwardedHops(req.Header)
+	for i := len(hops) - 1; i >= 0 && r.isTrusted(client); i-- {
+		hop, ok := parseHost(hops[i])
+		if !ok {
+			break
+		}
+		client = hop
+	}
+
+	return client
+}
+
+// Key returns the identity of the client at addr. IPv4 clients are identified
+// by their IP, and IPv6 clients by the network containing it.
+func (r *ClientIPResolver) Key(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+
+	if addr.Is6() && r.cfg.IPv6Prefix > 0 && r.cfg.IPv6Prefix < 128 {
+		return netip.PrefixFrom(addr, r.cfg.IPv6Prefix).Masked().String()
+	}
+
+	return addr.String()
+}
+
+// KeyString is like Key for an IP in a string. It returns false if s isn't
+// an IP.
+func (r *ClientIPResolver) KeyString(s string) (string, bool) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", false
+	}
+
+	return r.Key(addr.Unmap()), true
+}
+
+const clientIPContextKey = "gomments.client_ip"
+
+// NewClientIPMiddleware resolves the client of each request, for ClientIP.
+func NewClientIPMiddleware(r *ClientIPResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(clientIPContextKey, r.Key(r.Resolve(c.Request)))
+		c.Next()
+	}
+}
+
+var defaultClientIPResolver = NewClientIPResolver(DefaultClientIPConfig())
+
+// ClientIP returns the client identity resolved by NewClientIPMiddleware. If
+// the middleware isn't in use, no proxies are trusted.
+func ClientIP(c *gin.Context) string {
+	if key, ok := c.Get(clientIPContextKey); ok {
+		return key.(string)
+	}
+
+	return defaultClientIPResolver.Key(defaultClientIPResolver.Resolve(c.Request))
+}
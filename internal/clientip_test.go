@@ -0,0 +1,156 @@
+package internal_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/arizard/gomments/internal"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	proxies, err := internal.ParseTrustedProxies("10.0.0.0/8, 2001:db8:ffff::/48,192.0.2.1")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "uses_remote_addr_without_headers",
+			remoteAddr: "198.51.100.7:1234",
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "ignores_headers_from_untrusted_clients",
+			remoteAddr: "198.51.100.7:1234",
+			headers: map[string]string{
+				"X-Forwarded-For":  "203.0.113.1",
+				"Forwarded":        "for=203.0.113.1",
+				"CF-Connecting-IP": "203.0.113.1",
+			},
+			want: "198.51.100.7",
+		},
+		{
+			name:       "uses_x_forwarded_for_from_trusted_proxies",
+			remoteAddr: "10.1.2.3:1234",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.1"},
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "skips_spoofed_hops_before_the_nearest_untrusted_hop",
+			remoteAddr: "10.1.2.3:1234",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.1, 10.9.9.9"},
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "ignores_other_headers",
+			remoteAddr: "10.1.2.3:1234",
+			headers: map[string]string{
+				"Forwarded":        "for=203.0.113.1",
+				"CF-Connecting-IP": "203.0.113.9",
+			},
+			want: "10.1.2.3",
+		},
+		{
+			name:       "reads_forwarded_when_configured",
+			header:     "forwarded",
+			remoteAddr: "192.0.2.1:1234",
+			headers: map[string]string{
+				"Forwarded":       `for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.1`,
+				"X-Forwarded-For": "203.0.113.1",
+			},
+			want: "2001:db8:cafe::/64",
+		},
+		{
+			name:       "reads_cf_connecting_ip_when_configured",
+			header:     "CF-Connecting-IP",
+			remoteAddr: "10.1.2.3:1234",
+			headers: map[string]string{
+				"CF-Connecting-IP": "203.0.113.9",
+				"X-Forwarded-For":  "203.0.113.1",
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:       "ignores_cf_connecting_ip_from_untrusted_clients",
+			header:     "CF-Connecting-IP",
+			remoteAddr: "198.51.100.7:1234",
+			headers:    map[string]string{"CF-Connecting-IP": "203.0.113.9"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "stops_at_unparsable_hops",
+			header:     "Forwarded",
+			remoteAddr: "10.1.2.3:1234",
+			headers:    map[string]string{"Forwarded": "for=203.0.113.1, for=unknown"},
+			want:       "10.1.2.3",
+		},
+		{
+			name:       "groups_ipv6_clients_by_prefix",
+			remoteAddr: "[2001:db8:1:2:3:4:5:6]:1234",
+			want:       "2001:db8:1:2::/64",
+		},
+		{
+			name:       "unmaps_ipv4_in_ipv6",
+			remoteAddr: "[::ffff:198.51.100.7]:1234",
+			want:       "198.51.100.7",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(tt *testing.T) {
+			header := internal.HeaderXForwardedFor
+			if tc.header != "" {
+				header, err = internal.ParseClientIPHeader(tc.header)
+				require.NoError(tt, err)
+			}
+			resolver := internal.NewClientIPResolver(internal.ClientIPConfig{
+				TrustedProxies: proxies,
+				Header:         header,
+				IPv6Prefix:     64,
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			require.Equal(tt, tc.want, resolver.Key(resolver.Resolve(req)))
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	_, err := internal.ParseTrustedProxies("10.0.0.0/8,not-a-proxy")
+	require.ErrorContains(t, err, "not a CIDR or IP")
+}
+
+func TestParseClientIPHeader(t *testing.T) {
+	_, err := internal.ParseClientIPHeader("X-Real-IP")
+	require.ErrorContains(t, err, "not a supported header")
+}
+
+func TestNewClientIPMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	resolver := internal.NewClientIPResolver(internal.DefaultClientIPConfig())
+	router := gin.New()
+	router.Use(internal.NewClientIPMiddleware(resolver))
+	router.GET("/test", func(c *gin.Context) {
+		c.String(http.StatusOK, internal.ClientIP(c))
+	})
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "198.51.100.7:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, "198.51.100.7", w.Body.String())
+}
@@ -20,7 +20,8 @@ func InitSQLiteDatabase(p string) (*sqlx.DB, error) {
 		log.Println("db does not exist, creating new")
 	}
 
-	db, err := sql.Open("sqlite3", p)
+	// Wait for locks instead of failing, since instances can share the db.
+	db, err := sql.Open("sqlite3", p+"?_busy_timeout=5000")
 	if err != nil {
 		return nil, fmt.Errorf("opening db: %w", err)
 	}
@@ -52,3 +53,59 @@ func InitSQLiteDatabase(p string) (*sqlx.DB, error) {
 
 	return sqlx.NewDb(db, "sqlite3"), nil
 }
+
+// OpenSQLiteDatabase opens an existing database without creating or migrating
+// it, for looking at it without changing its schema.
+func OpenSQLiteDatabase(p string) (*sqlx.DB, error) {
+	if _, err := os.Stat(p); err != nil {
+		return nil, err
+	}
+
+	db, err := sqlx.Open("sqlite3", p+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("opening db: %w", err)
+	}
+
+	return db, nil
+}
+
+// OpenSQLiteDatabaseReadOnly opens another application's database, without
+// migrating or changing it.
+func OpenSQLiteDatabaseReadOnly(p string) (*sqlx.DB, error) {
+	if _, err := os.Stat(p); err != nil {
+		return nil, err
+	}
+
+	db, err := sqlx.Open("sqlite3", "file:"+p+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("opening db: %w", err)
+	}
+
+	return db, nil
+}
+
+// InitSQLiteRateLimitDatabase opens the database SQLiteRateLimitStore keeps
+// its windows in, creating its table if needed. It's kept apart from the
+// comments, so counting requests doesn't hold the comments' write lock.
+func InitSQLiteRateLimitDatabase(p string) (*sqlx.DB, error) {
+	db, err := sqlx.Open("sqlite3", p+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("opening db: %w", err)
+	}
+
+	if _, err := db.Exec(`
+		create table if not exists rate_limit (
+			key text not null,
+			window_start integer not null,
+			count integer not null,
+			expires_at integer not null,
+			primary key (key, window_start)
+		);
+
+		create index if not exists rate_limit_expires_at on rate_limit (expires_at);
+	`); err != nil {
+		return nil, fmt.Errorf("creating rate_limit table: %w", err)
+	}
+
+	return db, nil
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+type FakeSMTPMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// FakeSMTPServer accepts every message sent to it and keeps it in memory, for
+// testing email without delivering it. It doesn't support TLS or
+// authentication.
+type FakeSMTPServer struct {
+	ln        net.Listener
+	onMessage func(FakeSMTPMessage)
+
+	mu       sync.Mutex
+	messages []FakeSMTPMessage
+}
+
+// NewFakeSMTPServer listens on addr, calling onMessage, if it's set, with
+// each message received.
+func NewFakeSMTPServer(addr string, onMessage func(FakeSMTPMessage)) (*FakeSMTPServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FakeSMTPServer{ln: ln, onMessage: onMessage}
+	go s.serve()
+
+	return s, nil
+}
+
+func (s *FakeSMTPServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *FakeSMTPServer) Close() error {
+	return s.ln.Close()
+}
+
+// Messages returns the messages received so far.
+func (s *FakeSMTPServer) Messages() []FakeSMTPMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]FakeSMTPMessage{}, s.messages...)
+}
+
+func (s *FakeSMTPServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *FakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := textproto.NewReader(bufio.NewReader(conn))
+	w := textproto.NewWriter(bufio.NewWriter(conn))
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			w.PrintfLine("%s", line)
+		}
+	}
+
+	reply("220 localhost fake ESMTP")
+
+	msg := FakeSMTPMessage{}
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply("250-localhost", "250 8BITMIME")
+		case "HELO", "NOOP":
+			reply("250 OK")
+		case "RSET":
+			msg = FakeSMTPMessage{}
+			reply("250 OK")
+		case "MAIL":
+			msg.From = addressArg(arg)
+			reply("250 OK")
+		case "RCPT":
+			msg.To = append(msg.To, addressArg(arg))
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(r.DotReader())
+			if err != nil {
+				return
+			}
+			msg.Data = data
+
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			if s.onMessage != nil {
+				s.onMessage(msg)
+			}
+
+			msg = FakeSMTPMessage{}
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// addressArg returns the address in a "FROM:<address>" argument.
+func addressArg(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	addr, _, _ = strings.Cut(strings.TrimSpace(addr), " ")
+	return strings.Trim(addr, "<>")
+}
@@ -1,43 +1,155 @@
 package internal
 
 import (
+	"context"
 	"log"
-	"sync"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"go.uber.org/ratelimit"
 )
 
-func NewClientIPRateLimiterMiddleware(rps int) gin.HandlerFunc {
-	limiters := map[string]ratelimit.Limiter{}
-	mu := sync.RWMutex{}
+// RateLimit allows Rate requests every Per, with bursts of up to Burst
+// requests.
+type RateLimit struct {
+	Rate  int
+	Per   time.Duration
+	Burst int
+}
+
+// interval is how long it takes to earn one request.
+func (l RateLimit) interval() time.Duration {
+	return l.Per / time.Duration(l.Rate)
+}
+
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until a request would be allowed.
+	RetryAfter time.Duration
+	// Reset is how long until the full burst is available again.
+	Reset time.Duration
+}
+
+// RateLimitStore keeps track of requests made under rate limits. Keys are
+// opaque, and identify a policy and a client.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+	Stats(ctx context.Context, now time.Time) (RateLimiterStats, error)
+}
+
+type RateLimiterStats struct {
+	// ActiveKeys is how many clients are being tracked.
+	ActiveKeys int `json:"active_keys"`
+	// Evictions counts clients forgotten to stay under the maximum.
+	Evictions int `json:"evictions"`
+	// Expirations counts clients forgotten after being idle.
+	Expirations int `json:"expirations"`
+}
+
+// ceilSeconds rounds d up to whole seconds, for headers that only take
+// seconds.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// RateLimiterConfig configures a RateLimiter. Every policy matching a request
+// applies to it. State is kept in Store, which defaults to memory.
+type RateLimiterConfig struct {
+	Policies []RateLimitPolicy
+	Store    RateLimitStore
+}
+
+// DefaultRateLimiterConfig limits every client to 10 requests per second,
+// with bursts of up to 20.
+func DefaultRateLimiterConfig() RateLimiterConfig {
+	return RateLimiterConfig{
+		Policies: []RateLimitPolicy{
+			{Name: "default", Limit: RateLimit{Rate: 10, Per: time.Second, Burst: 20}},
+		},
+	}
+}
+
+type RateLimiter struct {
+	cfg RateLimiterConfig
+}
+
+func NewRateLimiter(cfg RateLimiterConfig) *RateLimiter {
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryRateLimitStore(DefaultMemoryRateLimitStoreConfig())
+	}
+
+	return &RateLimiter{cfg: cfg}
+}
+
+func (l *RateLimiter) take(ctx context.Context, policy RateLimitPolicy, key string, now time.Time) (RateLimitResult, error) {
+	return l.cfg.Store.Take(ctx, policy.Name+"\x00"+key, policy.Limit, now)
+}
 
+func (l *RateLimiter) Stats(ctx context.Context) (RateLimiterStats, error) {
+	return l.cfg.Store.Stats(ctx, time.Now())
+}
+
+// NewRateLimiterMiddleware applies the limiter's policies to each request.
+// Requests over any limit are rejected with 429 Too Many Requests rather than
+// delayed. Every limited response carries RateLimit-* headers for the policy
+// closest to its limit. If the store fails, requests are let through.
+func NewRateLimiterMiddleware(limiter *RateLimiter) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var ip string
+		now := time.Now()
 
-		if fh := c.GetHeader("X-Forwarded-For"); fh != "" {
-			ip = fh
-		} else {
-			ip = c.ClientIP()
-		}
+		var closest *RateLimitResult
+		var closestPolicy RateLimitPolicy
+		policies := []string{}
 
-		log.Printf("client ip: %s", ip)
+		for _, policy := range limiter.cfg.Policies {
+			if !policy.matches(c) {
+				continue
+			}
 
-		mu.RLock()
-		l, rOK := limiters[ip]
-		mu.RUnlock()
+			key, ok := policy.key(c)
+			if c.IsAborted() {
+				return
+			}
+			if !ok {
+				continue
+			}
+
+			res, err := limiter.take(c.Request.Context(), policy, key, now)
+			if err != nil {
+				log.Printf("rate limiting %q: %s", policy.Name, err)
+				continue
+			}
 
-		if !rOK {
-			mu.Lock()
-			if wL, wOK := limiters[ip]; wOK {
-				l = wL
-			} else {
-				l = ratelimit.New(rps)
-				limiters[ip] = l
+			policies = append(policies, policy.header())
+			if closest == nil || !res.Allowed || res.Remaining < closest.Remaining {
+				closest = &res
+				closestPolicy = policy
 			}
-			mu.Unlock()
+			if !res.Allowed {
+				break
+			}
+		}
+
+		if closest == nil {
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Policy", strings.Join(policies, ", "))
+		c.Header("RateLimit-Limit", strconv.Itoa(closestPolicy.Limit.Burst))
+		c.Header("RateLimit-Remaining", strconv.Itoa(closest.Remaining))
+		c.Header("RateLimit-Reset", ceilSeconds(closest.Reset))
+
+		if !closest.Allowed {
+			c.Header("Retry-After", ceilSeconds(closest.RetryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			return
 		}
 
-		l.Take()
+		c.Next()
 	}
 }
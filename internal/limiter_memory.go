@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds up to Burst tokens, and is refilled at the limit's rate.
+// Each request takes a token, and is rejected if there are none left.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: float64(limit.Burst), last: now}
+}
+
+func (b *tokenBucket) take(limit RateLimit, now time.Time) RateLimitResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	interval := limit.interval()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+float64(elapsed)/float64(interval))
+		b.last = now
+	}
+
+	res := RateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) * float64(interval))
+	}
+
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((float64(limit.Burst) - b.tokens) * float64(interval))
+
+	return res
+}
+
+// MemoryRateLimitStoreConfig bounds the memory used by a
+// MemoryRateLimitStore. Clients are forgotten after IdleTTL without requests,
+// or when more than MaxKeys clients are being tracked, starting with the least
+// recently seen.
+type MemoryRateLimitStoreConfig struct {
+	MaxKeys int
+	IdleTTL time.Duration
+}
+
+func DefaultMemoryRateLimitStoreConfig() MemoryRateLimitStoreConfig {
+	return MemoryRateLimitStoreConfig{
+		MaxKeys: 10000,
+		IdleTTL: 10 * time.Minute,
+	}
+}
+
+// MemoryRateLimitStore keeps a token bucket per key in memory, so limits
+// aren't shared with other instances.
+type MemoryRateLimitStore struct {
+	buckets *lruCache[*tokenBucket]
+}
+
+func NewMemoryRateLimitStore(cfg MemoryRateLimitStoreConfig) *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: newLRUCache[*tokenBucket](cfg.MaxKeys, cfg.IdleTTL),
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	b := s.buckets.getOrCreate(key, now, func() *tokenBucket {
+		return newTokenBucket(limit, now)
+	})
+
+	return b.take(limit, now), nil
+}
+
+func (s *MemoryRateLimitStore) Stats(ctx context.Context, now time.Time) (RateLimiterStats, error) {
+	stats := s.buckets.stats(now)
+
+	return RateLimiterStats{
+		ActiveKeys:  stats.Size,
+		Evictions:   stats.Evictions,
+		Expirations: stats.Expirations,
+	}, nil
+}
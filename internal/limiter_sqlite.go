@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sqliteRateLimitPruneEvery is how many takes there are between deleting
+// expired windows.
+const sqliteRateLimitPruneEvery = 1000
+
+// SQLiteRateLimitStore counts requests in sliding windows in the database, so
+// limits are shared by every instance using it. A limit allows Burst requests
+// in any window of Burst intervals, which averages out to the same rate as a
+// token bucket.
+//
+// Rejected requests aren't written, so only allowed requests take the write
+// lock. Keys are hashed with salt before they're stored, since they contain
+// client IPs.
+type SQLiteRateLimitStore struct {
+	db   *sqlx.DB
+	salt []byte
+
+	takes       atomic.Int64
+	expirations atomic.Int64
+}
+
+func NewSQLiteRateLimitStore(db *sqlx.DB, salt []byte) *SQLiteRateLimitStore {
+	return &SQLiteRateLimitStore{db: db, salt: salt}
+}
+
+func (s *SQLiteRateLimitStore) hashKey(key string) string {
+	mac := hmac.New(sha256.New, s.salt)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// slidingWindowWait returns how long until the weighted count of requests
+// drops to target, given the counts of the previous and current window, and
+// how far into the current window we are.
+func slidingWindowWait(previous float64, current float64, elapsed float64, window float64, target float64) float64 {
+	if current > target {
+		// the current window becomes the previous one, and has to be weighed
+		// down far enough
+		return window - elapsed + window*(1-target/current)
+	}
+
+	if previous == 0 {
+		return 0
+	}
+
+	return max(0, window*(1-(target-current)/previous)-elapsed)
+}
+
+func (s *SQLiteRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	if s.takes.Add(1)%sqliteRateLimitPruneEvery == 0 {
+		if err := s.prune(ctx, now); err != nil {
+			return RateLimitResult{}, err
+		}
+	}
+
+	window := max(1, (time.Duration(limit.Burst) * limit.interval()).Milliseconds())
+	nowMs := now.UnixMilli()
+	start := nowMs - nowMs%window
+	key = s.hashKey(key)
+
+	previous, current, err := s.counts(ctx, key, start-window, start)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	elapsed := float64(nowMs - start)
+	burst := float64(limit.Burst)
+	weighted := float64(previous) * (1 - elapsed/float64(window))
+
+	// Only allowed requests are written. The limit is checked again as the
+	// request is counted, in case another instance counted one in between.
+	res := RateLimitResult{}
+	if weighted+float64(current)+1 <= burst {
+		counted := []int{}
+		if err := s.db.SelectContext(
+			ctx,
+			&counted,
+			`
+				insert into rate_limit (key, window_start, count, expires_at)
+				values ($1, $2, 1, $3)
+				on conflict (key, window_start) do update set count = rate_limit.count + 1
+				where rate_limit.count + 1 <= $4
+				returning count
+			`,
+			key,
+			start,
+			start+2*window,
+			burst-weighted,
+		); err != nil {
+			return RateLimitResult{}, fmt.Errorf("counting request: %w", err)
+		}
+
+		if len(counted) > 0 {
+			res.Allowed = true
+			current = counted[0]
+		}
+	}
+
+	if !res.Allowed {
+		wait := slidingWindowWait(float64(previous), float64(current), elapsed, float64(window), burst-1)
+		res.RetryAfter = time.Duration(wait) * time.Millisecond
+	}
+
+	res.Remaining = max(0, int(burst-weighted-float64(current)))
+	res.Reset = time.Duration(slidingWindowWait(float64(previous), float64(current), elapsed, float64(window), 0)) * time.Millisecond
+
+	return res, nil
+}
+
+// counts returns the number of requests counted in the previous and current
+// windows for key.
+func (s *SQLiteRateLimitStore) counts(ctx context.Context, key string, previousStart int64, currentStart int64) (int, int, error) {
+	rows := []struct {
+		WindowStart int64 `db:"window_start"`
+		Count       int   `db:"count"`
+	}{}
+	if err := s.db.SelectContext(
+		ctx,
+		&rows,
+		`select window_start, count from rate_limit where key = $1 and window_start in ($2, $3)`,
+		key,
+		previousStart,
+		currentStart,
+	); err != nil {
+		return 0, 0, fmt.Errorf("getting windows: %w", err)
+	}
+
+	previous, current := 0, 0
+	for _, row := range rows {
+		if row.WindowStart == currentStart {
+			current = row.Count
+		} else {
+			previous = row.Count
+		}
+	}
+
+	return previous, current, nil
+}
+
+// prune deletes windows that are too old to count towards any limit.
+func (s *SQLiteRateLimitStore) prune(ctx context.Context, now time.Time) error {
+	res, err := s.db.ExecContext(ctx, `delete from rate_limit where expires_at <= $1`, now.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("pruning rate limits: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("getting rows affected: %w", err)
+	}
+	s.expirations.Add(n)
+
+	return nil
+}
+
+func (s *SQLiteRateLimitStore) Stats(ctx context.Context, now time.Time) (RateLimiterStats, error) {
+	stats := RateLimiterStats{Expirations: int(s.expirations.Load())}
+
+	if err := s.db.GetContext(
+		ctx,
+		&stats.ActiveKeys,
+		`select count(distinct key) from rate_limit where expires_at > $1`,
+		now.UnixMilli(),
+	); err != nil {
+		return stats, fmt.Errorf("counting keys: %w", err)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,75 @@
+package internal_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments/internal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteRateLimitStore(t *testing.T) {
+	ctx := context.Background()
+	r := require.New(t)
+
+	// two instances sharing the database
+	p := filepath.Join(t.TempDir(), "ratelimit.db")
+	adb, err := internal.InitSQLiteRateLimitDatabase(p)
+	r.NoError(err)
+	bdb, err := internal.InitSQLiteRateLimitDatabase(p)
+	r.NoError(err)
+	a := internal.NewSQLiteRateLimitStore(adb, []byte("salt"))
+	b := internal.NewSQLiteRateLimitStore(bdb, []byte("salt"))
+
+	limit := internal.RateLimit{Rate: 1, Per: time.Second, Burst: 2}
+	now := time.UnixMilli(1_000_000)
+
+	res, err := a.Take(ctx, "reply\x00192.0.2.1", limit, now)
+	r.NoError(err)
+	r.True(res.Allowed)
+	r.Equal(1, res.Remaining)
+
+	res, err = b.Take(ctx, "reply\x00192.0.2.1", limit, now.Add(100*time.Millisecond))
+	r.NoError(err)
+	r.True(res.Allowed)
+	r.Equal(0, res.Remaining)
+
+	res, err = a.Take(ctx, "reply\x00192.0.2.1", limit, now.Add(200*time.Millisecond))
+	r.NoError(err)
+	r.False(res.Allowed)
+	r.Equal(2800*time.Millisecond, res.RetryAfter)
+
+	// rejected requests aren't counted
+	counts := []int{}
+	r.NoError(adb.SelectContext(ctx, &counts, `select count from rate_limit`))
+	r.Equal([]int{2}, counts)
+
+	// other keys have their own limits
+	res, err = b.Take(ctx, "reply\x00192.0.2.2", limit, now.Add(200*time.Millisecond))
+	r.NoError(err)
+	r.True(res.Allowed)
+
+	// half of the previous window still counts
+	res, err = b.Take(ctx, "reply\x00192.0.2.1", limit, now.Add(3000*time.Millisecond))
+	r.NoError(err)
+	r.True(res.Allowed)
+	r.Equal(0, res.Remaining)
+
+	res, err = a.Take(ctx, "reply\x00192.0.2.1", limit, now.Add(3000*time.Millisecond))
+	r.NoError(err)
+	r.False(res.Allowed)
+
+	stats, err := a.Stats(ctx, now.Add(3000*time.Millisecond))
+	r.NoError(err)
+	r.Equal(2, stats.ActiveKeys)
+
+	// client IPs aren't stored
+	keys := []string{}
+	r.NoError(adb.SelectContext(ctx, &keys, `select key from rate_limit`))
+	r.NotEmpty(keys)
+	for _, key := range keys {
+		r.NotContains(key, "192.0.2")
+	}
+}
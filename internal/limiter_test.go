@@ -1,9 +1,13 @@
 package internal_test
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,145 +17,289 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestNewClientIPRateLimiterMiddleware(t *testing.T) {
-	gin.SetMode(gin.TestMode)
+func newLimitedRouter(limit internal.RateLimit) *gin.Engine {
+	cfg := internal.DefaultRateLimiterConfig()
+	cfg.Policies = []internal.RateLimitPolicy{{Name: "default", Limit: limit}}
 
-	t.Run("allows requests under limit", func(t *testing.T) {
-		middleware := internal.NewClientIPRateLimiterMiddleware(10) // 10 RPS
-		router := gin.New()
-		router.Use(middleware)
-		router.GET("/test", func(c *gin.Context) {
-			c.Status(http.StatusOK)
-		})
+	return newLimiterRouter(internal.NewRateLimiter(cfg))
+}
 
-		// init the rate limiter, because it needs to fill the bucket
-		req := httptest.NewRequest("GET", "/test", nil)
-		req.RemoteAddr = "192.168.1.1:12345"
-		w := httptest.NewRecorder()
-		router.ServeHTTP(w, req)
-		time.Sleep(500 * time.Millisecond)
+func newLimiterRouter(limiter *internal.RateLimiter) *gin.Engine {
+	router := gin.New()
+	router.Use(internal.NewRateLimiterMiddleware(limiter))
+	router.GET("/test", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	return router
+}
+
+func doRequest(router *gin.Engine, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestNewRateLimiterMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Run("allows bursts under limit", func(t *testing.T) {
+		router := newLimitedRouter(internal.RateLimit{Rate: 10, Per: time.Second, Burst: 5})
 
-		// Make 5 requests quickly - should all succeed
 		for i := 0; i < 5; i++ {
-			req := httptest.NewRequest("GET", "/test", nil)
-			req.RemoteAddr = "192.168.1.1:12345"
-			w := httptest.NewRecorder()
+			w := doRequest(router, "192.168.1.1:12345")
+			assert.Equal(t, http.StatusOK, w.Code, "iteration: %d", i)
+			assert.Equal(t, "5", w.Header().Get("RateLimit-Limit"))
+			assert.Equal(t, `10;w=1;burst=5;name="default"`, w.Header().Get("RateLimit-Policy"))
+			assert.Equal(t, strconv.Itoa(4-i), w.Header().Get("RateLimit-Remaining"), "iteration: %d", i)
+		}
+	})
 
-			start := time.Now()
-			router.ServeHTTP(w, req)
-			duration := time.Since(start)
+	t.Run("rejects requests over limit without blocking", func(t *testing.T) {
+		router := newLimitedRouter(internal.RateLimit{Rate: 1, Per: 2 * time.Second, Burst: 2})
 
+		for i := 0; i < 2; i++ {
+			w := doRequest(router, "192.168.1.1:12345")
 			assert.Equal(t, http.StatusOK, w.Code)
-			// Should not be significantly delayed (rate limiter working)
-			assert.Less(t, duration, 50*time.Millisecond, "iteration: %d", i)
 		}
-	})
 
-	t.Run("rate limits per IP address", func(t *testing.T) {
-		middleware := internal.NewClientIPRateLimiterMiddleware(2) // 2 RPS for easier testing
-		router := gin.New()
-		router.Use(middleware)
-		router.GET("/test", func(c *gin.Context) {
-			c.Status(http.StatusOK)
-		})
+		start := time.Now()
+		w := doRequest(router, "192.168.1.1:12345")
+		duration := time.Since(start)
 
-		// init the limiter to fill the leaky bucket
-		req := httptest.NewRequest("GET", "/test", nil)
-		req.RemoteAddr = "192.168.1.1:12345"
-		w := httptest.NewRecorder()
-		router.ServeHTTP(w, req)
-		time.Sleep(1000 * time.Millisecond)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Less(t, duration, 50*time.Millisecond)
+		assert.Equal(t, "2", w.Header().Get("Retry-After"))
+		assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "4", w.Header().Get("RateLimit-Reset"))
+		assert.JSONEq(t, `{"error": "rate limit exceeded"}`, w.Body.String())
+	})
 
-		// First IP - make 3 requests rapidly
-		ip1Delays := make([]time.Duration, 3)
-		for i := 0; i < 3; i++ {
-			req := httptest.NewRequest("GET", "/test", nil)
-			req.RemoteAddr = "192.168.1.1:12345"
-			w := httptest.NewRecorder()
+	t.Run("refills tokens over time", func(t *testing.T) {
+		router := newLimitedRouter(internal.RateLimit{Rate: 20, Per: time.Second, Burst: 1})
 
-			start := time.Now()
-			router.ServeHTTP(w, req)
-			ip1Delays[i] = time.Since(start)
+		assert.Equal(t, http.StatusOK, doRequest(router, "192.168.1.1:12345").Code)
+		assert.Equal(t, http.StatusTooManyRequests, doRequest(router, "192.168.1.1:12345").Code)
 
-			assert.Equal(t, http.StatusOK, w.Code)
-		}
+		time.Sleep(60 * time.Millisecond)
 
-		// First 2 requests should be fast, 3rd should be delayed
-		assert.Less(t, ip1Delays[0], 50*time.Millisecond)
-		assert.Less(t, ip1Delays[1], 50*time.Millisecond)
-		assert.Greater(t, ip1Delays[2], 400*time.Millisecond) // ~500ms delay for 2 RPS
+		assert.Equal(t, http.StatusOK, doRequest(router, "192.168.1.1:12345").Code)
 	})
 
 	t.Run("isolates rate limits between different IPs", func(t *testing.T) {
-		middleware := internal.NewClientIPRateLimiterMiddleware(2) // 2 RPS
-		router := gin.New()
-		router.Use(middleware)
-		router.GET("/test", func(c *gin.Context) {
-			c.Status(http.StatusOK)
-		})
+		router := newLimitedRouter(internal.RateLimit{Rate: 2, Per: time.Second, Burst: 2})
 
 		// Exhaust IP1's rate limit
-		for i := 0; i < 2; i++ {
-			req := httptest.NewRequest("GET", "/test", nil)
-			req.RemoteAddr = "192.168.1.1:12345"
-			w := httptest.NewRecorder()
-			router.ServeHTTP(w, req)
+		for i := 0; i < 3; i++ {
+			doRequest(router, "192.168.1.1:12345")
 		}
+		assert.Equal(t, http.StatusTooManyRequests, doRequest(router, "192.168.1.1:12345").Code)
 
-		// IP2 should still be fast (not affected by IP1's limit)
-		req := httptest.NewRequest("GET", "/test", nil)
-		req.RemoteAddr = "192.168.1.2:12345"
-		w := httptest.NewRecorder()
-
-		start := time.Now()
-		router.ServeHTTP(w, req)
-		duration := time.Since(start)
-
-		assert.Equal(t, http.StatusOK, w.Code)
-		assert.Less(t, duration, 50*time.Millisecond)
+		// IP2 is not affected by IP1's limit
+		assert.Equal(t, http.StatusOK, doRequest(router, "192.168.1.2:12345").Code)
 	})
 
 	t.Run("handles concurrent requests safely", func(t *testing.T) {
-		middleware := internal.NewClientIPRateLimiterMiddleware(100) // High limit to avoid delays
-		router := gin.New()
-		router.Use(middleware)
-		router.GET("/test", func(c *gin.Context) {
-			c.Status(http.StatusOK)
-		})
+		router := newLimitedRouter(internal.RateLimit{Rate: 1, Per: time.Minute, Burst: 100})
 
 		const numGoroutines = 50
 		const requestsPerGoroutine = 10
 
 		var wg sync.WaitGroup
-		successCount := int64(0)
-		var mu sync.Mutex
+		var okCount, limitedCount atomic.Int64
 
-		// Launch many goroutines making concurrent requests
 		for i := 0; i < numGoroutines; i++ {
 			wg.Add(1)
-			go func(goroutineID int) {
+			go func() {
 				defer wg.Done()
 
 				for j := 0; j < requestsPerGoroutine; j++ {
-					req := httptest.NewRequest("GET", "/test", nil)
-					req.RemoteAddr = "192.168.1.100:12345" // Same IP for all
-					w := httptest.NewRecorder()
-
-					router.ServeHTTP(w, req)
-
-					if w.Code == http.StatusOK {
-						mu.Lock()
-						successCount++
-						mu.Unlock()
+					switch doRequest(router, "192.168.1.100:12345").Code {
+					case http.StatusOK:
+						okCount.Add(1)
+					case http.StatusTooManyRequests:
+						limitedCount.Add(1)
 					}
 				}
-			}(i)
+			}()
 		}
 
 		wg.Wait()
 
-		// All requests should succeed (no panics or race conditions)
-		require.Equal(t, int64(numGoroutines*requestsPerGoroutine), successCount)
+		// Exactly the burst is let through, no matter how requests interleave
+		require.Equal(t, int64(100), okCount.Load())
+		require.Equal(t, int64(numGoroutines*requestsPerGoroutine-100), limitedCount.Load())
+	})
+}
+
+func TestRateLimiter_Stats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Run("evicts least recently seen clients", func(t *testing.T) {
+		limiter := internal.NewRateLimiter(internal.RateLimiterConfig{
+			Policies: []internal.RateLimitPolicy{
+				{Name: "default", Limit: internal.RateLimit{Rate: 1, Per: time.Minute, Burst: 1}},
+			},
+			Store: internal.NewMemoryRateLimitStore(internal.MemoryRateLimitStoreConfig{
+				MaxKeys: 2,
+				IdleTTL: time.Hour,
+			}),
+		})
+		router := newLimiterRouter(limiter)
+
+		assert.Equal(t, http.StatusOK, doRequest(router, "192.168.1.1:12345").Code)
+		assert.Equal(t, http.StatusOK, doRequest(router, "192.168.1.2:12345").Code)
+		// seeing 192.168.1.1 again makes 192.168.1.2 the least recently seen
+		assert.Equal(t, http.StatusTooManyRequests, doRequest(router, "192.168.1.1:12345").Code)
+		assert.Equal(t, http.StatusOK, doRequest(router, "192.168.1.3:12345").Code)
+
+		stats, err := limiter.Stats(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, internal.RateLimiterStats{ActiveKeys: 2, Evictions: 1}, stats)
+
+		// 192.168.1.1 is still limited, 192.168.1.2 was forgotten
+		assert.Equal(t, http.StatusTooManyRequests, doRequest(router, "192.168.1.1:12345").Code)
+		assert.Equal(t, http.StatusOK, doRequest(router, "192.168.1.2:12345").Code)
+	})
+
+	t.Run("expires idle clients", func(t *testing.T) {
+		limiter := internal.NewRateLimiter(internal.RateLimiterConfig{
+			Policies: []internal.RateLimitPolicy{
+				{Name: "default", Limit: internal.RateLimit{Rate: 1, Per: time.Minute, Burst: 1}},
+			},
+			Store: internal.NewMemoryRateLimitStore(internal.MemoryRateLimitStoreConfig{
+				MaxKeys: 100,
+				IdleTTL: 20 * time.Millisecond,
+			}),
+		})
+		router := newLimiterRouter(limiter)
+
+		for _, addr := range []string{"192.168.1.1:12345", "192.168.1.2:12345"} {
+			assert.Equal(t, http.StatusOK, doRequest(router, addr).Code)
+		}
+		stats, err := limiter.Stats(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 2, stats.ActiveKeys)
+
+		time.Sleep(30 * time.Millisecond)
+
+		stats, err = limiter.Stats(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, internal.RateLimiterStats{ActiveKeys: 0, Expirations: 2}, stats)
+		assert.Equal(t, http.StatusOK, doRequest(router, "192.168.1.1:12345").Code)
 	})
 }
 
+func TestRateLimitPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := internal.DefaultRateLimiterConfig()
+	cfg.Policies = []internal.RateLimitPolicy{
+		{
+			Name:    "read",
+			Methods: []string{"GET"},
+			Limit:   internal.RateLimit{Rate: 1, Per: time.Minute, Burst: 100},
+		},
+		{
+			Name:    "reply",
+			Methods: []string{"POST"},
+			Routes:  []string{"/articles/:article/replies"},
+			Limit:   internal.RateLimit{Rate: 1, Per: 30 * time.Second, Burst: 3},
+		},
+		{
+			Name:      "reply-article",
+			Methods:   []string{"POST"},
+			Routes:    []string{"/articles/:article/replies"},
+			Limit:     internal.RateLimit{Rate: 1, Per: time.Minute, Burst: 4},
+			Dimension: internal.ByParam("article"),
+		},
+		{
+			Name:    "reply-author",
+			Methods: []string{"POST"},
+			Routes:  []string{"/articles/:article/replies"},
+			Limit:   internal.RateLimit{Rate: 1, Per: time.Minute, Burst: 1},
+			Dimension: func(c *gin.Context) (string, bool) {
+				return internal.JSONField(c, "author_name")
+			},
+		},
+	}
+
+	router := gin.New()
+	router.Use(internal.NewRateLimiterMiddleware(internal.NewRateLimiter(cfg)))
+	router.GET("/articles/:article/replies", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.POST("/articles/:article/replies", func(c *gin.Context) {
+		// the handler can still read the body
+		req := struct {
+			Body string `json:"body"`
+		}{}
+		if err := c.BindJSON(&req); err != nil || req.Body == "" {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	router.DELETE("/reactions", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	post := func(article string, remoteAddr string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/articles/"+article+"/replies", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("limits writes per client", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusOK, post("a", "192.168.1.1:1234", `{"body": "hi"}`).Code)
+		}
+
+		w := post("a", "192.168.1.1:1234", `{"body": "hi"}`)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "30", w.Header().Get("Retry-After"))
+
+		// reads use their own budget
+		req := httptest.NewRequest("GET", "/articles/a/replies", nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `1;w=60;burst=100;name="read"`, w.Header().Get("RateLimit-Policy"))
+		assert.Equal(t, "99", w.Header().Get("RateLimit-Remaining"))
+	})
+
+	t.Run("limits writes per article", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, post("b", "192.168.2.1:1234", `{"body": "hi"}`).Code)
+		assert.Equal(t, http.StatusOK, post("b", "192.168.2.2:1234", `{"body": "hi"}`).Code)
+		assert.Equal(t, http.StatusOK, post("b", "192.168.2.3:1234", `{"body": "hi"}`).Code)
+		assert.Equal(t, http.StatusOK, post("b", "192.168.2.4:1234", `{"body": "hi"}`).Code)
+		assert.Equal(t, http.StatusTooManyRequests, post("b", "192.168.2.5:1234", `{"body": "hi"}`).Code)
+		assert.Equal(t, http.StatusOK, post("c", "192.168.2.5:1234", `{"body": "hi"}`).Code)
+	})
+
+	t.Run("limits writes per author", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, post("d", "192.168.3.1:1234", `{"body": "hi", "author_name": "spammer"}`).Code)
+		assert.Equal(t, http.StatusTooManyRequests, post("e", "192.168.3.2:1234", `{"body": "hi", "author_name": "spammer"}`).Code)
+		assert.Equal(t, http.StatusOK, post("e", "192.168.3.2:1234", `{"body": "hi"}`).Code)
+	})
+
+	t.Run("rejects large bodies", func(t *testing.T) {
+		body := `{"body": "` + strings.Repeat("a", internal.MaxJSONFieldBody) + `"}`
+		assert.Equal(t, http.StatusRequestEntityTooLarge, post("f", "192.168.5.1:1234", body).Code)
+	})
+
+	t.Run("leaves unmatched requests alone", func(t *testing.T) {
+		req := httptest.NewRequest("DELETE", "/reactions", nil)
+		req.RemoteAddr = "192.168.4.1:1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Policy"))
+	})
+}
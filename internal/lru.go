@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache holds at most maxSize values, evicting the least recently used
+// value when it's full. Values not used within ttl are expired as well.
+type lruCache[V any] struct {
+	mu      sync.Mutex
+	maxSize int
+	ttl     time.Duration
+	items   map[string]*list.Element
+	// order has the most recently used entry at the front.
+	order *list.List
+
+	evictions   int
+	expirations int
+}
+
+type lruEntry[V any] struct {
+	key      string
+	value    V
+	lastUsed time.Time
+}
+
+func newLRUCache[V any](maxSize int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{
+		maxSize: maxSize,
+		ttl:     ttl,
+		items:   map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// getOrCreate returns the value for key, calling create to add one if there
+// isn't one yet.
+func (c *lruCache[V]) getOrCreate(key string, now time.Time, create func() V) V {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*lruEntry[V])
+		entry.lastUsed = now
+		c.order.MoveToFront(el)
+		return entry.value
+	}
+
+	for c.order.Len() >= c.maxSize {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+
+	entry := &lruEntry[V]{key: key, value: create(), lastUsed: now}
+	c.items[key] = c.order.PushFront(entry)
+
+	return entry.value
+}
+
+// expire removes entries that have been idle for longer than the ttl. They're
+// always at the back, so this only looks at the entries it removes.
+func (c *lruCache[V]) expire(now time.Time) {
+	for el := c.order.Back(); el != nil; el = c.order.Back() {
+		if now.Sub(el.Value.(*lruEntry[V]).lastUsed) <= c.ttl {
+			return
+		}
+		c.remove(el)
+		c.expirations++
+	}
+}
+
+func (c *lruCache[V]) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*lruEntry[V]).key)
+}
+
+type lruStats struct {
+	Size        int
+	Evictions   int
+	Expirations int
+}
+
+func (c *lruCache[V]) stats(now time.Time) lruStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+
+	return lruStats{
+		Size:        c.order.Len(),
+		Evictions:   c.evictions,
+		Expirations: c.expirations,
+	}
+}
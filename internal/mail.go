@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Email is a message with plain text and HTML alternatives. Headers are added
+// to the standard ones.
+type Email struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	Headers map[string]string
+}
+
+// Message renders the email as a MIME message.
+func (e Email) Message(now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	domain := "gomments"
+	if addr, err := mail.ParseAddress(e.From); err == nil {
+		if _, d, ok := strings.Cut(addr.Address, "@"); ok {
+			domain = d
+		}
+	}
+
+	headers := []string{
+		"From: " + e.From,
+		"To: " + e.To,
+		"Subject: " + mime.QEncoding.Encode("utf-8", e.Subject),
+		"Date: " + now.Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <%s@%s>", hex.EncodeToString(randomID()), domain),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + mw.Boundary(),
+	}
+	for _, k := range slices.Sorted(maps.Keys(e.Headers)) {
+		headers = append(headers, k+": "+e.Headers[k])
+	}
+	buf.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", e.Text},
+		{"text/html; charset=utf-8", e.HTML},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("creating part: %w", err)
+		}
+
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(part.body)); err != nil {
+			return nil, fmt.Errorf("writing part: %w", err)
+		}
+		if err := qw.Close(); err != nil {
+			return nil, fmt.Errorf("writing part: %w", err)
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("closing message: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func randomID() []byte {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b
+}
+
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// SMTPConfig is where to send email. Connections are upgraded with STARTTLS
+// when the server supports it, and authenticated if Username is set.
+type SMTPConfig struct {
+	Addr     string
+	Username string
+	Password string
+	// Timeout limits how long sending each email can take, and defaults to
+	// DefaultSMTPTimeout.
+	Timeout time.Duration
+}
+
+const DefaultSMTPTimeout = 30 * time.Second
+
+type SMTPMailer struct {
+	cfg SMTPConfig
+}
+
+func NewSMTPMailer(cfg SMTPConfig) *SMTPMailer {
+	return &SMTPMailer{cfg: cfg}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, email Email) error {
+	msg, err := email.Message(time.Now())
+	if err != nil {
+		return err
+	}
+
+	from, err := mail.ParseAddress(email.From)
+	if err != nil {
+		return fmt.Errorf("parsing from address: %w", err)
+	}
+	to, err := mail.ParseAddress(email.To)
+	if err != nil {
+		return fmt.Errorf("parsing to address: %w", err)
+	}
+
+	host, _, err := net.SplitHostPort(m.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("parsing smtp address: %w", err)
+	}
+
+	timeout := m.cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultSMTPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", m.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("connecting to smtp server: %w", err)
+	}
+	// ctx always has a deadline now, which covers the whole conversation.
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return fmt.Errorf("setting smtp deadline: %w", err)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("greeting smtp server: %w", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("starting tls: %w", err)
+		}
+	}
+
+	if m.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, host)); err != nil {
+			return fmt.Errorf("authenticating: %w", err)
+		}
+	}
+
+	if err := c.Mail(from.Address); err != nil {
+		return fmt.Errorf("setting sender: %w", err)
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return fmt.Errorf("setting recipient: %w", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("starting data: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("writing data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("finishing data: %w", err)
+	}
+
+	return c.Quit()
+}
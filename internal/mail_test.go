@@ -0,0 +1,41 @@
+package internal_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments/internal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSMTPMailer_Send_timeout(t *testing.T) {
+	r := require.New(t)
+
+	// a server that accepts connections but never greets
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	m := internal.NewSMTPMailer(internal.SMTPConfig{Addr: ln.Addr().String(), Timeout: 100 * time.Millisecond})
+
+	start := time.Now()
+	err = m.Send(context.Background(), internal.Email{
+		From:    "gomments@example.com",
+		To:      "alice@example.com",
+		Subject: "hello",
+		Text:    "hello",
+	})
+	r.ErrorContains(err, "greeting smtp server")
+	r.Less(time.Since(start), 5*time.Second)
+}
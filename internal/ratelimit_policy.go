@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitDimension picks the key that requests limited together share,
+// such as the client or the article. Requests it returns false for aren't
+// limited by the policy.
+type RateLimitDimension func(c *gin.Context) (string, bool)
+
+// ByClient limits each client separately, as resolved by
+// NewClientIPMiddleware.
+func ByClient(c *gin.Context) (string, bool) {
+	ip := ClientIP(c)
+	return ip, ip != ""
+}
+
+// ByParam limits requests by a route parameter, like the article.
+func ByParam(name string) RateLimitDimension {
+	return func(c *gin.Context) (string, bool) {
+		v := c.Param(name)
+		return v, v != ""
+	}
+}
+
+// MaxJSONFieldBody caps the request bodies JSONField reads, since they're
+// read before the request is rate limited.
+const MaxJSONFieldBody = 64 << 10
+
+// JSONField returns a string field from a JSON request body, leaving the body
+// to be read again by the handler. Bodies over MaxJSONFieldBody are rejected
+// with a 413.
+func JSONField(c *gin.Context, field string) (string, bool) {
+	if c.Request.Body == nil {
+		return "", false
+	}
+
+	b, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, MaxJSONFieldBody))
+	c.Request.Body = io.NopCloser(bytes.NewReader(b))
+	if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large"})
+		return "", false
+	}
+	if err != nil {
+		return "", false
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return "", false
+	}
+
+	var v string
+	if err := json.Unmarshal(fields[field], &v); err != nil {
+		return "", false
+	}
+
+	return v, v != ""
+}
+
+// RateLimitPolicy limits the requests matching Methods and Routes, which are
+// gin route patterns like /articles/:article/replies. Either matches every
+// request when empty. Requests are limited per Dimension, or per client when
+// it isn't set.
+type RateLimitPolicy struct {
+	Name      string
+	Methods   []string
+	Routes    []string
+	Limit     RateLimit
+	Dimension RateLimitDimension
+}
+
+func (p RateLimitPolicy) matches(c *gin.Context) bool {
+	if len(p.Methods) > 0 && !slices.Contains(p.Methods, c.Request.Method) {
+		return false
+	}
+
+	if len(p.Routes) > 0 && !slices.Contains(p.Routes, c.FullPath()) {
+		return false
+	}
+
+	return true
+}
+
+func (p RateLimitPolicy) key(c *gin.Context) (string, bool) {
+	if p.Dimension == nil {
+		return ByClient(c)
+	}
+
+	return p.Dimension(c)
+}
+
+// header describes the policy for the RateLimit-Policy header.
+func (p RateLimitPolicy) header() string {
+	return fmt.Sprintf("%d;w=%s;burst=%d;name=%q", p.Limit.Rate, ceilSeconds(p.Limit.Per), p.Limit.Burst, p.Name)
+}
@@ -0,0 +1,83 @@
+package gomments
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/arizard/gomments/internal"
+)
+
+// Isso comment modes, besides 1 for accepted comments.
+const (
+	issoModePending = 2
+	issoModeDeleted = 4
+)
+
+type issoComment struct {
+	ID      int     `db:"id"`
+	URI     string  `db:"uri"`
+	Created float64 `db:"created"`
+	Mode    int     `db:"mode"`
+	Author  string  `db:"author"`
+	Text    string  `db:"text"`
+}
+
+// IssoImporter reads the replies in an Isso SQLite database. Isso threads are
+// identified by the path of their page, so rules are written like
+// "/posts/{article}".
+//
+// Pending comments are imported pending. Comments are written in Markdown,
+// which is kept as it is.
+type IssoImporter struct{}
+
+func (IssoImporter) Parse(ctx context.Context, path string, rule ArticleRule) ([]ImportReply, []ImportMapping, error) {
+	db, err := internal.OpenSQLiteDatabaseReadOnly(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer db.Close()
+
+	comments := []issoComment{}
+	if err := db.SelectContext(
+		ctx,
+		&comments,
+		`
+		select c.id, t.uri, c.created, c.mode, coalesce(c.author, '') as author, coalesce(c.text, '') as text
+		from comments c
+		join threads t on t.id = c.tid
+		order by c.created, c.id
+		`,
+	); err != nil {
+		return nil, nil, fmt.Errorf("selecting isso comments: %w", err)
+	}
+
+	mappings := newImportMappings(rule)
+	replies := []ImportReply{}
+
+	for _, c := range comments {
+		article := mappings.add(c.URI)
+		if article == "" {
+			continue
+		}
+
+		sec, frac := math.Modf(c.Created)
+		createdAt := time.Unix(int64(sec), int64(frac*1e9)).UTC()
+
+		replies = append(replies, ImportReply{
+			Source: "isso",
+			// Isso IDs are only unique to a database, so they're qualified
+			// with what the comment was on and when.
+			SourceID:   fmt.Sprintf("%s:%d:%d", c.URI, c.ID, createdAt.UnixMicro()),
+			Article:    article,
+			AuthorName: c.Author,
+			Body:       c.Text,
+			CreatedAt:  createdAt,
+			Deleted:    c.Mode == issoModeDeleted,
+			Pending:    c.Mode == issoModePending,
+		})
+	}
+
+	return replies, mappings.mappings, nil
+}
@@ -0,0 +1,84 @@
+package gomments_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+// newIssoDatabase creates an Isso database with the comments of its schema
+// that are imported.
+func newIssoDatabase(t *testing.T) string {
+	path := fmt.Sprintf("./data/isso_test_%s.db", uuid.NewString())
+	t.Cleanup(func() { os.Remove(path) })
+
+	db, err := sqlx.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	db.MustExec(`
+		CREATE TABLE threads (id INTEGER PRIMARY KEY, uri VARCHAR(256) UNIQUE, title VARCHAR(256));
+		CREATE TABLE comments (
+			tid REFERENCES threads(id), id INTEGER PRIMARY KEY, parent INTEGER,
+			created FLOAT NOT NULL, modified FLOAT, mode INTEGER, remote_addr VARCHAR,
+			text VARCHAR, author VARCHAR, email VARCHAR, website VARCHAR,
+			likes INTEGER DEFAULT 0, dislikes INTEGER DEFAULT 0, voters BLOB NOT NULL DEFAULT '',
+			notification INTEGER DEFAULT 0
+		);
+		INSERT INTO threads (id, uri, title) VALUES (1, '/posts/hello-world/', 'Hello world'), (2, '/about', 'About');
+		INSERT INTO comments (tid, id, created, mode, text, author) VALUES
+			(1, 1, 1367490600.25, 1, 'Nice *post*', 'Alice'),
+			(1, 2, 1367571600, 2, 'Waiting', NULL),
+			(1, 3, 1367654400, 4, '', NULL),
+			(2, 4, 1367740800, 1, 'About what?', 'Carol');
+	`)
+
+	return path
+}
+
+func TestIssoImporter(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	path := newIssoDatabase(t)
+
+	rule, err := gomments.ParseArticleRule("/posts/{article}")
+	f.NoError(err)
+
+	replies, mappings, err := gomments.Importers["isso"].Parse(ctx, path, rule)
+	f.NoError(err)
+
+	f.Equal([]gomments.ImportMapping{
+		{Thread: "/posts/hello-world/", Article: "hello-world", Replies: 3},
+		{Thread: "/about", Article: "", Replies: 1},
+	}, mappings)
+
+	f.Len(replies, 3)
+	f.Equal("Alice", replies[0].AuthorName)
+	f.Equal("Nice *post*", replies[0].Body)
+	f.Equal(time.Date(2013, 5, 2, 10, 30, 0, 250_000_000, time.UTC), replies[0].CreatedAt)
+	f.True(replies[1].Pending)
+	f.True(replies[2].Deleted)
+
+	t.Run("imports once", func(tt *testing.T) {
+		r := require.New(tt)
+
+		resp, err := f.service.ImportReplies(ctx, gomments.ImportRepliesRequest{Replies: replies})
+		r.NoError(err)
+		r.Equal(gomments.ImportArticleStats{Imported: 3, Deleted: 1, Pending: 1}, resp.Articles["hello-world"])
+
+		resp, err = f.service.ImportReplies(ctx, gomments.ImportRepliesRequest{Replies: replies})
+		r.NoError(err)
+		r.Equal(3, resp.Existing)
+
+		repliesResp, err := f.service.GetReplies(ctx, gomments.GetRepliesRequest{Article: "hello-world"})
+		r.NoError(err)
+		r.Len(repliesResp.Replies, 1)
+	})
+}
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS ban (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL,
+    value TEXT NOT NULL,
+    mode TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    expires_at DATETIME,
+    deleted BOOLEAN DEFAULT FALSE NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ban_kind_value ON ban (kind, value);
+
+ALTER TABLE reply ADD COLUMN client_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE reply ADD COLUMN shadowbanned BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE article_reaction ADD COLUMN shadowbanned BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS used_challenge (
+    id TEXT PRIMARY KEY,
+    expires_at DATETIME NOT NULL
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS captcha (
+    id TEXT PRIMARY KEY,
+    answer TEXT NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS reply_client_hash_created_at ON reply (client_hash, created_at);
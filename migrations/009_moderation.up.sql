@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS moderation_event (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL,
+    target_id TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+CREATE TRIGGER IF NOT EXISTS moderation_event_no_update
+BEFORE UPDATE ON moderation_event
+BEGIN
+    SELECT RAISE(ABORT, 'moderation_event is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS moderation_event_no_delete
+BEFORE DELETE ON moderation_event
+BEGIN
+    SELECT RAISE(ABORT, 'moderation_event is append-only');
+END;
+
+CREATE TABLE IF NOT EXISTS reply_flag (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    reply_id INTEGER NOT NULL REFERENCES reply (id),
+    reason TEXT NOT NULL DEFAULT '',
+    client_hash TEXT NOT NULL DEFAULT '',
+    resolved BOOLEAN DEFAULT FALSE NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS reply_flag_resolved ON reply_flag (resolved, created_at);
@@ -0,0 +1,5 @@
+ALTER TABLE article_reaction ADD COLUMN client_key TEXT NOT NULL DEFAULT '';
+
+CREATE UNIQUE INDEX IF NOT EXISTS article_reaction_client
+ON article_reaction (article, kind, client_key)
+WHERE deleted = false AND client_key != '';
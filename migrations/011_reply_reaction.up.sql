@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS reply_reaction (
+    reply_id INTEGER NOT NULL REFERENCES reply (id),
+    kind TEXT NOT NULL,
+    deletion_key TEXT NOT NULL UNIQUE,
+    client_key TEXT NOT NULL DEFAULT '',
+    shadowbanned BOOLEAN NOT NULL DEFAULT FALSE,
+    deleted BOOLEAN DEFAULT FALSE NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS reply_reaction_client
+ON reply_reaction (reply_id, kind, client_key)
+WHERE deleted = false AND client_key != '';
+
+CREATE INDEX IF NOT EXISTS reply_reaction_reply_id ON reply_reaction (reply_id);
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS email_subscription (
+    email TEXT NOT NULL,
+    -- article is '' for the site owners' subscription to every article.
+    article TEXT NOT NULL,
+    unsubscribed BOOLEAN DEFAULT FALSE NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (email, article)
+);
+
+CREATE TABLE IF NOT EXISTS email_notification (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    email TEXT NOT NULL,
+    -- article is the article of the subscription the notification is for.
+    article TEXT NOT NULL,
+    reply_id INTEGER NOT NULL REFERENCES reply (id),
+    created_at DATETIME NOT NULL,
+    sent_at DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS email_notification_unsent ON email_notification (email, article) WHERE sent_at IS NULL;
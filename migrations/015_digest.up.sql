@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS digest (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    period_start DATETIME NOT NULL,
+    period_end DATETIME NOT NULL,
+    created_at DATETIME NOT NULL
+);
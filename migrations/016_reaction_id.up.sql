@@ -0,0 +1,45 @@
+-- Reactions are given ids, keeping their rowids, since rowids of tables
+-- without an INTEGER PRIMARY KEY can change when the database is vacuumed.
+CREATE TABLE article_reaction_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    article TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    deletion_key TEXT NOT NULL UNIQUE,
+    deleted BOOLEAN DEFAULT FALSE NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    shadowbanned BOOLEAN NOT NULL DEFAULT FALSE,
+    client_key TEXT NOT NULL DEFAULT ''
+);
+
+INSERT INTO article_reaction_new (id, article, kind, deletion_key, deleted, created_at, shadowbanned, client_key)
+SELECT rowid, article, kind, deletion_key, deleted, created_at, shadowbanned, client_key FROM article_reaction;
+
+DROP TABLE article_reaction;
+ALTER TABLE article_reaction_new RENAME TO article_reaction;
+
+CREATE UNIQUE INDEX IF NOT EXISTS article_reaction_client
+ON article_reaction (article, kind, client_key)
+WHERE deleted = false AND client_key != '';
+
+CREATE TABLE reply_reaction_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    reply_id INTEGER NOT NULL REFERENCES reply (id),
+    kind TEXT NOT NULL,
+    deletion_key TEXT NOT NULL UNIQUE,
+    client_key TEXT NOT NULL DEFAULT '',
+    shadowbanned BOOLEAN NOT NULL DEFAULT FALSE,
+    deleted BOOLEAN DEFAULT FALSE NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO reply_reaction_new (id, reply_id, kind, deletion_key, client_key, shadowbanned, deleted, created_at)
+SELECT rowid, reply_id, kind, deletion_key, client_key, shadowbanned, deleted, created_at FROM reply_reaction;
+
+DROP TABLE reply_reaction;
+ALTER TABLE reply_reaction_new RENAME TO reply_reaction;
+
+CREATE UNIQUE INDEX IF NOT EXISTS reply_reaction_client
+ON reply_reaction (reply_id, kind, client_key)
+WHERE deleted = false AND client_key != '';
+
+CREATE INDEX IF NOT EXISTS reply_reaction_reply_id ON reply_reaction (reply_id);
@@ -0,0 +1,6 @@
+-- Subscriptions only become active once their email is confirmed.
+ALTER TABLE email_subscription ADD COLUMN confirmed_at DATETIME;
+ALTER TABLE email_subscription ADD COLUMN confirmation_sent_at DATETIME;
+
+-- Subscriptions from before confirmation was required stay active.
+UPDATE email_subscription SET confirmed_at = created_at;
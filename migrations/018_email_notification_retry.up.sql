@@ -0,0 +1,7 @@
+ALTER TABLE email_notification ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE email_notification ADD COLUMN next_attempt_at DATETIME;
+-- dead_at is set when sending has failed too many times, and it's given up on.
+ALTER TABLE email_notification ADD COLUMN dead_at DATETIME;
+
+DROP INDEX IF EXISTS email_notification_unsent;
+CREATE INDEX IF NOT EXISTS email_notification_unsent ON email_notification (email, article) WHERE sent_at IS NULL AND dead_at IS NULL;
@@ -0,0 +1,12 @@
+-- A client can only have one unresolved flag on a reply, so keep the first of
+-- any repeats before indexing.
+DELETE FROM reply_flag
+WHERE NOT resolved AND client_hash != '' AND id NOT IN (
+    SELECT min(id) FROM reply_flag
+    WHERE NOT resolved AND client_hash != ''
+    GROUP BY reply_id, client_hash
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS reply_flag_client
+ON reply_flag (reply_id, client_hash)
+WHERE NOT resolved AND client_hash != '';
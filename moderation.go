@@ -0,0 +1,368 @@
+package gomments
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type ModerationAction string
+
+const (
+	ModerationActionDelete      ModerationAction = "delete"
+	ModerationActionRestore     ModerationAction = "restore"
+	ModerationActionApprove     ModerationAction = "approve"
+	ModerationActionBan         ModerationAction = "ban"
+	ModerationActionUnban       ModerationAction = "unban"
+	ModerationActionFlagResolve ModerationAction = "flag-resolve"
+)
+
+type ModerationTarget string
+
+const (
+	ModerationTargetReply         ModerationTarget = "reply"
+	ModerationTargetReaction      ModerationTarget = "reaction"
+	ModerationTargetReplyReaction ModerationTarget = "reply_reaction"
+	ModerationTargetBan           ModerationTarget = "ban"
+	ModerationTargetFlag          ModerationTarget = "flag"
+)
+
+// ModerationEvent is an entry in the append-only moderation audit log. Every
+// moderation action taken through the service, and so the admin API and
+// gommentsctl, is logged. Changes made to the database by hand aren't.
+type ModerationEvent struct {
+	ID         int              `db:"id" json:"id"`
+	Actor      string           `db:"actor" json:"actor"`
+	Action     ModerationAction `db:"action" json:"action"`
+	TargetType ModerationTarget `db:"target_type" json:"target_type"`
+	TargetID   string           `db:"target_id" json:"target_id"`
+	Reason     string           `db:"reason" json:"reason"`
+	CreatedAt  time.Time        `db:"created_at" json:"created_at"`
+}
+
+func getActorFallback(s string) string {
+	if s = strings.TrimSpace(s); s == "" {
+		return "admin"
+	}
+	return s
+}
+
+type ModerateReplyRequest struct {
+	Actor   string
+	ReplyID int
+	Action  ModerationAction `json:"action"`
+	Reason  string           `json:"reason"`
+}
+
+type ModerateReplyResponse struct {
+	Event ModerationEvent `json:"event"`
+}
+
+// ModerateReply deletes, restores or approves a reply. Approving a reply
+// makes a shadowbanned reply visible to everyone.
+func (s *Service) ModerateReply(ctx context.Context, req ModerateReplyRequest) (*ModerateReplyResponse, error) {
+	var update func(ctx context.Context, db sqlx.ExtContext, id int) (bool, error)
+	switch req.Action {
+	case ModerationActionDelete:
+		update = func(ctx context.Context, db sqlx.ExtContext, id int) (bool, error) {
+			return setReplyDeleted(ctx, db, id, true)
+		}
+	case ModerationActionRestore:
+		update = func(ctx context.Context, db sqlx.ExtContext, id int) (bool, error) {
+			return setReplyDeleted(ctx, db, id, false)
+		}
+	case ModerationActionApprove:
+		update = approveReply
+	default:
+		return nil, Errorf(http.StatusBadRequest, "not a valid reply moderation action: %q", req.Action)
+	}
+
+	event := ModerationEvent{
+		Actor:      getActorFallback(req.Actor),
+		Action:     req.Action,
+		TargetType: ModerationTargetReply,
+		TargetID:   strconv.Itoa(req.ReplyID),
+		Reason:     req.Reason,
+		CreatedAt:  time.Now(),
+	}
+
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		ok, err := update(ctx, tx, req.ReplyID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errNotFound
+		}
+
+		event.ID, err = insertModerationEvent(ctx, tx, event)
+		if err != nil {
+			return err
+		}
+
+		return s.enqueueModerated(ctx, tx, event)
+	})
+	if errors.Is(err, errNotFound) {
+		return nil, Errorf(http.StatusNotFound, "reply not found: %d", req.ReplyID)
+	}
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "moderating reply: %w", err)
+	}
+
+	return &ModerateReplyResponse{Event: event}, nil
+}
+
+type ModerateReactionRequest struct {
+	Actor      string
+	ReactionID int
+	Action     ModerationAction `json:"action"`
+	Reason     string           `json:"reason"`
+}
+
+type ModerateReactionResponse struct {
+	Event ModerationEvent `json:"event"`
+}
+
+// ModerateReaction deletes or restores an article reaction by its ID.
+func (s *Service) ModerateReaction(ctx context.Context, req ModerateReactionRequest) (*ModerateReactionResponse, error) {
+	return s.moderateReaction(ctx, req, ModerationTargetReaction, setReactionDeleted)
+}
+
+// ModerateReplyReaction deletes or restores a reply reaction by its ID.
+func (s *Service) ModerateReplyReaction(ctx context.Context, req ModerateReactionRequest) (*ModerateReactionResponse, error) {
+	return s.moderateReaction(ctx, req, ModerationTargetReplyReaction, setReplyReactionDeleted)
+}
+
+func (s *Service) moderateReaction(
+	ctx context.Context,
+	req ModerateReactionRequest,
+	target ModerationTarget,
+	setDeleted func(ctx context.Context, db sqlx.ExtContext, id int, deleted bool) (bool, error),
+) (*ModerateReactionResponse, error) {
+	var deleted bool
+	switch req.Action {
+	case ModerationActionDelete:
+		deleted = true
+	case ModerationActionRestore:
+		deleted = false
+	default:
+		return nil, Errorf(http.StatusBadRequest, "not a valid reaction moderation action: %q", req.Action)
+	}
+
+	event := ModerationEvent{
+		Actor:      getActorFallback(req.Actor),
+		Action:     req.Action,
+		TargetType: target,
+		TargetID:   strconv.Itoa(req.ReactionID),
+		Reason:     req.Reason,
+		CreatedAt:  time.Now(),
+	}
+
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		ok, err := setDeleted(ctx, tx, req.ReactionID, deleted)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errNotFound
+		}
+
+		event.ID, err = insertModerationEvent(ctx, tx, event)
+		if err != nil {
+			return err
+		}
+
+		return s.enqueueModerated(ctx, tx, event)
+	})
+	if errors.Is(err, errNotFound) {
+		return nil, Errorf(http.StatusNotFound, "reaction not found: %d", req.ReactionID)
+	}
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "moderating reaction: %w", err)
+	}
+
+	return &ModerateReactionResponse{Event: event}, nil
+}
+
+// Reaction is a reaction as moderators see it, on an article or a reply.
+type Reaction struct {
+	ID           int       `json:"id"`
+	Article      string    `json:"article,omitempty"`
+	ReplyID      int       `json:"reply_id,omitempty"`
+	Kind         string    `json:"kind"`
+	Deleted      bool      `json:"deleted"`
+	Shadowbanned bool      `json:"shadowbanned"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type ListReactionsRequest struct {
+	// Article or ReplyID is set, depending on the reactions to list.
+	Article string
+	ReplyID int
+}
+
+type ListReactionsResponse struct {
+	Reactions []Reaction `json:"reactions"`
+}
+
+// ListReactions lists the reactions on an article or a reply, newest first,
+// including deleted ones, so moderators can find their IDs.
+func (s *Service) ListReactions(ctx context.Context, req ListReactionsRequest) (*ListReactionsResponse, error) {
+	if (req.Article == "") == (req.ReplyID == 0) {
+		return nil, Errorf(http.StatusBadRequest, "requires either an article or a reply id")
+	}
+
+	reactions, err := getReactions(ctx, s.db, req.Article, req.ReplyID)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting reactions: %w", err)
+	}
+
+	return &ListReactionsResponse{Reactions: reactions}, nil
+}
+
+type Flag struct {
+	ID        int       `db:"id" json:"id"`
+	ReplyID   int       `db:"reply_id" json:"reply_id"`
+	Reason    string    `db:"reason" json:"reason"`
+	Resolved  bool      `db:"resolved" json:"resolved"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+type FlagReplyRequest struct {
+	ReplyID  int
+	Reason   string `json:"reason"`
+	ClientIP string `json:"-"`
+}
+
+type FlagReplyResponse struct {
+	// Duplicate is set when the client had already flagged the reply, and the
+	// flag is still unresolved.
+	Duplicate bool `json:"duplicate"`
+}
+
+// FlagReply lets a reader report a reply to the moderators.
+func (s *Service) FlagReply(ctx context.Context, req FlagReplyRequest) (*FlagReplyResponse, error) {
+	reason := strings.TrimSpace(req.Reason)
+	if len(reason) > 500 {
+		return nil, Errorf(http.StatusBadRequest, "flag reason max length 500 characters reached")
+	}
+
+	inserted, err := insertFlag(ctx, s.db, req.ReplyID, reason, s.hashClientIP(req.ClientIP), time.Now())
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "inserting flag: %w", err)
+	}
+	if inserted {
+		return &FlagReplyResponse{}, nil
+	}
+
+	reply, err := getReplyByID(ctx, s.db, req.ReplyID)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting reply: %w", err)
+	}
+	if reply == nil || reply.Deleted {
+		return nil, Errorf(http.StatusNotFound, "reply not found: %d", req.ReplyID)
+	}
+
+	return &FlagReplyResponse{Duplicate: true}, nil
+}
+
+type ListFlagsRequest struct {
+	IncludeResolved bool
+}
+
+type ListFlagsResponse struct {
+	Flags []Flag `json:"flags"`
+}
+
+func (s *Service) ListFlags(ctx context.Context, req ListFlagsRequest) (*ListFlagsResponse, error) {
+	flags, err := getFlags(ctx, s.db, req.IncludeResolved)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting flags: %w", err)
+	}
+
+	return &ListFlagsResponse{Flags: flags}, nil
+}
+
+type ResolveFlagRequest struct {
+	Actor  string
+	FlagID int
+	Reason string `json:"reason"`
+}
+
+type ResolveFlagResponse struct {
+	Event ModerationEvent `json:"event"`
+}
+
+func (s *Service) ResolveFlag(ctx context.Context, req ResolveFlagRequest) (*ResolveFlagResponse, error) {
+	event := ModerationEvent{
+		Actor:      getActorFallback(req.Actor),
+		Action:     ModerationActionFlagResolve,
+		TargetType: ModerationTargetFlag,
+		TargetID:   strconv.Itoa(req.FlagID),
+		Reason:     req.Reason,
+		CreatedAt:  time.Now(),
+	}
+
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		ok, err := resolveFlag(ctx, tx, req.FlagID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errNotFound
+		}
+
+		event.ID, err = insertModerationEvent(ctx, tx, event)
+		return err
+	})
+	if errors.Is(err, errNotFound) {
+		return nil, Errorf(http.StatusNotFound, "unresolved flag not found: %d", req.FlagID)
+	}
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "resolving flag: %w", err)
+	}
+
+	return &ResolveFlagResponse{Event: event}, nil
+}
+
+type ListModerationEventsRequest struct {
+	// Before is the id of the oldest event already seen. Zero starts from
+	// the newest event.
+	Before int
+	Limit  int
+}
+
+type ListModerationEventsResponse struct {
+	Events []ModerationEvent `json:"events"`
+	// NextBefore is passed as Before to get the next page. It is zero when
+	// there are no more events.
+	NextBefore int `json:"next_before"`
+}
+
+// ListModerationEvents pages through the moderation log, newest first.
+func (s *Service) ListModerationEvents(ctx context.Context, req ListModerationEventsRequest) (*ListModerationEventsResponse, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	limit = min(limit, 500)
+
+	// Fetch one extra event to find out whether there's another page.
+	events, err := getModerationEvents(ctx, s.db, req.Before, limit+1)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting moderation events: %w", err)
+	}
+
+	resp := &ListModerationEventsResponse{Events: events}
+	if len(events) > limit {
+		resp.Events = events[:limit]
+		resp.NextBefore = resp.Events[limit-1].ID
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,174 @@
+package gomments_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arizard/gomments"
+	"github.com/google/uuid"
+)
+
+func TestService_ModerateReply(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	s := f.service
+
+	_, err := s.CreateBan(ctx, gomments.CreateBanRequest{
+		Actor: "mod",
+		Kind:  gomments.BanKindIPHash,
+		Value: "203.0.113.7",
+		Mode:  gomments.BanModeShadow,
+	})
+	f.NoError(err)
+
+	submitResp, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "test-article",
+		Body:           "hello",
+		ClientIP:       "203.0.113.7",
+	})
+	f.NoError(err)
+	replyID := submitResp.Reply.ID
+
+	_, err = s.ModerateReply(ctx, gomments.ModerateReplyRequest{Actor: "mod", ReplyID: replyID, Action: gomments.ModerationActionApprove})
+	f.NoError(err)
+
+	repliesResp, err := s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "test-article"})
+	f.NoError(err)
+	f.Len(repliesResp.Replies, 1)
+
+	_, err = s.FlagReply(ctx, gomments.FlagReplyRequest{ReplyID: replyID, Reason: "rude"})
+	f.NoError(err)
+
+	flagsResp, err := s.ListFlags(ctx, gomments.ListFlagsRequest{})
+	f.NoError(err)
+	f.Len(flagsResp.Flags, 1)
+
+	_, err = s.ModerateReply(ctx, gomments.ModerateReplyRequest{Actor: "mod", ReplyID: replyID, Action: gomments.ModerationActionDelete, Reason: "rude"})
+	f.NoError(err)
+
+	_, err = s.ResolveFlag(ctx, gomments.ResolveFlagRequest{Actor: "mod", FlagID: flagsResp.Flags[0].ID})
+	f.NoError(err)
+
+	_, err = s.ResolveFlag(ctx, gomments.ResolveFlagRequest{Actor: "mod", FlagID: flagsResp.Flags[0].ID})
+	f.ErrorContains(err, "unresolved flag not found")
+
+	repliesResp, err = s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "test-article"})
+	f.NoError(err)
+	f.Empty(repliesResp.Replies)
+
+	_, err = s.ModerateReply(ctx, gomments.ModerateReplyRequest{ReplyID: 9999, Action: gomments.ModerationActionRestore})
+	f.ErrorContains(err, "reply not found")
+
+	_, err = f.db.Exec("delete from moderation_event")
+	f.ErrorContains(err, "append-only")
+
+	eventsResp, err := s.ListModerationEvents(ctx, gomments.ListModerationEventsRequest{Limit: 3})
+	f.NoError(err)
+	f.Len(eventsResp.Events, 3)
+	f.Equal(gomments.ModerationActionFlagResolve, eventsResp.Events[0].Action)
+	f.Equal(gomments.ModerationActionDelete, eventsResp.Events[1].Action)
+	f.Equal("rude", eventsResp.Events[1].Reason)
+	f.Equal(gomments.ModerationActionApprove, eventsResp.Events[2].Action)
+	f.NotZero(eventsResp.NextBefore)
+
+	eventsResp, err = s.ListModerationEvents(ctx, gomments.ListModerationEventsRequest{Before: eventsResp.NextBefore, Limit: 3})
+	f.NoError(err)
+	f.Len(eventsResp.Events, 1)
+	f.Equal(gomments.ModerationActionBan, eventsResp.Events[0].Action)
+	f.Equal("mod", eventsResp.Events[0].Actor)
+	f.Zero(eventsResp.NextBefore)
+}
+
+func TestService_FlagReply_duplicate(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	s := f.service
+
+	submitResp, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "test-article",
+		Body:           "hello",
+	})
+	f.NoError(err)
+	replyID := submitResp.Reply.ID
+
+	flagResp, err := s.FlagReply(ctx, gomments.FlagReplyRequest{ReplyID: replyID, Reason: "rude", ClientIP: "203.0.113.7"})
+	f.NoError(err)
+	f.False(flagResp.Duplicate)
+
+	flagResp, err = s.FlagReply(ctx, gomments.FlagReplyRequest{ReplyID: replyID, Reason: "spam", ClientIP: "203.0.113.7"})
+	f.NoError(err)
+	f.True(flagResp.Duplicate)
+
+	_, err = s.FlagReply(ctx, gomments.FlagReplyRequest{ReplyID: replyID, ClientIP: "203.0.113.8"})
+	f.NoError(err)
+
+	flagsResp, err := s.ListFlags(ctx, gomments.ListFlagsRequest{})
+	f.NoError(err)
+	f.Len(flagsResp.Flags, 2)
+
+	_, err = s.ResolveFlag(ctx, gomments.ResolveFlagRequest{Actor: "mod", FlagID: flagsResp.Flags[0].ID})
+	f.NoError(err)
+	_, err = s.ResolveFlag(ctx, gomments.ResolveFlagRequest{Actor: "mod", FlagID: flagsResp.Flags[1].ID})
+	f.NoError(err)
+
+	// Once resolved, the reply can be flagged again.
+	flagResp, err = s.FlagReply(ctx, gomments.FlagReplyRequest{ReplyID: replyID, ClientIP: "203.0.113.7"})
+	f.NoError(err)
+	f.False(flagResp.Duplicate)
+
+	_, err = s.FlagReply(ctx, gomments.FlagReplyRequest{ReplyID: 9999, ClientIP: "203.0.113.7"})
+	f.ErrorContains(err, "reply not found")
+}
+
+func TestService_ModerateReactions(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	s := f.service
+
+	articleResp, err := s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like", ClientIP: "192.0.2.1"})
+	f.NoError(err)
+	f.NotZero(articleResp.ID)
+
+	submitResp, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "test-article",
+		Body:           "hello",
+	})
+	f.NoError(err)
+	replyResp, err := s.CreateReplyReaction(ctx, gomments.CreateReplyReactionRequest{ReplyID: submitResp.Reply.ID, Kind: "like", ClientIP: "192.0.2.1"})
+	f.NoError(err)
+	f.NotZero(replyResp.ID)
+
+	listResp, err := s.ListReactions(ctx, gomments.ListReactionsRequest{Article: "test-article"})
+	f.NoError(err)
+	f.Len(listResp.Reactions, 1)
+	f.Equal(articleResp.ID, listResp.Reactions[0].ID)
+
+	listResp, err = s.ListReactions(ctx, gomments.ListReactionsRequest{ReplyID: submitResp.Reply.ID})
+	f.NoError(err)
+	f.Len(listResp.Reactions, 1)
+	f.Equal(replyResp.ID, listResp.Reactions[0].ID)
+
+	_, err = s.ModerateReaction(ctx, gomments.ModerateReactionRequest{Actor: "mod", ReactionID: articleResp.ID, Action: gomments.ModerationActionDelete})
+	f.NoError(err)
+	moderateResp, err := s.ModerateReplyReaction(ctx, gomments.ModerateReactionRequest{Actor: "mod", ReactionID: replyResp.ID, Action: gomments.ModerationActionDelete})
+	f.NoError(err)
+	f.Equal(gomments.ModerationTargetReplyReaction, moderateResp.Event.TargetType)
+
+	statsResp, err := s.GetReactionStatsByArticles(ctx, gomments.GetReactionStatsByArticlesRequest{Articles: []string{"test-article"}})
+	f.NoError(err)
+	f.Equal(0, statsResp.Stats["test-article"]["like"])
+
+	repliesResp, err := s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "test-article"})
+	f.NoError(err)
+	f.Equal(0, repliesResp.Replies[0].Reactions["like"])
+
+	eventsResp, err := s.ListModerationEvents(ctx, gomments.ListModerationEventsRequest{})
+	f.NoError(err)
+	f.Len(eventsResp.Events, 2)
+
+	_, err = s.ModerateReplyReaction(ctx, gomments.ModerateReactionRequest{ReactionID: 999, Action: gomments.ModerationActionDelete})
+	f.ErrorContains(err, "reaction not found")
+}
@@ -0,0 +1,546 @@
+package gomments
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/arizard/gomments/internal"
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultNotificationText = `{{if .Owner}}New comments on your site:{{else}}New comments on {{.Article}}, where you commented:{{end}}
+{{range .Replies}}
+{{.AuthorName}} on {{.Article}}{{if .Shadowbanned}} (shadowbanned){{end}}, {{.CreatedAt.UTC.Format "2 Jan 2006 15:04 MST"}}:
+{{.Body}}
+{{with .Link}}{{.}}
+{{end}}{{end}}{{with .More}}
+...and {{.}} more.
+{{end}}
+--
+Unsubscribe: {{.UnsubscribeURL}}
+`
+
+const defaultNotificationHTML = `<!DOCTYPE html>
+<html>
+<body>
+<p>{{if .Owner}}New comments on your site:{{else}}New comments on {{.Article}}, where you commented:{{end}}</p>
+{{range .Replies}}
+<div style="margin: 1em 0">
+<p><strong>{{.AuthorName}}</strong> on {{.Article}}{{if .Shadowbanned}} <em>(shadowbanned)</em>{{end}}, {{.CreatedAt.UTC.Format "2 Jan 2006 15:04 MST"}}:</p>
+<p style="white-space: pre-wrap">{{.Body}}</p>
+{{with .Link}}<p><a href="{{.}}">View comment</a></p>{{end}}
+</div>
+{{end}}
+{{with .More}}<p>...and {{.}} more.</p>{{end}}
+<p style="font-size: small"><a href="{{.UnsubscribeURL}}">Unsubscribe</a></p>
+</body>
+</html>
+`
+
+const confirmationText = `Confirm that you'd like to be emailed about new comments on {{.Article}}:
+
+{{.ConfirmURL}}
+
+If you didn't ask for this, ignore this email and you won't hear from us again.
+`
+
+const confirmationHTML = `<!DOCTYPE html>
+<html>
+<body>
+<p>Confirm that you'd like to be emailed about new comments on {{.Article}}:</p>
+<p><a href="{{.ConfirmURL}}">Confirm your email address</a></p>
+<p style="font-size: small">If you didn't ask for this, ignore this email and you won't hear from us again.</p>
+</body>
+</html>
+`
+
+var confirmationTemplates = NotificationTemplates{
+	Text: texttemplate.Must(texttemplate.New("confirmation.txt").Parse(confirmationText)),
+	HTML: htmltemplate.Must(htmltemplate.New("confirmation.html").Parse(confirmationHTML)),
+}
+
+// NotificationTemplates render notification emails, from NotificationData.
+type NotificationTemplates struct {
+	Text *texttemplate.Template
+	HTML *htmltemplate.Template
+}
+
+func DefaultNotificationTemplates() NotificationTemplates {
+	return NotificationTemplates{
+		Text: texttemplate.Must(texttemplate.New("notification.txt").Parse(defaultNotificationText)),
+		HTML: htmltemplate.Must(htmltemplate.New("notification.html").Parse(defaultNotificationHTML)),
+	}
+}
+
+// LoadNotificationTemplates reads notification.txt and notification.html from
+// a directory, keeping the default for either that doesn't exist.
+func LoadNotificationTemplates(dir string) (NotificationTemplates, error) {
+	templates := DefaultNotificationTemplates()
+
+	if b, err := os.ReadFile(filepath.Join(dir, "notification.txt")); err == nil {
+		if templates.Text, err = texttemplate.New("notification.txt").Parse(string(b)); err != nil {
+			return templates, fmt.Errorf("parsing notification.txt: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return templates, err
+	}
+
+	if b, err := os.ReadFile(filepath.Join(dir, "notification.html")); err == nil {
+		if templates.HTML, err = htmltemplate.New("notification.html").Parse(string(b)); err != nil {
+			return templates, fmt.Errorf("parsing notification.html: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return templates, err
+	}
+
+	return templates, nil
+}
+
+// NotificationConfig configures email notifications. Owners are emailed about
+// every reply, and commenters can ask to be emailed about replies after theirs
+// on the same article, once they've confirmed their email.
+//
+// Replies are batched: a recipient is emailed once their oldest unsent
+// notification is BatchDelay old, about every reply since, so a busy article
+// doesn't flood them. An email that fails to send is retried after Backoff,
+// doubling each time up to MaxBackoff, until it has been attempted
+// MaxAttempts times and is given up on.
+type NotificationConfig struct {
+	Mailer internal.Mailer
+	From   string
+	Owners []string
+	// UnsubscribeURL is the URL of the unsubscribe endpoint, with {token} in
+	// place of the recipient's unsubscribe token.
+	UnsubscribeURL string
+	// ConfirmURL is the URL of the confirmation endpoint, with {token} in
+	// place of the commenter's confirmation token.
+	ConfirmURL string
+	BatchDelay time.Duration
+	// MaxReplies is how many replies an email lists at most.
+	MaxReplies  int
+	Templates   NotificationTemplates
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+func DefaultNotificationConfig() NotificationConfig {
+	return NotificationConfig{
+		BatchDelay:  5 * time.Minute,
+		MaxReplies:  20,
+		Templates:   DefaultNotificationTemplates(),
+		MaxAttempts: 8,
+		Backoff:     time.Minute,
+		MaxBackoff:  6 * time.Hour,
+	}
+}
+
+// WithNotifications enables email notifications.
+func WithNotifications(cfg NotificationConfig) Option {
+	return func(s *Service) {
+		s.notify = &cfg
+	}
+}
+
+// NotificationData is what notification templates are rendered with. Article
+// is "" when Owner is set.
+type NotificationData struct {
+	Owner          bool
+	Article        string
+	Replies        []NotificationReply
+	More           int
+	UnsubscribeURL string
+}
+
+type NotificationReply struct {
+	Reply
+	// Link is the reply's permalink, if articles have URLs.
+	Link string
+}
+
+// parseNotifyEmail normalizes an address given by a commenter.
+func parseNotifyEmail(email string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil {
+		return "", Errorf(http.StatusBadRequest, "not a valid email address: %q", email)
+	}
+
+	return strings.ToLower(addr.Address), nil
+}
+
+// ParseNotifyEmails parses a comma separated list of email addresses, like
+// NotificationConfig.Owners or DigestConfig.Recipients, skipping blank entries.
+func ParseNotifyEmails(list string) ([]string, error) {
+	emails := []string{}
+	for _, entry := range strings.Split(list, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		email, err := parseNotifyEmail(entry)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+
+	return emails, nil
+}
+
+// unsubscribeToken returns the token that unsubscribes an email from an
+// article's replies, or from every reply for owners.
+func (s *Service) unsubscribeToken(email string, article string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(email + "\n" + article))
+	return payload + "." + s.sign("unsubscribe\n"+payload)
+}
+
+func (s *Service) parseUnsubscribeToken(token string) (string, string, bool) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !s.verifySignature("unsubscribe\n"+payload, sig) {
+		return "", "", false
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", "", false
+	}
+
+	email, article, ok := strings.Cut(string(b), "\n")
+	return email, article, ok
+}
+
+// confirmToken returns the token that confirms an email's subscriptions.
+func (s *Service) confirmToken(email string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(email))
+	return payload + "." + s.sign("confirm\n"+payload)
+}
+
+func (s *Service) parseConfirmToken(token string) (string, bool) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !s.verifySignature("confirm\n"+payload, sig) {
+		return "", false
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", false
+	}
+
+	return string(b), true
+}
+
+// enqueueNotifications queues emails about a new reply, in the transaction
+// inserting it. Commenters aren't told about shadowbanned replies, or their
+// own.
+func (s *Service) enqueueNotifications(ctx context.Context, db sqlx.ExtContext, reply Reply, authorEmail string) error {
+	now := time.Now()
+
+	unsubscribed, err := getEmailSubscribers(ctx, db, "", true)
+	if err != nil {
+		return err
+	}
+
+	owners := []string{}
+	for _, owner := range s.notify.Owners {
+		owner = strings.ToLower(strings.TrimSpace(owner))
+		if slices.Contains(unsubscribed, owner) {
+			continue
+		}
+		owners = append(owners, owner)
+
+		if err := insertEmailNotification(ctx, db, owner, "", reply.ID, now); err != nil {
+			return err
+		}
+	}
+
+	if !reply.Shadowbanned {
+		subscribers, err := getEmailSubscribers(ctx, db, reply.Article, false)
+		if err != nil {
+			return err
+		}
+
+		for _, email := range subscribers {
+			if email == authorEmail || slices.Contains(owners, email) {
+				continue
+			}
+			if err := insertEmailNotification(ctx, db, email, reply.Article, reply.ID, now); err != nil {
+				return err
+			}
+		}
+	}
+
+	if authorEmail != "" {
+		return insertEmailSubscription(ctx, db, authorEmail, reply.Article, now)
+	}
+
+	return nil
+}
+
+func (s *Service) notificationEmail(group emailNotificationGroup, replies Replies) (internal.Email, error) {
+	data := NotificationData{
+		Owner:          group.Article == "",
+		Article:        group.Article,
+		UnsubscribeURL: strings.ReplaceAll(s.notify.UnsubscribeURL, "{token}", url.QueryEscape(s.unsubscribeToken(group.Email, group.Article))),
+	}
+
+	if len(replies) > s.notify.MaxReplies {
+		data.More = len(replies) - s.notify.MaxReplies
+		replies = replies[:s.notify.MaxReplies]
+	}
+	for _, reply := range replies {
+		link := ""
+		if articleURL := s.articleURL(reply.Article); articleURL != "" {
+			link = fmt.Sprintf("%s#reply-%d", articleURL, reply.ID)
+		}
+		data.Replies = append(data.Replies, NotificationReply{Reply: reply, Link: link})
+	}
+
+	subject := fmt.Sprintf("%d new comments", len(replies)+data.More)
+	switch {
+	case len(replies) == 1:
+		subject = fmt.Sprintf("%s commented on %s", replies[0].AuthorName, replies[0].Article)
+	case !data.Owner:
+		subject += " on " + group.Article
+	}
+
+	var text, html bytes.Buffer
+	if err := s.notify.Templates.Text.Execute(&text, data); err != nil {
+		return internal.Email{}, fmt.Errorf("rendering text: %w", err)
+	}
+	if err := s.notify.Templates.HTML.Execute(&html, data); err != nil {
+		return internal.Email{}, fmt.Errorf("rendering html: %w", err)
+	}
+
+	return internal.Email{
+		From:    s.notify.From,
+		To:      group.Email,
+		Subject: subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<" + data.UnsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	}, nil
+}
+
+// confirmationEmail asks a commenter to confirm their email before they're
+// emailed about replies.
+func (s *Service) confirmationEmail(email string, article string) (internal.Email, error) {
+	data := struct {
+		Article    string
+		ConfirmURL string
+	}{
+		Article:    article,
+		ConfirmURL: strings.ReplaceAll(s.notify.ConfirmURL, "{token}", url.QueryEscape(s.confirmToken(email))),
+	}
+
+	var text, html bytes.Buffer
+	if err := confirmationTemplates.Text.Execute(&text, data); err != nil {
+		return internal.Email{}, fmt.Errorf("rendering text: %w", err)
+	}
+	if err := confirmationTemplates.HTML.Execute(&html, data); err != nil {
+		return internal.Email{}, fmt.Errorf("rendering html: %w", err)
+	}
+
+	return internal.Email{
+		From:    s.notify.From,
+		To:      email,
+		Subject: "Confirm your email address",
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// sendConfirmations emails every commenter waiting to confirm their email.
+func (s *Service) sendConfirmations(ctx context.Context, resp *SendNotificationsResponse) error {
+	emails, err := getUnconfirmedEmailSubscriptions(ctx, s.db, 100)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range emails {
+		email, err := s.confirmationEmail(sub.Email, sub.Article)
+		if err != nil {
+			return err
+		}
+
+		if err := s.notify.Mailer.Send(ctx, email); err != nil {
+			log.Printf("sending confirmation: %s", err)
+			resp.Failed++
+			continue
+		}
+		resp.Confirmations++
+
+		if err := markEmailConfirmationSent(ctx, s.db, sub.Email, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type SendNotificationsRequest struct {
+}
+
+type SendNotificationsResponse struct {
+	// Sent counts emails sent.
+	Sent int `json:"sent"`
+	// Confirmations counts emails sent asking commenters to confirm their
+	// email.
+	Confirmations int `json:"confirmations"`
+	// Failed counts emails that couldn't be sent, and will be retried.
+	Failed int `json:"failed"`
+	// Dead counts emails given up on after this attempt.
+	Dead int `json:"dead"`
+}
+
+// SendNotifications emails every recipient whose batch is due.
+func (s *Service) SendNotifications(ctx context.Context, req SendNotificationsRequest) (*SendNotificationsResponse, error) {
+	if s.notify == nil {
+		return nil, Errorf(http.StatusNotFound, "notifications are disabled")
+	}
+
+	resp := &SendNotificationsResponse{}
+	if err := s.sendConfirmations(ctx, resp); err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "sending confirmations: %w", err)
+	}
+
+	now := time.Now()
+	groups, err := getDueEmailNotificationGroups(ctx, s.db, now.Add(-s.notify.BatchDelay), now, 100)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting due notifications: %w", err)
+	}
+
+	for _, group := range groups {
+		notifications, err := getUnsentEmailNotifications(ctx, s.db, group)
+		if err != nil {
+			return nil, Errorf(http.StatusInternalServerError, "getting notifications: %w", err)
+		}
+
+		ids := []int{}
+		replies := Replies{}
+		attempts := 0
+		for _, n := range notifications {
+			ids = append(ids, n.ID)
+			if !n.Deleted {
+				replies = append(replies, n.Reply)
+			}
+			attempts = max(attempts, n.Attempts)
+		}
+
+		// Every reply might have been deleted in the meantime.
+		if len(replies) > 0 {
+			email, err := s.notificationEmail(group, replies)
+			if err != nil {
+				return nil, Errorf(http.StatusInternalServerError, "rendering notification: %w", err)
+			}
+
+			if err := s.notify.Mailer.Send(ctx, email); err != nil {
+				log.Printf("sending notification: %s", err)
+
+				attempts++
+				dead := attempts >= s.notify.MaxAttempts
+				if dead {
+					resp.Dead++
+				} else {
+					resp.Failed++
+				}
+
+				nextAttemptAt := time.Now().Add(retryBackoff(s.notify.Backoff, s.notify.MaxBackoff, attempts))
+				if err := markEmailNotificationsFailed(ctx, s.db, ids, attempts, nextAttemptAt, dead, time.Now()); err != nil {
+					return nil, Errorf(http.StatusInternalServerError, "marking notifications failed: %w", err)
+				}
+				continue
+			}
+			resp.Sent++
+		}
+
+		if err := markEmailNotificationsSent(ctx, s.db, ids, time.Now()); err != nil {
+			return nil, Errorf(http.StatusInternalServerError, "marking notifications sent: %w", err)
+		}
+	}
+
+	return resp, nil
+}
+
+// RunNotifications sends notifications every interval until ctx is done.
+func (s *Service) RunNotifications(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := s.SendNotifications(ctx, SendNotificationsRequest{}); err != nil {
+			log.Printf("sending notifications: %s", err)
+		}
+	}
+}
+
+type UnsubscribeRequest struct {
+	Token string
+}
+
+type UnsubscribeResponse struct {
+	// Article is the article unsubscribed from, or "" for every article.
+	Article string `json:"article"`
+}
+
+// Unsubscribe stops the emails an unsubscribe token was sent with.
+func (s *Service) Unsubscribe(ctx context.Context, req UnsubscribeRequest) (*UnsubscribeResponse, error) {
+	email, article, ok := s.parseUnsubscribeToken(req.Token)
+	if !ok {
+		return nil, Errorf(http.StatusBadRequest, "not a valid unsubscribe token")
+	}
+
+	if err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		if err := setEmailUnsubscribed(ctx, tx, email, article, time.Now()); err != nil {
+			return err
+		}
+		return deleteUnsentEmailNotifications(ctx, tx, email, article)
+	}); err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "unsubscribing: %w", err)
+	}
+
+	return &UnsubscribeResponse{Article: article}, nil
+}
+
+type ConfirmSubscriptionRequest struct {
+	Token string
+}
+
+type ConfirmSubscriptionResponse struct {
+}
+
+// ConfirmSubscription activates the subscriptions of the email a confirmation
+// token was sent to. Later subscriptions of the email are active right away.
+func (s *Service) ConfirmSubscription(ctx context.Context, req ConfirmSubscriptionRequest) (*ConfirmSubscriptionResponse, error) {
+	email, ok := s.parseConfirmToken(req.Token)
+	if !ok {
+		return nil, Errorf(http.StatusBadRequest, "not a valid confirmation token")
+	}
+
+	if err := confirmEmailSubscriptions(ctx, s.db, email, time.Now()); err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "confirming subscriptions: %w", err)
+	}
+
+	return &ConfirmSubscriptionResponse{}, nil
+}
@@ -0,0 +1,322 @@
+package gomments_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/arizard/gomments/internal"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedEmail struct {
+	To      string
+	Subject string
+	Header  mail.Header
+	Text    string
+	HTML    string
+}
+
+func parseEmail(r *require.Assertions, msg internal.FakeSMTPMessage) receivedEmail {
+	m, err := mail.ReadMessage(bytes.NewReader(msg.Data))
+	r.NoError(err)
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	r.NoError(err)
+
+	email := receivedEmail{To: strings.Join(msg.To, ","), Subject: subject, Header: m.Header}
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	r.NoError(err)
+	r.Equal("multipart/alternative", mediaType)
+
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		r.NoError(err)
+
+		body, err := io.ReadAll(quotedprintable.NewReader(part))
+		r.NoError(err)
+
+		switch {
+		case strings.HasPrefix(part.Header.Get("Content-Type"), "text/plain"):
+			email.Text = string(body)
+		case strings.HasPrefix(part.Header.Get("Content-Type"), "text/html"):
+			email.HTML = string(body)
+		}
+	}
+
+	return email
+}
+
+// emailsTo returns the emails received by an address, in order.
+func emailsTo(r *require.Assertions, server *internal.FakeSMTPServer, to string) []receivedEmail {
+	emails := []receivedEmail{}
+	for _, msg := range server.Messages() {
+		if strings.Join(msg.To, ",") == to {
+			emails = append(emails, parseEmail(r, msg))
+		}
+	}
+	return emails
+}
+
+func newNotificationFixture(t *testing.T, batchDelay time.Duration) (fixture, *internal.FakeSMTPServer) {
+	server, err := internal.NewFakeSMTPServer("127.0.0.1:0", nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	cfg := gomments.DefaultNotificationConfig()
+	cfg.Mailer = internal.NewSMTPMailer(internal.SMTPConfig{Addr: server.Addr()})
+	cfg.From = "Comments <comments@example.com>"
+	cfg.Owners = []string{"Owner@example.com"}
+	cfg.UnsubscribeURL = "https://comments.example.com/unsubscribe?token={token}"
+	cfg.ConfirmURL = "https://comments.example.com/confirm?token={token}"
+	cfg.BatchDelay = batchDelay
+	cfg.MaxReplies = 2
+
+	f := newFixture(t, gomments.WithNotifications(cfg), gomments.WithFeedConfig(gomments.FeedConfig{
+		Title:      "Comments",
+		ArticleURL: "https://example.com/posts/{article}",
+		Limit:      10,
+	}))
+
+	return f, server
+}
+
+func TestService_SendNotifications(t *testing.T) {
+	ctx := context.Background()
+	f, server := newNotificationFixture(t, 0)
+	s := f.service
+
+	submit := func(r *require.Assertions, article string, author string, notifyEmail string) int {
+		resp, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			Article:        article,
+			AuthorName:     author,
+			Body:           "hello from " + author,
+			NotifyEmail:    notifyEmail,
+			IdempotencyKey: uuid.NewString(),
+		})
+		r.NoError(err)
+		return resp.Reply.ID
+	}
+
+	_, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+		Article:        "test-article",
+		Body:           "hello",
+		NotifyEmail:    "not an email",
+		IdempotencyKey: uuid.NewString(),
+	})
+	var gsErr gomments.ServiceError
+	f.ErrorAs(err, &gsErr)
+	f.Equal(http.StatusBadRequest, gsErr.Status())
+
+	submit(f.Assertions, "test-article", "alice", "Alice <ALICE@example.com>")
+	bobID := submit(f.Assertions, "test-article", "bob", "bob@example.com")
+	submit(f.Assertions, "test-article", "erin", "")
+
+	resp, err := s.SendNotifications(ctx, gomments.SendNotificationsRequest{})
+	f.NoError(err)
+	f.Equal(&gomments.SendNotificationsResponse{Sent: 1, Confirmations: 2}, resp)
+
+	t.Run("asks commenters to confirm their email first", func(tt *testing.T) {
+		r := require.New(tt)
+
+		for _, to := range []string{"alice@example.com", "bob@example.com"} {
+			emails := emailsTo(r, server, to)
+			r.Len(emails, 1)
+			r.Equal("Confirm your email address", emails[0].Subject)
+			r.Contains(emails[0].Text, "new comments on test-article")
+
+			link := regexp.MustCompile(`https://comments\.example\.com/confirm\?token=\S+`).FindString(emails[0].Text)
+			u, err := url.Parse(link)
+			r.NoError(err)
+
+			_, err = s.ConfirmSubscription(ctx, gomments.ConfirmSubscriptionRequest{Token: u.Query().Get("token") + "x"})
+			var gsErr gomments.ServiceError
+			r.ErrorAs(err, &gsErr)
+			r.Equal(http.StatusBadRequest, gsErr.Status())
+
+			_, err = s.ConfirmSubscription(ctx, gomments.ConfirmSubscriptionRequest{Token: u.Query().Get("token")})
+			r.NoError(err)
+		}
+	})
+
+	submit(f.Assertions, "test-article", "carol", "")
+	submit(f.Assertions, "other-article", "dave", "")
+
+	resp, err = s.SendNotifications(ctx, gomments.SendNotificationsRequest{})
+	f.NoError(err)
+	f.Equal(&gomments.SendNotificationsResponse{Sent: 3}, resp)
+
+	t.Run("emails owners every reply", func(tt *testing.T) {
+		r := require.New(tt)
+
+		emails := emailsTo(r, server, "owner@example.com")
+		r.Len(emails, 2)
+		r.Equal("3 new comments", emails[0].Subject)
+		r.Contains(emails[0].Text, "New comments on your site:")
+		r.Contains(emails[0].Text, "hello from alice")
+		r.Contains(emails[0].Text, "hello from bob")
+		r.Contains(emails[0].Text, "...and 1 more.")
+		r.NotContains(emails[0].Text, "hello from erin")
+		r.Contains(emails[0].HTML, "<strong>alice</strong>")
+		r.Equal("List-Unsubscribe=One-Click", emails[0].Header.Get("List-Unsubscribe-Post"))
+		r.Equal("2 new comments", emails[1].Subject)
+	})
+
+	t.Run("emails commenters later replies on their article", func(tt *testing.T) {
+		r := require.New(tt)
+
+		emails := emailsTo(r, server, "alice@example.com")
+		r.Len(emails, 2)
+		r.Equal("carol commented on test-article", emails[1].Subject)
+		r.Contains(emails[1].Text, "https://example.com/posts/test-article#reply-")
+		r.Contains(emails[1].HTML, "hello from carol")
+		r.NotContains(emails[1].Text, "hello from dave")
+
+		emails = emailsTo(r, server, "bob@example.com")
+		r.Len(emails, 2)
+		r.Equal("carol commented on test-article", emails[1].Subject)
+	})
+
+	t.Run("unsubscribes with the token from the email", func(tt *testing.T) {
+		r := require.New(tt)
+
+		emails := emailsTo(r, server, "alice@example.com")
+		link := strings.Trim(emails[1].Header.Get("List-Unsubscribe"), "<>")
+		u, err := url.Parse(link)
+		r.NoError(err)
+		r.Contains(emails[1].Text, link)
+
+		_, err = s.Unsubscribe(ctx, gomments.UnsubscribeRequest{Token: u.Query().Get("token") + "x"})
+		var gsErr gomments.ServiceError
+		r.ErrorAs(err, &gsErr)
+		r.Equal(http.StatusBadRequest, gsErr.Status())
+
+		unsubResp, err := s.Unsubscribe(ctx, gomments.UnsubscribeRequest{Token: u.Query().Get("token")})
+		r.NoError(err)
+		r.Equal("test-article", unsubResp.Article)
+
+		// commenting again doesn't resubscribe
+		submit(r, "test-article", "alice", "alice@example.com")
+		submit(r, "test-article", "grace", "")
+		_, err = s.ModerateReply(ctx, gomments.ModerateReplyRequest{ReplyID: bobID, Action: gomments.ModerationActionDelete})
+		r.NoError(err)
+
+		resp, err := s.SendNotifications(ctx, gomments.SendNotificationsRequest{})
+		r.NoError(err)
+		r.Equal(2, resp.Sent)
+		r.Zero(resp.Confirmations)
+
+		r.Len(emailsTo(r, server, "alice@example.com"), 2)
+		r.Len(emailsTo(r, server, "bob@example.com"), 3)
+		r.Len(emailsTo(r, server, "owner@example.com"), 3)
+	})
+}
+
+func TestService_SendNotifications_batches(t *testing.T) {
+	ctx := context.Background()
+	f, server := newNotificationFixture(t, time.Hour)
+	s := f.service
+
+	for _, author := range []string{"alice", "bob"} {
+		_, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			Article:        "busy-article",
+			AuthorName:     author,
+			Body:           "hello",
+			IdempotencyKey: uuid.NewString(),
+		})
+		f.NoError(err)
+	}
+
+	resp, err := s.SendNotifications(ctx, gomments.SendNotificationsRequest{})
+	f.NoError(err)
+	f.Equal(&gomments.SendNotificationsResponse{}, resp)
+	f.Empty(server.Messages())
+}
+
+// failingMailer fails to send every email.
+type failingMailer struct {
+	attempts atomic.Int64
+}
+
+func (m *failingMailer) Send(ctx context.Context, email internal.Email) error {
+	m.attempts.Add(1)
+	return errors.New("connection refused")
+}
+
+func TestService_SendNotifications_retries(t *testing.T) {
+	ctx := context.Background()
+	mailer := &failingMailer{}
+
+	cfg := gomments.DefaultNotificationConfig()
+	cfg.Mailer = mailer
+	cfg.Owners = []string{"owner@example.com"}
+	cfg.BatchDelay = 0
+	cfg.MaxAttempts = 2
+	cfg.Backoff = 20 * time.Millisecond
+	cfg.MaxBackoff = 20 * time.Millisecond
+
+	f := newFixture(t, gomments.WithNotifications(cfg))
+	s := f.service
+
+	_, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+		Article:        "test-article",
+		Body:           "hello",
+		IdempotencyKey: uuid.NewString(),
+	})
+	f.NoError(err)
+
+	resp, err := s.SendNotifications(ctx, gomments.SendNotificationsRequest{})
+	f.NoError(err)
+	f.Equal(&gomments.SendNotificationsResponse{Failed: 1}, resp)
+
+	// backing off
+	resp, err = s.SendNotifications(ctx, gomments.SendNotificationsRequest{})
+	f.NoError(err)
+	f.Equal(&gomments.SendNotificationsResponse{}, resp)
+
+	time.Sleep(30 * time.Millisecond)
+	resp, err = s.SendNotifications(ctx, gomments.SendNotificationsRequest{})
+	f.NoError(err)
+	f.Equal(&gomments.SendNotificationsResponse{Dead: 1}, resp)
+
+	// given up on
+	time.Sleep(30 * time.Millisecond)
+	resp, err = s.SendNotifications(ctx, gomments.SendNotificationsRequest{})
+	f.NoError(err)
+	f.Equal(&gomments.SendNotificationsResponse{}, resp)
+	f.Equal(int64(2), mailer.attempts.Load())
+}
+
+func TestParseNotifyEmails(t *testing.T) {
+	r := require.New(t)
+
+	emails, err := gomments.ParseNotifyEmails(" Owner@Example.com, mod@example.com ,,")
+	r.NoError(err)
+	r.Equal([]string{"owner@example.com", "mod@example.com"}, emails)
+
+	emails, err = gomments.ParseNotifyEmails("")
+	r.NoError(err)
+	r.Empty(emails)
+
+	_, err = gomments.ParseNotifyEmails("owner@example.com, not an email")
+	r.ErrorContains(err, "not a valid email address")
+}
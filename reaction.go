@@ -0,0 +1,129 @@
+package gomments
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// ReactionKind is a kind of reaction readers can leave, along with how
+// clients should display it.
+type ReactionKind struct {
+	Name  string `json:"name"`
+	Emoji string `json:"emoji,omitempty"`
+	Label string `json:"label,omitempty"`
+}
+
+// ReactionConfig defines the reaction kinds for a site. Articles can override
+// the kinds available to them by listing kind names defined in Kinds.
+type ReactionConfig struct {
+	Kinds    []ReactionKind      `json:"kinds"`
+	Articles map[string][]string `json:"articles,omitempty"`
+}
+
+func DefaultReactionConfig() ReactionConfig {
+	return ReactionConfig{
+		Kinds: []ReactionKind{
+			{Name: "like", Emoji: "👍", Label: "Like"},
+		},
+	}
+}
+
+var reReactionKindName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+func (cfg ReactionConfig) Validate() error {
+	if len(cfg.Kinds) == 0 {
+		return fmt.Errorf("requires at least one reaction kind")
+	}
+
+	names := map[string]bool{}
+	for _, kind := range cfg.Kinds {
+		if !reReactionKindName.MatchString(kind.Name) {
+			return fmt.Errorf("reaction kind name must be 1-32 lowercase letters, digits, - or _: %q", kind.Name)
+		}
+		if names[kind.Name] {
+			return fmt.Errorf("duplicate reaction kind: %q", kind.Name)
+		}
+		names[kind.Name] = true
+	}
+
+	for article, kinds := range cfg.Articles {
+		for _, name := range kinds {
+			if !names[name] {
+				return fmt.Errorf("article %q uses undefined reaction kind: %q", article, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// LoadReactionConfig reads a ReactionConfig from a JSON file.
+func LoadReactionConfig(p string) (ReactionConfig, error) {
+	cfg := ReactionConfig{}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return cfg, fmt.Errorf("reading reaction config: %w", err)
+	}
+
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing reaction config: %w", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("validating reaction config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// WithReactionConfig replaces the default reaction kinds.
+func WithReactionConfig(cfg ReactionConfig) Option {
+	return func(s *Service) {
+		s.reactions = cfg
+	}
+}
+
+// reactionKinds returns the reaction kinds available on an article.
+func (s *Service) reactionKinds(article string) []ReactionKind {
+	names, ok := s.reactions.Articles[article]
+	if !ok {
+		return s.reactions.Kinds
+	}
+
+	kinds := []ReactionKind{}
+	for _, kind := range s.reactions.Kinds {
+		for _, name := range names {
+			if kind.Name == name {
+				kinds = append(kinds, kind)
+			}
+		}
+	}
+
+	return kinds
+}
+
+func (s *Service) isReactionKind(article string, name string) bool {
+	for _, kind := range s.reactionKinds(article) {
+		if kind.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+type GetReactionKindsRequest struct {
+	Article string
+}
+
+type GetReactionKindsResponse struct {
+	Kinds []ReactionKind `json:"kinds"`
+}
+
+func (s *Service) GetReactionKinds(ctx context.Context, req GetReactionKindsRequest) (*GetReactionKindsResponse, error) {
+	return &GetReactionKindsResponse{Kinds: s.reactionKinds(req.Article)}, nil
+}
@@ -0,0 +1,92 @@
+package gomments_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arizard/gomments"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_ReactionKinds(t *testing.T) {
+	cfg := gomments.ReactionConfig{
+		Kinds: []gomments.ReactionKind{
+			{Name: "like", Emoji: "👍", Label: "Like"},
+			{Name: "heart", Emoji: "❤️", Label: "Love"},
+			{Name: "laugh", Emoji: "😂", Label: "Funny"},
+		},
+		Articles: map[string][]string{
+			"serious-article": {"like"},
+		},
+	}
+
+	ctx := context.Background()
+	f := newFixture(t, gomments.WithReactionConfig(cfg))
+	s := f.service
+
+	kindsResp, err := s.GetReactionKinds(ctx, gomments.GetReactionKindsRequest{Article: "test-article"})
+	f.NoError(err)
+	f.Equal(cfg.Kinds, kindsResp.Kinds)
+
+	kindsResp, err = s.GetReactionKinds(ctx, gomments.GetReactionKindsRequest{Article: "serious-article"})
+	f.NoError(err)
+	f.Equal(cfg.Kinds[:1], kindsResp.Kinds)
+
+	createResp, err := s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "laugh", ClientIP: "192.0.2.1"})
+	f.NoError(err)
+	f.Equal(gomments.ArticleReactionStats{"like": 0, "heart": 0, "laugh": 1}, createResp.Counts)
+
+	_, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "serious-article", Kind: "laugh", ClientIP: "192.0.2.1"})
+	f.ErrorContains(err, "not a valid kind")
+
+	statsResp, err := s.GetReactionStatsByArticles(ctx, gomments.GetReactionStatsByArticlesRequest{
+		Articles: []string{"test-article", "serious-article"},
+	})
+	f.NoError(err)
+	f.Equal(gomments.ArticleReactionStats{"like": 0, "heart": 0, "laugh": 1}, statsResp.Stats["test-article"])
+	f.Equal(gomments.ArticleReactionStats{"like": 0}, statsResp.Stats["serious-article"])
+}
+
+func TestLoadReactionConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "loads_config",
+			config: `{"kinds": [{"name": "like", "emoji": "👍"}, {"name": "wow"}], "articles": {"a": ["wow"]}}`,
+		},
+		{
+			name:   "rejects_duplicate_kinds",
+			config: `{"kinds": [{"name": "like"}, {"name": "like"}]}`,
+			err:    "duplicate reaction kind",
+		},
+		{
+			name:   "rejects_invalid_names",
+			config: `{"kinds": [{"name": "Thumbs Up"}]}`,
+			err:    "reaction kind name must be",
+		},
+		{
+			name:   "rejects_undefined_article_kinds",
+			config: `{"kinds": [{"name": "like"}], "articles": {"a": ["wow"]}}`,
+			err:    "undefined reaction kind",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(tt *testing.T) {
+			r := require.New(tt)
+			p := filepath.Join(tt.TempDir(), "reactions.json")
+			r.NoError(os.WriteFile(p, []byte(tc.config), 0o600))
+
+			_, err := gomments.LoadReactionConfig(p)
+			if tc.err == "" {
+				r.NoError(err)
+			} else {
+				r.ErrorContains(err, tc.err)
+			}
+		})
+	}
+}
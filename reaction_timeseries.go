@@ -0,0 +1,135 @@
+package gomments
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type ReactionInterval string
+
+const (
+	ReactionIntervalDay  ReactionInterval = "day"
+	ReactionIntervalWeek ReactionInterval = "week"
+)
+
+// maxReactionBuckets bounds how many buckets a single request can return.
+const maxReactionBuckets = 366
+
+// truncate returns the start of the interval containing t, in UTC. Weeks
+// start on Monday.
+func (i ReactionInterval) truncate(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	if i == ReactionIntervalWeek {
+		offset := (int(day.Weekday()) + 6) % 7
+		day = day.AddDate(0, 0, -offset)
+	}
+
+	return day
+}
+
+func (i ReactionInterval) next(t time.Time) time.Time {
+	if i == ReactionIntervalWeek {
+		return t.AddDate(0, 0, 7)
+	}
+
+	return t.AddDate(0, 0, 1)
+}
+
+type ReactionBucket struct {
+	Start  time.Time      `json:"start"`
+	Counts map[string]int `json:"counts"`
+}
+
+type GetReactionTimeSeriesRequest struct {
+	Articles []string
+	Interval ReactionInterval
+	// Start and End bound the series, and default to the last 30 days. Start
+	// is rounded down to the start of its interval, and End is exclusive.
+	Start time.Time
+	End   time.Time
+}
+
+type GetReactionTimeSeriesResponse struct {
+	Interval ReactionInterval            `json:"interval"`
+	Series   map[string][]ReactionBucket `json:"series"`
+}
+
+// GetReactionTimeSeries counts reactions per kind per day or week. Every
+// interval between Start and End has a bucket, even when it has no reactions.
+func (s *Service) GetReactionTimeSeries(ctx context.Context, req GetReactionTimeSeriesRequest) (*GetReactionTimeSeriesResponse, error) {
+	if len(req.Articles) == 0 {
+		return nil, Errorf(http.StatusBadRequest, "requires at least one article")
+	}
+
+	if req.Interval == "" {
+		req.Interval = ReactionIntervalDay
+	}
+	if req.Interval != ReactionIntervalDay && req.Interval != ReactionIntervalWeek {
+		return nil, Errorf(http.StatusBadRequest, "not a valid interval: %q", req.Interval)
+	}
+
+	if req.End.IsZero() {
+		req.End = time.Now()
+	}
+	if req.Start.IsZero() {
+		req.Start = req.End.AddDate(0, 0, -30)
+	}
+	start := req.Interval.truncate(req.Start)
+	if !start.Before(req.End) {
+		return nil, Errorf(http.StatusBadRequest, "start must be before end")
+	}
+
+	buckets := []time.Time{}
+	for t := start; t.Before(req.End); t = req.Interval.next(t) {
+		if len(buckets) == maxReactionBuckets {
+			return nil, Errorf(http.StatusBadRequest, "too many %ss between start and end, max is %d", req.Interval, maxReactionBuckets)
+		}
+		buckets = append(buckets, t)
+	}
+
+	aggs, err := getReactionTimeSeries(ctx, s.db, req.Articles, req.Interval, start, req.End)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "aggregating reactions: %w", err)
+	}
+
+	resp := &GetReactionTimeSeriesResponse{
+		Interval: req.Interval,
+		Series:   map[string][]ReactionBucket{},
+	}
+
+	index := map[string]map[time.Time]ReactionBucket{}
+	for _, article := range req.Articles {
+		kinds := s.reactionKinds(article)
+		series := make([]ReactionBucket, 0, len(buckets))
+		index[article] = map[time.Time]ReactionBucket{}
+		for _, t := range buckets {
+			bucket := ReactionBucket{Start: t, Counts: map[string]int{}}
+			for _, kind := range kinds {
+				bucket.Counts[kind.Name] = 0
+			}
+			series = append(series, bucket)
+			index[article][t] = bucket
+		}
+		resp.Series[article] = series
+	}
+
+	for _, agg := range aggs {
+		bucketStart, err := time.Parse(time.DateOnly, agg.Bucket)
+		if err != nil {
+			return nil, Errorf(http.StatusInternalServerError, "parsing bucket: %w", err)
+		}
+
+		bucket, ok := index[agg.Article][bucketStart]
+		if !ok {
+			continue
+		}
+		if _, ok := bucket.Counts[agg.Kind]; !ok {
+			continue
+		}
+		bucket.Counts[agg.Kind] = agg.Count
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,113 @@
+package gomments_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/google/uuid"
+)
+
+func TestService_GetReactionTimeSeries(t *testing.T) {
+	reactions := []struct {
+		article   string
+		kind      string
+		createdAt string
+		deleted   bool
+	}{
+		{"article-a", "like", "2026-03-02 09:00:00", false}, // Monday
+		{"article-a", "like", "2026-03-02 23:59:59", false},
+		{"article-a", "like", "2026-03-04 12:00:00", false},
+		{"article-a", "like", "2026-03-04 13:00:00", true},
+		{"article-a", "like", "2026-03-09 00:00:00", false}, // next Monday
+		{"article-b", "like", "2026-03-08 23:00:00", false}, // Sunday
+		{"article-b", "like", "2026-02-28 12:00:00", false}, // before start
+	}
+
+	day := func(s string) time.Time {
+		t, _ := time.Parse(time.DateOnly, s)
+		return t
+	}
+
+	tests := []struct {
+		name string
+		req  gomments.GetReactionTimeSeriesRequest
+		want map[string][]int
+		err  string
+	}{
+		{
+			name: "counts_per_day",
+			req: gomments.GetReactionTimeSeriesRequest{
+				Articles: []string{"article-a", "article-b"},
+				Interval: gomments.ReactionIntervalDay,
+				Start:    day("2026-03-02"),
+				End:      day("2026-03-05"),
+			},
+			want: map[string][]int{
+				"article-a": {2, 0, 1},
+				"article-b": {0, 0, 0},
+			},
+		},
+		{
+			name: "counts_per_week",
+			req: gomments.GetReactionTimeSeriesRequest{
+				Articles: []string{"article-a", "article-b"},
+				Interval: gomments.ReactionIntervalWeek,
+				Start:    day("2026-03-04"), // rounded down to Monday
+				End:      day("2026-03-16"),
+			},
+			want: map[string][]int{
+				"article-a": {3, 1},
+				"article-b": {1, 0},
+			},
+		},
+		{
+			name: "rejects_unknown_interval",
+			req: gomments.GetReactionTimeSeriesRequest{
+				Articles: []string{"article-a"},
+				Interval: "fortnight",
+			},
+			err: "not a valid interval",
+		},
+		{
+			name: "rejects_too_many_buckets",
+			req: gomments.GetReactionTimeSeriesRequest{
+				Articles: []string{"article-a"},
+				Start:    day("2020-01-01"),
+				End:      day("2026-01-01"),
+			},
+			err: "too many days",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(tt *testing.T) {
+			ctx := context.Background()
+			f := newFixture(tt)
+			s := f.service
+
+			for _, r := range reactions {
+				_, err := f.db.Exec(
+					"insert into article_reaction (article, kind, deletion_key, deleted, created_at) values (?, ?, ?, ?, ?)",
+					r.article, r.kind, uuid.NewString(), r.deleted, r.createdAt,
+				)
+				f.NoError(err)
+			}
+
+			got, err := s.GetReactionTimeSeries(ctx, tc.req)
+			if tc.err != "" {
+				f.ErrorContains(err, tc.err)
+				return
+			}
+			f.NoError(err)
+
+			for article, counts := range tc.want {
+				f.Len(got.Series[article], len(counts))
+				for i, count := range counts {
+					f.Equal(count, got.Series[article][i].Counts["like"], "%s bucket %d", article, i)
+				}
+			}
+			f.Equal(day("2026-03-02"), got.Series["article-a"][0].Start)
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package gomments
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+type remark42Comment struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	User struct {
+		Name string `json:"name"`
+	} `json:"user"`
+	Locator struct {
+		Site string `json:"site"`
+		URL  string `json:"url"`
+	} `json:"locator"`
+	Time    time.Time `json:"time"`
+	Deleted bool      `json:"delete"`
+}
+
+// ParseRemark42 reads the replies in a Remark42 backup, which can be
+// gzipped. Threads are identified by their page's URL.
+//
+// Remark42 renders comments to HTML, which is converted back to text.
+func ParseRemark42(r io.Reader, rule ArticleRule) ([]ImportReply, []ImportMapping, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading gzipped remark42 backup: %w", err)
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+
+	dec := json.NewDecoder(br)
+
+	// The backup starts with its metadata, followed by a comment per line.
+	var meta struct {
+		Version int `json:"version"`
+	}
+	if err := dec.Decode(&meta); err != nil {
+		return nil, nil, fmt.Errorf("reading remark42 metadata: %w", err)
+	}
+	if meta.Version != 1 {
+		return nil, nil, fmt.Errorf("unsupported remark42 backup version: %d", meta.Version)
+	}
+
+	mappings := newImportMappings(rule)
+	replies := []ImportReply{}
+
+	for {
+		var c remark42Comment
+		if err := dec.Decode(&c); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("reading remark42 comment: %w", err)
+		}
+
+		article := mappings.add(c.Locator.URL)
+		if article == "" {
+			continue
+		}
+
+		replies = append(replies, ImportReply{
+			Source:     "remark42",
+			SourceID:   c.Locator.Site + ":" + c.ID,
+			Article:    article,
+			AuthorName: c.User.Name,
+			Body:       htmlToText(c.Text),
+			CreatedAt:  c.Time,
+			Deleted:    c.Deleted,
+		})
+	}
+
+	return replies, mappings.mappings, nil
+}
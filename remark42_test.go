@@ -0,0 +1,50 @@
+package gomments_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/stretchr/testify/require"
+)
+
+const remark42Backup = `{"version":1,"users":[],"posts":[{"url":"https://example.com/posts/hello-world/","count":2}]}
+{"id":"7a3d","pid":"","text":"<p>Hello &amp; welcome</p>\n","orig":"Hello & welcome","user":{"name":"Alice","id":"github_1"},"locator":{"site":"blog","url":"https://example.com/posts/hello-world/"},"score":0,"votes":{},"time":"2020-01-02T03:04:05Z"}
+{"id":"8b4e","pid":"7a3d","text":"","orig":"","user":{"name":"Bob","id":"github_2"},"locator":{"site":"blog","url":"https://example.com/posts/hello-world/"},"score":0,"time":"2020-01-03T03:04:05Z","delete":true}
+`
+
+func TestParseRemark42(t *testing.T) {
+	r := require.New(t)
+
+	replies, mappings, err := gomments.ParseRemark42(strings.NewReader(remark42Backup), gomments.ArticleRule{})
+	r.NoError(err)
+
+	r.Equal([]gomments.ImportMapping{
+		{Thread: "https://example.com/posts/hello-world/", Article: "hello-world", Replies: 2},
+	}, mappings)
+	r.Equal(gomments.ImportReply{
+		Source:     "remark42",
+		SourceID:   "blog:7a3d",
+		Article:    "hello-world",
+		AuthorName: "Alice",
+		Body:       "Hello & welcome",
+		CreatedAt:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}, replies[0])
+	r.True(replies[1].Deleted)
+
+	t.Run("reads gzipped backups", func(tt *testing.T) {
+		r := require.New(tt)
+
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(remark42Backup))
+		r.NoError(zw.Close())
+
+		gzipped, _, err := gomments.ParseRemark42(&buf, gomments.ArticleRule{})
+		r.NoError(err)
+		r.Equal(replies, gzipped)
+	})
+}
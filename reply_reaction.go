@@ -0,0 +1,168 @@
+package gomments
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type ReplyReactionStats map[string]int
+
+func (stats ReplyReactionStats) Total() int {
+	total := 0
+	for _, count := range stats {
+		total += count
+	}
+
+	return total
+}
+
+// zeroReplyReactionStats returns stats with a zero count for every reaction
+// kind available on the article.
+func (s *Service) zeroReplyReactionStats(article string) ReplyReactionStats {
+	stats := ReplyReactionStats{}
+	for _, kind := range s.reactionKinds(article) {
+		stats[kind.Name] = 0
+	}
+
+	return stats
+}
+
+// fillReplyReactions sets the reaction counts on each reply.
+func (s *Service) fillReplyReactions(ctx context.Context, db sqlx.ExtContext, replies Replies) error {
+	if len(replies) == 0 {
+		return nil
+	}
+
+	ids := make([]int, 0, len(replies))
+	byID := map[int]*Reply{}
+	for i := range replies {
+		replies[i].Reactions = s.zeroReplyReactionStats(replies[i].Article)
+		ids = append(ids, replies[i].ID)
+		byID[replies[i].ID] = &replies[i]
+	}
+
+	aggs, err := getReactionStatsByReplies(ctx, db, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, agg := range aggs {
+		reply := byID[agg.ReplyID]
+		if _, ok := reply.Reactions[agg.Kind]; !ok {
+			continue
+		}
+		reply.Reactions[agg.Kind] = agg.Count
+	}
+
+	return nil
+}
+
+type CreateReplyReactionRequest struct {
+	Kind     string
+	ReplyID  int
+	ClientIP string
+}
+
+type CreateReplyReactionResponse struct {
+	// ID identifies the reaction to moderators.
+	ID          int    `json:"id,omitempty"`
+	DeletionKey string `json:"deletion_key,omitempty"`
+	Active      bool   `json:"active"`
+	Count       int    `json:"count"`
+	// Counts has the reply's count of every reaction kind, as of the write.
+	Counts ReplyReactionStats `json:"counts"`
+}
+
+// CreateReplyReaction toggles the client's reaction of a kind on a reply,
+// like CreateReaction does for articles.
+func (s *Service) CreateReplyReaction(ctx context.Context, req CreateReplyReactionRequest) (*CreateReplyReactionResponse, error) {
+	reply, err := getReplyByID(ctx, s.db, req.ReplyID)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting reply: %w", err)
+	}
+	if reply == nil || reply.Deleted || !s.replyVisibleTo(*reply, req.ClientIP) {
+		return nil, Errorf(http.StatusNotFound, "reply not found: %d", req.ReplyID)
+	}
+
+	if !s.isReactionKind(reply.Article, req.Kind) {
+		return nil, Errorf(http.StatusBadRequest, "not a valid kind: %q", req.Kind)
+	}
+
+	clientKey, shadowbanned, err := s.reactionClient(ctx, req.ClientIP)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &CreateReplyReactionResponse{}
+
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		removed, err := deleteReplyReactionByClient(ctx, tx, req.ReplyID, req.Kind, clientKey)
+		if err != nil {
+			return err
+		}
+
+		if !removed {
+			resp.Active = true
+			inserted, err := insertReplyReaction(ctx, tx, insertReplyReactionParams{
+				ReplyID:      req.ReplyID,
+				Kind:         req.Kind,
+				DeletionKey:  uuid.New().String(),
+				ClientKey:    clientKey,
+				Shadowbanned: shadowbanned,
+			})
+			if err != nil {
+				return err
+			}
+			resp.ID, resp.DeletionKey = inserted.ID, inserted.DeletionKey
+		}
+
+		resp.Counts, err = s.replyReactionCounts(ctx, tx, *reply)
+		if err != nil || !resp.Active {
+			return err
+		}
+
+		return s.enqueueReactionCreated(ctx, tx, WebhookReactionData{
+			ID:      resp.ID,
+			ReplyID: req.ReplyID,
+			Kind:    req.Kind,
+			Counts:  resp.Counts,
+		})
+	})
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "toggling reply reaction: %w", err)
+	}
+	resp.Count = resp.Counts[req.Kind]
+
+	if !reply.Shadowbanned {
+		s.stream.publish(reply.Article, StreamEvent{
+			Type: StreamEventReplyReactions,
+			Data: ReplyReactionsStreamData{ReplyID: req.ReplyID, Counts: resp.Counts},
+		})
+	}
+
+	return resp, nil
+}
+
+// replyVisibleTo reports whether a client can see a reply. Like
+// getRepliesForArticle, shadowbanned replies are only shown to their author.
+func (s *Service) replyVisibleTo(reply Reply, clientIP string) bool {
+	if !reply.Shadowbanned {
+		return true
+	}
+
+	clientHash := s.hashClientIP(clientIP)
+	return clientHash != "" && clientHash == reply.ClientHash
+}
+
+// replyReactionCounts counts each reaction kind available on a reply.
+func (s *Service) replyReactionCounts(ctx context.Context, db sqlx.ExtContext, reply Reply) (ReplyReactionStats, error) {
+	replies := Replies{reply}
+	if err := s.fillReplyReactions(ctx, db, replies); err != nil {
+		return nil, err
+	}
+
+	return replies[0].Reactions, nil
+}
@@ -0,0 +1,121 @@
+package gomments_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/arizard/gomments"
+	"github.com/google/uuid"
+)
+
+func TestService_CreateReplyReaction(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	s := f.service
+
+	ids := []int{}
+	for _, body := range []string{"first", "second", "third"} {
+		resp, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			IdempotencyKey: uuid.NewString(),
+			Article:        "test-article",
+			Body:           body,
+		})
+		f.NoError(err)
+		ids = append(ids, resp.Reply.ID)
+	}
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		resp, err := s.CreateReplyReaction(ctx, gomments.CreateReplyReactionRequest{ReplyID: ids[0], Kind: "like", ClientIP: ip})
+		f.NoError(err)
+		f.True(resp.Active)
+	}
+
+	resp, err := s.CreateReplyReaction(ctx, gomments.CreateReplyReactionRequest{ReplyID: ids[1], Kind: "like", ClientIP: "192.0.2.1"})
+	f.NoError(err)
+	f.Equal(1, resp.Count)
+	f.Equal(gomments.ReplyReactionStats{"like": 1}, resp.Counts)
+
+	resp, err = s.CreateReplyReaction(ctx, gomments.CreateReplyReactionRequest{ReplyID: ids[2], Kind: "like", ClientIP: "192.0.2.1"})
+	f.NoError(err)
+	deleteResp, err := s.DeleteReaction(ctx, gomments.DeleteReactionRequest{DeletionKey: resp.DeletionKey})
+	f.NoError(err)
+	f.Equal(ids[2], deleteResp.ReplyID)
+	f.Equal(gomments.ReplyReactionStats{"like": 0}, deleteResp.ReplyCounts)
+	deleteJSON, err := json.Marshal(deleteResp)
+	f.NoError(err)
+	f.JSONEq(fmt.Sprintf(`{"reply_id": %d, "counts": {"like": 0}}`, ids[2]), string(deleteJSON))
+
+	_, err = s.CreateReplyReaction(ctx, gomments.CreateReplyReactionRequest{ReplyID: 9999, Kind: "like", ClientIP: "192.0.2.1"})
+	f.ErrorContains(err, "reply not found")
+
+	_, err = s.CreateReplyReaction(ctx, gomments.CreateReplyReactionRequest{ReplyID: ids[0], Kind: "non-existent-reaction", ClientIP: "192.0.2.1"})
+	f.ErrorContains(err, "not a valid kind")
+
+	newResp, err := s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "test-article"})
+	f.NoError(err)
+	f.Len(newResp.Replies, 3)
+	f.Equal(ids[2], newResp.Replies[0].ID)
+
+	topResp, err := s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "test-article", Sort: "top"})
+	f.NoError(err)
+	f.Len(topResp.Replies, 3)
+	f.Equal(ids[0], topResp.Replies[0].ID)
+	f.Equal(gomments.ReplyReactionStats{"like": 2}, topResp.Replies[0].Reactions)
+	f.Equal(ids[1], topResp.Replies[1].ID)
+	f.Equal(gomments.ReplyReactionStats{"like": 1}, topResp.Replies[1].Reactions)
+	f.Equal(ids[2], topResp.Replies[2].ID)
+	f.Equal(gomments.ReplyReactionStats{"like": 0}, topResp.Replies[2].Reactions)
+
+	_, err = s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "test-article", Sort: "hot"})
+	f.ErrorContains(err, "not a valid sort")
+}
+
+func TestService_CreateReplyReaction_shadowbanned(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	s := f.service
+
+	_, err := s.CreateBan(ctx, gomments.CreateBanRequest{
+		Actor: "mod",
+		Kind:  gomments.BanKindIPHash,
+		Value: "203.0.113.7",
+		Mode:  gomments.BanModeShadow,
+	})
+	f.NoError(err)
+
+	submitResp, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+		IdempotencyKey: uuid.NewString(),
+		Article:        "test-article",
+		Body:           "hello",
+		ClientIP:       "203.0.113.7",
+	})
+	f.NoError(err)
+	replyID := submitResp.Reply.ID
+
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	subResp, err := s.SubscribeReplies(subCtx, gomments.SubscribeRepliesRequest{Article: "test-article", ClientIP: "192.0.2.1"})
+	f.NoError(err)
+
+	_, err = s.CreateReplyReaction(ctx, gomments.CreateReplyReactionRequest{ReplyID: replyID, Kind: "like", ClientIP: "192.0.2.1"})
+	f.ErrorContains(err, "reply not found")
+
+	// the author still sees their reply, and can react to it
+	resp, err := s.CreateReplyReaction(ctx, gomments.CreateReplyReactionRequest{ReplyID: replyID, Kind: "like", ClientIP: "203.0.113.7"})
+	f.NoError(err)
+	f.True(resp.Active)
+
+	_, err = s.DeleteReaction(ctx, gomments.DeleteReactionRequest{DeletionKey: resp.DeletionKey, ClientIP: "192.0.2.1"})
+	f.ErrorContains(err, "reaction not found")
+
+	_, err = s.DeleteReaction(ctx, gomments.DeleteReactionRequest{DeletionKey: resp.DeletionKey, ClientIP: "203.0.113.7"})
+	f.NoError(err)
+
+	select {
+	case event := <-subResp.Events:
+		f.Failf("published an event about a shadowbanned reply", "%+v", event)
+	default:
+	}
+}
@@ -2,15 +2,23 @@ package gomments
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"regexp"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
 	"github.com/aquilax/tripcode"
+	"github.com/arizard/gomments/internal"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 )
@@ -18,16 +26,98 @@ import (
 type Service struct {
 	db       *sqlx.DB
 	sessions sync.Map
+	// banPatterns holds the compiled author name patterns of bans.
+	banPatterns sync.Map
+	// honeypotReplies counts the replies caught by the honeypot, to give
+	// them distinct IDs.
+	honeypotReplies atomic.Int64
+
+	ipHashSalt string
+	signingKey []byte
+	challenge  *ChallengeConfig
+	formToken  *FormTokenConfig
+	captcha    *CaptchaConfig
+	reactions  ReactionConfig
+	clientIP   *internal.ClientIPResolver
+	feed       FeedConfig
+	stream     *broadcaster
+	webhooks   WebhookConfig
+	notify     *NotificationConfig
+	digest     DigestConfig
 }
 
-func New(ctx context.Context, db *sqlx.DB) *Service {
+type Option func(*Service)
+
+// WithIPHashSalt sets the salt mixed into client IP hashes, so that stored
+// hashes can't be reversed by hashing every IPv4 address.
+func WithIPHashSalt(salt string) Option {
+	return func(s *Service) {
+		s.ipHashSalt = salt
+	}
+}
+
+// WithClientIPResolver sets how client IPs are grouped, so that IPs given by
+// moderators identify the same clients as IPs resolved from requests.
+func WithClientIPResolver(r *internal.ClientIPResolver) Option {
+	return func(s *Service) {
+		s.clientIP = r
+	}
+}
+
+func New(ctx context.Context, db *sqlx.DB, opts ...Option) *Service {
 	s := &Service{
-		db: db,
+		db:        db,
+		reactions: DefaultReactionConfig(),
+		clientIP:  internal.NewClientIPResolver(internal.DefaultClientIPConfig()),
+		feed:      DefaultFeedConfig(),
+		stream:    newBroadcaster(DefaultStreamConfig()),
+		webhooks:  DefaultWebhookConfig(),
+		digest:    DefaultDigestConfig(),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if len(s.signingKey) == 0 {
+		s.signingKey = randomBytes(32)
 	}
 
 	return s
 }
 
+// inTx runs fn in a transaction, which is committed if fn succeeds and rolled
+// back otherwise.
+func (s *Service) inTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// hashClientIP returns a stable, salted hash of a client IP. Raw IPs are never
+// stored.
+func (s *Service) hashClientIP(ip string) string {
+	if ip == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.ipHashSalt))
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 func getAuthorNameFallback(s string) string {
 	if s == "" {
 		return "Anonymous"
@@ -35,6 +125,12 @@ func getAuthorNameFallback(s string) string {
 	return s
 }
 
+// ReplySignature returns the signature of replies written with a signature
+// secret.
+func ReplySignature(secret string) string {
+	return getReplySignatureFallback(secret)
+}
+
 func getReplySignatureFallback(s string) string {
 	if s == "" {
 		return ""
@@ -56,22 +152,46 @@ func stripConsecutiveWhitespace(s string) string {
 }
 
 type GetRepliesRequest struct {
-	Article string
+	Article  string
+	ClientIP string
+	// Sort is either "new" (the default) for newest first, or "top" for the
+	// most reacted first.
+	Sort string
 }
 
 type GetRepliesResponse struct {
-	Replies Replies `json:"replies"`
+	Replies   Replies `json:"replies"`
+	FormToken string  `json:"form_token,omitempty"`
 }
 
 func (s *Service) GetReplies(ctx context.Context, req GetRepliesRequest) (*GetRepliesResponse, error) {
 	resp := &GetRepliesResponse{}
 
-	replies, err := getRepliesForArticle(ctx, s.db, req.Article)
+	if req.Sort != "" && req.Sort != "new" && req.Sort != "top" {
+		return nil, Errorf(http.StatusBadRequest, "not a valid sort: %q", req.Sort)
+	}
+
+	replies, err := getRepliesForArticle(ctx, s.db, req.Article, s.hashClientIP(req.ClientIP))
 	if err != nil {
 		return nil, Errorf(http.StatusInternalServerError, "getting replies: %w", err)
 	}
 
+	if err := s.fillReplyReactions(ctx, s.db, replies); err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting reply reactions: %w", err)
+	}
+
+	if req.Sort == "top" {
+		// replies are already newest first, which breaks ties
+		slices.SortStableFunc(replies, func(a, b Reply) int {
+			return b.Reactions.Total() - a.Reactions.Total()
+		})
+	}
+
 	resp.Replies = replies
+	if s.formToken != nil {
+		resp.FormToken = s.issueFormToken(strings.TrimSpace(req.Article), time.Now())
+	}
+
 	return resp, nil
 }
 
@@ -81,6 +201,17 @@ type SubmitReplyRequest struct {
 	Article         string
 	Body            string `json:"body"`
 	AuthorName      string `json:"author_name"`
+	Challenge       string `json:"challenge"`
+	Nonce           string `json:"nonce"`
+	FormToken       string `json:"form_token"`
+	CaptchaID       string `json:"captcha_id"`
+	CaptchaAnswer   string `json:"captcha_answer"`
+	// Website is a honeypot: it's hidden from people, so only bots fill it in.
+	Website string `json:"website"`
+	// NotifyEmail is emailed about later replies on the article, if
+	// notifications are enabled.
+	NotifyEmail string `json:"notify_email"`
+	ClientIP    string `json:"-"`
 }
 
 type SubmitReplyResponse struct {
@@ -112,6 +243,15 @@ func (s *Service) SubmitReply(ctx context.Context, req SubmitReplyRequest) (*Sub
 		return nil, Errorf(http.StatusBadRequest, "parsing idempotency key: %w", err)
 	}
 
+	notifyEmail := ""
+	if req.NotifyEmail != "" && s.notify != nil {
+		email, err := parseNotifyEmail(req.NotifyEmail)
+		if err != nil {
+			return nil, err
+		}
+		notifyEmail = email
+	}
+
 	params := insertReplyParams{
 		Article:        article,
 		Body:           body,
@@ -119,21 +259,81 @@ func (s *Service) SubmitReply(ctx context.Context, req SubmitReplyRequest) (*Sub
 		IdempotencyKey: req.IdempotencyKey,
 		AuthorName:     getAuthorNameFallback(authorName),
 		CreatedAt:      time.Now(),
+		ClientHash:     s.hashClientIP(req.ClientIP),
 	}
-	replyID := 0
-	if id, err := insertReply(
-		ctx,
-		s.db,
-		params,
-	); err != nil {
-		return nil, Errorf(http.StatusInternalServerError, "inserting reply: %w", err)
-	} else {
-		replyID = id
+
+	if req.Website != "" {
+		// Pretend the reply was accepted, so the bot doesn't learn to adapt.
+		// The response has the same shape as a real one, down to an ID that
+		// follows the real ones.
+		lastID, err := getLastReplyID(ctx, s.db)
+		if err != nil {
+			return nil, Errorf(http.StatusInternalServerError, "getting reply id: %w", err)
+		}
+
+		return &SubmitReplyResponse{
+			Reply: Reply{
+				ID:             lastID + int(s.honeypotReplies.Add(1)),
+				IdempotencyKey: params.IdempotencyKey,
+				Signature:      params.Signature,
+				Article:        params.Article,
+				Body:           params.Body,
+				CreatedAt:      params.CreatedAt,
+				AuthorName:     params.AuthorName,
+				Reactions:      s.zeroReplyReactionStats(params.Article),
+			},
+		}, nil
+	}
+
+	if s.formToken != nil {
+		if err := s.verifyFormToken(article, req.FormToken, time.Now()); err != nil {
+			return nil, err
+		}
 	}
 
-	return &SubmitReplyResponse{
+	// A solved captcha stands in for the proof-of-work, for browsers that
+	// struggle with it. The captcha is checked first, so a client told to
+	// solve one can resend its unburnt challenge along with the answer.
+	captchaSolved := false
+	if s.captcha != nil {
+		required, err := s.captchaRequired(ctx, params)
+		if err != nil {
+			return nil, Errorf(http.StatusInternalServerError, "checking captcha: %w", err)
+		}
+		if required || req.CaptchaID != "" {
+			if err := s.verifyCaptcha(ctx, req.CaptchaID, req.CaptchaAnswer); err != nil {
+				return nil, err
+			}
+			captchaSolved = true
+		}
+	}
+
+	var solved *challenge
+	if s.challenge != nil && !captchaSolved {
+		c, err := s.verifyChallenge(req.Challenge, req.Nonce)
+		if err != nil {
+			return nil, err
+		}
+		solved = c
+	}
+
+	ban, err := s.findBan(ctx, banSubject{
+		Signature:  params.Signature,
+		ClientHash: params.ClientHash,
+		AuthorName: params.AuthorName,
+	})
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "checking bans: %w", err)
+	}
+	if ban != nil {
+		if ban.Mode == BanModeReject {
+			return nil, banError(ban)
+		}
+		params.Shadowbanned = true
+	}
+
+	resp := &SubmitReplyResponse{
 		Reply: Reply{
-			ID:             replyID,
 			IdempotencyKey: params.IdempotencyKey,
 			Signature:      params.Signature,
 			Article:        params.Article,
@@ -141,12 +341,66 @@ func (s *Service) SubmitReply(ctx context.Context, req SubmitReplyRequest) (*Sub
 			Deleted:        params.Deleted,
 			CreatedAt:      params.CreatedAt,
 			AuthorName:     params.AuthorName,
+			ClientHash:     params.ClientHash,
+			Shadowbanned:   params.Shadowbanned,
+			Reactions:      s.zeroReplyReactionStats(params.Article),
 		},
-	}, nil
+	}
+
+	replayed := false
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		id, inserted, err := insertReply(ctx, tx, params)
+		if err != nil {
+			return err
+		}
+
+		// A retried submission gets the reply it already inserted, without
+		// needing a fresh challenge, and without announcing it again.
+		if !inserted {
+			existing, err := getReplyByIdempotencyKey(ctx, tx, params.IdempotencyKey)
+			if err != nil {
+				return err
+			}
+			replayed = true
+			resp.Reply = *existing
+			resp.Reply.Reactions, err = s.replyReactionCounts(ctx, tx, *existing)
+			return err
+		}
+		resp.Reply.ID = id
+
+		if solved != nil {
+			if err := s.burnChallenge(ctx, tx, *solved); err != nil {
+				return err
+			}
+		}
+
+		if err := s.enqueueReplyCreated(ctx, tx, resp.Reply); err != nil {
+			return err
+		}
+		if s.notify != nil {
+			return s.enqueueNotifications(ctx, tx, resp.Reply, notifyEmail)
+		}
+		return nil
+	})
+	var gsErr ServiceError
+	if errors.As(err, &gsErr) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "inserting reply: %w", err)
+	}
+
+	if !replayed && !params.Shadowbanned {
+		s.stream.publish(article, StreamEvent{Type: StreamEventReply, ID: resp.Reply.ID, Data: resp.Reply})
+	}
+
+	return resp, nil
 }
 
 type GetReplyStatsByArticlesRequest struct {
 	Articles []string
+	// Since only counts replies written since, if set.
+	Since time.Time
 }
 
 type ArticleReplyStats struct {
@@ -159,7 +413,7 @@ type GetReplyStatsByArticlesResponse struct {
 }
 
 func (s *Service) GetReplyStatsByArticles(ctx context.Context, req GetReplyStatsByArticlesRequest) (*GetReplyStatsByArticlesResponse, error) {
-	aggs, err := getReplyStatsByArticles(ctx, s.db, req.Articles)
+	aggs, err := getReplyStatsByArticles(ctx, s.db, req.Articles, req.Since)
 	if err != nil {
 		return nil, Errorf(http.StatusInternalServerError, "getting aggs: %w", err)
 	}
@@ -182,48 +436,213 @@ func (s *Service) GetReplyStatsByArticles(ctx context.Context, req GetReplyStats
 	return resp, nil
 }
 
-var allowedReactionKinds []string = []string{"like"}
-
 type CreateReactionRequest struct {
-	Kind    string
-	Article string
+	Kind     string
+	Article  string
+	ClientIP string
 }
 
 type CreateReactionResponse struct {
-	DeletionKey string `json:"deletion_key"`
+	// ID identifies the reaction to moderators.
+	ID          int    `json:"id,omitempty"`
+	DeletionKey string `json:"deletion_key,omitempty"`
+	Active      bool   `json:"active"`
+	Count       int    `json:"count"`
+	// Counts has the article's count of every reaction kind, as of the write.
+	Counts ArticleReactionStats `json:"counts"`
 }
 
+// reactionClient identifies the client leaving a reaction by the salted hash
+// of its IP, and checks whether it's banned. Shadowbanned clients can react,
+// but their reactions aren't counted.
+func (s *Service) reactionClient(ctx context.Context, clientIP string) (string, bool, error) {
+	clientKey := s.hashClientIP(clientIP)
+	if clientKey == "" {
+		return "", false, Errorf(400, "requires client ip")
+	}
+
+	ban, err := s.findBan(ctx, banSubject{ClientHash: clientKey})
+	if err != nil {
+		return "", false, Errorf(http.StatusInternalServerError, "checking bans: %w", err)
+	}
+	if ban != nil && ban.Mode == BanModeReject {
+		return "", false, banError(ban)
+	}
+
+	return clientKey, ban != nil, nil
+}
+
+// CreateReaction toggles the client's reaction of a kind on an article. Each
+// client has at most one reaction of each kind per article.
 func (s *Service) CreateReaction(ctx context.Context, req CreateReactionRequest) (*CreateReactionResponse, error) {
-	if !slices.Contains(allowedReactionKinds, req.Kind) {
+	if !s.isReactionKind(req.Article, req.Kind) {
 		return nil, Errorf(400, "not a valid kind: %q", req.Kind)
 	}
-	deletionKey := uuid.New().String()
-	err := insertReaction(ctx, s.db, req.Article, req.Kind, deletionKey)
+
+	clientKey, shadowbanned, err := s.reactionClient(ctx, req.ClientIP)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &CreateReactionResponse{}
+
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		removed, err := deleteReactionByClient(ctx, tx, req.Article, req.Kind, clientKey)
+		if err != nil {
+			return err
+		}
+
+		if !removed {
+			resp.Active = true
+			inserted, err := insertReaction(ctx, tx, insertReactionParams{
+				Article:      req.Article,
+				Kind:         req.Kind,
+				DeletionKey:  uuid.New().String(),
+				ClientKey:    clientKey,
+				Shadowbanned: shadowbanned,
+			})
+			if err != nil {
+				return err
+			}
+			resp.ID, resp.DeletionKey = inserted.ID, inserted.DeletionKey
+		}
+
+		resp.Counts, err = s.articleReactionCounts(ctx, tx, req.Article)
+		if err != nil || !resp.Active {
+			return err
+		}
+
+		return s.enqueueReactionCreated(ctx, tx, WebhookReactionData{
+			ID:      resp.ID,
+			Article: req.Article,
+			Kind:    req.Kind,
+			Counts:  resp.Counts,
+		})
+	})
 	if err != nil {
-		return nil, Errorf(500, "creating reaction: %w", err)
+		return nil, Errorf(500, "toggling reaction: %w", err)
 	}
+	resp.Count = resp.Counts[req.Kind]
+
+	s.stream.publish(req.Article, StreamEvent{
+		Type: StreamEventReactions,
+		Data: ReactionsStreamData{Article: req.Article, Counts: resp.Counts},
+	})
 
-	return &CreateReactionResponse{DeletionKey: deletionKey}, nil
+	return resp, nil
 }
 
 type DeleteReactionRequest struct {
 	DeletionKey string
+	ClientIP    string
 }
 
 type DeleteReactionResponse struct {
+	// Article and ArticleCounts, or ReplyID and ReplyCounts are set, depending
+	// on what the reaction was on. The counts have every reaction kind, as of
+	// the delete.
+	Article       string
+	ArticleCounts ArticleReactionStats
+	ReplyID       int
+	ReplyCounts   ReplyReactionStats
+}
+
+// MarshalJSON writes the article's or reply's counts as "counts", like
+// CreateReactionResponse and CreateReplyReactionResponse.
+func (r DeleteReactionResponse) MarshalJSON() ([]byte, error) {
+	counts := map[string]int(r.ArticleCounts)
+	if r.ReplyID != 0 {
+		counts = r.ReplyCounts
+	}
+
+	return json.Marshal(struct {
+		Article string         `json:"article,omitempty"`
+		ReplyID int            `json:"reply_id,omitempty"`
+		Counts  map[string]int `json:"counts"`
+	}{r.Article, r.ReplyID, counts})
 }
 
 func (s *Service) DeleteReaction(ctx context.Context, req DeleteReactionRequest) (*DeleteReactionResponse, error) {
-	err := deleteReactionByDeletionKey(ctx, s.db, req.DeletionKey)
+	resp := &DeleteReactionResponse{}
+	var reply *Reply
+
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		article, ok, err := deleteReactionByDeletionKey(ctx, tx, req.DeletionKey)
+		if err != nil {
+			return err
+		}
+		if ok {
+			resp.Article = article
+			resp.ArticleCounts, err = s.articleReactionCounts(ctx, tx, article)
+			return err
+		}
+
+		replyID, ok, err := deleteReplyReactionByDeletionKey(ctx, tx, req.DeletionKey)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errNotFound
+		}
+
+		reply, err = getReplyByID(ctx, tx, replyID)
+		if err != nil {
+			return err
+		}
+		if reply == nil || !s.replyVisibleTo(*reply, req.ClientIP) {
+			return errNotFound
+		}
+
+		resp.ReplyID = replyID
+		resp.ReplyCounts, err = s.replyReactionCounts(ctx, tx, *reply)
+		return err
+	})
+	if errors.Is(err, errNotFound) {
+		return nil, Errorf(http.StatusNotFound, "reaction not found")
+	}
 	if err != nil {
 		return nil, Errorf(500, "deleting reaction: %w", err)
 	}
 
-	return &DeleteReactionResponse{}, nil
+	if resp.Article != "" {
+		s.stream.publish(resp.Article, StreamEvent{
+			Type: StreamEventReactions,
+			Data: ReactionsStreamData{Article: resp.Article, Counts: resp.ArticleCounts},
+		})
+	} else if !reply.Shadowbanned {
+		s.stream.publish(reply.Article, StreamEvent{
+			Type: StreamEventReplyReactions,
+			Data: ReplyReactionsStreamData{ReplyID: resp.ReplyID, Counts: resp.ReplyCounts},
+		})
+	}
+
+	return resp, nil
+}
+
+// articleReactionCounts counts each reaction kind available on an article.
+func (s *Service) articleReactionCounts(ctx context.Context, db sqlx.ExtContext, article string) (ArticleReactionStats, error) {
+	aggs, err := getReactionStatsByArticles(ctx, db, []string{article}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := ArticleReactionStats{}
+	for _, kind := range s.reactionKinds(article) {
+		counts[kind.Name] = 0
+	}
+	for _, agg := range aggs {
+		if _, ok := counts[agg.Kind]; ok {
+			counts[agg.Kind] = agg.Count
+		}
+	}
+
+	return counts, nil
 }
 
 type GetReactionStatsByArticlesRequest struct {
 	Articles []string
+	// Since only counts reactions made since, if set.
+	Since time.Time
 }
 
 type ArticleReactionStats map[string]int
@@ -232,7 +651,7 @@ type GetReactionStatsByArticlesResponse struct {
 }
 
 func (s *Service) GetReactionStatsByArticles(ctx context.Context, req GetReactionStatsByArticlesRequest) (*GetReactionStatsByArticlesResponse, error) {
-	aggs, err := getReactionStatsByArticles(ctx, s.db, req.Articles)
+	aggs, err := getReactionStatsByArticles(ctx, s.db, req.Articles, req.Since)
 	if err != nil {
 		return nil, Errorf(500, "aggregating reactions: %w", err)
 	}
@@ -243,8 +662,8 @@ func (s *Service) GetReactionStatsByArticles(ctx context.Context, req GetReactio
 
 	for _, article := range req.Articles {
 		resp.Stats[article] = ArticleReactionStats{}
-		for _, kind := range allowedReactionKinds {
-			resp.Stats[article][kind] = 0
+		for _, kind := range s.reactionKinds(article) {
+			resp.Stats[article][kind.Name] = 0
 		}
 	}
 
@@ -24,6 +24,7 @@ func TestService_GetReplies(t *testing.T) {
 			Deleted:        false,
 			CreatedAt:      now,
 			AuthorName:     "Arie",
+			Reactions:      gomments.ReplyReactionStats{"like": 0},
 		},
 		{
 			ID:             3,
@@ -33,6 +34,7 @@ func TestService_GetReplies(t *testing.T) {
 			Deleted:        false,
 			CreatedAt:      now,
 			AuthorName:     "Anonymous",
+			Reactions:      gomments.ReplyReactionStats{"like": 0},
 		},
 		{
 			ID:             4,
@@ -42,6 +44,7 @@ func TestService_GetReplies(t *testing.T) {
 			Deleted:        false,
 			CreatedAt:      now,
 			AuthorName:     "Anonymous",
+			Reactions:      gomments.ReplyReactionStats{"like": 0},
 		},
 		{
 			ID:             5,
@@ -51,6 +54,7 @@ func TestService_GetReplies(t *testing.T) {
 			Deleted:        false,
 			CreatedAt:      now,
 			AuthorName:     "Anonymous",
+			Reactions:      gomments.ReplyReactionStats{"like": 0},
 		},
 		{
 			ID:             6,
@@ -60,6 +64,7 @@ func TestService_GetReplies(t *testing.T) {
 			Deleted:        false,
 			CreatedAt:      now,
 			AuthorName:     "Arie",
+			Reactions:      gomments.ReplyReactionStats{"like": 0},
 		},
 		{
 			ID:             7,
@@ -69,6 +74,7 @@ func TestService_GetReplies(t *testing.T) {
 			Deleted:        true,
 			CreatedAt:      now.Add(-time.Hour),
 			AuthorName:     "Arie",
+			Reactions:      gomments.ReplyReactionStats{"like": 0},
 		},
 		{
 			ID:             8,
@@ -78,6 +84,7 @@ func TestService_GetReplies(t *testing.T) {
 			Deleted:        false,
 			CreatedAt:      now.Add(-time.Hour),
 			AuthorName:     "Arie",
+			Reactions:      gomments.ReplyReactionStats{"like": 0},
 		},
 		{
 			ID:             9,
@@ -87,6 +94,7 @@ func TestService_GetReplies(t *testing.T) {
 			Deleted:        true,
 			CreatedAt:      now.Add(-time.Hour),
 			AuthorName:     "Arie",
+			Reactions:      gomments.ReplyReactionStats{"like": 0},
 		},
 	}
 
@@ -301,27 +309,66 @@ func TestService_CreateReaction(t *testing.T) {
 		f := newFixture(tt)
 		s := f.service
 
-		resp, err := s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like"})
+		resp, err := s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like", ClientIP: "192.0.2.1"})
 		f.NoError(err)
 		f.NotEmpty(resp.DeletionKey)
 
-		resp, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like"})
+		resp, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like", ClientIP: "192.0.2.2"})
 		f.NoError(err)
 		f.NotEmpty(resp.DeletionKey)
 
-		resp, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like"})
+		resp, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like", ClientIP: "192.0.2.3"})
 		f.NoError(err)
 		f.NotEmpty(resp.DeletionKey)
+		f.Equal(3, resp.Count)
+		f.Equal(gomments.ArticleReactionStats{"like": 3}, resp.Counts)
 
 		deleteResp, err := s.DeleteReaction(ctx, gomments.DeleteReactionRequest{DeletionKey: resp.DeletionKey})
-		f.NotNil(deleteResp)
 		f.NoError(err)
+		f.Equal("test-article", deleteResp.Article)
+		f.Equal(gomments.ArticleReactionStats{"like": 2}, deleteResp.ArticleCounts)
 
-		_, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "non-existent-reaction"})
+		_, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "non-existent-reaction", ClientIP: "192.0.2.1"})
 		f.NotNil(err)
 
 		statsResp, err := s.GetReactionStatsByArticles(ctx, gomments.GetReactionStatsByArticlesRequest{Articles: []string{"test-article"}})
 		f.NoError(err)
 		f.Equal(2, statsResp.Stats["test-article"]["like"])
 	})
+
+	t.Run("toggles reactions per client", func(tt *testing.T) {
+		ctx := context.Background()
+		f := newFixture(tt)
+		s := f.service
+
+		resp, err := s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like", ClientIP: "192.0.2.1"})
+		f.NoError(err)
+		f.True(resp.Active)
+		f.Equal(1, resp.Count)
+
+		deletionKey := resp.DeletionKey
+
+		resp, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like", ClientIP: "192.0.2.1"})
+		f.NoError(err)
+		f.False(resp.Active)
+		f.Empty(resp.DeletionKey)
+		f.Equal(0, resp.Count)
+
+		resp, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like", ClientIP: "192.0.2.2"})
+		f.NoError(err)
+		f.True(resp.Active)
+		f.Equal(1, resp.Count)
+
+		_, err = s.DeleteReaction(ctx, gomments.DeleteReactionRequest{DeletionKey: deletionKey})
+		var gsErr gomments.ServiceError
+		f.ErrorAs(err, &gsErr)
+		f.Equal(404, gsErr.Status())
+
+		_, err = s.DeleteReaction(ctx, gomments.DeleteReactionRequest{DeletionKey: "unknown"})
+		f.ErrorAs(err, &gsErr)
+		f.Equal(404, gsErr.Status())
+
+		_, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "test-article", Kind: "like"})
+		f.ErrorContains(err, "requires client ip")
+	})
 }
@@ -0,0 +1,26 @@
+package gomments
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// WithSigningKey sets the key used to sign tokens handed out to clients. If it
+// isn't set a random key is generated, so tokens won't survive a restart or be
+// accepted by other instances.
+func WithSigningKey(key []byte) Option {
+	return func(s *Service) {
+		s.signingKey = key
+	}
+}
+
+func (s *Service) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Service) verifySignature(payload string, sig string) bool {
+	return hmac.Equal([]byte(s.sign(payload)), []byte(sig))
+}
@@ -0,0 +1,55 @@
+package gomments
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var reLinks = regexp.MustCompile(`(?i)https?://|www\.`)
+
+// spamScore is a rough guess at how spammy a reply is. Zero is clean, and
+// each suspicious trait adds to the score.
+func spamScore(body string, authorName string) int {
+	score := 2 * len(reLinks.FindAllString(body, -1))
+
+	if reLinks.MatchString(authorName) {
+		score += 2
+	}
+
+	letters, upper := 0, 0
+	for _, r := range body {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters > 20 && upper*10 > letters*6 {
+		score += 2
+	}
+
+	if longestRun(strings.ToLower(body)) >= 10 {
+		score++
+	}
+
+	return score
+}
+
+// longestRun returns the length of the longest run of a repeated rune.
+func longestRun(s string) int {
+	longest, run := 0, 0
+	var prev rune
+	for i, r := range s {
+		if i > 0 && r == prev {
+			run++
+		} else {
+			run = 1
+		}
+		prev = r
+		longest = max(longest, run)
+	}
+
+	return longest
+}
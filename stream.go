@@ -0,0 +1,204 @@
+package gomments
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// StreamConfig limits reply streams. Each client can hold at most
+// MaxSubscribersPerClient streams open at once.
+type StreamConfig struct {
+	MaxSubscribersPerClient int
+	// Buffer is how many events a subscriber can fall behind by before it's
+	// dropped.
+	Buffer int
+}
+
+func DefaultStreamConfig() StreamConfig {
+	return StreamConfig{
+		MaxSubscribersPerClient: 5,
+		Buffer:                  32,
+	}
+}
+
+// WithStreamConfig replaces the default reply stream limits.
+func WithStreamConfig(cfg StreamConfig) Option {
+	return func(s *Service) {
+		s.stream = newBroadcaster(cfg)
+	}
+}
+
+type StreamEventType string
+
+const (
+	StreamEventReply          StreamEventType = "reply"
+	StreamEventReactions      StreamEventType = "reactions"
+	StreamEventReplyReactions StreamEventType = "reply_reactions"
+)
+
+// StreamEvent is something that happened on an article. Only reply events
+// have an ID, which is the reply's, so clients can resume after the last
+// reply they saw.
+type StreamEvent struct {
+	Type StreamEventType
+	ID   int
+	Data any
+}
+
+type ReactionsStreamData struct {
+	Article string               `json:"article"`
+	Counts  ArticleReactionStats `json:"counts"`
+}
+
+type ReplyReactionsStreamData struct {
+	ReplyID int                `json:"reply_id"`
+	Counts  ReplyReactionStats `json:"counts"`
+}
+
+type subscriber struct {
+	article  string
+	clientIP string
+	events   chan StreamEvent
+	closed   bool
+}
+
+// broadcaster fans events on an article out to its subscribers, in this
+// process only.
+type broadcaster struct {
+	cfg StreamConfig
+
+	mu          sync.Mutex
+	subscribers map[string][]*subscriber
+	perClient   map[string]int
+}
+
+func newBroadcaster(cfg StreamConfig) *broadcaster {
+	return &broadcaster{
+		cfg:         cfg,
+		subscribers: map[string][]*subscriber{},
+		perClient:   map[string]int{},
+	}
+}
+
+func (b *broadcaster) subscribe(article string, clientIP string) (*subscriber, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.perClient[clientIP] >= b.cfg.MaxSubscribersPerClient {
+		return nil, false
+	}
+	b.perClient[clientIP]++
+
+	sub := &subscriber{
+		article:  article,
+		clientIP: clientIP,
+		events:   make(chan StreamEvent, b.cfg.Buffer),
+	}
+	b.subscribers[article] = append(b.subscribers[article], sub)
+
+	return sub, true
+}
+
+func (b *broadcaster) unsubscribe(sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remove(sub)
+}
+
+// remove closes the subscriber's events, which the caller must hold the lock
+// for.
+func (b *broadcaster) remove(sub *subscriber) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	close(sub.events)
+
+	b.subscribers[sub.article] = slices.DeleteFunc(b.subscribers[sub.article], func(other *subscriber) bool {
+		return other == sub
+	})
+	if len(b.subscribers[sub.article]) == 0 {
+		delete(b.subscribers, sub.article)
+	}
+
+	b.perClient[sub.clientIP]--
+	if b.perClient[sub.clientIP] <= 0 {
+		delete(b.perClient, sub.clientIP)
+	}
+}
+
+// publish sends an event to every subscriber of the article without waiting.
+// Subscribers that have fallen too far behind are dropped, and can resume from
+// the last reply they saw.
+func (b *broadcaster) publish(article string, event StreamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, sub := range slices.Clone(b.subscribers[article]) {
+		select {
+		case sub.events <- event:
+		default:
+			b.remove(sub)
+		}
+	}
+}
+
+type SubscribeRepliesRequest struct {
+	Article  string
+	ClientIP string
+	// LastEventID is the ID of the last reply the client saw, if it's
+	// resuming.
+	LastEventID int
+}
+
+type SubscribeRepliesResponse struct {
+	// Backlog has the replies after LastEventID, oldest first, when resuming.
+	Backlog Replies
+	// Events are closed when the subscription ends. They can include replies
+	// that are also in the backlog.
+	Events <-chan StreamEvent
+}
+
+// SubscribeReplies streams events on an article until ctx is done.
+func (s *Service) SubscribeReplies(ctx context.Context, req SubscribeRepliesRequest) (*SubscribeRepliesResponse, error) {
+	if req.Article == "" {
+		return nil, Errorf(http.StatusBadRequest, "requires article")
+	}
+
+	// Subscribe before reading the backlog, so no reply falls in between.
+	sub, ok := s.stream.subscribe(req.Article, req.ClientIP)
+	if !ok {
+		return nil, Errorf(http.StatusTooManyRequests, "too many open streams")
+	}
+	go func() {
+		<-ctx.Done()
+		s.stream.unsubscribe(sub)
+	}()
+
+	resp := &SubscribeRepliesResponse{Events: sub.events}
+	if req.LastEventID == 0 {
+		return resp, nil
+	}
+
+	replies, err := getRepliesForArticle(ctx, s.db, req.Article, "")
+	if err != nil {
+		s.stream.unsubscribe(sub)
+		return nil, Errorf(http.StatusInternalServerError, "getting replies: %w", err)
+	}
+	if err := s.fillReplyReactions(ctx, s.db, replies); err != nil {
+		s.stream.unsubscribe(sub)
+		return nil, Errorf(http.StatusInternalServerError, "getting reply reactions: %w", err)
+	}
+
+	resp.Backlog = Replies{}
+	for _, reply := range slices.Backward(replies) {
+		if reply.ID > req.LastEventID {
+			resp.Backlog = append(resp.Backlog, reply)
+		}
+	}
+
+	return resp, nil
+}
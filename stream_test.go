@@ -0,0 +1,177 @@
+package gomments_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func receiveEvent(r *require.Assertions, events <-chan gomments.StreamEvent) gomments.StreamEvent {
+	select {
+	case event, ok := <-events:
+		r.True(ok, "stream closed")
+		return event
+	case <-time.After(time.Second):
+		r.FailNow("timed out waiting for event")
+		return gomments.StreamEvent{}
+	}
+}
+
+func TestService_SubscribeReplies(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t, gomments.WithStreamConfig(gomments.StreamConfig{
+		MaxSubscribersPerClient: 2,
+		Buffer:                  4,
+	}))
+	s := f.service
+
+	submit := func(r *require.Assertions, article string, clientIP string) int {
+		resp, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			Article:        article,
+			AuthorName:     "alice",
+			Body:           "hello",
+			ClientIP:       clientIP,
+			IdempotencyKey: uuid.NewString(),
+		})
+		r.NoError(err)
+		return resp.Reply.ID
+	}
+
+	t.Run("publishes replies and reaction counts", func(tt *testing.T) {
+		r := require.New(tt)
+		subCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		resp, err := s.SubscribeReplies(subCtx, gomments.SubscribeRepliesRequest{Article: "live-article", ClientIP: "192.0.2.1"})
+		r.NoError(err)
+		r.Empty(resp.Backlog)
+
+		submit(r, "other-article", "")
+		id := submit(r, "live-article", "")
+
+		event := receiveEvent(r, resp.Events)
+		r.Equal(gomments.StreamEventReply, event.Type)
+		r.Equal(id, event.ID)
+		r.Equal("live-article", event.Data.(gomments.Reply).Article)
+
+		_, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "live-article", Kind: "like", ClientIP: "192.0.2.2"})
+		r.NoError(err)
+
+		event = receiveEvent(r, resp.Events)
+		r.Equal(gomments.StreamEventReactions, event.Type)
+		r.Equal(1, event.Data.(gomments.ReactionsStreamData).Counts["like"])
+
+		reaction, err := s.CreateReplyReaction(ctx, gomments.CreateReplyReactionRequest{ReplyID: id, Kind: "like", ClientIP: "192.0.2.2"})
+		r.NoError(err)
+
+		event = receiveEvent(r, resp.Events)
+		r.Equal(gomments.StreamEventReplyReactions, event.Type)
+		r.Equal(id, event.Data.(gomments.ReplyReactionsStreamData).ReplyID)
+		r.Equal(1, event.Data.(gomments.ReplyReactionsStreamData).Counts["like"])
+
+		_, err = s.DeleteReaction(ctx, gomments.DeleteReactionRequest{DeletionKey: reaction.DeletionKey})
+		r.NoError(err)
+
+		event = receiveEvent(r, resp.Events)
+		r.Equal(gomments.StreamEventReplyReactions, event.Type)
+		r.Equal(0, event.Data.(gomments.ReplyReactionsStreamData).Counts["like"])
+
+		cancel()
+		r.Eventually(func() bool {
+			_, ok := <-resp.Events
+			return !ok
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("doesn't publish shadowbanned replies", func(tt *testing.T) {
+		r := require.New(tt)
+		subCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		_, err := s.CreateBan(ctx, gomments.CreateBanRequest{
+			Kind:  gomments.BanKindIPHash,
+			Value: "203.0.113.7",
+			Mode:  gomments.BanModeShadow,
+		})
+		r.NoError(err)
+
+		resp, err := s.SubscribeReplies(subCtx, gomments.SubscribeRepliesRequest{Article: "shadow-article", ClientIP: "192.0.2.1"})
+		r.NoError(err)
+
+		submit(r, "shadow-article", "203.0.113.7")
+		id := submit(r, "shadow-article", "")
+
+		event := receiveEvent(r, resp.Events)
+		r.Equal(id, event.ID)
+	})
+
+	t.Run("resumes after the last event", func(tt *testing.T) {
+		r := require.New(tt)
+		subCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		ids := []int{}
+		for range 3 {
+			ids = append(ids, submit(r, "resume-article", ""))
+		}
+
+		resp, err := s.SubscribeReplies(subCtx, gomments.SubscribeRepliesRequest{
+			Article:     "resume-article",
+			ClientIP:    "192.0.2.1",
+			LastEventID: ids[0],
+		})
+		r.NoError(err)
+		r.Len(resp.Backlog, 2)
+		r.Equal(ids[1], resp.Backlog[0].ID)
+		r.Equal(ids[2], resp.Backlog[1].ID)
+	})
+
+	t.Run("limits subscribers per client", func(tt *testing.T) {
+		r := require.New(tt)
+		subCtx, cancel := context.WithCancel(ctx)
+
+		for range 2 {
+			_, err := s.SubscribeReplies(subCtx, gomments.SubscribeRepliesRequest{Article: "busy-article", ClientIP: "192.0.2.9"})
+			r.NoError(err)
+		}
+
+		_, err := s.SubscribeReplies(ctx, gomments.SubscribeRepliesRequest{Article: "busy-article", ClientIP: "192.0.2.9"})
+		var gsErr gomments.ServiceError
+		r.ErrorAs(err, &gsErr)
+		r.Equal(429, gsErr.Status())
+
+		_, err = s.SubscribeReplies(subCtx, gomments.SubscribeRepliesRequest{Article: "busy-article", ClientIP: "192.0.2.10"})
+		r.NoError(err)
+
+		cancel()
+		r.Eventually(func() bool {
+			otherCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			_, err := s.SubscribeReplies(otherCtx, gomments.SubscribeRepliesRequest{Article: "busy-article", ClientIP: "192.0.2.9"})
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("drops subscribers that fall behind", func(tt *testing.T) {
+		r := require.New(tt)
+		subCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		resp, err := s.SubscribeReplies(subCtx, gomments.SubscribeRepliesRequest{Article: "slow-article", ClientIP: "192.0.2.1"})
+		r.NoError(err)
+
+		for range 5 {
+			submit(r, "slow-article", "")
+		}
+
+		received := 0
+		for range resp.Events {
+			received++
+		}
+		r.Equal(4, received)
+	})
+}
@@ -0,0 +1,598 @@
+package gomments
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// WebhookConfig configures how webhooks are delivered. A delivery that fails
+// is retried after Backoff, doubling each time up to MaxBackoff, until it has
+// been attempted MaxAttempts times and is given up on.
+type WebhookConfig struct {
+	Timeout     time.Duration
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	// BatchSize is how many deliveries are attempted at a time.
+	BatchSize int
+}
+
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		Timeout:     10 * time.Second,
+		MaxAttempts: 8,
+		Backoff:     30 * time.Second,
+		MaxBackoff:  6 * time.Hour,
+		BatchSize:   20,
+	}
+}
+
+// WithWebhookConfig replaces the default webhook timeouts and retries.
+func WithWebhookConfig(cfg WebhookConfig) Option {
+	return func(s *Service) {
+		s.webhooks = cfg
+	}
+}
+
+// backoff returns how long to wait before retrying a delivery that has failed
+// attempts times.
+func (cfg WebhookConfig) backoff(attempts int) time.Duration {
+	return retryBackoff(cfg.Backoff, cfg.MaxBackoff, attempts)
+}
+
+// retryBackoff returns how long to wait before retrying something that has
+// failed attempts times, doubling from base up to maxBackoff.
+func retryBackoff(base time.Duration, maxBackoff time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+
+	return min(d, maxBackoff)
+}
+
+type WebhookEvent string
+
+const (
+	WebhookEventReplyCreated      WebhookEvent = "reply.created"
+	WebhookEventReactionCreated   WebhookEvent = "reaction.created"
+	WebhookEventReplyModerated    WebhookEvent = "reply.moderated"
+	WebhookEventReactionModerated WebhookEvent = "reaction.moderated"
+	WebhookEventDigestCreated     WebhookEvent = "digest.created"
+)
+
+var WebhookEvents = []WebhookEvent{
+	WebhookEventReplyCreated,
+	WebhookEventReactionCreated,
+	WebhookEventReplyModerated,
+	WebhookEventReactionModerated,
+	WebhookEventDigestCreated,
+}
+
+// WebhookFormat is the shape of the payload sent to a webhook. Slack and
+// Discord incoming webhooks only take a message, so they're sent a summary of
+// the event.
+type WebhookFormat string
+
+const (
+	WebhookFormatJSON    WebhookFormat = "json"
+	WebhookFormatSlack   WebhookFormat = "slack"
+	WebhookFormatDiscord WebhookFormat = "discord"
+)
+
+type Webhook struct {
+	ID     int           `json:"id"`
+	URL    string        `json:"url"`
+	Format WebhookFormat `json:"format"`
+	// Events are the events delivered to the webhook, or every event if
+	// empty.
+	Events []WebhookEvent `json:"events"`
+	// Secret signs payloads. It's only returned when the webhook is created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (w Webhook) wants(event WebhookEvent) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, event)
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+	// WebhookDeliveryDead deliveries failed too many times, and are only
+	// retried by hand.
+	WebhookDeliveryDead WebhookDeliveryStatus = "dead"
+)
+
+type WebhookDelivery struct {
+	ID            int                   `db:"id" json:"id"`
+	WebhookID     int                   `db:"webhook_id" json:"webhook_id"`
+	Event         WebhookEvent          `db:"event" json:"event"`
+	Payload       json.RawMessage       `db:"payload" json:"payload"`
+	Status        WebhookDeliveryStatus `db:"status" json:"status"`
+	Attempts      int                   `db:"attempts" json:"attempts"`
+	NextAttemptAt time.Time             `db:"next_attempt_at" json:"next_attempt_at"`
+	CreatedAt     time.Time             `db:"created_at" json:"created_at"`
+
+	Log []WebhookAttempt `db:"-" json:"log"`
+}
+
+// WebhookAttempt is a record of one attempt at a delivery. StatusCode is zero
+// if there was no response.
+type WebhookAttempt struct {
+	ID         int       `db:"id" json:"id"`
+	DeliveryID int       `db:"delivery_id" json:"-"`
+	StatusCode int       `db:"status_code" json:"status_code"`
+	Error      string    `db:"error" json:"error"`
+	DurationMs int       `db:"duration_ms" json:"duration_ms"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+type WebhookReplyData struct {
+	Reply        Reply `json:"reply"`
+	Shadowbanned bool  `json:"shadowbanned"`
+}
+
+type WebhookReactionData struct {
+	ID      int            `json:"id"`
+	Article string         `json:"article,omitempty"`
+	ReplyID int            `json:"reply_id,omitempty"`
+	Kind    string         `json:"kind"`
+	Counts  map[string]int `json:"counts"`
+}
+
+type webhookPayload struct {
+	Event     WebhookEvent `json:"event"`
+	CreatedAt time.Time    `json:"created_at"`
+	Data      any          `json:"data"`
+}
+
+// slackEscaper escapes the characters Slack reads as control sequences, so
+// commenters can't ping channels or hide links in a summary.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+type discordMessage struct {
+	Content string `json:"content"`
+	// AllowedMentions stops Discord pinging anyone mentioned in the content.
+	AllowedMentions discordAllowedMentions `json:"allowed_mentions"`
+}
+
+type discordAllowedMentions struct {
+	Parse []string `json:"parse"`
+}
+
+func renderWebhookPayload(format WebhookFormat, event WebhookEvent, summary string, data any, now time.Time) ([]byte, error) {
+	switch format {
+	case WebhookFormatSlack:
+		return json.Marshal(map[string]string{"text": slackEscaper.Replace(summary)})
+	case WebhookFormatDiscord:
+		return json.Marshal(discordMessage{
+			Content:         summary,
+			AllowedMentions: discordAllowedMentions{Parse: []string{}},
+		})
+	default:
+		return json.Marshal(webhookPayload{Event: event, CreatedAt: now.UTC(), Data: data})
+	}
+}
+
+// SignWebhook returns the X-Gomments-Signature header for a payload sent at t:
+// the time as a Unix timestamp, and an HMAC-SHA256 of the timestamp, a dot and
+// the payload.
+func SignWebhook(secret string, t time.Time, payload []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(payload)
+
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// VerifyWebhook checks an X-Gomments-Signature header, rejecting payloads
+// signed more than tolerance away from now so they can't be replayed.
+func VerifyWebhook(secret string, header string, payload []byte, now time.Time, tolerance time.Duration) bool {
+	ts := ""
+	for _, part := range strings.Split(header, ",") {
+		if v, ok := strings.CutPrefix(part, "t="); ok {
+			ts = v
+		}
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	t := time.Unix(unix, 0)
+	if t.Before(now.Add(-tolerance)) || t.After(now.Add(tolerance)) {
+		return false
+	}
+
+	return hmac.Equal([]byte(SignWebhook(secret, t, payload)), []byte(header))
+}
+
+// summarize truncates text to n runes for summaries.
+func summarize(text string, n int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > n {
+		return string(runes[:n]) + "…"
+	}
+
+	return text
+}
+
+// enqueueWebhooks queues an event for delivery to every webhook that wants
+// it. It runs in the transaction making the change, so an event is queued if
+// and only if the change is committed.
+func (s *Service) enqueueWebhooks(ctx context.Context, db sqlx.ExtContext, event WebhookEvent, summary string, data any) error {
+	webhooks, err := getWebhooks(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, w := range webhooks {
+		if !w.wants(event) {
+			continue
+		}
+
+		payload, err := renderWebhookPayload(w.Format, event, summary, data, now)
+		if err != nil {
+			return fmt.Errorf("rendering webhook payload: %w", err)
+		}
+
+		if err := insertWebhookDelivery(ctx, db, WebhookDelivery{
+			WebhookID:     w.ID,
+			Event:         event,
+			Payload:       payload,
+			Status:        WebhookDeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) enqueueReplyCreated(ctx context.Context, db sqlx.ExtContext, reply Reply) error {
+	summary := fmt.Sprintf("%s commented on %s: %s", reply.AuthorName, reply.Article, summarize(reply.Body, 200))
+	if reply.Shadowbanned {
+		summary += " (shadowbanned)"
+	}
+	if link := s.articleURL(reply.Article); link != "" {
+		summary += fmt.Sprintf("\n%s#reply-%d", link, reply.ID)
+	}
+
+	return s.enqueueWebhooks(ctx, db, WebhookEventReplyCreated, summary, WebhookReplyData{
+		Reply:        reply,
+		Shadowbanned: reply.Shadowbanned,
+	})
+}
+
+func (s *Service) enqueueReactionCreated(ctx context.Context, db sqlx.ExtContext, data WebhookReactionData) error {
+	target := data.Article
+	if data.ReplyID != 0 {
+		target = fmt.Sprintf("reply %d", data.ReplyID)
+	}
+	summary := fmt.Sprintf("New %q reaction on %s (%d in total)", data.Kind, target, data.Counts[data.Kind])
+
+	return s.enqueueWebhooks(ctx, db, WebhookEventReactionCreated, summary, data)
+}
+
+func (s *Service) enqueueModerated(ctx context.Context, db sqlx.ExtContext, event ModerationEvent) error {
+	webhookEvent := WebhookEventReplyModerated
+	if event.TargetType == ModerationTargetReaction || event.TargetType == ModerationTargetReplyReaction {
+		webhookEvent = WebhookEventReactionModerated
+	}
+
+	summary := fmt.Sprintf("%s used %s on %s %s", event.Actor, event.Action, event.TargetType, event.TargetID)
+	if event.Reason != "" {
+		summary += ": " + event.Reason
+	}
+
+	return s.enqueueWebhooks(ctx, db, webhookEvent, summary, event)
+}
+
+type CreateWebhookRequest struct {
+	URL    string         `json:"url"`
+	Format WebhookFormat  `json:"format"`
+	Events []WebhookEvent `json:"events"`
+}
+
+type CreateWebhookResponse struct {
+	Webhook Webhook `json:"webhook"`
+}
+
+// CreateWebhook subscribes a URL to events, generating the secret its
+// payloads are signed with.
+func (s *Service) CreateWebhook(ctx context.Context, req CreateWebhookRequest) (*CreateWebhookResponse, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, Errorf(http.StatusBadRequest, "not a valid webhook url: %q", req.URL)
+	}
+
+	if req.Format == "" {
+		req.Format = WebhookFormatJSON
+	}
+	if !slices.Contains([]WebhookFormat{WebhookFormatJSON, WebhookFormatSlack, WebhookFormatDiscord}, req.Format) {
+		return nil, Errorf(http.StatusBadRequest, "not a valid webhook format: %q", req.Format)
+	}
+
+	for _, event := range req.Events {
+		if !slices.Contains(WebhookEvents, event) {
+			return nil, Errorf(http.StatusBadRequest, "not a valid webhook event: %q", event)
+		}
+	}
+
+	w := Webhook{
+		URL:       req.URL,
+		Format:    req.Format,
+		Events:    slices.Compact(slices.Sorted(slices.Values(req.Events))),
+		Secret:    "whsec_" + hex.EncodeToString(randomBytes(24)),
+		CreatedAt: time.Now(),
+	}
+	if w.Events == nil {
+		w.Events = []WebhookEvent{}
+	}
+
+	w.ID, err = insertWebhook(ctx, s.db, w)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "inserting webhook: %w", err)
+	}
+
+	return &CreateWebhookResponse{Webhook: w}, nil
+}
+
+type ListWebhooksRequest struct {
+}
+
+type ListWebhooksResponse struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+func (s *Service) ListWebhooks(ctx context.Context, req ListWebhooksRequest) (*ListWebhooksResponse, error) {
+	webhooks, err := getWebhooks(ctx, s.db)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting webhooks: %w", err)
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	return &ListWebhooksResponse{Webhooks: webhooks}, nil
+}
+
+type DeleteWebhookRequest struct {
+	ID int
+}
+
+type DeleteWebhookResponse struct {
+}
+
+// DeleteWebhook unsubscribes a webhook. Its pending deliveries are never
+// attempted.
+func (s *Service) DeleteWebhook(ctx context.Context, req DeleteWebhookRequest) (*DeleteWebhookResponse, error) {
+	ok, err := deleteWebhook(ctx, s.db, req.ID)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "deleting webhook: %w", err)
+	}
+	if !ok {
+		return nil, Errorf(http.StatusNotFound, "webhook not found: %d", req.ID)
+	}
+
+	return &DeleteWebhookResponse{}, nil
+}
+
+type ListWebhookDeliveriesRequest struct {
+	WebhookID int
+	// Status only lists deliveries with the status, if set.
+	Status WebhookDeliveryStatus
+	Limit  int
+}
+
+type ListWebhookDeliveriesResponse struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+// ListWebhookDeliveries lists a webhook's newest deliveries, with a log of
+// every attempt at them.
+func (s *Service) ListWebhookDeliveries(ctx context.Context, req ListWebhookDeliveriesRequest) (*ListWebhookDeliveriesResponse, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	limit = min(limit, 500)
+
+	deliveries, err := getWebhookDeliveries(ctx, s.db, req.WebhookID, req.Status, limit)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting webhook deliveries: %w", err)
+	}
+
+	ids := []int{}
+	byID := map[int]*WebhookDelivery{}
+	for i := range deliveries {
+		deliveries[i].Log = []WebhookAttempt{}
+		ids = append(ids, deliveries[i].ID)
+		byID[deliveries[i].ID] = &deliveries[i]
+	}
+
+	attempts, err := getWebhookAttempts(ctx, s.db, ids)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting webhook attempts: %w", err)
+	}
+	for _, attempt := range attempts {
+		d := byID[attempt.DeliveryID]
+		d.Log = append(d.Log, attempt)
+	}
+
+	return &ListWebhookDeliveriesResponse{Deliveries: deliveries}, nil
+}
+
+type RetryWebhookDeliveryRequest struct {
+	DeliveryID int
+}
+
+type RetryWebhookDeliveryResponse struct {
+}
+
+// RetryWebhookDelivery queues a dead or delivered delivery to be attempted
+// again.
+func (s *Service) RetryWebhookDelivery(ctx context.Context, req RetryWebhookDeliveryRequest) (*RetryWebhookDeliveryResponse, error) {
+	ok, err := retryWebhookDelivery(ctx, s.db, req.DeliveryID, time.Now())
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "retrying webhook delivery: %w", err)
+	}
+	if !ok {
+		return nil, Errorf(http.StatusNotFound, "finished webhook delivery not found: %d", req.DeliveryID)
+	}
+
+	return &RetryWebhookDeliveryResponse{}, nil
+}
+
+// attemptWebhookDelivery posts a delivery to its webhook once.
+func (s *Service) attemptWebhookDelivery(ctx context.Context, w Webhook, d WebhookDelivery) WebhookAttempt {
+	start := time.Now()
+	attempt := WebhookAttempt{DeliveryID: d.ID, CreatedAt: start}
+	defer func() {
+		attempt.DurationMs = int(time.Since(start).Milliseconds())
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, s.webhooks.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gomments-webhook")
+	req.Header.Set("X-Gomments-Event", string(d.Event))
+	req.Header.Set("X-Gomments-Delivery", strconv.Itoa(d.ID))
+	req.Header.Set("X-Gomments-Signature", SignWebhook(w.Secret, start, d.Payload))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		attempt.Error = fmt.Sprintf("unexpected status %d: %s", resp.StatusCode, summarize(string(body), 200))
+	}
+
+	return attempt
+}
+
+type DeliverWebhooksRequest struct {
+}
+
+type DeliverWebhooksResponse struct {
+	Delivered int `json:"delivered"`
+	Failed    int `json:"failed"`
+	// Dead counts deliveries given up on after this attempt.
+	Dead int `json:"dead"`
+}
+
+// DeliverWebhooks attempts a batch of deliveries that are due. Deliveries are
+// leased while they're being attempted, so several instances can deliver
+// webhooks at once.
+func (s *Service) DeliverWebhooks(ctx context.Context, req DeliverWebhooksRequest) (*DeliverWebhooksResponse, error) {
+	now := time.Now()
+	lease := s.webhooks.Timeout * time.Duration(s.webhooks.BatchSize+1)
+
+	deliveries, err := claimWebhookDeliveries(ctx, s.db, now, now.Add(lease), s.webhooks.BatchSize)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "claiming webhook deliveries: %w", err)
+	}
+
+	webhooks, err := getWebhooks(ctx, s.db)
+	if err != nil {
+		return nil, Errorf(http.StatusInternalServerError, "getting webhooks: %w", err)
+	}
+
+	resp := &DeliverWebhooksResponse{}
+	for _, d := range deliveries {
+		i := slices.IndexFunc(webhooks, func(w Webhook) bool { return w.ID == d.WebhookID })
+		if i < 0 {
+			// deleted since it was claimed
+			continue
+		}
+
+		attempt := s.attemptWebhookDelivery(ctx, webhooks[i], d)
+
+		d.Attempts++
+		switch {
+		case attempt.Error == "":
+			d.Status = WebhookDeliveryDelivered
+			resp.Delivered++
+		case d.Attempts >= s.webhooks.MaxAttempts:
+			d.Status = WebhookDeliveryDead
+			resp.Dead++
+		default:
+			d.NextAttemptAt = time.Now().Add(s.webhooks.backoff(d.Attempts))
+			resp.Failed++
+		}
+
+		if err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+			if err := insertWebhookAttempt(ctx, tx, attempt); err != nil {
+				return err
+			}
+			return updateWebhookDelivery(ctx, tx, d)
+		}); err != nil {
+			return nil, Errorf(http.StatusInternalServerError, "recording webhook attempt: %w", err)
+		}
+	}
+
+	return resp, nil
+}
+
+// RunWebhookDeliveries delivers webhooks every interval until ctx is done.
+func (s *Service) RunWebhookDeliveries(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Keep going while there's a backlog, rather than waiting for the
+		// next tick.
+		for {
+			resp, err := s.DeliverWebhooks(ctx, DeliverWebhooksRequest{})
+			if err != nil {
+				log.Printf("delivering webhooks: %s", err)
+				break
+			}
+			if resp.Delivered+resp.Failed+resp.Dead < s.webhooks.BatchSize {
+				break
+			}
+		}
+	}
+}
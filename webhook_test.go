@@ -0,0 +1,301 @@
+package gomments_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type webhookRequest struct {
+	Header http.Header
+	Body   []byte
+}
+
+// webhookReceiver records webhook requests, responding with each status in
+// turn and then 200.
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []webhookRequest
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	rcv := &webhookReceiver{statuses: statuses}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+
+		rcv.requests = append(rcv.requests, webhookRequest{Header: r.Header.Clone(), Body: body})
+		status := http.StatusOK
+		if len(rcv.statuses) > 0 {
+			status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rcv.Close)
+
+	return rcv
+}
+
+func (rcv *webhookReceiver) received() []webhookRequest {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	return append([]webhookRequest{}, rcv.requests...)
+}
+
+func TestService_Webhooks(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t, gomments.WithWebhookConfig(gomments.WebhookConfig{
+		Timeout:     time.Second,
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  10 * time.Millisecond,
+		BatchSize:   10,
+	}))
+	s := f.service
+
+	submit := func(r *require.Assertions, article string) gomments.Reply {
+		resp, err := s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			Article:        article,
+			AuthorName:     "alice",
+			Body:           "hello",
+			IdempotencyKey: uuid.NewString(),
+		})
+		r.NoError(err)
+		return resp.Reply
+	}
+
+	// deliver attempts deliveries until none are left due.
+	deliver := func(r *require.Assertions) gomments.DeliverWebhooksResponse {
+		total := gomments.DeliverWebhooksResponse{}
+		for range 10 {
+			time.Sleep(15 * time.Millisecond)
+			resp, err := s.DeliverWebhooks(ctx, gomments.DeliverWebhooksRequest{})
+			r.NoError(err)
+			if *resp == (gomments.DeliverWebhooksResponse{}) {
+				break
+			}
+			total.Delivered += resp.Delivered
+			total.Failed += resp.Failed
+			total.Dead += resp.Dead
+		}
+		return total
+	}
+
+	t.Run("validates webhooks", func(tt *testing.T) {
+		r := require.New(tt)
+
+		for _, req := range []gomments.CreateWebhookRequest{
+			{URL: "ftp://example.com/hook"},
+			{URL: "https://example.com/hook", Format: "teams"},
+			{URL: "https://example.com/hook", Events: []gomments.WebhookEvent{"reply.exploded"}},
+		} {
+			_, err := s.CreateWebhook(ctx, req)
+			var gsErr gomments.ServiceError
+			r.ErrorAs(err, &gsErr)
+			r.Equal(http.StatusBadRequest, gsErr.Status())
+		}
+	})
+
+	t.Run("delivers signed events it subscribes to, retrying failures", func(tt *testing.T) {
+		r := require.New(tt)
+		rcv := newWebhookReceiver(tt, http.StatusInternalServerError)
+
+		created, err := s.CreateWebhook(ctx, gomments.CreateWebhookRequest{
+			URL:    rcv.URL,
+			Events: []gomments.WebhookEvent{gomments.WebhookEventReplyCreated, gomments.WebhookEventReplyModerated},
+		})
+		r.NoError(err)
+		r.NotEmpty(created.Webhook.Secret)
+
+		reply := submit(r, "hooked-article")
+		_, err = s.CreateReaction(ctx, gomments.CreateReactionRequest{Article: "hooked-article", Kind: "like", ClientIP: "192.0.2.1"})
+		r.NoError(err)
+		_, err = s.ModerateReply(ctx, gomments.ModerateReplyRequest{ReplyID: reply.ID, Action: gomments.ModerationActionDelete, Reason: "spam"})
+		r.NoError(err)
+
+		r.Equal(gomments.DeliverWebhooksResponse{Delivered: 2, Failed: 1}, deliver(r))
+
+		requests := rcv.received()
+		r.Len(requests, 3)
+		for _, req := range requests {
+			r.True(gomments.VerifyWebhook(created.Webhook.Secret, req.Header.Get("X-Gomments-Signature"), req.Body, time.Now(), time.Minute))
+			r.False(gomments.VerifyWebhook("wrong", req.Header.Get("X-Gomments-Signature"), req.Body, time.Now(), time.Minute))
+			r.False(gomments.VerifyWebhook(created.Webhook.Secret, req.Header.Get("X-Gomments-Signature"), req.Body, time.Now().Add(time.Hour), time.Minute))
+		}
+
+		payload := struct {
+			Event gomments.WebhookEvent `json:"event"`
+			Data  struct {
+				Reply struct {
+					ID      int    `json:"id"`
+					Article string `json:"article"`
+				} `json:"reply"`
+			} `json:"data"`
+		}{}
+		retried := requests[0].Body
+		r.NoError(json.Unmarshal(retried, &payload))
+		r.Equal(gomments.WebhookEventReplyCreated, payload.Event)
+		r.Equal(reply.ID, payload.Data.Reply.ID)
+		r.Equal("hooked-article", payload.Data.Reply.Article)
+		r.Equal("reply.created", requests[0].Header.Get("X-Gomments-Event"))
+		r.Equal(retried, requests[2].Body, "retry should resend the same payload")
+		r.Equal("reply.moderated", requests[1].Header.Get("X-Gomments-Event"))
+
+		deliveries, err := s.ListWebhookDeliveries(ctx, gomments.ListWebhookDeliveriesRequest{WebhookID: created.Webhook.ID})
+		r.NoError(err)
+		r.Len(deliveries.Deliveries, 2)
+		for _, d := range deliveries.Deliveries {
+			r.Equal(gomments.WebhookDeliveryDelivered, d.Status)
+		}
+		first := deliveries.Deliveries[1]
+		r.Equal(2, first.Attempts)
+		r.Len(first.Log, 2)
+		r.Equal(http.StatusInternalServerError, first.Log[0].StatusCode)
+		r.Contains(first.Log[0].Error, "unexpected status 500")
+		r.Equal(http.StatusOK, first.Log[1].StatusCode)
+		r.Empty(first.Log[1].Error)
+
+		_, err = s.DeleteWebhook(ctx, gomments.DeleteWebhookRequest{ID: created.Webhook.ID})
+		r.NoError(err)
+	})
+
+	t.Run("dead-letters deliveries that keep failing", func(tt *testing.T) {
+		r := require.New(tt)
+		rcv := newWebhookReceiver(tt, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+
+		created, err := s.CreateWebhook(ctx, gomments.CreateWebhookRequest{
+			URL:    rcv.URL,
+			Format: gomments.WebhookFormatSlack,
+		})
+		r.NoError(err)
+
+		submit(r, "flaky-article")
+		r.Equal(gomments.DeliverWebhooksResponse{Failed: 2, Dead: 1}, deliver(r))
+		r.Len(rcv.received(), 3)
+
+		slack := map[string]string{}
+		r.NoError(json.Unmarshal(rcv.received()[0].Body, &slack))
+		r.Equal("alice commented on flaky-article: hello", slack["text"])
+
+		dead, err := s.ListWebhookDeliveries(ctx, gomments.ListWebhookDeliveriesRequest{
+			WebhookID: created.Webhook.ID,
+			Status:    gomments.WebhookDeliveryDead,
+		})
+		r.NoError(err)
+		r.Len(dead.Deliveries, 1)
+		r.Len(dead.Deliveries[0].Log, 3)
+
+		_, err = s.RetryWebhookDelivery(ctx, gomments.RetryWebhookDeliveryRequest{DeliveryID: dead.Deliveries[0].ID})
+		r.NoError(err)
+		r.Equal(gomments.DeliverWebhooksResponse{Delivered: 1}, deliver(r))
+
+		_, err = s.RetryWebhookDelivery(ctx, gomments.RetryWebhookDeliveryRequest{DeliveryID: 9999})
+		var gsErr gomments.ServiceError
+		r.ErrorAs(err, &gsErr)
+		r.Equal(http.StatusNotFound, gsErr.Status())
+
+		list, err := s.ListWebhooks(ctx, gomments.ListWebhooksRequest{})
+		r.NoError(err)
+		r.Len(list.Webhooks, 1)
+		r.Empty(list.Webhooks[0].Secret)
+
+		_, err = s.DeleteWebhook(ctx, gomments.DeleteWebhookRequest{ID: created.Webhook.ID})
+		r.NoError(err)
+	})
+
+	t.Run("escapes mentions in chat messages", func(tt *testing.T) {
+		r := require.New(tt)
+		slackRcv := newWebhookReceiver(tt)
+		discordRcv := newWebhookReceiver(tt)
+
+		slackHook, err := s.CreateWebhook(ctx, gomments.CreateWebhookRequest{URL: slackRcv.URL, Format: gomments.WebhookFormatSlack})
+		r.NoError(err)
+		discordHook, err := s.CreateWebhook(ctx, gomments.CreateWebhookRequest{URL: discordRcv.URL, Format: gomments.WebhookFormatDiscord})
+		r.NoError(err)
+
+		_, err = s.SubmitReply(ctx, gomments.SubmitReplyRequest{
+			Article:        "mention-article",
+			AuthorName:     "<!channel>",
+			Body:           "@everyone <@123> & <https://evil.example|click>",
+			IdempotencyKey: uuid.NewString(),
+		})
+		r.NoError(err)
+		r.Equal(gomments.DeliverWebhooksResponse{Delivered: 2}, deliver(r))
+
+		r.Len(slackRcv.received(), 1)
+		slack := map[string]string{}
+		r.NoError(json.Unmarshal(slackRcv.received()[0].Body, &slack))
+		r.Equal("&lt;!channel&gt; commented on mention-article: @everyone &lt;@123&gt; &amp; &lt;https://evil.example|click&gt;", slack["text"])
+
+		r.Len(discordRcv.received(), 1)
+		r.JSONEq(
+			`{"content": "<!channel> commented on mention-article: @everyone <@123> & <https://evil.example|click>", "allowed_mentions": {"parse": []}}`,
+			string(discordRcv.received()[0].Body),
+		)
+
+		for _, id := range []int{slackHook.Webhook.ID, discordHook.Webhook.ID} {
+			_, err = s.DeleteWebhook(ctx, gomments.DeleteWebhookRequest{ID: id})
+			r.NoError(err)
+		}
+	})
+
+	t.Run("delivers retried replies once", func(tt *testing.T) {
+		r := require.New(tt)
+		rcv := newWebhookReceiver(tt)
+
+		created, err := s.CreateWebhook(ctx, gomments.CreateWebhookRequest{URL: rcv.URL})
+		r.NoError(err)
+
+		req := gomments.SubmitReplyRequest{
+			Article:        "retried-article",
+			AuthorName:     "alice",
+			Body:           "hello",
+			IdempotencyKey: uuid.NewString(),
+		}
+		ids := map[int]bool{}
+		for range 3 {
+			resp, err := s.SubmitReply(ctx, req)
+			r.NoError(err)
+			ids[resp.Reply.ID] = true
+		}
+		r.Len(ids, 1)
+
+		r.Equal(gomments.DeliverWebhooksResponse{Delivered: 1}, deliver(r))
+		requests := rcv.received()
+		r.Len(requests, 1)
+		r.Equal("reply.created", requests[0].Header.Get("X-Gomments-Event"))
+
+		_, err = s.DeleteWebhook(ctx, gomments.DeleteWebhookRequest{ID: created.Webhook.ID})
+		r.NoError(err)
+	})
+
+	t.Run("doesn't deliver to deleted webhooks", func(tt *testing.T) {
+		r := require.New(tt)
+		rcv := newWebhookReceiver(tt)
+
+		created, err := s.CreateWebhook(ctx, gomments.CreateWebhookRequest{URL: rcv.URL})
+		r.NoError(err)
+
+		submit(r, "abandoned-article")
+		_, err = s.DeleteWebhook(ctx, gomments.DeleteWebhookRequest{ID: created.Webhook.ID})
+		r.NoError(err)
+
+		r.Equal(gomments.DeliverWebhooksResponse{}, deliver(r))
+		r.Empty(rcv.received())
+	})
+}
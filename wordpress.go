@@ -0,0 +1,156 @@
+package gomments
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// wxrDateLayout is how WXR exports write comment dates.
+const wxrDateLayout = "2006-01-02 15:04:05"
+
+// WXR elements are matched by their local names, since the wp namespace
+// changes with the export version.
+type wxrItem struct {
+	Link     string       `xml:"link"`
+	PostName string       `xml:"post_name"`
+	Comments []wxrComment `xml:"comment"`
+}
+
+type wxrComment struct {
+	ID       string `xml:"comment_id"`
+	Author   string `xml:"comment_author"`
+	Date     string `xml:"comment_date"`
+	DateGMT  string `xml:"comment_date_gmt"`
+	Content  string `xml:"comment_content"`
+	Approved string `xml:"comment_approved"`
+	Type     string `xml:"comment_type"`
+}
+
+// createdAt returns when a comment was written, and whether it was read in
+// the site's local time, loc.
+func (c wxrComment) createdAt(loc *time.Location) (time.Time, bool, error) {
+	if c.DateGMT != "" && !strings.HasPrefix(c.DateGMT, "0000") {
+		t, err := time.Parse(wxrDateLayout, c.DateGMT)
+		return t, false, err
+	}
+
+	// Unapproved comments can be missing their GMT date, so fall back to the
+	// site's local time.
+	t, err := time.ParseInLocation(wxrDateLayout, c.Date, loc)
+	return t.UTC(), true, err
+}
+
+// WordPressImporter reads the comments in a WordPress WXR export, like
+// ParseWordPress. Location is the site's timezone, which comments missing
+// their GMT date are read in. It defaults to UTC.
+type WordPressImporter struct {
+	Location *time.Location
+}
+
+func (i WordPressImporter) Parse(ctx context.Context, path string, rule ArticleRule) ([]ImportReply, []ImportMapping, error) {
+	return ImporterFunc(i.parse).Parse(ctx, path, rule)
+}
+
+// ParseWordPress reads the comments in a WordPress WXR export. Posts are
+// mapped to articles by their slugs, or by their URLs if rule isn't the zero
+// ArticleRule. Comments on posts that don't map to an article are left out,
+// and reported in the mappings with an empty Article.
+//
+// Unapproved comments are imported pending, and trashed comments deleted.
+// Pingbacks and trackbacks aren't comments, so they're left out. Comments
+// missing their GMT date are read in the site's local time, and marked
+// LocalTime. ParseWordPress takes the site to be in UTC; use a
+// WordPressImporter with a Location (gommentsctl's -timezone) otherwise.
+func ParseWordPress(r io.Reader, rule ArticleRule) ([]ImportReply, []ImportMapping, error) {
+	return WordPressImporter{}.parse(r, rule)
+}
+
+func (i WordPressImporter) parse(r io.Reader, rule ArticleRule) ([]ImportReply, []ImportMapping, error) {
+	loc := i.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	// Comment IDs are only unique to a site, so they're prefixed with its URL.
+	site := ""
+	mappings := []ImportMapping{}
+	replies := []ImportReply{}
+
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading wordpress export: %w", err)
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "link":
+			// The first RSS link is the site's, in the channel.
+			if site != "" || start.Name.Space != "" {
+				continue
+			}
+			if err := dec.DecodeElement(&site, &start); err != nil {
+				return nil, nil, fmt.Errorf("reading wordpress site: %w", err)
+			}
+			site = normalizeThreadURL(site)
+		case "item":
+			var item wxrItem
+			if err := dec.DecodeElement(&item, &start); err != nil {
+				return nil, nil, fmt.Errorf("reading wordpress item: %w", err)
+			}
+
+			mapping := ImportMapping{Thread: item.Link, Article: item.PostName}
+			if rule.re != nil {
+				mapping.Article, _ = rule.Article(item.Link)
+			}
+
+			for _, c := range item.Comments {
+				if c.Type == "pingback" || c.Type == "trackback" {
+					continue
+				}
+				mapping.Replies++
+
+				if mapping.Article == "" {
+					continue
+				}
+
+				createdAt, localTime, err := c.createdAt(loc)
+				if err != nil {
+					return nil, nil, fmt.Errorf("parsing date of comment %s: %w", c.ID, err)
+				}
+
+				replies = append(replies, ImportReply{
+					Source:     "wordpress",
+					SourceID:   site + ":" + c.ID,
+					Article:    mapping.Article,
+					AuthorName: c.Author,
+					Body:       htmlToText(c.Content),
+					CreatedAt:  createdAt,
+					LocalTime:  localTime,
+					Deleted:    c.Approved == "trash" || c.Approved == "post-trashed",
+					Spam:       c.Approved == "spam",
+					Pending:    c.Approved == "0",
+				})
+			}
+
+			if mapping.Replies > 0 {
+				mappings = append(mappings, mapping)
+			}
+		}
+	}
+
+	return replies, mappings, nil
+}
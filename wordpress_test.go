@@ -0,0 +1,173 @@
+package gomments_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arizard/gomments"
+	"github.com/stretchr/testify/require"
+)
+
+const wordPressExport = `<?xml version="1.0" encoding="UTF-8" ?>
+<rss version="2.0"
+	xmlns:content="http://purl.org/rss/1.0/modules/content/"
+	xmlns:atom="http://www.w3.org/2005/Atom"
+	xmlns:wp="http://wordpress.org/export/1.2/">
+<channel>
+	<title>Example Blog</title>
+	<atom:link href="https://blog.example.com/feed/" rel="self" type="application/rss+xml" />
+	<link>https://blog.example.com</link>
+	<wp:wxr_version>1.2</wp:wxr_version>
+	<item>
+		<title>Hello world</title>
+		<link>https://blog.example.com/2013/05/hello-world/</link>
+		<wp:post_id>1</wp:post_id>
+		<wp:post_name><![CDATA[hello-world]]></wp:post_name>
+		<wp:comment>
+			<wp:comment_id>1</wp:comment_id>
+			<wp:comment_author><![CDATA[Alice]]></wp:comment_author>
+			<wp:comment_date><![CDATA[2013-05-02 20:30:00]]></wp:comment_date>
+			<wp:comment_date_gmt><![CDATA[2013-05-02 10:30:00]]></wp:comment_date_gmt>
+			<wp:comment_content><![CDATA[Lovely post.
+Thanks &amp; see you soon]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[1]]></wp:comment_approved>
+			<wp:comment_type><![CDATA[comment]]></wp:comment_type>
+		</wp:comment>
+		<wp:comment>
+			<wp:comment_id>2</wp:comment_id>
+			<wp:comment_author><![CDATA[Bob]]></wp:comment_author>
+			<wp:comment_date><![CDATA[2013-05-03 09:00:00]]></wp:comment_date>
+			<wp:comment_date_gmt><![CDATA[0000-00-00 00:00:00]]></wp:comment_date_gmt>
+			<wp:comment_content><![CDATA[Is this <em>approved</em> yet?]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[0]]></wp:comment_approved>
+			<wp:comment_type><![CDATA[]]></wp:comment_type>
+		</wp:comment>
+		<wp:comment>
+			<wp:comment_id>3</wp:comment_id>
+			<wp:comment_author><![CDATA[Spammer]]></wp:comment_author>
+			<wp:comment_date_gmt><![CDATA[2013-05-04 00:00:00]]></wp:comment_date_gmt>
+			<wp:comment_content><![CDATA[cheap pills]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[spam]]></wp:comment_approved>
+		</wp:comment>
+		<wp:comment>
+			<wp:comment_id>4</wp:comment_id>
+			<wp:comment_author><![CDATA[Carol]]></wp:comment_author>
+			<wp:comment_date_gmt><![CDATA[2013-05-05 00:00:00]]></wp:comment_date_gmt>
+			<wp:comment_content><![CDATA[Never mind]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[trash]]></wp:comment_approved>
+		</wp:comment>
+		<wp:comment>
+			<wp:comment_id>5</wp:comment_id>
+			<wp:comment_author><![CDATA[Other Blog]]></wp:comment_author>
+			<wp:comment_date_gmt><![CDATA[2013-05-06 00:00:00]]></wp:comment_date_gmt>
+			<wp:comment_content><![CDATA[Linked to this]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[1]]></wp:comment_approved>
+			<wp:comment_type><![CDATA[pingback]]></wp:comment_type>
+		</wp:comment>
+	</item>
+	<item>
+		<title>About</title>
+		<link>https://blog.example.com/about/</link>
+		<wp:post_name><![CDATA[about]]></wp:post_name>
+	</item>
+</channel>
+</rss>
+`
+
+func TestParseWordPress(t *testing.T) {
+	r := require.New(t)
+
+	replies, mappings, err := gomments.ParseWordPress(strings.NewReader(wordPressExport), gomments.ArticleRule{})
+	r.NoError(err)
+
+	r.Equal([]gomments.ImportMapping{
+		{Thread: "https://blog.example.com/2013/05/hello-world/", Article: "hello-world", Replies: 4},
+	}, mappings)
+
+	r.Len(replies, 4)
+	r.Equal(gomments.ImportReply{
+		Source:     "wordpress",
+		SourceID:   "blog.example.com:1",
+		Article:    "hello-world",
+		AuthorName: "Alice",
+		Body:       "Lovely post.\nThanks & see you soon",
+		CreatedAt:  time.Date(2013, 5, 2, 10, 30, 0, 0, time.UTC),
+	}, replies[0])
+
+	r.True(replies[1].Pending)
+	r.Equal("Is this approved yet?", replies[1].Body)
+	r.Equal(time.Date(2013, 5, 3, 9, 0, 0, 0, time.UTC), replies[1].CreatedAt)
+	r.True(replies[1].LocalTime)
+	r.True(replies[2].Spam)
+	r.True(replies[3].Deleted)
+
+	t.Run("maps by url with a rule", func(tt *testing.T) {
+		r := require.New(tt)
+
+		rule, err := gomments.ParseArticleRule("https://blog.example.com/{article}")
+		r.NoError(err)
+
+		replies, mappings, err := gomments.ParseWordPress(strings.NewReader(wordPressExport), rule)
+		r.NoError(err)
+		r.Equal("2013/05/hello-world", mappings[0].Article)
+		r.Equal("2013/05/hello-world", replies[0].Article)
+	})
+
+	t.Run("reads local times in the site's timezone", func(tt *testing.T) {
+		r := require.New(tt)
+
+		path := filepath.Join(tt.TempDir(), "export.xml")
+		r.NoError(os.WriteFile(path, []byte(wordPressExport), 0o600))
+
+		importer := gomments.WordPressImporter{Location: time.FixedZone("AEST", 10*60*60)}
+		replies, _, err := importer.Parse(context.Background(), path, gomments.ArticleRule{})
+		r.NoError(err)
+		r.Equal(time.Date(2013, 5, 2, 10, 30, 0, 0, time.UTC), replies[0].CreatedAt)
+		r.False(replies[0].LocalTime)
+		r.Equal(time.Date(2013, 5, 2, 23, 0, 0, 0, time.UTC), replies[1].CreatedAt)
+		r.True(replies[1].LocalTime)
+	})
+}
+
+func TestService_ImportReplies_wordPress(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	s := f.service
+
+	replies, _, err := gomments.ParseWordPress(strings.NewReader(wordPressExport), gomments.ArticleRule{})
+	f.NoError(err)
+
+	resp, err := s.ImportReplies(ctx, gomments.ImportRepliesRequest{Replies: replies})
+	f.NoError(err)
+	f.Equal(gomments.ImportArticleStats{Imported: 4, Deleted: 1, Spam: 1, Pending: 1}, resp.Articles["hello-world"])
+
+	repliesResp, err := s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "hello-world"})
+	f.NoError(err)
+	f.Len(repliesResp.Replies, 1)
+
+	t.Run("shows pending replies once approved", func(tt *testing.T) {
+		r := require.New(tt)
+
+		var id int
+		r.NoError(f.db.Get(&id, "select id from reply where author_name = 'Bob'"))
+		_, err := s.ModerateReply(ctx, gomments.ModerateReplyRequest{ReplyID: id, Action: gomments.ModerationActionApprove})
+		r.NoError(err)
+
+		repliesResp, err := s.GetReplies(ctx, gomments.GetRepliesRequest{Article: "hello-world"})
+		r.NoError(err)
+		r.Len(repliesResp.Replies, 2)
+	})
+
+	t.Run("doesn't import replies twice", func(tt *testing.T) {
+		r := require.New(tt)
+
+		again, err := s.ImportReplies(ctx, gomments.ImportRepliesRequest{Replies: replies})
+		r.NoError(err)
+		r.Equal(0, again.Imported)
+		r.Equal(4, again.Existing)
+	})
+}